@@ -296,7 +296,8 @@ func (a *agent) init() {
 		AnnouncementBanners: func() *[]codersdk.BannerConfig { return a.announcementBanners.Load() },
 		UpdateEnv:           a.updateCommandEnv,
 		WorkingDirectory:    func() string { return a.manifest.Load().Directory },
-		BlockFileTransfer:   a.blockFileTransfer,
+		Policy:              agentssh.Policy{BlockFileTransfer: a.blockFileTransfer},
+		ServerVersion:       agentssh.AgentServerVersion(buildinfo.Version()),
 		ReportConnection: func(id uuid.UUID, magicType agentssh.MagicSessionType, ip string) func(code int, reason string) {
 			var connectionType proto.Connection_Type
 			switch magicType {
@@ -315,6 +316,9 @@ func (a *agent) init() {
 
 			return a.reportConnection(id, connectionType, ip)
 		},
+		OnStateChange: func(from, to agentssh.ServerState) {
+			a.logger.Info(a.hardCtx, "ssh server state changed", slog.F("from", from), slog.F("to", to))
+		},
 
 		ExperimentalContainers: a.devcontainers,
 	})
@@ -820,8 +824,9 @@ const (
 
 func (a *agent) reportConnection(id uuid.UUID, connectionType proto.Connection_Type, ip string) (disconnected func(code int, reason string)) {
 	// Remove the port from the IP because ports are not supported in coderd.
+	// Addresses of in-memory listeners have no port and are reported as is.
 	if host, _, err := net.SplitHostPort(ip); err != nil {
-		a.logger.Error(a.hardCtx, "split host and port for connection report failed", slog.F("ip", ip), slog.Error(err))
+		a.logger.Debug(a.hardCtx, "connection address has no port", slog.F("ip", ip), slog.Error(err))
 	} else {
 		// Best effort.
 		ip = host
@@ -1840,6 +1845,13 @@ func (a *agent) HandleHTTPDebugManifest(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+func (a *agent) HandleHTTPDebugSSHProcesses(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(a.sshServer.TrackedProcesses()); err != nil {
+		a.logger.Error(a.hardCtx, "write debug ssh processes", slog.Error(err))
+	}
+}
+
 func (a *agent) HandleHTTPDebugLogs(w http.ResponseWriter, r *http.Request) {
 	logPath := filepath.Join(a.logDir, "coder-agent.log")
 	f, err := os.Open(logPath)
@@ -1867,6 +1879,7 @@ func (a *agent) HTTPDebug() http.Handler {
 	r.Get("/debug/magicsock", a.HandleHTTPDebugMagicsock)
 	r.Get("/debug/magicsock/debug-logging/{state}", a.HandleHTTPMagicsockDebugLoggingState)
 	r.Get("/debug/manifest", a.HandleHTTPDebugManifest)
+	r.Get("/debug/ssh/processes", a.HandleHTTPDebugSSHProcesses)
 	r.NotFound(func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		_, _ = w.Write([]byte("404 not found"))
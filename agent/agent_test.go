@@ -1243,10 +1243,11 @@ func TestAgent_SSHConnectionEnvVars(t *testing.T) {
 func TestAgent_SSHConnectionLoginVars(t *testing.T) {
 	t.Parallel()
 
+	ctx := testutil.Context(t, testutil.WaitShort)
 	envInfo := usershell.SystemEnvInfo{}
-	u, err := envInfo.User()
+	u, err := envInfo.User(ctx)
 	require.NoError(t, err, "get current user")
-	shell, err := envInfo.Shell(u.Username)
+	shell, err := envInfo.Shell(ctx, u.Username)
 	require.NoError(t, err, "get current shell")
 
 	tests := []struct {
@@ -3278,6 +3279,10 @@ func TestAgent_Metrics_SSH(t *testing.T) {
 			Type:  proto.Stats_Metric_COUNTER,
 			Value: 1,
 			Labels: []*proto.Stats_Metric_Label{
+				{
+					Name:  "container",
+					Value: "no",
+				},
 				{
 					Name:  "magic_type",
 					Value: "ssh",
@@ -3288,21 +3293,56 @@ func TestAgent_Metrics_SSH(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name:  "agent_ssh_server_accept_backoffs_total",
+			Type:  proto.Stats_Metric_COUNTER,
+			Value: 0,
+		},
+		{
+			Name:  "agent_ssh_server_container_requests_disabled_total",
+			Type:  proto.Stats_Metric_COUNTER,
+			Value: 0,
+		},
 		{
 			Name:  "agent_ssh_server_failed_connections_total",
 			Type:  proto.Stats_Metric_COUNTER,
 			Value: 0,
 		},
+		{
+			Name:  "agent_ssh_server_pty_start_retries_total",
+			Type:  proto.Stats_Metric_COUNTER,
+			Value: 0,
+		},
 		{
 			Name:  "agent_ssh_server_sftp_connections_total",
 			Type:  proto.Stats_Metric_COUNTER,
 			Value: 0,
 		},
+		{
+			Name:  "agent_ssh_server_sftp_pty_requests_total",
+			Type:  proto.Stats_Metric_COUNTER,
+			Value: 0,
+		},
 		{
 			Name:  "agent_ssh_server_sftp_server_errors_total",
 			Type:  proto.Stats_Metric_COUNTER,
 			Value: 0,
 		},
+		{
+			Name:  "agent_ssh_server_stats_deltas_dropped_total",
+			Type:  proto.Stats_Metric_COUNTER,
+			Value: 0,
+		},
+		{
+			Name:  "agent_ssh_server_tracked_processes",
+			Type:  proto.Stats_Metric_GAUGE,
+			Value: 1,
+		},
+		{
+			Name:  "agent_ssh_server_unix_forwards_denied_total",
+			Type:  proto.Stats_Metric_COUNTER,
+			Value: 0,
+		},
 		{
 			Name:  "coderd_agentstats_currently_reachable_peers",
 			Type:  proto.Stats_Metric_GAUGE,
@@ -117,8 +117,8 @@ func WithExecer(execer agentexec.Execer) Option {
 // WithCommandEnv sets the CommandEnv implementation to use.
 func WithCommandEnv(ce CommandEnv) Option {
 	return func(api *API) {
-		api.commandEnv = func(ei usershell.EnvInfoer, preEnv []string) (string, string, []string, error) {
-			shell, dir, env, err := ce(ei, preEnv)
+		api.commandEnv = func(ctx context.Context, ei usershell.EnvInfoer, preEnv []string) (string, string, []string, error) {
+			shell, dir, env, err := ce(ctx, ei, preEnv)
 			if err != nil {
 				return shell, dir, env, err
 			}
@@ -2450,7 +2450,7 @@ func TestAPI(t *testing.T) {
 		testDir := t.TempDir()
 		testEnv := []string{"CUSTOM_VAR=test_value", "PATH=/custom/path"}
 
-		commandEnv := func(ei usershell.EnvInfoer, addEnv []string) (shell, dir string, env []string, err error) {
+		commandEnv := func(_ context.Context, ei usershell.EnvInfoer, addEnv []string) (shell, dir string, env []string, err error) {
 			return testShell, testDir, testEnv, nil
 		}
 
@@ -113,13 +113,27 @@ func EnvInfo(ctx context.Context, execer agentexec.Execer, container, containerU
 	return &dei, nil
 }
 
-func (dei *DockerEnvInfoer) User() (*user.User, error) {
+// ContainerInstance returns an identifier of the running instance of a
+// container, which changes when the container is recreated or restarted. It
+// only inspects the container, which is much cheaper than EnvInfo.
+func ContainerInstance(ctx context.Context, execer agentexec.Execer, container string) (string, error) {
+	stdout, stderr, err := run(ctx, execer, "docker", "container", "inspect", "--format", "{{.Id}} {{.State.StartedAt}}", container)
+	if err != nil {
+		return "", xerrors.Errorf("inspect container: %w: %q", err, stderr)
+	}
+	if stdout == "" {
+		return "", xerrors.New("inspect container: empty output")
+	}
+	return stdout, nil
+}
+
+func (dei *DockerEnvInfoer) User(context.Context) (*user.User, error) {
 	// Clone the user so that the caller can't modify it
 	u := *dei.user
 	return &u, nil
 }
 
-func (dei *DockerEnvInfoer) Shell(string) (string, error) {
+func (dei *DockerEnvInfoer) Shell(context.Context, string) (string, error) {
 	return dei.userShell, nil
 }
 
@@ -17,7 +17,7 @@ import (
 // and environment variables to use when executing a command. It takes
 // an EnvInfoer and a pre-existing environment slice as arguments.
 // This signature matches agentssh.Server.CommandEnv.
-type CommandEnv func(ei usershell.EnvInfoer, addEnv []string) (shell, dir string, env []string, err error)
+type CommandEnv func(ctx context.Context, ei usershell.EnvInfoer, addEnv []string) (shell, dir string, env []string, err error)
 
 // commandEnvExecer is an agentexec.Execer that uses a CommandEnv to
 // determine the shell, working directory, and environment variables
@@ -45,7 +45,7 @@ func newCommandEnvExecer(
 var _ agentexec.Execer = (*commandEnvExecer)(nil)
 
 func (e *commandEnvExecer) prepare(ctx context.Context, inName string, inArgs ...string) (name string, args []string, dir string, env []string) {
-	shell, dir, env, err := e.commandEnv(nil, nil)
+	shell, dir, env, err := e.commandEnv(ctx, nil, nil)
 	if err != nil {
 		e.logger.Error(ctx, "get command environment failed", slog.Error(err))
 		return inName, inArgs, "", nil
@@ -43,6 +43,42 @@ type Execer interface {
 	PTYCommandContext(ctx context.Context, cmd string, args ...string) *pty.Cmd
 }
 
+// CommandChecker is implemented by Execers that may refuse to run some
+// commands. CheckCommand is called with the command that would be passed to
+// CommandContext or PTYCommandContext, before it is created.
+type CommandChecker interface {
+	CheckCommand(ctx context.Context, cmd string, args ...string) error
+}
+
+// CheckCommand returns the error of e refusing to run cmd if e implements
+// CommandChecker, and nil otherwise.
+func CheckCommand(ctx context.Context, e Execer, cmd string, args ...string) error {
+	checker, ok := e.(CommandChecker)
+	if !ok {
+		return nil
+	}
+	return checker.CheckCommand(ctx, cmd, args...)
+}
+
+// ExecRefusedError is returned by an Execer refusing to run a command.
+// Message is shown to the user that ran the command, so it must not contain
+// details of the agent that the user shouldn't see, Err can.
+type ExecRefusedError struct {
+	Message string
+	Err     error
+}
+
+func (e *ExecRefusedError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("exec refused: %s: %s", e.Message, e.Err)
+	}
+	return "exec refused: " + e.Message
+}
+
+func (e *ExecRefusedError) Unwrap() error {
+	return e.Err
+}
+
 func NewExecer() (Execer, error) {
 	_, enabled := os.LookupEnv(EnvProcPrioMgmt)
 	if runtime.GOOS != "linux" || !enabled {
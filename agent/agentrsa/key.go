@@ -6,14 +6,25 @@ import (
 	"math/rand"
 )
 
+// DefaultBits is the size of the keys generated by GenerateDeterministicKey.
+const DefaultBits = 2048
+
 // GenerateDeterministicKey generates an RSA private key deterministically based on the provided seed.
 // This function uses a deterministic random source to generate the primes p and q, ensuring that the
 // same seed will always produce the same private key. The generated key is 2048 bits in size.
 //
 // Reference: https://pkg.go.dev/crypto/rsa#GenerateKey
 func GenerateDeterministicKey(seed int64) *rsa.PrivateKey {
+	return GenerateDeterministicKeyBits(seed, DefaultBits)
+}
+
+// GenerateDeterministicKeyBits is like GenerateDeterministicKey, generating
+// a key of the given size instead. The same seed and size always produce the
+// same key, and keys of DefaultBits are those of GenerateDeterministicKey.
+func GenerateDeterministicKeyBits(seed int64, bits int) *rsa.PrivateKey {
 	// Since the standard lib purposefully does not generate
 	// deterministic rsa keys, we need to do it ourselves.
+	primeBits := bits / 2
 
 	// Create deterministic random source
 	// nolint: gosec
@@ -26,10 +37,10 @@ func GenerateDeterministicKey(seed int64) *rsa.PrivateKey {
 
 	for {
 		// Generate deterministic primes using the seeded random
-		// Each prime should be ~1024 bits to get a 2048-bit key
+		// Each prime should be ~bits/2 bits to get a key of the requested size
 		for {
-			p.SetBit(p, 1024, 1) // Ensure it's large enough
-			for i := range 1024 {
+			p.SetBit(p, primeBits, 1) // Ensure it's large enough
+			for i := range primeBits {
 				if deterministicRand.Int63()%2 == 1 {
 					p.SetBit(p, i, 1)
 				} else {
@@ -43,8 +54,8 @@ func GenerateDeterministicKey(seed int64) *rsa.PrivateKey {
 		}
 
 		for {
-			q.SetBit(q, 1024, 1) // Ensure it's large enough
-			for i := range 1024 {
+			q.SetBit(q, primeBits, 1) // Ensure it's large enough
+			for i := range primeBits {
 				if deterministicRand.Int63()%2 == 1 {
 					q.SetBit(q, i, 1)
 				} else {
@@ -0,0 +1,50 @@
+package agentssh
+
+import (
+	"slices"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+)
+
+// DefaultSessionAdmissionErrorCode is the exit code of sessions rejected by
+// Config.SessionAdmission, unless Config.SessionAdmissionErrorCode is set.
+const DefaultSessionAdmissionErrorCode = 77 // Error code: permission denied
+
+// PreSessionInfo describes a session being admitted by
+// Config.SessionAdmission, before anything is done for it.
+type PreSessionInfo struct {
+	ID uuid.UUID
+	// SessionType is the magic session type, RawSessionType is the value
+	// sent by the client.
+	SessionType    MagicSessionType
+	RawSessionType string
+	// CLIVersion is the version of the Coder CLI that started the session,
+	// empty if it wasn't started by the CLI.
+	CLIVersion string
+	User       string
+	RemoteAddr string
+	// RawCommand is empty for shells, Subsystem is set for subsystems
+	// such as sftp. CommandArgv is RawCommand split into words, see
+	// SessionCommand.
+	RawCommand  string
+	CommandArgv []string
+	Subsystem   string
+	IsPty       bool
+}
+
+func newPreSessionInfo(id uuid.UUID, session ssh.Session, magicType MagicSessionType, magicTypeRaw, cliVersion string, command SessionCommand) PreSessionInfo {
+	_, _, isPty := session.Pty()
+	return PreSessionInfo{
+		ID:             id,
+		SessionType:    magicType,
+		RawSessionType: magicTypeRaw,
+		CLIVersion:     cliVersion,
+		User:           session.User(),
+		RemoteAddr:     session.RemoteAddr().String(),
+		RawCommand:     command.Raw,
+		CommandArgv:    slices.Clone(command.Argv),
+		Subsystem:      session.Subsystem(),
+		IsPty:          isPty,
+	}
+}
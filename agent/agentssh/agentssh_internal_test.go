@@ -7,17 +7,35 @@ import (
 	"context"
 	"io"
 	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	gliderssh "github.com/gliderlabs/ssh"
 	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
 
 	"github.com/coder/coder/v2/agent/agentexec"
+	"github.com/coder/coder/v2/agent/usershell"
+	"github.com/coder/coder/v2/codersdk"
 	"github.com/coder/coder/v2/pty"
 	"github.com/coder/coder/v2/testutil"
+	"github.com/coder/quartz"
 )
 
 const longScript = `
@@ -64,7 +82,7 @@ func Test_sessionStart_orphan(t *testing.T) {
 		// we don't really care what the error is here.  In the larger scenario,
 		// the client has disconnected, so we can't return any error information
 		// to them.
-		_ = s.startPTYSession(logger, sess, "ssh", cmd, ptyInfo, windowSize)
+		_ = s.startPTYSession(logger, sess, "ssh", "no", cmd, ptyInfo, windowSize, ptySessionOptions{})
 	}()
 
 	readDone := make(chan struct{})
@@ -92,6 +110,641 @@ func Test_sessionStart_orphan(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func Test_startPTYSession_initProfile(t *testing.T) {
+	t.Parallel()
+
+	// The fake shells are slow to print anything and slower to show a
+	// prompt.
+	tests := []struct {
+		name          string
+		shell         string
+		script        string
+		wantDetection string
+	}{
+		{
+			name:          "BashSentinel",
+			shell:         "bash",
+			script:        `sleep 0.1; echo loading; sleep 0.1; eval "$PROMPT_COMMAND"; printf 'ready'`,
+			wantDetection: "sentinel",
+		},
+		{
+			name:          "ZshPattern",
+			shell:         "zsh",
+			script:        `sleep 0.1; echo loading; sleep 0.1; printf 'host%% '`,
+			wantDetection: "pattern",
+		},
+		{
+			name:   "UnknownShell",
+			shell:  "fish",
+			script: `sleep 0.1; echo loading; sleep 0.1; printf 'host> '`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := testutil.Logger(t)
+			s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+			require.NoError(t, err)
+			defer s.Close()
+
+			shell := filepath.Join(t.TempDir(), tt.shell)
+			err = os.WriteFile(shell, []byte("#!/bin/sh\n"+tt.script+"\n"), 0o700) //nolint:gosec
+			require.NoError(t, err)
+
+			toClient, fromClient, sess := newTestSession(ctx)
+			defer fromClient.Close()
+			output := make(chan string, 1)
+			go func() {
+				out, _ := io.ReadAll(toClient)
+				output <- string(out)
+			}()
+			windowSize := make(chan gliderssh.Window)
+			close(windowSize)
+			cmd := pty.CommandContext(ctx, shell)
+			cmd.Env = append(cmd.Env, "PATH="+os.Getenv("PATH"))
+			profiler := newInitProfiler(s.config.Clock, cmd)
+			err = s.startPTYSession(logger, sess, "ssh", "no", cmd, gliderssh.Pty{}, windowSize, ptySessionOptions{profiler: profiler})
+			require.NoError(t, err)
+			_ = toClient.Close()
+			out := testutil.RequireReceive(ctx, t, output)
+
+			profile := profiler.result()
+			require.Equal(t, tt.shell, profile.Shell)
+			require.GreaterOrEqual(t, profile.FirstOutput, 100*time.Millisecond)
+			require.Equal(t, tt.wantDetection, profile.PromptDetection)
+			if tt.wantDetection != "" {
+				require.GreaterOrEqual(t, profile.Prompt, profile.FirstOutput+100*time.Millisecond)
+			} else {
+				require.Zero(t, profile.Prompt)
+			}
+			require.NotContains(t, out, initProfileSentinel)
+			require.Contains(t, out, profile.Summary())
+		})
+	}
+}
+
+func Test_startPTYSession_latencyProbe(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := testutil.Logger(t)
+	s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	clock := quartz.NewMock(t)
+	trap := clock.Trap().AfterFunc("latency_probe")
+	defer trap.Close()
+	rtts := make(chan time.Duration, 1)
+	probe := newLatencyProbe(clock, 30*time.Second, func(d time.Duration) { rtts <- d })
+
+	toClient, fromClient, sess := newTestSession(ctx)
+	defer fromClient.Close()
+	// The fake terminal tells when it got the probe, the test replies.
+	probed := make(chan struct{})
+	output := make(chan string, 1)
+	go func() {
+		var out []byte
+		buf := make([]byte, 1024)
+		for {
+			n, err := toClient.Read(buf)
+			seen := strings.Contains(string(out), latencyProbeRequest)
+			out = append(out, buf[:n]...)
+			if !seen && strings.Contains(string(out), latencyProbeRequest) {
+				close(probed)
+			}
+			if err != nil {
+				output <- string(out)
+				return
+			}
+		}
+	}()
+	windowSize := make(chan gliderssh.Window)
+	close(windowSize)
+	cmd := pty.CommandContext(ctx, "sh", "-c", `IFS= read -r line; printf 'got:%s\n' "$line"`)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.startPTYSession(logger, sess, "ssh", "no", cmd, gliderssh.Pty{}, windowSize, ptySessionOptions{latencyProbe: probe})
+	}()
+
+	trap.MustWait(ctx).MustRelease(ctx)
+	trap.Close()
+	clock.Advance(30 * time.Second).MustWait(ctx)
+	testutil.RequireReceive(ctx, t, probed)
+	clock.Advance(50 * time.Millisecond).MustWait(ctx)
+	_, err = fromClient.Write([]byte("\x1b[12;1Rhello\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, testutil.RequireReceive(ctx, t, done))
+	_ = toClient.Close()
+	out := testutil.RequireReceive(ctx, t, output)
+	require.Equal(t, 50*time.Millisecond, testutil.RequireReceive(ctx, t, rtts))
+	require.Equal(t, 50*time.Millisecond, probe.latency())
+	// The shell only got the input of the user.
+	require.Contains(t, out, "got:hello\r\n")
+	require.NotContains(t, out, "12;1R")
+}
+
+func Test_copyErrorClass(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: io.EOF, want: "eof"},
+		{err: xerrors.Errorf("read: %w", io.ErrUnexpectedEOF), want: "eof"},
+		{err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, want: "reset"},
+		{err: xerrors.Errorf("read: %w", os.ErrDeadlineExceeded), want: "timeout"},
+		{err: io.ErrClosedPipe, want: "channel_closed"},
+		{err: xerrors.Errorf("write: %w", syscall.EPIPE), want: "channel_closed"},
+		{err: net.ErrClosed, want: "channel_closed"},
+		{err: xerrors.New("boom"), want: "other"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, copyErrorClass(tt.err), tt.err.Error())
+	}
+}
+
+func Test_startPTYSession_inputCopyError(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	sink := &testLogSink{}
+	logger := testutil.Logger(t).AppendSinks(sink)
+	s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	toClient, fromClient, sess := newTestSession(ctx)
+	go func() {
+		_, _ = io.Copy(io.Discard, toClient)
+	}()
+	// The client sends some input, then the connection is reset.
+	go func() {
+		_, _ = fromClient.Write([]byte("abc"))
+		_ = fromClient.CloseWithError(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)})
+	}()
+	windowSize := make(chan gliderssh.Window)
+	close(windowSize)
+	cmd := pty.CommandContext(ctx, "sh", "-c", "head -c 3 >/dev/null")
+	err = s.startPTYSession(logger, sess, "ssh", "no", cmd, gliderssh.Pty{}, windowSize, ptySessionOptions{})
+	require.NoError(t, err)
+	_ = toClient.Close()
+
+	require.Eventually(t, func() bool {
+		return promtestutil.ToFloat64(s.metrics.sessionErrors.WithLabelValues("ssh", "yes", "input_io_copy_reset")) == 1
+	}, testutil.WaitShort, testutil.IntervalFast)
+	var fields map[string]any
+	for _, e := range sink.entries() {
+		if e.Message == "copying session data failed" {
+			fields = map[string]any{}
+			for _, f := range e.Fields {
+				fields[f.Name] = f.Value
+			}
+		}
+	}
+	require.NotNil(t, fields, "copy error not logged")
+	require.Equal(t, "input_io_copy", fields["copy"])
+	require.EqualValues(t, 3, fields["bytes"])
+	require.Equal(t, "reset", fields["error_class"])
+}
+
+func Test_startPTYSession_retry(t *testing.T) {
+	t.Parallel()
+
+	eagain := xerrors.Errorf("newPty failed: %w", &os.PathError{Op: "open", Path: "/dev/ptmx", Err: syscall.EAGAIN})
+	tests := []struct {
+		name        string
+		failures    int
+		err         error
+		wantErr     bool
+		wantRetries float64
+		wantErrType string
+		wantOutput  string
+	}{
+		{
+			name:        "TransientThenSuccess",
+			failures:    1,
+			err:         eagain,
+			wantRetries: 1,
+			wantOutput:  "started",
+		},
+		{
+			name:        "TransientExhausted",
+			failures:    ptyStartAttempts,
+			err:         eagain,
+			wantErr:     true,
+			wantRetries: ptyStartAttempts - 1,
+			wantErrType: "start_command_eagain",
+			wantOutput:  "out of pseudo-terminals",
+		},
+		{
+			name:        "Permanent",
+			failures:    1,
+			err:         xerrors.Errorf("start: %w", syscall.EACCES),
+			wantErr:     true,
+			wantErrType: "start_command",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := testutil.Logger(t)
+			s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+			require.NoError(t, err)
+			defer s.Close()
+
+			var attempts int
+			s.ptyStart = func(cmd *pty.Cmd, opts ...pty.StartOption) (pty.PTYCmd, pty.Process, error) {
+				attempts++
+				if attempts <= tt.failures {
+					return nil, nil, tt.err
+				}
+				return pty.Start(cmd, opts...)
+			}
+
+			toClient, fromClient, sess := newTestSession(ctx)
+			defer fromClient.Close()
+			output := make(chan string, 1)
+			go func() {
+				out, _ := io.ReadAll(toClient)
+				output <- string(out)
+			}()
+			windowSize := make(chan gliderssh.Window)
+			close(windowSize)
+			cmd := pty.CommandContext(ctx, "sh", "-c", "echo started")
+			err = s.startPTYSession(logger, sess, "ssh", "no", cmd, gliderssh.Pty{}, windowSize, ptySessionOptions{})
+			_ = toClient.Close()
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Contains(t, testutil.RequireReceive(ctx, t, output), tt.wantOutput)
+			require.Equal(t, tt.wantRetries, promtestutil.ToFloat64(s.metrics.ptyStartRetries))
+			if tt.wantErrType != "" {
+				require.EqualValues(t, 1, promtestutil.ToFloat64(s.metrics.sessionErrors.WithLabelValues("ssh", "yes", tt.wantErrType)))
+			}
+		})
+	}
+}
+
+// Test_sessionHandler_releasesSession verifies that nothing retains the
+// session after the handler has returned, so that it can be garbage collected
+// even while the connection stays open.
+func Test_sessionHandler_releasesSession(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := testutil.Logger(t)
+	s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	require.NoError(t, err)
+
+	var collected atomic.Int64
+	handler := s.srv.Handler
+	s.srv.Handler = func(session gliderssh.Session) {
+		runtime.SetFinalizer(session, func(any) { collected.Add(1) })
+		handler(session)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.Serve(ln)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	sshConn, channels, requests, err := gossh.NewClientConn(conn, "localhost:22", &gossh.ClientConfig{
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(), //nolint:gosec // This is a test.
+	})
+	require.NoError(t, err)
+	c := gossh.NewClient(sshConn, channels, requests)
+	defer c.Close()
+
+	const sessions = 5
+	for range sessions {
+		sess, err := c.NewSession()
+		require.NoError(t, err)
+		err = sess.Run("true")
+		require.NoError(t, err)
+		_ = sess.Close()
+	}
+
+	// The connection is kept open, only the sessions have ended.
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.sessions) == 0
+	}, testutil.WaitShort, testutil.IntervalFast)
+	require.Eventually(t, func() bool {
+		runtime.GC()
+		return collected.Load() == sessions
+	}, testutil.WaitShort, testutil.IntervalFast)
+
+	_ = c.Close()
+	err = s.Close()
+	require.NoError(t, err)
+	<-done
+}
+
+func Test_sessionHandler_container(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	sink := &testLogSink{}
+	logger := testutil.Logger(t).AppendSinks(sink)
+	audits := make(chan SessionStartAuditEntry, 2)
+	s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &Config{
+		ExperimentalContainers: true,
+		SessionStartAudit: func(e SessionStartAuditEntry) {
+			audits <- e
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	require.NoError(t, err)
+
+	containers := make(chan [2]string, 1)
+	s.containerEnvInfo = func(_ context.Context, _ agentexec.Execer, container, containerUser string) (usershell.EnvInfoer, error) {
+		containers <- [2]string{container, containerUser}
+		// Run the command on the host.
+		return &usershell.SystemEnvInfo{}, nil
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.Serve(ln)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	sshConn, channels, requests, err := gossh.NewClientConn(conn, "localhost:22", &gossh.ClientConfig{
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(), //nolint:gosec // This is a test.
+	})
+	require.NoError(t, err)
+	c := gossh.NewClient(sshConn, channels, requests)
+	defer c.Close()
+
+	// Sessions on the host are unchanged.
+	sess, err := c.NewSession()
+	require.NoError(t, err)
+	err = sess.Run("true")
+	require.NoError(t, err)
+	audit := testutil.RequireReceive(ctx, t, audits)
+	require.Empty(t, audit.Container)
+	require.Empty(t, audit.ContainerUser)
+	require.EqualValues(t, 1, promtestutil.ToFloat64(s.metrics.sessionsTotal.WithLabelValues("ssh", "no", "no")))
+
+	sess, err = c.NewSession()
+	require.NoError(t, err)
+	err = sess.Setenv(ContainerEnvironmentVariable, "my-container")
+	require.NoError(t, err)
+	err = sess.Setenv(ContainerUserEnvironmentVariable, "coder")
+	require.NoError(t, err)
+	err = sess.Run("true")
+	require.NoError(t, err)
+	require.Equal(t, [2]string{"my-container", "coder"}, testutil.RequireReceive(ctx, t, containers))
+	audit = testutil.RequireReceive(ctx, t, audits)
+	require.Equal(t, "my-container", audit.Container)
+	require.Equal(t, "coder", audit.ContainerUser)
+	require.EqualValues(t, 1, promtestutil.ToFloat64(s.metrics.sessionsTotal.WithLabelValues("ssh", "no", "yes")))
+
+	// All session logs carry the container.
+	var found bool
+	for _, e := range sink.entries() {
+		if e.Message != "session targets container" {
+			continue
+		}
+		found = true
+		fields := map[string]any{}
+		for _, f := range e.Fields {
+			fields[f.Name] = f.Value
+		}
+		require.Equal(t, "my-container", fields["container"])
+		require.Equal(t, "coder", fields["container_user"])
+	}
+	require.True(t, found, "container log entry not found")
+
+	_ = c.Close()
+	err = s.Close()
+	require.NoError(t, err)
+	<-done
+}
+
+type testLogSink struct {
+	mu sync.Mutex
+	es []slog.SinkEntry
+}
+
+func (s *testLogSink) LogEntry(_ context.Context, e slog.SinkEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.es = append(s.es, e)
+}
+
+func (*testLogSink) Sync() {}
+
+func (s *testLogSink) entries() []slog.SinkEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.es)
+}
+
+func Test_writeWithCarriageReturn(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		input string
+		pty   string
+		noPty string
+	}{
+		{name: "Empty", input: "", pty: "", noPty: ""},
+		{name: "LF", input: "hello\nworld\n", pty: "hello\r\nworld\r\n", noPty: "hello\nworld\n"},
+		{name: "CRLF", input: "hello\r\nworld\r\n", pty: "hello\r\nworld\r\n", noPty: "hello\nworld\n"},
+		{name: "Mixed", input: "a\r\nb\nc\r\r\n", pty: "a\r\nb\r\nc\r\n", noPty: "a\nb\nc\n"},
+		{name: "NoTrailingNewline", input: "hello\nworld", pty: "hello\r\nworld", noPty: "hello\nworld"},
+		{name: "BlankLines", input: "hello\n\n\nworld\n", pty: "hello\r\n\r\n\r\nworld\r\n", noPty: "hello\n\n\nworld\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var pty, noPty strings.Builder
+			err := writeWithCarriageReturn(strings.NewReader(tt.input), &pty, true)
+			require.NoError(t, err)
+			require.Equal(t, tt.pty, pty.String())
+			err = writeWithCarriageReturn(strings.NewReader(tt.input), &noPty, false)
+			require.NoError(t, err)
+			require.Equal(t, tt.noPty, noPty.String())
+		})
+	}
+}
+
+func Test_isBlockedFileTransferCommand(t *testing.T) {
+	t.Parallel()
+
+	custom := []string{"curl", "wget", "scp"}
+	tests := []struct {
+		name     string
+		blocked  []string
+		binary   string
+		foldCase bool
+		want     bool
+	}{
+		{name: "Name", blocked: BlockedFileTransferCommands, binary: "rsync", want: true},
+		{name: "AbsolutePath", blocked: BlockedFileTransferCommands, binary: "/usr/bin/scp", want: true},
+		{name: "NotBlocked", blocked: BlockedFileTransferCommands, binary: "curl"},
+		{name: "Prefix", blocked: BlockedFileTransferCommands, binary: "scp2"},
+		{name: "Custom", blocked: custom, binary: "/usr/bin/wget", want: true},
+		{name: "CustomUnblocked", blocked: custom, binary: "rsync"},
+		{name: "WindowsPath", blocked: custom, binary: `C:\Windows\System32\OpenSSH\scp.exe`, want: true},
+		{name: "WindowsExtension", blocked: custom, binary: "curl.EXE", want: true},
+		{name: "OtherExtension", blocked: custom, binary: "scp.bat"},
+		{name: "CaseSensitive", blocked: custom, binary: `C:\OpenSSH\SCP.exe`},
+		{name: "CaseInsensitive", blocked: custom, binary: `C:\OpenSSH\SCP.exe`, foldCase: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.want, isBlockedFileTransferCommand(tt.blocked, tt.binary, tt.foldCase))
+		})
+	}
+}
+
+func Test_remoteAddrAllowed(t *testing.T) {
+	t.Parallel()
+
+	allowed := []netip.Prefix{
+		netip.MustParsePrefix("100.64.0.0/10"),
+		netip.MustParsePrefix("fd7a:115c:a1e0::/48"),
+	}
+	tests := []struct {
+		name string
+		addr net.Addr
+		want bool
+	}{
+		{name: "IPv4", addr: &net.TCPAddr{IP: net.ParseIP("100.64.1.2"), Port: 22}, want: true},
+		{name: "IPv4Denied", addr: &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 22}},
+		{name: "IPv4Mapped", addr: &net.TCPAddr{IP: net.ParseIP("::ffff:100.64.1.2"), Port: 22}, want: true},
+		{name: "IPv4MappedDenied", addr: &net.TCPAddr{IP: net.ParseIP("::ffff:192.168.1.2"), Port: 22}},
+		{name: "IPv6", addr: &net.TCPAddr{IP: net.ParseIP("fd7a:115c:a1e0::1"), Port: 22}, want: true},
+		{name: "IPv6Zone", addr: &net.TCPAddr{IP: net.ParseIP("fd7a:115c:a1e0::1"), Port: 22, Zone: "eth0"}, want: true},
+		{name: "IPv6Denied", addr: &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 22}},
+		{name: "OtherAddr", addr: &net.UDPAddr{IP: net.ParseIP("100.64.1.2"), Port: 22}, want: true},
+		{name: "Malformed", addr: &net.UnixAddr{Name: "100.64.1.2", Net: "unix"}},
+		{name: "NoIP", addr: &net.TCPAddr{Port: 22}},
+		{name: "Nil"},
+		{name: "NilTCPAddr", addr: (*net.TCPAddr)(nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.want, remoteAddrAllowed(tt.addr, allowed))
+		})
+	}
+}
+
+func Test_clientAlive(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		config       Config
+		wantInterval time.Duration
+		wantCountMax int
+	}{
+		{name: "Disabled"},
+		{name: "ShortMaxTimeout", config: Config{MaxTimeout: time.Second}},
+		{name: "MaxTimeout", config: Config{MaxTimeout: 3 * time.Second}, wantInterval: time.Second, wantCountMax: 3},
+		{name: "Interval", config: Config{MaxTimeout: 3 * time.Second, ClientAliveInterval: 10 * time.Second}, wantInterval: 10 * time.Second, wantCountMax: 3},
+		{name: "CountMax", config: Config{MaxTimeout: time.Minute, ClientAliveCountMax: 5}, wantInterval: 20 * time.Second, wantCountMax: 5},
+		{name: "Both", config: Config{MaxTimeout: time.Minute, ClientAliveInterval: 15 * time.Second, ClientAliveCountMax: 2}, wantInterval: 15 * time.Second, wantCountMax: 2},
+		{name: "IntervalWithoutMaxTimeout", config: Config{ClientAliveInterval: 15 * time.Second}, wantInterval: 15 * time.Second, wantCountMax: 3},
+		{name: "CountMaxWithoutInterval", config: Config{ClientAliveCountMax: 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			interval, countMax := clientAlive(&tt.config)
+			require.Equal(t, tt.wantInterval, interval)
+			require.Equal(t, tt.wantCountMax, countMax)
+		})
+	}
+}
+
+func Test_wrapLines(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		input string
+		width int
+		want  string
+	}{
+		{name: "Disabled", input: "hello world", width: 0, want: "hello world"},
+		{name: "Fits", input: "hello world\n", width: 11, want: "hello world\n"},
+		{name: "WordBoundary", input: "hello world foo bar", width: 11, want: "hello world\nfoo bar"},
+		{name: "Indented", input: "  indented text that wraps here", width: 10, want: "  indented\ntext that\nwraps here"},
+		{name: "LongWord", input: "abcdefghijklmnopqrstuvwxyz", width: 10, want: "abcdefghij\nklmnopqrst\nuvwxyz"},
+		{name: "LongWordBetween", input: "a abcdefghijklmnop b", width: 5, want: "a\nabcde\nfghij\nklmno\np b"},
+		{name: "KeepsLineEndings", input: "short\r\nthis line is long\r\n", width: 8, want: "short\r\nthis\nline is\nlong\r\n"},
+		{name: "Runes", input: "héllo wörld", width: 5, want: "héllo\nwörld"},
+		{name: "NarrowWidth", input: "ab cd", width: 1, want: "a\nb\nc\nd"},
+		{name: "KeepsSpacing", input: "one  two   three", width: 9, want: "one  two\nthree"},
+		{name: "ANSIFits", input: "\x1b[1mhello\x1b[0m", width: 5, want: "\x1b[1mhello\x1b[0m"},
+		{name: "ANSIWordBoundary", input: "\x1b[31mhello world\x1b[0m", width: 5, want: "\x1b[31mhello\nworld\x1b[0m"},
+		{name: "ANSILongWord", input: "\x1b[32mabcdefghij\x1b[0m", width: 4, want: "\x1b[32mabcd\nefgh\nij\x1b[0m"},
+		{name: "ANSIBetweenWords", input: "one \x1b[1mtwo\x1b[0m three", width: 8, want: "one \x1b[1mtwo\x1b[0m\nthree"},
+		{name: "ANSIAtBreak", input: "one \x1b[1mtwo", width: 4, want: "one\x1b[1m\ntwo"},
+		{name: "ANSIIndent", input: "\x1b[1m      ab", width: 4, want: "\x1b[1mab"},
+		{
+			name:  "Hyperlink",
+			input: "\x1b]8;;https://example.com\x07link\x1b]8;;\x07 text",
+			width: 4,
+			want:  "\x1b]8;;https://example.com\x07link\x1b]8;;\x07\ntext",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.want, wrapLines(tt.input, tt.width))
+		})
+	}
+}
+
+func Test_showAnnouncementBanner_wrap(t *testing.T) {
+	t.Parallel()
+
+	banner := codersdk.BannerConfig{Enabled: true, Message: "Maintenance tonight, save your work"}
+	var out strings.Builder
+	err := showAnnouncementBanner(&out, banner, true, 12)
+	require.NoError(t, err)
+	require.Equal(t, "Maintenance\r\ntonight,\r\nsave your\r\nwork\r\n\r\n", out.String())
+
+	out.Reset()
+	err = showAnnouncementBanner(&out, banner, true, 0)
+	require.NoError(t, err)
+	require.Equal(t, "Maintenance tonight, save your work\r\n\r\n", out.String())
+}
+
 func waitForChan(ctx context.Context, t *testing.T, c <-chan struct{}, msg string) {
 	t.Helper()
 	select {
@@ -205,3 +858,134 @@ func (testSSHContext) SetValue(_, _ interface{}) {
 func (testSSHContext) KeepAlive() *gliderssh.SessionKeepAlive {
 	panic("not implemented")
 }
+
+//nolint:paralleltest // Sets $HOME.
+func Test_resolvedHomeDir_symlink(t *testing.T) {
+	// The temporary directory may itself be behind a symlink, e.g. on macOS.
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	realHome := filepath.Join(tmp, "mnt", "persist", "coder")
+	require.NoError(t, os.MkdirAll(realHome, 0o755))
+	require.NoError(t, os.Mkdir(filepath.Join(tmp, "home"), 0o755))
+	// A relative link to check that targets are resolved against the
+	// directory of the link.
+	linkHome := filepath.Join(tmp, "home", "coder")
+	require.NoError(t, os.Symlink("../mnt/persist/coder", linkHome))
+	require.NoError(t, os.WriteFile(filepath.Join(realHome, ".hushlogin"), nil, 0o600))
+	t.Setenv("HOME", linkHome)
+
+	t.Run("EvalSymlinks", func(t *testing.T) {
+		assert.Equal(t, realHome, evalSymlinks(afero.NewOsFs(), linkHome))
+		// Resolved one element at a time.
+		assert.Equal(t, realHome, evalSymlinks(afero.NewReadOnlyFs(afero.NewOsFs()), linkHome))
+		// Filesystems without symlinks leave the path unchanged.
+		assert.Equal(t, linkHome, evalSymlinks(afero.NewMemMapFs(), linkHome))
+		// So do missing paths and symlink loops.
+		missing := filepath.Join(tmp, "missing")
+		assert.Equal(t, missing, evalSymlinks(afero.NewReadOnlyFs(afero.NewOsFs()), missing))
+		loop := filepath.Join(tmp, "loop")
+		require.NoError(t, os.Symlink(loop, loop))
+		assert.Equal(t, loop, evalSymlinks(afero.NewReadOnlyFs(afero.NewOsFs()), loop))
+	})
+
+	t.Run("Server", func(t *testing.T) {
+		ctx := testutil.Context(t, testutil.WaitShort)
+		fs := afero.NewReadOnlyFs(afero.NewOsFs())
+		s, err := NewServer(ctx, testutil.Logger(t), prometheus.NewRegistry(), fs, agentexec.DefaultExecer, &Config{})
+		require.NoError(t, err)
+		defer s.Close()
+
+		assert.Equal(t, realHome, s.config.WorkingDirectory())
+		assert.Equal(t, noticeSkippedHushLogin, quietLoginReason(fs, ""))
+
+		s.config.WorkingDirectory = func() string { return "" }
+		_, dir, _, err := s.CommandEnv(ctx, nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, realHome, dir)
+	})
+}
+
+// blockingStatFs is a filesystem whose Stat blocks until unblocked, like a
+// hung network mount.
+type blockingStatFs struct {
+	afero.Fs
+	stats   chan string
+	unblock chan struct{}
+}
+
+func (fs *blockingStatFs) Stat(name string) (os.FileInfo, error) {
+	fs.stats <- name
+	<-fs.unblock
+	return nil, os.ErrNotExist
+}
+
+func TestServer_CommandEnv_workingDirectoryStat(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	clock := quartz.NewMock(t)
+	fs := &blockingStatFs{Fs: afero.NewMemMapFs(), stats: make(chan string, 1), unblock: make(chan struct{})}
+	defer close(fs.unblock)
+	const workDir = "/mnt/nfs/project"
+	newServer := func(skipCheck bool) *Server {
+		s, err := NewServer(ctx, testutil.Logger(t), prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &Config{
+			Clock:               clock,
+			WorkingDirectory:    func() string { return workDir },
+			SkipWorkingDirCheck: skipCheck,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = s.Close() })
+		s.workingDirFs = fs
+		return s
+	}
+
+	// The directory is used anyway once the stat times out.
+	s := newServer(false)
+	trap := clock.Trap().NewTimer("working_directory", "stat")
+	defer trap.Close()
+	dirs := make(chan string, 1)
+	go func() {
+		_, dir, _, err := s.CommandEnv(ctx, nil, nil)
+		assert.NoError(t, err)
+		dirs <- dir
+	}()
+	require.Equal(t, workDir, testutil.RequireReceive(ctx, t, fs.stats))
+	trap.MustWait(ctx).MustRelease(ctx)
+	clock.Advance(2 * time.Second).MustWait(ctx)
+	require.Equal(t, workDir, testutil.RequireReceive(ctx, t, dirs))
+
+	// Without the check, the filesystem isn't touched at all.
+	s = newServer(true)
+	_, dir, _, err := s.CommandEnv(ctx, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, workDir, dir)
+	select {
+	case name := <-fs.stats:
+		t.Fatalf("unexpected stat of %q", name)
+	default:
+	}
+}
+
+func TestServer_CommandEnv_sessionPolicy(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	s, err := NewServer(ctx, testutil.Logger(t), prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// A session keeps the policy it started with, even if the policy
+	// changes before its command is created.
+	sessionCtx := withPolicy(ctx, s.currentPolicy())
+	s.SetPolicy(Policy{BlockFileTransfer: true})
+
+	_, _, env, err := s.CommandEnv(sessionCtx, nil, nil)
+	require.NoError(t, err)
+	capabilities, _ := envValue(env, CapabilitiesEnvironmentVariable)
+	require.Contains(t, capabilities, "sftp=yes")
+
+	_, _, env, err = s.CommandEnv(ctx, nil, nil)
+	require.NoError(t, err)
+	capabilities, _ = envValue(env, CapabilitiesEnvironmentVariable)
+	require.Contains(t, capabilities, "sftp=no")
+}
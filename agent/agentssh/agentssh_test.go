@@ -6,288 +6,4166 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"os"
 	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	gliderssh "github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/xerrors"
 
 	"cdr.dev/slog"
 	"cdr.dev/slog/sloggers/slogtest"
 
 	"github.com/coder/coder/v2/agent/agentexec"
 	"github.com/coder/coder/v2/agent/agentssh"
+	"github.com/coder/coder/v2/agent/agentssh/sshtest"
+	"github.com/coder/coder/v2/agent/usershell"
+	"github.com/coder/coder/v2/codersdk"
+	"github.com/coder/coder/v2/pty"
 	"github.com/coder/coder/v2/pty/ptytest"
 	"github.com/coder/coder/v2/testutil"
+	"github.com/coder/quartz"
 )
 
 func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == agentssh.PAMSessionCommand {
+		// The test binary is the PAM helper of servers with PAM enabled.
+		err := agentssh.PAMSessionCLI()
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	goleak.VerifyTestMain(m, testutil.GoleakOptions...)
 }
 
-func TestNewServer_ServeClient(t *testing.T) {
-	t.Parallel()
+type testServerOptions struct {
+	reg    *prometheus.Registry
+	fs     afero.Fs
+	execer agentexec.Execer
+}
 
-	ctx := context.Background()
-	logger := testutil.Logger(t)
-	s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+// testServerOption configures the server created by newTestServer.
+type testServerOption func(*testServerOptions)
+
+// withRegistry registers the metrics of the server with reg.
+func withRegistry(reg *prometheus.Registry) testServerOption {
+	return func(o *testServerOptions) {
+		o.reg = reg
+	}
+}
+
+// withFs sets the file system the server uses, e.g. for SFTP.
+func withFs(fs afero.Fs) testServerOption {
+	return func(o *testServerOptions) {
+		o.fs = fs
+	}
+}
+
+// withExecer sets the execer the server starts commands with.
+func withExecer(execer agentexec.Execer) testServerOption {
+	return func(o *testServerOptions) {
+		o.execer = execer
+	}
+}
+
+// newTestServer creates a server with the given config and serves it on a
+// local TCP listener. It returns the server and the address of the
+// listener. The server is closed when the test ends.
+func newTestServer(t *testing.T, logger slog.Logger, cfg *agentssh.Config, opts ...testServerOption) (*agentssh.Server, string) {
+	t.Helper()
+
+	o := testServerOptions{
+		reg:    prometheus.NewRegistry(),
+		fs:     afero.NewMemMapFs(),
+		execer: agentexec.DefaultExecer,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	ctx := testutil.Context(t, testutil.WaitLong)
+	s, err := agentssh.NewServer(ctx, logger, o.reg, o.fs, o.execer, cfg)
 	require.NoError(t, err)
-	defer s.Close()
 	err = s.UpdateHostSigner(42)
-	assert.NoError(t, err)
+	require.NoError(t, err)
 
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
-
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
 		err := s.Serve(ln)
 		assert.Error(t, err) // Server is closed.
 	}()
+	t.Cleanup(func() {
+		_ = s.Close()
+		<-done
+	})
+	return s, ln.Addr().String()
+}
+
+func TestNewServer_ServeClient(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	logger := testutil.Logger(t)
+	_, addr := newTestServer(t, logger, nil)
 
-	c := sshClient(t, ln.Addr().String())
+	sess, _ := sshtest.DialSession(ctx, t, addr)
 
 	var b bytes.Buffer
-	sess, err := c.NewSession()
-	require.NoError(t, err)
 	sess.Stdout = &b
-	err = sess.Start("echo hello")
+	err := sess.Start("echo hello")
 	require.NoError(t, err)
 
 	err = sess.Wait()
 	require.NoError(t, err)
 
 	require.Equal(t, "hello", strings.TrimSpace(b.String()))
-
-	err = s.Close()
-	require.NoError(t, err)
-	<-done
 }
 
-func TestNewServer_ExecuteShebang(t *testing.T) {
+func TestNewServer_InMemoryListener(t *testing.T) {
 	t.Parallel()
-	if runtime.GOOS == "windows" {
-		t.Skip("bash doesn't exist on Windows")
-	}
 
-	ctx := context.Background()
+	ctx := testutil.Context(t, testutil.WaitMedium)
 	logger := testutil.Logger(t)
-	s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
-	require.NoError(t, err)
-	t.Cleanup(func() {
-		_ = s.Close()
-	})
-
-	t.Run("Basic", func(t *testing.T) {
-		t.Parallel()
-		cmd, err := s.CreateCommand(ctx, `#!/bin/bash
-		echo test`, nil, nil)
-		require.NoError(t, err)
-		output, err := cmd.AsExec().CombinedOutput()
-		require.NoError(t, err)
-		require.Equal(t, "test\n", string(output))
-	})
-	t.Run("Args", func(t *testing.T) {
-		t.Parallel()
-		cmd, err := s.CreateCommand(ctx, `#!/usr/bin/env bash
-		echo test`, nil, nil)
-		require.NoError(t, err)
-		output, err := cmd.AsExec().CombinedOutput()
-		require.NoError(t, err)
-		require.Equal(t, "test\n", string(output))
-	})
-	t.Run("CustomEnvInfoer", func(t *testing.T) {
-		t.Parallel()
-		ei := &fakeEnvInfoer{
-			CurrentUserFn: func() (u *user.User, err error) {
-				return nil, assert.AnError
-			},
-		}
-		_, err := s.CreateCommand(ctx, `whatever`, nil, ei)
-		require.ErrorIs(t, err, assert.AnError)
+	infos := make(chan agentssh.ConnectionInfo, 8)
+	s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		ReportConnectionV3: func(info agentssh.ConnectionInfo) agentssh.ReportedConnection {
+			infos <- info
+			return agentssh.ReportedConnection{}
+		},
 	})
-}
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	assert.NoError(t, err)
 
-type fakeEnvInfoer struct {
-	CurrentUserFn func() (*user.User, error)
-	EnvironFn     func() []string
-	UserHomeDirFn func() (string, error)
-	UserShellFn   func(string) (string, error)
-}
+	ln := agentssh.NewInMemoryListener("test")
+	require.Equal(t, agentssh.InMemoryNetwork, ln.Addr().Network())
 
-func (f *fakeEnvInfoer) User() (u *user.User, err error) {
-	return f.CurrentUserFn()
-}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := s.Serve(ln)
+		assert.Error(t, err) // Server is closed.
+	}()
 
-func (f *fakeEnvInfoer) Environ() []string {
-	return f.EnvironFn()
-}
+	c := sshtest.DialInMemory(ctx, t, ln)
+	// The synthetic address isn't a host:port pair, and is reported as is.
+	remoteAddr := c.LocalAddr().String()
+	require.Equal(t, "test#1", remoteAddr)
 
-func (f *fakeEnvInfoer) HomeDir() (string, error) {
-	return f.UserHomeDirFn()
-}
+	t.Run("Exec", func(t *testing.T) {
+		sess := sshtest.NewSession(t, c, sshtest.WithSessionType(agentssh.MagicSessionTypeVSCode))
+		out, err := sess.Output("echo hello")
+		require.NoError(t, err)
+		require.Equal(t, "hello", strings.TrimSpace(string(out)))
 
-func (f *fakeEnvInfoer) Shell(u string) (string, error) {
-	return f.UserShellFn(u)
-}
+		info := testutil.RequireReceive(ctx, t, infos)
+		require.Equal(t, remoteAddr, info.IP)
+	})
 
-func (*fakeEnvInfoer) ModifyCommand(cmd string, args ...string) (string, []string) {
-	return cmd, args
-}
+	t.Run("PTY", func(t *testing.T) {
+		sess := sshtest.NewSession(t, c, sshtest.WithPTY("xterm", 80, 24))
+		out, err := sess.Output("echo hello")
+		require.NoError(t, err)
+		require.Equal(t, "hello", strings.TrimSpace(string(out)))
+		_ = testutil.RequireReceive(ctx, t, infos)
+	})
 
-func TestNewServer_CloseActiveConnections(t *testing.T) {
-	t.Parallel()
+	t.Run("SFTP", func(t *testing.T) {
+		client, err := sftp.NewClient(c)
+		require.NoError(t, err)
+		_, err = client.Getwd()
+		require.NoError(t, err)
+		require.NoError(t, client.Close())
+	})
 
-	prepare := func(ctx context.Context, t *testing.T) (*agentssh.Server, func()) {
-		t.Helper()
-		logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true}).Leveled(slog.LevelDebug)
-		s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+	t.Run("LocalForward", func(t *testing.T) {
+		echo, err := net.Listen("tcp", "127.0.0.1:0")
 		require.NoError(t, err)
-		t.Cleanup(func() {
-			_ = s.Close()
-		})
-		err = s.UpdateHostSigner(42)
-		assert.NoError(t, err)
+		defer echo.Close()
+		go func() {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}()
 
-		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		conn, err := c.Dial("tcp", echo.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
 		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+	})
 
-		waitConns := make([]chan struct{}, 4)
+	t.Run("ReverseForward", func(t *testing.T) {
+		rln, err := c.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer rln.Close()
 
-		var wg sync.WaitGroup
-		wg.Add(1 + len(waitConns))
+		forwards := s.ReverseForwards()
+		require.Len(t, forwards, 1)
+		require.Equal(t, remoteAddr, forwards[0].RemoteAddr)
 
+		accepted := make(chan net.Conn, 1)
 		go func() {
-			defer wg.Done()
-			err := s.Serve(ln)
-			assert.Error(t, err) // Server is closed.
+			conn, err := rln.Accept()
+			if assert.NoError(t, err) {
+				accepted <- conn
+			}
 		}()
+		conn, err := net.Dial("tcp", rln.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		fwdConn := testutil.RequireReceive(ctx, t, accepted)
+		defer fwdConn.Close()
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(fwdConn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+	})
 
-		for i := 0; i < len(waitConns); i++ {
-			waitConns[i] = make(chan struct{})
-			go func(ch chan struct{}) {
-				defer wg.Done()
-				c := sshClient(t, ln.Addr().String())
-				sess, err := c.NewSession()
-				assert.NoError(t, err)
-				pty := ptytest.New(t)
-				sess.Stdin = pty.Input()
-				sess.Stdout = pty.Output()
-				sess.Stderr = pty.Output()
+	err = s.Close()
+	require.NoError(t, err)
+	<-done
 
-				// Every other session will request a PTY.
-				if i%2 == 0 {
-					err = sess.RequestPty("xterm", 80, 80, nil)
-					assert.NoError(t, err)
-				}
-				// The 60 seconds here is intended to be longer than the
-				// test. The shutdown should propagate.
-				if runtime.GOOS == "windows" {
-					// Best effort to at least partially test this in Windows.
-					err = sess.Start("echo start\"ed\" && sleep 60")
-				} else {
-					err = sess.Start("/bin/bash -c 'trap \"sleep 60\" SIGTERM; echo start\"ed\"; sleep 60'")
-				}
-				assert.NoError(t, err)
+	// The listener was closed with the server.
+	_, err = ln.Dial(ctx)
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+func TestNewServer_ServerVersion(t *testing.T) {
+	t.Parallel()
 
-				// Allow the session to settle (i.e. reach echo).
-				pty.ExpectMatchContext(ctx, "started")
-				// Sleep a bit to ensure the sleep has started.
-				time.Sleep(testutil.IntervalMedium)
+	t.Run("Handshake", func(t *testing.T) {
+		t.Parallel()
 
-				close(ch)
+		for _, tt := range []struct {
+			name    string
+			version string
+			want    string
+		}{
+			{name: "Default", want: "SSH-2.0-Go"},
+			{name: "Custom", version: "SSH-2.0-Acme_1.0 built by ops", want: "SSH-2.0-Acme_1.0 built by ops"},
+			{name: "Agent", version: agentssh.AgentServerVersion("v2.24.1-rc.0+abc123"), want: "SSH-2.0-CoderAgent_v2.24.1_rc.0+abc123"},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				t.Parallel()
 
-				err = sess.Wait()
-				assert.Error(t, err)
-			}(waitConns[i])
-		}
+				ctx := testutil.Context(t, testutil.WaitShort)
+				logger := testutil.Logger(t)
+				s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+					ServerVersion: tt.version,
+				})
+				require.NoError(t, err)
+				defer s.Close()
+				err = s.UpdateHostSigner(42)
+				assert.NoError(t, err)
 
-		for _, ch := range waitConns {
-			select {
-			case <-ctx.Done():
-				t.Fatal("timeout")
-			case <-ch:
-			}
-		}
+				ln := agentssh.NewInMemoryListener("test")
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					err := s.Serve(ln)
+					assert.Error(t, err) // Server is closed.
+				}()
 
-		return s, wg.Wait
-	}
+				c := sshtest.DialInMemory(ctx, t, ln)
+				require.Equal(t, tt.want, string(c.ServerVersion()))
 
-	t.Run("Close", func(t *testing.T) {
-		t.Parallel()
-		ctx := testutil.Context(t, testutil.WaitMedium)
-		s, wait := prepare(ctx, t)
-		err := s.Close()
-		require.NoError(t, err)
-		wait()
+				err = s.Close()
+				require.NoError(t, err)
+				<-done
+			})
+		}
 	})
 
-	t.Run("Shutdown", func(t *testing.T) {
+	t.Run("Invalid", func(t *testing.T) {
 		t.Parallel()
-		ctx := testutil.Context(t, testutil.WaitMedium)
-		s, wait := prepare(ctx, t)
-		err := s.Shutdown(ctx)
-		require.NoError(t, err)
-		wait()
-	})
 
-	t.Run("Shutdown Early", func(t *testing.T) {
-		t.Parallel()
-		ctx := testutil.Context(t, testutil.WaitMedium)
-		s, wait := prepare(ctx, t)
-		ctx, cancel := context.WithCancel(ctx)
-		cancel()
-		err := s.Shutdown(ctx)
-		require.ErrorIs(t, err, context.Canceled)
-		wait()
+		for _, version := range []string{
+			"Acme_1.0",
+			"SSH-1.99-Acme_1.0",
+			"SSH-2.0-",
+			"SSH-2.0- comment",
+			"SSH-2.0-Acme-1.0",
+			"SSH-2.0-Acme_1.0 ",
+			"SSH-2.0-Acme\t1.0",
+			"SSH-2.0-Acme_1.0\r\nInjected",
+			"SSH-2.0-Acmé_1.0",
+			"SSH-2.0-" + strings.Repeat("a", 246),
+		} {
+			ctx := testutil.Context(t, testutil.WaitShort)
+			_, err := agentssh.NewServer(ctx, testutil.Logger(t), prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+				ServerVersion: version,
+			})
+			require.Error(t, err, version)
+		}
 	})
 }
 
-func TestNewServer_Signal(t *testing.T) {
+func TestNewServer_PublicKeyCallback(t *testing.T) {
 	t.Parallel()
 
-	t.Run("Stdout", func(t *testing.T) {
-		t.Parallel()
-
-		ctx := context.Background()
-		logger := testutil.Logger(t)
-		s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+	newSigner := func(t *testing.T) ssh.Signer {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
 		require.NoError(t, err)
-		defer s.Close()
-		err = s.UpdateHostSigner(42)
-		assert.NoError(t, err)
-
-		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		signer, err := ssh.NewSignerFromKey(key)
 		require.NoError(t, err)
+		return signer
+	}
+	authorized := newSigner(t)
 
-		done := make(chan struct{})
-		go func() {
-			defer close(done)
-			err := s.Serve(ln)
-			assert.Error(t, err) // Server is closed.
-		}()
-		defer func() {
-			err := s.Close()
-			require.NoError(t, err)
-			<-done
-		}()
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := testutil.Logger(t)
+	reg := prometheus.NewRegistry()
+	users := make(chan string, 8)
+	s, err := agentssh.NewServer(ctx, logger, reg, afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		PublicKeyCallback: func(ctx gliderssh.Context, key gliderssh.PublicKey) bool {
+			users <- ctx.User()
+			return bytes.Equal(key.Marshal(), authorized.PublicKey().Marshal())
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	assert.NoError(t, err)
 
-		c := sshClient(t, ln.Addr().String())
+	ln := agentssh.NewInMemoryListener("test")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := s.Serve(ln)
+		assert.Error(t, err) // Server is closed.
+	}()
 
-		sess, err := c.NewSession()
+	handshake := func(opts ...sshtest.Option) error {
+		conn, err := ln.Dial(ctx)
 		require.NoError(t, err)
-		r, err := sess.StdoutPipe()
+		defer conn.Close()
+		sshConn, _, _, err := ssh.NewClientConn(conn, "localhost:22", sshtest.ClientConfig(opts...))
+		if err == nil {
+			_ = sshConn.Close()
+		}
+		return err
+	}
+
+	// Without a key, and with a key the callback rejects.
+	require.Error(t, handshake())
+	require.Error(t, handshake(sshtest.WithUser("coder"), sshtest.WithSigner(newSigner(t))))
+	require.Equal(t, "coder", testutil.RequireReceive(ctx, t, users))
+
+	c := sshtest.DialInMemory(ctx, t, ln, sshtest.WithUser("coder"), sshtest.WithSigner(authorized))
+	require.Equal(t, "coder", testutil.RequireReceive(ctx, t, users))
+	sess := sshtest.NewSession(t, c)
+	out, err := sess.Output("echo hello")
+	require.NoError(t, err)
+	require.Equal(t, "hello", strings.TrimSpace(string(out)))
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	require.True(t, testutil.PromCounterHasValue(t, metrics, 1, "agent_ssh_server_public_key_auth_failures_total"))
+
+	err = s.Close()
+	require.NoError(t, err)
+	<-done
+}
+
+func TestNewServer_InvalidClientAlive(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	_, err := agentssh.NewServer(ctx, testutil.Logger(t), prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		ClientAliveInterval: -time.Second,
+	})
+	require.ErrorContains(t, err, "invalid client alive interval")
+	_, err = agentssh.NewServer(ctx, testutil.Logger(t), prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		ClientAliveCountMax: -1,
+	})
+	require.ErrorContains(t, err, "invalid client alive count max")
+}
+
+func TestNewServer_AllowedCIDRs(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	_, err := agentssh.NewServer(ctx, testutil.Logger(t), prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		AllowedCIDRs: []netip.Prefix{{}},
+	})
+	require.ErrorContains(t, err, "invalid allowed CIDR")
+
+	for _, tt := range []struct {
+		cidr    string
+		allowed bool
+	}{
+		{cidr: "10.0.0.0/8"},
+		{cidr: "127.0.0.0/8", allowed: true},
+	} {
+		t.Run(tt.cidr, func(t *testing.T) {
+			t.Parallel()
+
+			logger := testutil.Logger(t)
+			reg := prometheus.NewRegistry()
+			s, addr := newTestServer(t, logger, &agentssh.Config{
+				AllowedCIDRs: []netip.Prefix{netip.MustParsePrefix(tt.cidr)},
+			}, withRegistry(reg))
+
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			sshConn, _, _, err := ssh.NewClientConn(conn, addr, sshtest.ClientConfig())
+			denied := 0.0
+			if tt.allowed {
+				require.NoError(t, err)
+				_ = sshConn.Close()
+			} else {
+				// The connection is closed before the handshake.
+				require.Error(t, err)
+				denied = 1
+			}
+
+			err = s.Close()
+			require.NoError(t, err)
+
+			metrics, err := reg.Gather()
+			require.NoError(t, err)
+			require.True(t, testutil.PromCounterHasValue(t, metrics, denied, "agent_ssh_server_connections_denied_cidr_total"))
+		})
+	}
+}
+
+// flakyListener fails Accept with EMFILE the given number of times before
+// delegating to the wrapped listener.
+type flakyListener struct {
+	net.Listener
+	mu       sync.Mutex
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.failures > 0 {
+		l.failures--
+		l.mu.Unlock()
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	l.mu.Unlock()
+	return l.Listener.Accept()
+}
+
+func TestNewServer_AcceptBackoff(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	reg := prometheus.NewRegistry()
+	s, err := agentssh.NewServer(ctx, logger, reg, afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	assert.NoError(t, err)
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln := &flakyListener{Listener: tcpLn, failures: 3}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := s.Serve(ln)
+		assert.Error(t, err) // Server is closed.
+	}()
+
+	c := sshtest.Dial(ctx, t, ln.Addr().String())
+
+	var b bytes.Buffer
+	sess, err := c.NewSession()
+	require.NoError(t, err)
+	sess.Stdout = &b
+	err = sess.Run("echo hello")
+	require.NoError(t, err)
+	require.Equal(t, "hello", strings.TrimSpace(b.String()))
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	var backoffs float64
+	for _, m := range metrics {
+		if m.GetName() == "agent_ssh_server_accept_backoffs_total" {
+			backoffs = m.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	require.Equal(t, float64(3), backoffs)
+
+	err = s.Close()
+	require.NoError(t, err)
+	<-done
+}
+
+func TestNewServer_AgentForwardingUnavailable(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("agent forwarding uses unix sockets")
+	}
+
+	// A regular file can't contain the temporary socket directory, so
+	// creating the agent listener fails.
+	notDir := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(notDir, nil, 0o600)
+	require.NoError(t, err)
+
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Strict=%t", strict), func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			_, addr := newTestServer(t, logger, &agentssh.Config{
+				AgentSocketDir: notDir,
+				Policy:         agentssh.Policy{StrictAgentForwarding: strict},
+			})
+
+			sess, _ := sshtest.DialSession(ctx, t, addr, sshtest.WithPTY("xterm", 80, 24))
+			err := agent.RequestAgentForwarding(sess)
+			require.NoError(t, err)
+
+			out, err := sess.Output("echo sock=${SSH_AUTH_SOCK}")
+			if strict {
+				exitErr := &ssh.ExitError{}
+				require.ErrorAs(t, err, &exitErr)
+				require.Equal(t, agentssh.MagicSessionErrorCode, exitErr.ExitStatus())
+			} else {
+				require.NoError(t, err)
+				require.Contains(t, string(out), "agent forwarding unavailable")
+				require.Contains(t, string(out), "sock=")
+			}
+		})
+	}
+}
+
+func TestNewServer_CloseAgentForwarding(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("agent forwarding uses unix sockets")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	socketDir := t.TempDir()
+	s, addr := newTestServer(t, logger, &agentssh.Config{
+		AgentSocketDir: socketDir,
+	})
+
+	sess, _ := sshtest.DialSession(ctx, t, addr)
+	err := agent.RequestAgentForwarding(sess)
+	require.NoError(t, err)
+	stdout, err := sess.StdoutPipe()
+	require.NoError(t, err)
+	err = sess.Start("echo sock=$SSH_AUTH_SOCK; sleep 30")
+	require.NoError(t, err)
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	sock := strings.TrimSpace(strings.TrimPrefix(line, "sock="))
+	require.True(t, strings.HasPrefix(sock, socketDir), "socket %q not in %q", sock, socketDir)
+	_, err = os.Stat(sock)
+	require.NoError(t, err)
+
+	err = s.Close()
+	require.NoError(t, err)
+
+	// The socket and its temporary directory are removed.
+	entries, err := os.ReadDir(socketDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestNewServer_DisableAgentForwarding(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("agent forwarding uses unix sockets")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, nil)
+	reg := prometheus.NewRegistry()
+	socketDir := t.TempDir()
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		AgentSocketDir:         socketDir,
+		DisableAgentForwarding: true,
+	}, withRegistry(reg))
+
+	sess, _ := sshtest.DialSession(ctx, t, addr)
+	err := agent.RequestAgentForwarding(sess)
+	require.NoError(t, err)
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	out, err := sess.Output("echo sock=${SSH_AUTH_SOCK-unset}")
+	require.NoError(t, err)
+	require.Equal(t, "sock=unset\n", string(out))
+	require.Equal(t, "agent forwarding disabled by administrator\n", stderr.String())
+
+	entries, err := os.ReadDir(socketDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	require.True(t, testutil.PromCounterHasValue(t, metrics, 1, "agent_ssh_server_agent_forwards_denied_total"))
+}
+
+func TestNewServer_CallbackPanics(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("login shells are not supported on Windows")
+	}
+
+	tests := []struct {
+		name     string
+		callback string
+		// config returns a config whose callback calls panicOnce.
+		config func(panicOnce func()) *agentssh.Config
+		pty    bool
+		sftp   bool
+		// unixSocket forwards to a Unix socket instead of starting a
+		// session.
+		unixSocket bool
+		// survives is set if the session continues without the callback.
+		survives bool
+	}{
+		{
+			name:     "UpdateEnv",
+			callback: "UpdateEnv",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{UpdateEnv: func(current []string) ([]string, error) {
+					panicOnce()
+					return current, nil
+				}}
+			},
+		},
+		{
+			name:     "WorkingDirectory",
+			callback: "WorkingDirectory",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{WorkingDirectory: func() string {
+					panicOnce()
+					return ""
+				}}
+			},
+		},
+		{
+			name:     "WorkingDirectory/SFTP",
+			callback: "WorkingDirectory",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{WorkingDirectory: func() string {
+					panicOnce()
+					return ""
+				}}
+			},
+			sftp: true,
+		},
+		{
+			name:     "MOTDFile",
+			callback: "MOTDFile",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{MOTDFile: func() string {
+					panicOnce()
+					return ""
+				}}
+			},
+			pty: true,
+		},
+		{
+			// A panic only fails the banner fetch, not the session.
+			name:     "AnnouncementBanners",
+			callback: "AnnouncementBanners",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{AnnouncementBanners: func() *[]codersdk.BannerConfig {
+					panicOnce()
+					return &[]codersdk.BannerConfig{}
+				}}
+			},
+			pty:      true,
+			survives: true,
+		},
+		{
+			name:     "SessionAdmission",
+			callback: "SessionAdmission",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{SessionAdmission: func(gliderssh.Context, agentssh.PreSessionInfo) error {
+					panicOnce()
+					return nil
+				}}
+			},
+		},
+		{
+			name:     "CommandPolicy",
+			callback: "CommandPolicy",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{CommandPolicy: func([]string, agentssh.MagicSessionType) error {
+					panicOnce()
+					return nil
+				}}
+			},
+		},
+		{
+			name:     "PTYOptions",
+			callback: "PTYOptions",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{PTYOptions: func(agentssh.SessionMetadata, gliderssh.Pty) []pty.Option {
+					panicOnce()
+					return nil
+				}}
+			},
+			pty: true,
+		},
+		{
+			name:     "SessionRecorder",
+			callback: "SessionRecorder",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{SessionRecorder: func(uuid.UUID, agentssh.MagicSessionType) io.WriteCloser {
+					panicOnce()
+					return nil
+				}}
+			},
+			pty: true,
+		},
+		{
+			// A panic only skips the greeting.
+			name:     "Greeting",
+			callback: "Greeting",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{Greeting: func(context.Context) (string, error) {
+					panicOnce()
+					return "", nil
+				}}
+			},
+			pty:      true,
+			survives: true,
+		},
+		{
+			name:     "SessionStartAudit",
+			callback: "SessionStartAudit",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{SessionStartAudit: func(agentssh.SessionStartAuditEntry) {
+					panicOnce()
+				}}
+			},
+			pty:      true,
+			survives: true,
+		},
+		{
+			name:     "OnSessionEnd",
+			callback: "OnSessionEnd",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{OnSessionEnd: func(agentssh.SessionMetadata) {
+					panicOnce()
+				}}
+			},
+			survives: true,
+		},
+		{
+			// A panic only skips reporting the connection.
+			name:     "ReportConnection",
+			callback: "ReportConnection",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{ReportConnectionV3: func(agentssh.ConnectionInfo) agentssh.ReportedConnection {
+					panicOnce()
+					return agentssh.ReportedConnection{}
+				}}
+			},
+			survives: true,
+		},
+		{
+			// A panic denies the forward.
+			name:     "UnixSocketForwardPolicy",
+			callback: "UnixSocketForwardPolicy",
+			config: func(panicOnce func()) *agentssh.Config {
+				return &agentssh.Config{Policy: agentssh.Policy{UnixSocketForwardPolicy: func(string) bool {
+					panicOnce()
+					return true
+				}}}
+			},
+			unixSocket: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			// The panic is logged as an error.
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			reg := prometheus.NewRegistry()
+			var panicked atomic.Bool
+			config := tt.config(func() {
+				if panicked.CompareAndSwap(false, true) {
+					panic(strings.Repeat("boom ", 1000))
+				}
+			})
+			_, addr := newTestServer(t, logger, config, withRegistry(reg))
+
+			var socketPath string
+			if tt.unixSocket {
+				// Socket paths are length limited, so keep the directory
+				// short.
+				dir, err := os.MkdirTemp("/tmp", "fwd")
+				require.NoError(t, err)
+				t.Cleanup(func() { _ = os.RemoveAll(dir) })
+				socketPath = filepath.Join(dir, "app.sock")
+				l, err := net.Listen("unix", socketPath)
+				require.NoError(t, err)
+				t.Cleanup(func() { _ = l.Close() })
+				go func() {
+					for {
+						c, err := l.Accept()
+						if err != nil {
+							return
+						}
+						_ = c.Close()
+					}
+				}()
+			}
+
+			c := sshtest.Dial(ctx, t, addr)
+			run := func() error {
+				if tt.unixSocket {
+					conn, err := c.Dial("unix", socketPath)
+					if err != nil {
+						return err
+					}
+					return conn.Close()
+				}
+				if tt.sftp {
+					client, err := sftp.NewClient(c)
+					if err != nil {
+						return err
+					}
+					return client.Close()
+				}
+				var opts []sshtest.Option
+				if tt.pty {
+					opts = append(opts, sshtest.WithPTY("xterm", 80, 24))
+				}
+				sess := sshtest.NewSession(t, c, opts...)
+				sess.Stdin = strings.NewReader("exit\n")
+				if tt.pty {
+					err := sess.Shell()
+					require.NoError(t, err)
+					return sess.Wait()
+				}
+				return sess.Run("true")
+			}
+
+			// The session of the panic fails, the server survives.
+			err := run()
+			switch {
+			case tt.survives:
+				require.NoError(t, err)
+			case tt.sftp:
+				require.Error(t, err)
+			case tt.unixSocket:
+				var openErr *ssh.OpenChannelError
+				require.ErrorAs(t, err, &openErr)
+				require.Equal(t, ssh.Prohibited, openErr.Reason)
+			default:
+				exitErr := &ssh.ExitError{}
+				require.ErrorAs(t, err, &exitErr)
+				require.Equal(t, agentssh.MagicSessionErrorCode, exitErr.ExitStatus())
+			}
+			require.True(t, panicked.Load())
+			metrics, err := reg.Gather()
+			require.NoError(t, err)
+			require.True(t, testutil.PromCounterHasValue(t, metrics, 1, "agent_ssh_server_callback_panics_total", tt.callback))
+
+			err = run()
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestNewServer_StrictSessionTypes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		strict      bool
+		require     bool
+		sessionType agentssh.MagicSessionType
+		rejected    bool
+	}{
+		{name: "Permissive/Allowed", sessionType: agentssh.MagicSessionTypeVSCode},
+		{name: "Permissive/Unknown", sessionType: "unknown-ide"},
+		{name: "Permissive/Missing"},
+		{name: "Strict/Allowed", strict: true, sessionType: agentssh.MagicSessionTypeVSCode},
+		{name: "Strict/Unknown", strict: true, sessionType: "unknown-ide", rejected: true},
+		{name: "Strict/NotAllowed", strict: true, sessionType: agentssh.MagicSessionTypeSSH, rejected: true},
+		{name: "Strict/Missing", strict: true},
+		{name: "Strict/MissingRequired", strict: true, require: true, rejected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			reasons := make(chan string, 1)
+			_, addr := newTestServer(t, logger, &agentssh.Config{
+				Policy: agentssh.Policy{
+					StrictSessionTypes:  tt.strict,
+					AllowedSessionTypes: []agentssh.MagicSessionType{agentssh.MagicSessionTypeVSCode},
+					RequireSessionType:  tt.require,
+				},
+				ReportConnection: func(uuid.UUID, agentssh.MagicSessionType, string) func(int, string) {
+					return func(_ int, reason string) { reasons <- reason }
+				},
+			})
+
+			var opts []sshtest.Option
+			if tt.sessionType != "" {
+				opts = append(opts, sshtest.WithSessionType(tt.sessionType))
+			}
+			sess, _ := sshtest.DialSession(ctx, t, addr, opts...)
+			var stderr bytes.Buffer
+			sess.Stderr = &stderr
+			err := sess.Run("true")
+			if tt.rejected {
+				exitErr := &ssh.ExitError{}
+				require.ErrorAs(t, err, &exitErr)
+				require.Equal(t, agentssh.SessionTypeRejectedErrorCode, exitErr.ExitStatus())
+				require.Contains(t, stderr.String(), "accepted values: vscode")
+				require.Equal(t, "session type rejected", testutil.RequireReceive(ctx, t, reasons))
+			} else {
+				require.NoError(t, err)
+				require.Empty(t, testutil.RequireReceive(ctx, t, reasons))
+			}
+		})
+	}
+}
+
+func TestNewServer_SFTPHandler(t *testing.T) {
+	t.Parallel()
+
+	for _, handlerErr := range []error{nil, xerrors.New("sftp failed")} {
+		t.Run(fmt.Sprintf("Error=%v", handlerErr), func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			reg := prometheus.NewRegistry()
+			calls := make(chan string, 1)
+			_, addr := newTestServer(t, logger, &agentssh.Config{
+				SFTPHandler: func(_ slog.Logger, session gliderssh.Session) error {
+					calls <- session.Subsystem()
+					return handlerErr
+				},
+			}, withRegistry(reg))
+
+			sess, _ := sshtest.DialSession(ctx, t, addr)
+			err := sess.RequestSubsystem("sftp")
+			require.NoError(t, err)
+			require.Equal(t, "sftp", testutil.RequireReceive(ctx, t, calls))
+			err = sess.Wait()
+
+			metrics, err2 := reg.Gather()
+			require.NoError(t, err2)
+			var connections, serverErrors float64
+			for _, m := range metrics {
+				switch m.GetName() {
+				case "agent_ssh_server_sftp_connections_total":
+					connections = m.GetMetric()[0].GetCounter().GetValue()
+				case "agent_ssh_server_sftp_server_errors_total":
+					serverErrors = m.GetMetric()[0].GetCounter().GetValue()
+				}
+			}
+			require.Equal(t, float64(1), connections)
+			if handlerErr == nil {
+				require.NoError(t, err)
+				require.Equal(t, float64(0), serverErrors)
+			} else {
+				exitErr := &ssh.ExitError{}
+				require.ErrorAs(t, err, &exitErr)
+				require.Equal(t, 1, exitErr.ExitStatus())
+				require.Equal(t, float64(1), serverErrors)
+			}
+		})
+	}
+}
+
+func TestNewServer_SessionStartAudit(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("login shells are not supported on Windows")
+	}
+
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	banner := agentssh.LoginNotice{
+		Kind:      agentssh.LoginNoticeBanner,
+		SHA256:    sum("Hello\r\nWorld\r\n\r\n"),
+		Bytes:     len("Hello\r\nWorld\r\n\r\n"),
+		Text:      "Hello\r\nWorld\r\n\r\n",
+		Completed: true,
+	}
+	motd := agentssh.LoginNotice{
+		Kind:      agentssh.LoginNoticeMOTD,
+		SHA256:    sum("Welcome\r\n"),
+		Bytes:     len("Welcome\r\n"),
+		Text:      "Welcome\r\n",
+		Completed: true,
+	}
+
+	tests := []struct {
+		name    string
+		pty     bool
+		command string
+		// exec sends an exec request even if command is empty.
+		exec      bool
+		hushLogin bool
+		want      []agentssh.LoginNotice
+	}{
+		{
+			name: "LoginShell",
+			pty:  true,
+			want: []agentssh.LoginNotice{
+				banner,
+				motd,
+				{Kind: agentssh.LoginNoticeGreeting, SkippedReason: "no greeting configured"},
+			},
+		},
+		{
+			// Some clients send an exec request with an empty command
+			// instead of a shell request.
+			name: "EmptyExec",
+			pty:  true,
+			exec: true,
+			want: []agentssh.LoginNotice{
+				banner,
+				motd,
+				{Kind: agentssh.LoginNoticeGreeting, SkippedReason: "no greeting configured"},
+			},
+		},
+		{
+			name:    "WhitespaceExec",
+			pty:     true,
+			command: " \t\n",
+			want: []agentssh.LoginNotice{
+				banner,
+				motd,
+				{Kind: agentssh.LoginNoticeGreeting, SkippedReason: "no greeting configured"},
+			},
+		},
+		{
+			// A command of only a comment is still a command, which exits
+			// right away.
+			name:    "CommentExec",
+			pty:     true,
+			command: "# nothing to do",
+			want: []agentssh.LoginNotice{
+				{Kind: agentssh.LoginNoticeBanner, SkippedReason: "not a login shell"},
+				{Kind: agentssh.LoginNoticeMOTD, SkippedReason: "not a login shell"},
+				{Kind: agentssh.LoginNoticeGreeting, SkippedReason: "not a login shell"},
+			},
+		},
+		{
+			name:      "HushLogin",
+			pty:       true,
+			hushLogin: true,
+			want: []agentssh.LoginNotice{
+				banner,
+				{Kind: agentssh.LoginNoticeMOTD, SkippedReason: ".hushlogin present"},
+				{Kind: agentssh.LoginNoticeGreeting, SkippedReason: ".hushlogin present"},
+			},
+		},
+		{
+			name:    "Command",
+			pty:     true,
+			command: "true",
+			want: []agentssh.LoginNotice{
+				{Kind: agentssh.LoginNoticeBanner, SkippedReason: "not a login shell"},
+				{Kind: agentssh.LoginNoticeMOTD, SkippedReason: "not a login shell"},
+				{Kind: agentssh.LoginNoticeGreeting, SkippedReason: "not a login shell"},
+			},
+		},
+		{
+			name:    "NoPTY",
+			command: "true",
+			want: []agentssh.LoginNotice{
+				{Kind: agentssh.LoginNoticeBanner, SkippedReason: "no pty"},
+				{Kind: agentssh.LoginNoticeMOTD, SkippedReason: "no pty"},
+				{Kind: agentssh.LoginNoticeGreeting, SkippedReason: "no pty"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			fs := afero.NewMemMapFs()
+			err := afero.WriteFile(fs, "/etc/motd", []byte("Welcome\n"), 0o644)
+			require.NoError(t, err)
+			if tt.hushLogin {
+				home, err := os.UserHomeDir()
+				require.NoError(t, err)
+				err = afero.WriteFile(fs, filepath.Join(home, ".hushlogin"), nil, 0o644)
+				require.NoError(t, err)
+			}
+			entries := make(chan agentssh.SessionStartAuditEntry, 1)
+			_, addr := newTestServer(t, logger, &agentssh.Config{
+				MOTDFile: func() string { return "/etc/motd" },
+				AnnouncementBanners: func() *[]codersdk.BannerConfig {
+					return &[]codersdk.BannerConfig{{Enabled: true, Message: "Hello\r\nWorld"}}
+				},
+				SessionStartAudit:            func(e agentssh.SessionStartAuditEntry) { entries <- e },
+				SessionStartAuditIncludeText: true,
+			}, withFs(fs))
+
+			var opts []sshtest.Option
+			if tt.pty {
+				opts = append(opts, sshtest.WithPTY("xterm", 80, 24))
+			}
+			sess, _ := sshtest.DialSession(ctx, t, addr, opts...)
+			sess.Stdin = strings.NewReader("exit\n")
+			if tt.command != "" || tt.exec {
+				err = sess.Run(tt.command)
+				require.NoError(t, err)
+			} else {
+				err = sess.Shell()
+				require.NoError(t, err)
+				_ = sess.Wait()
+			}
+
+			entry := testutil.RequireReceive(ctx, t, entries)
+			require.Equal(t, agentssh.MagicSessionTypeSSH, entry.SessionType)
+			require.Equal(t, tt.want, entry.Notices)
+		})
+	}
+}
+
+func TestNewServer_BannerSuppressedSessionTypes(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("login shells are not supported on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, nil)
+	fs := afero.NewMemMapFs()
+	err := afero.WriteFile(fs, "/etc/motd", []byte("Welcome\n"), 0o644)
+	require.NoError(t, err)
+	entries := make(chan agentssh.SessionStartAuditEntry, 1)
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		MOTDFile: func() string { return "/etc/motd" },
+		AnnouncementBanners: func() *[]codersdk.BannerConfig {
+			return &[]codersdk.BannerConfig{{Enabled: true, Message: "Hello"}}
+		},
+		BannerSuppressedSessionTypes: []agentssh.MagicSessionType{agentssh.MagicSessionTypeVSCode},
+		SessionStartAudit:            func(e agentssh.SessionStartAuditEntry) { entries <- e },
+	}, withFs(fs))
+
+	login := func(sessionType agentssh.MagicSessionType) agentssh.SessionStartAuditEntry {
+		sess, _ := sshtest.DialSession(ctx, t, addr,
+			sshtest.WithPTY("xterm", 80, 24),
+			sshtest.WithSessionType(sessionType),
+		)
+		sess.Stdin = strings.NewReader("exit\n")
+		err := sess.Shell()
+		require.NoError(t, err)
+		_ = sess.Wait()
+		return testutil.RequireReceive(ctx, t, entries)
+	}
+
+	// Suppressed for vscode.
+	entry := login(agentssh.MagicSessionTypeVSCode)
+	require.Equal(t, agentssh.MagicSessionTypeVSCode, entry.SessionType)
+	require.Equal(t, []agentssh.LoginNotice{
+		{Kind: agentssh.LoginNoticeBanner, SkippedReason: "suppressed for session type"},
+		{Kind: agentssh.LoginNoticeMOTD, SkippedReason: "suppressed for session type"},
+		{Kind: agentssh.LoginNoticeGreeting, SkippedReason: "no greeting configured"},
+	}, entry.Notices)
+
+	// Still shown for plain ssh.
+	entry = login(agentssh.MagicSessionTypeSSH)
+	require.Equal(t, agentssh.MagicSessionTypeSSH, entry.SessionType)
+	require.Len(t, entry.Notices, 3)
+	require.Equal(t, agentssh.LoginNoticeBanner, entry.Notices[0].Kind)
+	require.True(t, entry.Notices[0].Completed)
+	require.Empty(t, entry.Notices[0].SkippedReason)
+	require.Equal(t, agentssh.LoginNoticeMOTD, entry.Notices[1].Kind)
+	require.True(t, entry.Notices[1].Completed)
+	require.Empty(t, entry.Notices[1].SkippedReason)
+}
+
+func TestNewServer_Greeting(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("login shells are not supported on Windows")
+	}
+
+	type greetingData struct {
+		Workspace string
+	}
+	rendered, err := agentssh.GreetingTemplate("Welcome to {{ .Workspace }}!\nHave fun.", func(context.Context) (greetingData, error) {
+		return greetingData{Workspace: "dev"}, nil
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		greeting func(context.Context) (string, error)
+		want     agentssh.LoginNotice
+		output   string
+		warning  string
+	}{
+		{
+			name:     "Template",
+			greeting: rendered,
+			want: agentssh.LoginNotice{
+				Kind:      agentssh.LoginNoticeGreeting,
+				Bytes:     len("Welcome to dev!\r\nHave fun.\r\n\r\n"),
+				Completed: true,
+			},
+			output: "Welcome to dev!\r\nHave fun.\r\n",
+		},
+		{
+			name: "Truncated",
+			greeting: func(context.Context) (string, error) {
+				return strings.Repeat("x", 5000), nil
+			},
+			want: agentssh.LoginNotice{
+				Kind:      agentssh.LoginNoticeGreeting,
+				Bytes:     4096 + len("…\r\n\r\n"),
+				Completed: true,
+			},
+			output: strings.Repeat("x", 4096) + "…\r\n",
+		},
+		{
+			name: "Error",
+			greeting: func(context.Context) (string, error) {
+				return "", xerrors.New("secret failure")
+			},
+			want:    agentssh.LoginNotice{Kind: agentssh.LoginNoticeGreeting, SkippedReason: "greeting failed"},
+			warning: "agent failed to render greeting",
+		},
+		{
+			name: "Timeout",
+			greeting: func(ctx context.Context) (string, error) {
+				<-ctx.Done()
+				return "too late", nil
+			},
+			want:    agentssh.LoginNotice{Kind: agentssh.LoginNoticeGreeting, SkippedReason: "greeting timed out"},
+			warning: "agent failed to render greeting",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			sink := &fakeSink{}
+			logger := slog.Make(sink).Leveled(slog.LevelDebug)
+			entries := make(chan agentssh.SessionStartAuditEntry, 1)
+			_, addr := newTestServer(t, logger, &agentssh.Config{
+				Greeting:          tt.greeting,
+				SessionStartAudit: func(e agentssh.SessionStartAuditEntry) { entries <- e },
+			})
+
+			sess, _ := sshtest.DialSession(ctx, t, addr, sshtest.WithPTY("xterm", 80, 24))
+			var stdout bytes.Buffer
+			sess.Stdout = &stdout
+			sess.Stdin = strings.NewReader("exit\n")
+			start := time.Now()
+			err := sess.Shell()
+			require.NoError(t, err)
+			_ = sess.Wait()
+
+			entry := testutil.RequireReceive(ctx, t, entries)
+			// The greeting is last, after the banners and MOTD.
+			got := entry.Notices[len(entry.Notices)-1]
+			got.SHA256 = ""
+			require.Equal(t, tt.want, got)
+			if tt.output != "" {
+				require.Contains(t, stdout.String(), tt.output)
+			}
+			require.NotContains(t, stdout.String(), "secret failure")
+			require.NotContains(t, stdout.String(), "too late")
+			// A slow greeting must not hold the prompt back for long.
+			require.Less(t, time.Since(start), testutil.WaitShort)
+			if tt.warning != "" {
+				var messages []string
+				for _, e := range sink.warnings() {
+					messages = append(messages, e.Message)
+				}
+				require.Contains(t, messages, tt.warning)
+			}
+		})
+	}
+}
+
+func TestNewServer_CapabilitiesEnv(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		config agentssh.Config
+		want   string
+	}{
+		{
+			name: "Default",
+			want: "sftp=yes,portforward=yes,x11=yes,agentforward=yes",
+		},
+		{
+			name:   "BlockFileTransfer",
+			config: agentssh.Config{Policy: agentssh.Policy{BlockFileTransfer: true}},
+			want:   "sftp=no,portforward=yes,x11=yes,agentforward=yes",
+		},
+		{
+			name: "UpdateEnvCannotOverride",
+			config: agentssh.Config{
+				UpdateEnv: func(current []string) ([]string, error) {
+					return append(current, agentssh.CapabilitiesEnvironmentVariable+"=sftp=yes"), nil
+				},
+				Policy: agentssh.Policy{BlockFileTransfer: true},
+			},
+			want: "sftp=no,portforward=yes,x11=yes,agentforward=yes",
+		},
+		{
+			name:   "DisableAgentForwarding",
+			config: agentssh.Config{DisableAgentForwarding: true},
+			want:   "sftp=yes,portforward=yes,x11=yes,agentforward=no",
+		},
+		{
+			name:   "DisableX11",
+			config: agentssh.Config{DisableX11: true},
+			want:   "sftp=yes,portforward=yes,x11=no,agentforward=yes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitShort)
+			logger := slogtest.Make(t, nil)
+			config := tt.config
+			s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &config)
+			require.NoError(t, err)
+			defer s.Close()
+
+			// Clients can't override it either.
+			_, _, env, err := s.CommandEnv(ctx, nil, []string{agentssh.CapabilitiesEnvironmentVariable + "=sftp=yes"})
+			require.NoError(t, err)
+			var got string
+			for _, kv := range env {
+				if v, ok := strings.CutPrefix(kv, agentssh.CapabilitiesEnvironmentVariable+"="); ok {
+					got = v // Last value wins.
+				}
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNewServer_SessionEnvNoDuplicates(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := testutil.Logger(t)
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		// Every source sets some of the same variables.
+		UpdateEnv: func(current []string) ([]string, error) {
+			return append(current, "TERM=dumb", "SSH_CLIENT=update", "CLIENT=update", "CODER=true"), nil
+		},
+	})
+
+	c := sshtest.Dial(ctx, t, addr)
+	for _, pty := range []bool{false, true} {
+		opts := []sshtest.Option{sshtest.WithEnv("CLIENT", "client"), sshtest.WithEnv("TERM", "client")}
+		if pty {
+			opts = append(opts, sshtest.WithPTY("xterm", 80, 24))
+		}
+		sess := sshtest.NewSession(t, c, opts...)
+		out, err := sess.Output("env | cut -d= -f1 | sort | uniq -d")
+		require.NoError(t, err)
+		require.Empty(t, strings.TrimSpace(string(out)), "pty=%t", pty)
+	}
+}
+
+func TestNewServer_BlockedFileTransferCommands(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
+
+	tests := []struct {
+		name    string
+		blocked []string
+		command string
+		want    bool
+	}{
+		{name: "Default", command: "rsync --server", want: true},
+		{name: "DefaultUnblocked", command: "echo curl"},
+		{name: "Custom", blocked: []string{"echo", "scp"}, command: "/bin/echo hello", want: true},
+		{name: "CustomUnblocked", blocked: []string{"scp"}, command: "echo rsync"},
+		// An empty list means the default list, not that nothing is blocked.
+		{name: "Empty", blocked: []string{}, command: "nc -l 0", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitShort)
+			logger := testutil.Logger(t)
+			s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+				Policy:                      agentssh.Policy{BlockFileTransfer: true},
+				BlockedFileTransferCommands: tt.blocked,
+			})
+			require.NoError(t, err)
+			defer s.Close()
+			err = s.UpdateHostSigner(42)
+			assert.NoError(t, err)
+
+			ln := agentssh.NewInMemoryListener("test")
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				err := s.Serve(ln)
+				assert.Error(t, err) // Server is closed.
+			}()
+
+			c := sshtest.DialInMemory(ctx, t, ln)
+			err = sshtest.NewSession(t, c).Run(tt.command)
+			if tt.want {
+				exitErr := &ssh.ExitError{}
+				require.ErrorAs(t, err, &exitErr)
+				require.Equal(t, agentssh.BlockedFileTransferErrorCode, exitErr.ExitStatus())
+			} else {
+				require.NoError(t, err)
+			}
+
+			// The sftp subsystem is refused whatever the list.
+			_, err = sftp.NewClient(c)
+			require.Error(t, err)
+
+			err = s.Close()
+			require.NoError(t, err)
+			<-done
+		})
+	}
+}
+
+func TestNewServer_SessionTypeMetricLabels(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	reg := prometheus.NewRegistry()
+	s, err := agentssh.NewServer(ctx, logger, reg, afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		// Fails the command of sessions that ask for it, to count an error.
+		UpdateEnv: func(current []string) ([]string, error) {
+			if slices.Contains(current, "FAIL=1") {
+				return nil, xerrors.New("failed")
+			}
+			return current, nil
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	assert.NoError(t, err)
+
+	ln := agentssh.NewInMemoryListener("test")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := s.Serve(ln)
+		assert.Error(t, err) // Server is closed.
+	}()
+
+	labels := agentssh.SessionTypeLabels()
+	require.Contains(t, labels, agentssh.MagicSessionTypeUnknown)
+	c := sshtest.DialInMemory(ctx, t, ln)
+	for magicType, label := range labels {
+		// Unknown sessions are those of any undeclared type.
+		raw := string(magicType)
+		if magicType == agentssh.MagicSessionTypeUnknown {
+			raw = "cursor"
+		}
+		err := sshtest.NewSession(t, c, sshtest.WithEnv(agentssh.MagicSessionTypeEnvironmentVariable, raw)).Run("true")
+		require.NoError(t, err, magicType)
+		err = sshtest.NewSession(t, c, sshtest.WithEnv(agentssh.MagicSessionTypeEnvironmentVariable, raw), sshtest.WithEnv("FAIL", "1")).Run("true")
+		require.Error(t, err, magicType)
+
+		// Labels are sorted by name: container, magic_type, pty and
+		// error_type, magic_type, pty.
+		metrics, err := reg.Gather()
+		require.NoError(t, err)
+		require.True(t, testutil.PromCounterHasValue(t, metrics, 1, "agent_sessions_total", "no", label, "no"), magicType)
+		require.True(t, testutil.PromCounterHasValue(t, metrics, 1, "agent_sessions_errors_total", "create_command", label, "no"), magicType)
+	}
+
+	err = s.Close()
+	require.NoError(t, err)
+	<-done
+}
+
+//nolint:paralleltest // Sets $HOME to a missing directory.
+func TestNewServer_SFTPMissingHome(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("HOME doesn't set the home directory on Windows")
+	}
+	t.Setenv("HOME", filepath.Join(t.TempDir(), "missing"))
+
+	workDir := t.TempDir()
+	fallbackDir := t.TempDir()
+	tests := []struct {
+		name     string
+		config   agentssh.Config
+		wantDir  string
+		fallback string
+	}{
+		{
+			name:     "WorkingDirectory",
+			config:   agentssh.Config{WorkingDirectory: func() string { return workDir }, SFTPFallbackDirectory: fallbackDir},
+			wantDir:  workDir,
+			fallback: "working_directory",
+		},
+		{
+			name:     "FallbackDirectory",
+			config:   agentssh.Config{SFTPFallbackDirectory: fallbackDir},
+			wantDir:  fallbackDir,
+			fallback: "fallback_directory",
+		},
+		{
+			name:     "RequireHome",
+			config:   agentssh.Config{WorkingDirectory: func() string { return workDir }, Policy: agentssh.Policy{SFTPRequireHome: true}},
+			fallback: "rejected",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			reg := prometheus.NewRegistry()
+			s, addr := newTestServer(t, logger, &tt.config, withRegistry(reg))
+
+			if tt.wantDir != "" {
+				c := sshtest.Dial(ctx, t, addr)
+				client, err := sftp.NewClient(c)
+				require.NoError(t, err)
+				wd, err := client.Getwd()
+				require.NoError(t, err)
+				require.Equal(t, tt.wantDir, wd)
+				require.NoError(t, client.Close())
+			} else {
+				sess, _ := sshtest.DialSession(ctx, t, addr)
+				var stderr bytes.Buffer
+				sess.Stderr = &stderr
+				err := sess.RequestSubsystem("sftp")
+				require.NoError(t, err)
+				err = sess.Wait()
+				exitErr := &ssh.ExitError{}
+				require.ErrorAs(t, err, &exitErr)
+				require.Equal(t, 1, exitErr.ExitStatus())
+				require.Contains(t, stderr.String(), "SFTP is not available without a home directory")
+			}
+
+			err := s.Close()
+			require.NoError(t, err)
+
+			metrics, err := reg.Gather()
+			require.NoError(t, err)
+			var fallbacks []string
+			for _, m := range metrics {
+				if m.GetName() != "agent_ssh_server_sftp_home_fallbacks_total" {
+					continue
+				}
+				for _, metric := range m.GetMetric() {
+					fallbacks = append(fallbacks, metric.GetLabel()[0].GetValue())
+				}
+			}
+			require.Equal(t, []string{tt.fallback}, fallbacks)
+		})
+	}
+}
+
+func TestNewServer_SFTPWithPTY(t *testing.T) {
+	t.Parallel()
+
+	for _, reject := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Reject=%t", reject), func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			reg := prometheus.NewRegistry()
+			_, addr := newTestServer(t, logger, &agentssh.Config{
+				Policy: agentssh.Policy{RejectPTYSFTP: reject},
+				SFTPHandler: func(slog.Logger, gliderssh.Session) error {
+					return nil
+				},
+			}, withRegistry(reg))
+
+			sess, _ := sshtest.DialSession(ctx, t, addr, sshtest.WithPTY("xterm", 80, 24))
+			var stderr bytes.Buffer
+			sess.Stderr = &stderr
+			err := sess.RequestSubsystem("sftp")
+			require.NoError(t, err)
+			err = sess.Wait()
+			if reject {
+				exitErr := &ssh.ExitError{}
+				require.ErrorAs(t, err, &exitErr)
+				require.Equal(t, 1, exitErr.ExitStatus())
+				require.Contains(t, stderr.String(), "remove RequestTTY")
+			} else {
+				require.NoError(t, err)
+			}
+
+			metrics, err := reg.Gather()
+			require.NoError(t, err)
+			var ptyRequests float64
+			for _, m := range metrics {
+				if m.GetName() == "agent_ssh_server_sftp_pty_requests_total" {
+					ptyRequests = m.GetMetric()[0].GetCounter().GetValue()
+				}
+			}
+			require.Equal(t, float64(1), ptyRequests)
+		})
+	}
+}
+
+func TestNewServer_AferoSFTPHandler(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := testutil.Logger(t)
+	fs := afero.NewMemMapFs()
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		SFTPHandler: agentssh.NewAferoSFTPHandler(fs),
+	})
+
+	c := sshtest.Dial(ctx, t, addr)
+	client, err := sftp.NewClient(c)
+	require.NoError(t, err)
+
+	require.NoError(t, client.MkdirAll("/work"))
+	f, err := client.Create("/work/file.txt")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	old, err := client.Open("/work/file.txt")
+	require.NoError(t, err)
+
+	// Save the file like sshfs does for editors writing a temporary file
+	// and renaming it over the original.
+	tmp, err := client.OpenFile("/work/.file.txt.swp", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	require.NoError(t, err)
+	_, err = tmp.Write([]byte("hello world, long line\n"))
+	require.NoError(t, err)
+	require.NoError(t, tmp.Truncate(5))
+	_, err = tmp.WriteAt([]byte(" there\n"), 5)
+	require.NoError(t, err)
+	if _, ok := client.HasExtension("fsync@openssh.com"); ok {
+		require.NoError(t, tmp.Sync())
+	}
+	// Handles keep working on renamed files.
+	require.NoError(t, client.PosixRename("/work/.file.txt.swp", "/work/.file.txt.new"))
+	require.NoError(t, tmp.Truncate(12))
+	require.NoError(t, tmp.Close())
+	err = client.Rename("/work/.file.txt.new", "/work/file.txt")
+	require.Error(t, err, "plain rename must not replace the target")
+	require.NoError(t, client.PosixRename("/work/.file.txt.new", "/work/file.txt"))
+
+	f, err = client.Open("/work/file.txt")
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, "hello there\n", string(data))
+	data, err = io.ReadAll(old)
+	require.NoError(t, err)
+	require.NoError(t, old.Close())
+	require.Equal(t, "hello\n", string(data), "replaced file")
+
+	entries, err := client.ReadDir("/work")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.NoError(t, client.Close())
+
+	data, err = afero.ReadFile(fs, "/work/file.txt")
+	require.NoError(t, err)
+	require.Equal(t, "hello there\n", string(data))
+}
+
+func TestNewServer_PTYClientDisconnect(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
+
+	type report struct {
+		code   int
+		reason string
+	}
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	reg := prometheus.NewRegistry()
+	reports := make(chan report, 1)
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		ReportConnection: func(uuid.UUID, agentssh.MagicSessionType, string) func(int, string) {
+			return func(code int, reason string) { reports <- report{code: code, reason: reason} }
+		},
+	}, withRegistry(reg))
+
+	sess, closeClient := sshtest.DialSession(ctx, t, addr, sshtest.WithPTY("xterm", 80, 24))
+	stdout, err := sess.StdoutPipe()
+	require.NoError(t, err)
+	err = sess.Start("yes")
+	require.NoError(t, err)
+
+	// Close the client while the command is still writing output.
+	_, err = io.ReadFull(stdout, make([]byte, 4096))
+	require.NoError(t, err)
+	closeClient()
+
+	r := testutil.RequireReceive(ctx, t, reports)
+	require.NotEqual(t, agentssh.MagicSessionErrorCode, r.code)
+	require.Equal(t, "client disconnected", r.reason)
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	for _, m := range metrics {
+		if m.GetName() != "agent_sessions_errors_total" {
+			continue
+		}
+		for _, metric := range m.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				require.False(t, strings.HasPrefix(label.GetValue(), "output_io_copy"), label.GetValue())
+			}
+		}
+	}
+}
+
+func TestNewServer_StdinAfterExit(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	reg := prometheus.NewRegistry()
+	s, addr := newTestServer(t, logger, nil, withRegistry(reg))
+
+	for range 5 {
+		sess, _ := sshtest.DialSession(ctx, t, addr)
+		stdin, err := sess.StdinPipe()
+		require.NoError(t, err)
+		err = sess.Start("exit 0")
+		require.NoError(t, err)
+
+		// Keep sending input while the command exits.
+		writing := make(chan struct{})
+		go func() {
+			defer close(writing)
+			buf := make([]byte, 4096)
+			for {
+				if _, err := stdin.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+		err = sess.Wait()
+		require.NoError(t, err)
+		_ = sess.Close()
+		_ = testutil.TryReceive(ctx, t, writing)
+	}
+
+	err := s.Close()
+	require.NoError(t, err)
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	for _, m := range metrics {
+		if m.GetName() != "agent_sessions_errors_total" {
+			continue
+		}
+		for _, metric := range m.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				require.False(t, strings.HasPrefix(label.GetValue(), "stdin_io_copy"), label.GetValue())
+			}
+		}
+	}
+}
+
+func TestNewServer_VSCodeTunnels(t *testing.T) {
+	t.Parallel()
+
+	echo := func(t *testing.T) net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					_, _ = io.Copy(conn, conn)
+				}()
+			}
+		}()
+		return ln
+	}
+	vscodeLn, otherLn := echo(t), echo(t)
+	vscodePort := uint32(vscodeLn.Addr().(*net.TCPAddr).Port)
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	reg := prometheus.NewRegistry()
+	type report struct {
+		sessionType  agentssh.MagicSessionType
+		disconnected bool
+	}
+	reports := make(chan report, 4)
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		VSCodeTunnelMatcher: func(_ string, port uint32) bool { return port == vscodePort },
+		ReportConnection: func(_ uuid.UUID, sessionType agentssh.MagicSessionType, _ string) func(int, string) {
+			reports <- report{sessionType: sessionType}
+			return func(int, string) {
+				reports <- report{sessionType: sessionType, disconnected: true}
+			}
+		},
+	}, withRegistry(reg))
+
+	c := sshtest.Dial(ctx, t, addr)
+	for _, addr := range []string{vscodeLn.Addr().String(), otherLn.Addr().String()} {
+		conn, err := c.Dial("tcp", addr)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		got := make([]byte, 5)
+		_, err = io.ReadFull(conn, got)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(got))
+		_ = conn.Close()
+	}
+
+	// Only the VS Code tunnel is reported as a connection.
+	require.Equal(t, report{sessionType: agentssh.MagicSessionTypeVSCode}, testutil.RequireReceive(ctx, t, reports))
+	require.Equal(t, report{sessionType: agentssh.MagicSessionTypeVSCode, disconnected: true}, testutil.RequireReceive(ctx, t, reports))
+
+	want := map[string]float64{
+		"tunnels_total/vscode":               1,
+		"tunnels_total/port_forward":         1,
+		"tunnel_bytes_total/vscode/rx":       5,
+		"tunnel_bytes_total/vscode/tx":       5,
+		"tunnel_bytes_total/port_forward/rx": 5,
+		"tunnel_bytes_total/port_forward/tx": 5,
+	}
+	require.Eventually(t, func() bool {
+		metrics, err := reg.Gather()
+		assert.NoError(t, err)
+		got := map[string]float64{}
+		for _, m := range metrics {
+			name, ok := strings.CutPrefix(m.GetName(), "agent_ssh_server_")
+			if !ok || (name != "tunnels_total" && name != "tunnel_bytes_total") {
+				continue
+			}
+			for _, metric := range m.GetMetric() {
+				key := name
+				for _, l := range metric.GetLabel() {
+					key += "/" + l.GetValue()
+				}
+				got[key] = metric.GetCounter().GetValue()
+			}
+		}
+		return assert.ObjectsAreEqual(want, got)
+	}, testutil.WaitShort, testutil.IntervalFast)
+}
+
+func TestDefaultVSCodeTunnelMatcher(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		host string
+		port uint32
+		want bool
+	}{
+		{host: "localhost", port: 13337, want: true},
+		{host: "127.0.0.1", port: 13338, want: true},
+		{host: "::1", port: 13337, want: true},
+		{host: "127.0.0.1", port: 8080, want: false},
+		{host: "10.0.0.1", port: 13337, want: false},
+		{host: "example.com", port: 13337, want: false},
+	} {
+		assert.Equal(t, tt.want, agentssh.DefaultVSCodeTunnelMatcher(tt.host, tt.port), "%s:%d", tt.host, tt.port)
+	}
+}
+
+func TestNewServer_SubscribeStats(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Ordering", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := testutil.Context(t, testutil.WaitMedium)
+		logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+		s, addr := newTestServer(t, logger, nil)
+
+		deltas, unsubscribe := s.SubscribeStats(10)
+		defer unsubscribe()
+
+		c := sshtest.Dial(ctx, t, addr)
+		sess := sshtest.NewSession(t, c, sshtest.WithSessionType(agentssh.MagicSessionTypeSSH))
+		err := sess.Run("true")
+		require.NoError(t, err)
+
+		d := testutil.RequireReceive(ctx, t, deltas)
+		require.EqualValues(t, 1, d.Sessions)
+		require.Equal(t, agentssh.ConnStats{Sessions: 1}, d.Stats)
+		d = testutil.RequireReceive(ctx, t, deltas)
+		require.EqualValues(t, -1, d.Sessions)
+		require.Equal(t, agentssh.ConnStats{}, d.Stats)
+
+		fwd, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer fwd.Close()
+		conn, err := c.Dial("tcp", fwd.Addr().String())
+		require.NoError(t, err)
+		d = testutil.RequireReceive(ctx, t, deltas)
+		require.EqualValues(t, 1, d.ForwardedChannels)
+		require.Equal(t, agentssh.ConnStats{ForwardedChannels: 1}, d.Stats)
+		require.Equal(t, agentssh.ConnStats{ForwardedChannels: 1}, s.ConnStats())
+		_ = conn.Close()
+		d = testutil.RequireReceive(ctx, t, deltas)
+		require.EqualValues(t, -1, d.ForwardedChannels)
+		require.Equal(t, agentssh.ConnStats{}, d.Stats)
+	})
+
+	t.Run("SlowSubscriber", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := testutil.Context(t, testutil.WaitMedium)
+		logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+		reg := prometheus.NewRegistry()
+		s, addr := newTestServer(t, logger, nil, withRegistry(reg))
+
+		deltas, unsubscribe := s.SubscribeStats(1)
+		defer unsubscribe()
+
+		// Nothing is read from deltas, sessions must not block.
+		c := sshtest.Dial(ctx, t, addr)
+		for range 3 {
+			sess := sshtest.NewSession(t, c, sshtest.WithSessionType(agentssh.MagicSessionTypeSSH))
+			err := sess.Run("true")
+			require.NoError(t, err)
+		}
+
+		d := testutil.RequireReceive(ctx, t, deltas)
+		require.EqualValues(t, 1, d.Sessions)
+		require.Eventually(t, func() bool {
+			metrics, err := reg.Gather()
+			assert.NoError(t, err)
+			for _, m := range metrics {
+				if m.GetName() == "agent_ssh_server_stats_deltas_dropped_total" {
+					return m.GetMetric()[0].GetCounter().GetValue() == 5
+				}
+			}
+			return false
+		}, testutil.WaitShort, testutil.IntervalFast)
+	})
+
+	t.Run("UnsubscribeDuringClose", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := testutil.Context(t, testutil.WaitMedium)
+		logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+		s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+		require.NoError(t, err)
+		defer s.Close()
+
+		kept, _ := s.SubscribeStats(1)
+		var wg sync.WaitGroup
+		for range 10 {
+			_, unsubscribe := s.SubscribeStats(1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				unsubscribe()
+				unsubscribe()
+			}()
+		}
+		err = s.Close()
+		require.NoError(t, err)
+		wg.Wait()
+
+		requireClosed := func(ch <-chan agentssh.ConnStatsDelta) {
+			t.Helper()
+			select {
+			case _, ok := <-ch:
+				require.False(t, ok, "channel should be closed")
+			case <-ctx.Done():
+				t.Fatal("timeout waiting for channel to close")
+			}
+		}
+		requireClosed(kept)
+
+		// Subscribing after Close returns a closed channel.
+		after, unsubscribe := s.SubscribeStats(1)
+		unsubscribe()
+		requireClosed(after)
+	})
+}
+func TestNewServer_MaxTrackedProcesses(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("sleep is not available on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	s, addr := newTestServer(t, logger, &agentssh.Config{
+		MaxTrackedProcesses: 1,
+	})
+
+	c := sshtest.Dial(ctx, t, addr)
+	sess := sshtest.NewSession(t, c)
+	err := sess.Start("sleep 30")
+	require.NoError(t, err)
+
+	var procs []agentssh.TrackedProcess
+	require.Eventually(t, func() bool {
+		procs = s.TrackedProcesses()
+		return len(procs) == 1
+	}, testutil.WaitShort, testutil.IntervalFast)
+	require.Contains(t, strings.Join(procs[0].Argv, " "), "sleep 30")
+	require.NotZero(t, procs[0].PID)
+
+	// The limit is reached, new sessions without a PTY are rejected.
+	sess2 := sshtest.NewSession(t, c)
+	var stderr bytes.Buffer
+	sess2.Stderr = &stderr
+	err = sess2.Run("true")
+	exitErr := &ssh.ExitError{}
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, agentssh.MagicSessionErrorCode, exitErr.ExitStatus())
+	require.Contains(t, stderr.String(), "Too many background processes")
+
+	err = s.Close()
+	require.NoError(t, err)
+	require.Empty(t, s.TrackedProcesses())
+}
+
+func TestNewServer_UnixSocketForwardPolicy(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket forwarding is not supported on Windows")
+	}
+
+	// Socket paths are length limited, so keep the directory short.
+	dir, err := os.MkdirTemp("/tmp", "fwd")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	listen := func(name string) string {
+		path := filepath.Join(dir, name)
+		l, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				_ = c.Close()
+			}
+		}()
+		return path
+	}
+	allowed := listen("app.sock")
+	denied := listen("docker.sock")
+	link := filepath.Join(dir, "link.sock")
+	err = os.Symlink(denied, link)
+	require.NoError(t, err)
+	// A hard link has a name of its own, so only the identity of the
+	// socket tells it apart.
+	hardLink := filepath.Join(dir, "renamed.sock")
+	err = os.Link(denied, hardLink)
+	require.NoError(t, err)
+	exempt := filepath.Join(dir, "containerd.sock")
+	_ = listen("containerd.sock")
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		Policy: agentssh.Policy{
+			DeniedUnixSocketPaths: []string{denied},
+			AllowedUnixSockets:    []string{exempt},
+		},
+	})
+
+	c := sshtest.Dial(ctx, t, addr)
+	for _, path := range []string{allowed, exempt} {
+		conn, err := c.Dial("unix", path)
+		require.NoError(t, err, path)
+		_ = conn.Close()
+	}
+	for _, path := range []string{denied, link, hardLink} {
+		_, err := c.Dial("unix", path)
+		var openErr *ssh.OpenChannelError
+		require.ErrorAs(t, err, &openErr, path)
+		require.Equal(t, ssh.Prohibited, openErr.Reason, path)
+	}
+}
+
+func TestNewServer_DisableReversePortForwarding(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := testutil.Logger(t)
+	reg := prometheus.NewRegistry()
+	s, addr := newTestServer(t, logger, &agentssh.Config{
+		DisableReversePortForwarding: true,
+	}, withRegistry(reg))
+
+	c := sshtest.Dial(ctx, t, addr)
+	_, err := c.Listen("tcp", "127.0.0.1:0")
+	require.Error(t, err)
+	if runtime.GOOS != "windows" {
+		_, err = c.ListenUnix(filepath.Join(t.TempDir(), "fwd.sock"))
+		require.Error(t, err)
+	}
+	require.Empty(t, s.ReverseForwards())
+
+	// Local forwarding still works.
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer local.Close()
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("hello"))
+		_ = conn.Close()
+	}()
+	conn, err := c.Dial("tcp", local.Addr().String())
+	require.NoError(t, err)
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	err = s.Close()
+	require.NoError(t, err)
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	require.True(t, testutil.PromCounterHasValue(t, metrics, 1, "agent_ssh_server_reverse_forwards_denied_total", "tcpip-forward"))
+	if runtime.GOOS != "windows" {
+		require.True(t, testutil.PromCounterHasValue(t, metrics, 1, "agent_ssh_server_reverse_forwards_denied_total", "streamlocal-forward@openssh.com"))
+	}
+}
+
+func TestNewServer_MaxSessionLifetime(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("sleep doesn't exist on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitLong)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	mClock := quartz.NewMock(t)
+	trap := mClock.Trap().AfterFunc("session", "lifetime")
+	defer trap.Close()
+
+	reg := prometheus.NewRegistry()
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		Clock:  mClock,
+		Policy: agentssh.Policy{MaxSessionLifetime: 2 * time.Minute},
+	}, withRegistry(reg))
+
+	c := sshtest.Dial(ctx, t, addr)
+
+	// Sessions without a PTY are exempt by default.
+	out, err := sshtest.NewSession(t, c).Output("echo exempt")
+	require.NoError(t, err)
+	require.Equal(t, "exempt", strings.TrimSpace(string(out)))
+
+	sess := sshtest.NewSession(t, c, sshtest.WithPTY("xterm", 80, 24))
+	r, err := sess.StdoutPipe()
+	require.NoError(t, err)
+	err = sess.Start("echo started; sleep 600")
+	require.NoError(t, err)
+
+	// Warning and expiry timers.
+	trap.MustWait(ctx).MustRelease(ctx)
+	trap.MustWait(ctx).MustRelease(ctx)
+
+	sc := bufio.NewScanner(r)
+	require.True(t, sc.Scan())
+	require.Contains(t, sc.Text(), "started")
+
+	mClock.Advance(time.Minute).MustWait(ctx)
+	for sc.Scan() {
+		if strings.Contains(sc.Text(), "maximum session lifetime") {
+			break
+		}
+	}
+	require.NoError(t, sc.Err())
+
+	mClock.Advance(time.Minute).MustWait(ctx)
+	err = sess.Wait()
+	exitErr := &ssh.ExitError{}
+	require.ErrorAs(t, err, &exitErr)
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	var exceeded float64
+	for _, m := range metrics {
+		if m.GetName() == "agent_sessions_lifetime_exceeded_total" {
+			exceeded = m.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	require.Equal(t, float64(1), exceeded)
+}
+
+func TestNewServer_IdleTimeout(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("cat doesn't exist on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitLong)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	mClock := quartz.NewMock(t)
+	trap := mClock.Trap().NewTimer("session", "idle")
+	defer trap.Close()
+	resetTrap := mClock.Trap().TimerReset("session", "idle")
+	defer resetTrap.Close()
+
+	reg := prometheus.NewRegistry()
+	reasons := make(chan string, 1)
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		Clock:       mClock,
+		IdleTimeout: time.Minute,
+		ReportConnection: func(uuid.UUID, agentssh.MagicSessionType, string) func(int, string) {
+			return func(_ int, reason string) { reasons <- reason }
+		},
+	}, withRegistry(reg))
+
+	sess, _ := sshtest.DialSession(ctx, t, addr)
+	stdin, err := sess.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := sess.StdoutPipe()
+	require.NoError(t, err)
+	err = sess.Start("cat")
+	require.NoError(t, err)
+	trap.MustWait(ctx).MustRelease(ctx)
+
+	// Input halfway through postpones the timeout.
+	mClock.Advance(30 * time.Second).MustWait(ctx)
+	_, err = stdin.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	sc := bufio.NewScanner(stdout)
+	require.True(t, sc.Scan())
+	require.Equal(t, "hello", sc.Text())
+
+	mClock.Advance(30 * time.Second).MustWait(ctx)
+	call := resetTrap.MustWait(ctx)
+	require.Equal(t, 30*time.Second, call.Duration)
+	call.MustRelease(ctx)
+
+	mClock.Advance(30 * time.Second).MustWait(ctx)
+	err = sess.Wait()
+	exitErr := &ssh.ExitError{}
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, "idle timeout", testutil.RequireReceive(ctx, t, reasons))
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	require.True(t, testutil.PromCounterHasValue(t, metrics, 1, "agent_sessions_idle_timeouts_total", "ssh", "no"))
+}
+
+func TestNewServer_TeeOutput(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("the command used here is not available on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	dir := t.TempDir()
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		TeeOutputAllowedDirs: []string{dir},
+	}, withFs(afero.NewOsFs()))
+
+	c := sshtest.Dial(ctx, t, addr)
+
+	t.Run("Interleaved", func(t *testing.T) {
+		path := filepath.Join(dir, "build.log")
+		sess := sshtest.NewSession(t, c, sshtest.WithEnv(agentssh.TeeOutputEnvironmentVariable, path))
+		var stdout, stderr bytes.Buffer
+		sess.Stdout = &stdout
+		sess.Stderr = &stderr
+		err := sess.Run(`i=1; while [ $i -le 100 ]; do echo "out$i"; echo "err$i" >&2; i=$((i+1)); done`)
+		require.NoError(t, err)
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+		teed, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		// Every line is whole, and the lines of each stream are in order.
+		var outLines, errLines []string
+		for _, line := range strings.Split(strings.TrimSuffix(string(teed), "\n"), "\n") {
+			switch {
+			case strings.HasPrefix(line, "out"):
+				outLines = append(outLines, line)
+			case strings.HasPrefix(line, "err"):
+				errLines = append(errLines, line)
+			default:
+				t.Fatalf("unexpected line %q", line)
+			}
+		}
+		require.Equal(t, strings.Fields(stdout.String()), outLines)
+		require.Equal(t, strings.Fields(stderr.String()), errLines)
+		require.Len(t, outLines, 100)
+	})
+
+	t.Run("Symlink", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "target.log")
+		path := filepath.Join(dir, "link.log")
+		err := os.Symlink(target, path)
+		require.NoError(t, err)
+		sess := sshtest.NewSession(t, c, sshtest.WithEnv(agentssh.TeeOutputEnvironmentVariable, path))
+		var stderr bytes.Buffer
+		sess.Stderr = &stderr
+		out, err := sess.Output("echo hello; echo ${CODER_SSH_TEE_OUTPUT-unset}")
+		require.NoError(t, err)
+		// The session runs without teeing, the variable is stripped.
+		require.Equal(t, "hello\nunset\n", string(out))
+		require.Contains(t, stderr.String(), "Not teeing output to "+path)
+		require.NoFileExists(t, target)
+	})
+}
+
+func TestNewServer_ExecuteShebang(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("bash doesn't exist on Windows")
+	}
+
+	ctx := context.Background()
+	logger := testutil.Logger(t)
+	s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+
+	t.Run("Basic", func(t *testing.T) {
+		t.Parallel()
+		cmd, err := s.CreateCommand(ctx, `#!/bin/bash
+		echo test`, nil, nil)
+		require.NoError(t, err)
+		output, err := cmd.AsExec().CombinedOutput()
+		require.NoError(t, err)
+		require.Equal(t, "test\n", string(output))
+	})
+	t.Run("Args", func(t *testing.T) {
+		t.Parallel()
+		cmd, err := s.CreateCommand(ctx, `#!/usr/bin/env bash
+		echo test`, nil, nil)
+		require.NoError(t, err)
+		output, err := cmd.AsExec().CombinedOutput()
+		require.NoError(t, err)
+		require.Equal(t, "test\n", string(output))
+	})
+	t.Run("CustomEnvInfoer", func(t *testing.T) {
+		t.Parallel()
+		ei := &fakeEnvInfoer{
+			CurrentUserFn: func() (u *user.User, err error) {
+				return nil, assert.AnError
+			},
+		}
+		_, err := s.CreateCommand(ctx, `whatever`, nil, ei)
+		require.ErrorIs(t, err, assert.AnError)
+	})
+}
+
+func TestNewServer_CommandPATH(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("PATH fallback is not used on Windows")
+	}
+
+	binDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(binDir, "myshell"), []byte("#!/bin/sh\n"), 0o755) //nolint:gosec // Must be executable.
+	require.NoError(t, err)
+	home := t.TempDir()
+
+	tests := []struct {
+		name     string
+		environ  []string
+		shell    string
+		wantPath func(t *testing.T, path string)
+		wantPATH string
+	}{
+		{
+			name:  "MissingPATH",
+			shell: "sh",
+			wantPath: func(t *testing.T, path string) {
+				require.True(t, filepath.IsAbs(path), path)
+				require.Equal(t, "sh", filepath.Base(path))
+			},
+			wantPATH: agentssh.DefaultFallbackPATH,
+		},
+		{
+			name:    "RelativeShellInPATH",
+			environ: []string{"PATH=" + binDir},
+			shell:   "myshell",
+			wantPath: func(t *testing.T, path string) {
+				require.Equal(t, filepath.Join(binDir, "myshell"), path)
+			},
+			wantPATH: binDir,
+		},
+		{
+			name:    "RelativeShellNotInPATH",
+			environ: []string{"PATH=" + binDir},
+			shell:   "sh",
+			wantPath: func(t *testing.T, path string) {
+				require.True(t, filepath.IsAbs(path), path)
+				require.NotEqual(t, binDir, filepath.Dir(path))
+			},
+			wantPATH: binDir,
+		},
+		{
+			name:  "AbsoluteShell",
+			shell: "/bin/sh",
+			wantPath: func(t *testing.T, path string) {
+				require.Equal(t, "/bin/sh", path)
+			},
+			wantPATH: agentssh.DefaultFallbackPATH,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitShort)
+			logger := testutil.Logger(t)
+			s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+				WorkingDirectory: func() string { return home },
+			})
+			require.NoError(t, err)
+			defer s.Close()
+
+			ei := &fakeEnvInfoer{
+				CurrentUserFn: user.Current,
+				EnvironFn:     func() []string { return tt.environ },
+				UserHomeDirFn: func() (string, error) { return home, nil },
+				UserShellFn:   func(string) (string, error) { return tt.shell, nil },
+			}
+			cmd, err := s.CreateCommand(ctx, "", nil, ei)
+			require.NoError(t, err)
+			tt.wantPath(t, cmd.Path)
+
+			var paths []string
+			for _, kv := range cmd.Env {
+				if v, ok := strings.CutPrefix(kv, "PATH="); ok {
+					paths = append(paths, v)
+				}
+			}
+			require.Equal(t, []string{tt.wantPATH}, paths)
+		})
+	}
+}
+
+//nolint:paralleltest // Modifies the environment of the test process.
+func TestNewServer_DefaultLocaleAndTERM(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
+
+	// The server environment must not provide the variables under test.
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if name == "LANG" || name == "TERM" || strings.HasPrefix(name, "LC_") {
+			t.Setenv(name, "")
+			require.NoError(t, os.Unsetenv(name))
+		}
+	}
+
+	const locale = "C.UTF-8"
+	tests := []struct {
+		name      string
+		noDefault bool
+		pty       bool
+		env       [][2]string
+		updateEnv []string
+		want      map[string]string // Empty value means unset.
+	}{
+		{
+			name: "NonPTY/Defaults",
+			want: map[string]string{"LANG": locale, "LC_ALL": locale, "TERM": "xterm-256color"},
+		},
+		{
+			name: "NonPTY/ClientLANG",
+			env:  [][2]string{{"LANG", "en_US.UTF-8"}},
+			want: map[string]string{"LANG": "en_US.UTF-8", "LC_ALL": "", "TERM": "xterm-256color"},
+		},
+		{
+			name: "NonPTY/ClientLCCTYPE",
+			env:  [][2]string{{"LC_CTYPE", "en_US.UTF-8"}},
+			want: map[string]string{"LANG": locale, "LC_ALL": "", "LC_CTYPE": "en_US.UTF-8"},
+		},
+		{
+			name:      "NonPTY/UpdateEnvLCALL",
+			updateEnv: []string{"LC_ALL=de_DE.UTF-8"},
+			want:      map[string]string{"LANG": "", "LC_ALL": "de_DE.UTF-8"},
+		},
+		{
+			name: "NonPTY/ClientTERM",
+			env:  [][2]string{{"TERM", "vt100"}},
+			want: map[string]string{"TERM": "vt100"},
+		},
+		{
+			name:      "NonPTY/UpdateEnvTERM",
+			updateEnv: []string{"TERM=screen"},
+			want:      map[string]string{"TERM": "screen"},
+		},
+		{
+			name:      "NonPTY/NoDefaults",
+			noDefault: true,
+			want:      map[string]string{"LANG": "", "LC_ALL": "", "TERM": ""},
+		},
+		{
+			name: "PTY/Defaults",
+			pty:  true,
+			want: map[string]string{"LANG": locale, "LC_ALL": locale, "TERM": "xterm"},
+		},
+		{
+			name: "PTY/ClientLANG",
+			pty:  true,
+			env:  [][2]string{{"LANG", "en_US.UTF-8"}},
+			want: map[string]string{"LANG": "en_US.UTF-8", "LC_ALL": "", "TERM": "xterm"},
+		},
+		{
+			name:      "PTY/NoDefaults",
+			pty:       true,
+			noDefault: true,
+			want:      map[string]string{"LANG": "", "LC_ALL": "", "TERM": "xterm"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := testutil.Logger(t)
+			cfg := &agentssh.Config{
+				UpdateEnv: func(current []string) ([]string, error) {
+					return append(current, tt.updateEnv...), nil
+				},
+			}
+			if !tt.noDefault {
+				cfg.DefaultLocale = locale
+				cfg.DefaultTERM = "xterm-256color"
+			}
+			_, addr := newTestServer(t, logger, cfg)
+
+			var opts []sshtest.Option
+			for _, kv := range tt.env {
+				opts = append(opts, sshtest.WithEnv(kv[0], kv[1]))
+			}
+			if tt.pty {
+				opts = append(opts, sshtest.WithPTY("xterm", 80, 24))
+			}
+			sess, _ := sshtest.DialSession(ctx, t, addr, opts...)
+			out, err := sess.Output("env")
+			require.NoError(t, err)
+
+			got := map[string]string{}
+			for _, line := range strings.Split(string(out), "\n") {
+				if k, v, ok := strings.Cut(strings.TrimRight(line, "\r"), "="); ok {
+					got[k] = v
+				}
+			}
+			for k, want := range tt.want {
+				v, ok := got[k]
+				if want == "" {
+					require.False(t, ok, "%s should not be set, got %q", k, v)
+					continue
+				}
+				require.Equal(t, want, v, k)
+			}
+		})
+	}
+}
+
+func TestNewServer_OnSessionEnd(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := testutil.Logger(t)
+	ended := make(chan agentssh.SessionMetadata, 1)
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		OnSessionEnd: func(meta agentssh.SessionMetadata) {
+			ended <- meta
+		},
+	})
+
+	// Profiling is only supported for login shells, the variable is still
+	// stripped from the environment.
+	sess, _ := sshtest.DialSession(ctx, t, addr, sshtest.WithEnv(agentssh.ProfileInitEnvironmentVariable, "true"))
+	out, err := sess.Output("echo \"profile=$" + agentssh.ProfileInitEnvironmentVariable + "\"")
+	require.NoError(t, err)
+	require.Equal(t, "profile=\n", string(out))
+
+	meta := testutil.RequireReceive(ctx, t, ended)
+	require.NotEqual(t, uuid.Nil, meta.ID)
+	require.Equal(t, agentssh.MagicSessionTypeSSH, meta.SessionType)
+	require.NotEmpty(t, meta.RemoteAddr)
+	require.False(t, meta.StartedAt.IsZero())
+	require.Nil(t, meta.InitProfile)
+}
+
+func TestNewServer_ExecInSession(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("named sessions are only supported on Linux")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitLong)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	s, addr := newTestServer(t, logger, nil)
+	shell, _, _, err := s.CommandEnv(ctx, nil, nil)
+	require.NoError(t, err)
+	if filepath.Base(shell) != "bash" {
+		t.Skip("named sessions require bash as the login shell")
+	}
+
+	c := sshtest.Dial(ctx, t, addr)
+	shellSess := sshtest.NewSession(t, c,
+		sshtest.WithPTY("xterm", 80, 24),
+		sshtest.WithEnv(agentssh.SessionNameEnvironmentVariable, "main"),
+	)
+	stdin, err := shellSess.StdinPipe()
+	require.NoError(t, err)
+	shellOut, err := shellSess.StdoutPipe()
+	require.NoError(t, err)
+	err = shellSess.Shell()
+	require.NoError(t, err)
+	sc := bufio.NewScanner(shellOut)
+	waitFor := func(marker string) {
+		t.Helper()
+		for sc.Scan() {
+			if strings.Contains(sc.Text(), marker) {
+				return
+			}
+		}
+		require.FailNow(t, "shell output ended", "waiting for %q: %v", marker, sc.Err())
+	}
+
+	// The arithmetic keeps the echoed input from matching.
+	_, err = io.WriteString(stdin, strings.Join([]string{
+		"export CODER_TEST_FOO=from-shell",
+		"CODER_TEST_BAR=unexported",
+		"coder_test_func() { echo func; }",
+		"alias coder_test_alias='echo alias'",
+		"shopt -s extglob",
+		"cd /tmp",
+		"echo $((40+2))done",
+	}, "; ")+"\n")
+	require.NoError(t, err)
+	waitFor("42done")
+
+	execIn := func(c *gossh.Client, name, script string) (stdout, stderr string, err error) {
+		sess := sshtest.NewSession(t, c, sshtest.WithEnv(agentssh.ExecInEnvironmentVariable, name))
+		var outBuf, errBuf bytes.Buffer
+		sess.Stdout, sess.Stderr = &outBuf, &errBuf
+		err = sess.Run(script)
+		return strings.TrimSpace(outBuf.String()), errBuf.String(), err
+	}
+
+	// The command runs in the shell once it shows the next prompt.
+	require.Eventually(t, func() bool {
+		stdout, _, err := execIn(c, "main", `echo "${CODER_TEST_FOO:-unset}:$PWD"`)
+		return err == nil && stdout == "from-shell:/tmp"
+	}, testutil.WaitMedium, testutil.IntervalMedium)
+
+	// State that child processes don't inherit is available too.
+	stdout, stderr, err := execIn(c, "main", strings.Join([]string{
+		"coder_test_func",
+		"coder_test_alias",
+		`echo "$CODER_TEST_BAR"`,
+		"shopt -q extglob && echo extglob",
+	}, "\n"))
+	require.NoError(t, err)
+	require.Empty(t, stderr)
+	require.Equal(t, "func\nalias\nunexported\nextglob", stdout)
+
+	// The exit status is that of the command, which can't change the shell.
+	_, _, err = execIn(c, "main", "cd / && CODER_TEST_FOO=changed; exit 3")
+	var exitErr *gossh.ExitError
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, 3, exitErr.ExitStatus())
+
+	// A partially typed line is kept.
+	_, err = io.WriteString(stdin, "echo partial")
+	require.NoError(t, err)
+	stdout, _, err = execIn(c, "main", `echo "$CODER_TEST_FOO:$PWD"`)
+	require.NoError(t, err)
+	require.Equal(t, "from-shell:/tmp", stdout)
+	_, err = io.WriteString(stdin, " $((40+3))done\n")
+	require.NoError(t, err)
+	waitFor("partial 43done")
+	go func() {
+		_, _ = io.Copy(io.Discard, shellOut)
+	}()
+
+	stdout, stderr, err = execIn(c, "other", `echo "${CODER_TEST_FOO:-unset}:$PWD"`)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(stdout, "unset:"), stdout)
+	require.Contains(t, stderr, `session "other" not found`)
+
+	// Named sessions are only available to the same connection.
+	c2 := sshtest.Dial(ctx, t, addr)
+	stdout, stderr, err = execIn(c2, "main", `echo "${CODER_TEST_FOO:-unset}:$PWD"`)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(stdout, "unset:"), stdout)
+	require.Contains(t, stderr, `session "main" not found`)
+
+	_, err = io.WriteString(stdin, "exit\n")
+	require.NoError(t, err)
+	_ = shellSess.Wait()
+}
+
+func TestNewServer_ExecInSessionPromptCommand(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("named sessions are only supported on Linux")
+	}
+
+	tests := []struct {
+		name    string
+		profile string
+		stdout  string
+		stderr  string
+	}{
+		{
+			name:    "Appended",
+			profile: `PROMPT_COMMAND="${PROMPT_COMMAND:+$PROMPT_COMMAND; }true"`,
+			stdout:  "from-shell",
+		},
+		{
+			// Without the hook, the command runs in a new shell after a
+			// warning.
+			name:    "Replaced",
+			profile: `PROMPT_COMMAND=true`,
+			stdout:  "unset",
+			stderr:  `session "main" isn't ready to run commands`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			home := t.TempDir()
+			err := os.WriteFile(filepath.Join(home, ".bash_profile"), []byte(tt.profile+"\n"), 0o600)
+			require.NoError(t, err)
+
+			ctx := testutil.Context(t, testutil.WaitLong)
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			s, addr := newTestServer(t, logger, &agentssh.Config{
+				UpdateEnv: func(current []string) ([]string, error) {
+					return append(current, "HOME="+home), nil
+				},
+			})
+			shell, _, _, err := s.CommandEnv(ctx, nil, nil)
+			require.NoError(t, err)
+			if filepath.Base(shell) != "bash" {
+				t.Skip("named sessions require bash as the login shell")
+			}
+
+			c := sshtest.Dial(ctx, t, addr)
+			shellSess := sshtest.NewSession(t, c,
+				sshtest.WithPTY("xterm", 80, 24),
+				sshtest.WithEnv(agentssh.SessionNameEnvironmentVariable, "main"),
+			)
+			stdin, err := shellSess.StdinPipe()
+			require.NoError(t, err)
+			stdout, err := shellSess.StdoutPipe()
+			require.NoError(t, err)
+			err = shellSess.Shell()
+			require.NoError(t, err)
+			sc := bufio.NewScanner(stdout)
+			waitFor := func(marker string) {
+				t.Helper()
+				for sc.Scan() {
+					if strings.Contains(sc.Text(), marker) {
+						return
+					}
+				}
+				require.FailNow(t, "shell output ended", "waiting for %q: %v", marker, sc.Err())
+			}
+
+			// The arithmetic keeps the echoed input from matching. Once the
+			// second command runs, the prompt before it was shown.
+			_, err = io.WriteString(stdin, "export CODER_TEST_FOO=from-shell; echo $((40+2))done\n")
+			require.NoError(t, err)
+			waitFor("42done")
+			_, err = io.WriteString(stdin, "echo $((40+3))done\n")
+			require.NoError(t, err)
+			waitFor("43done")
+			go func() {
+				_, _ = io.Copy(io.Discard, stdout)
+			}()
+
+			sess := sshtest.NewSession(t, c, sshtest.WithEnv(agentssh.ExecInEnvironmentVariable, "main"))
+			var outBuf, errBuf bytes.Buffer
+			sess.Stdout, sess.Stderr = &outBuf, &errBuf
+			err = sess.Run(`echo "${CODER_TEST_FOO:-unset}"`)
+			require.NoError(t, err)
+			require.Equal(t, tt.stdout, strings.TrimSpace(outBuf.String()))
+			if tt.stderr == "" {
+				require.Empty(t, errBuf.String())
+			} else {
+				require.Contains(t, errBuf.String(), tt.stderr)
+			}
+
+			_, err = io.WriteString(stdin, "exit\n")
+			require.NoError(t, err)
+			_ = shellSess.Wait()
+		})
+	}
+}
+
+func TestNewServer_SFTPClientOverrides(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		overrides    []agentssh.SFTPClientOverride
+		wantStatVFS  bool
+		wantDisabled []string
+	}{
+		{
+			name:        "NoMatch",
+			overrides:   []agentssh.SFTPClientOverride{{ClientVersion: regexp.MustCompile(`WinSCP`), DisabledExtensions: []string{"statvfs@openssh.com"}}},
+			wantStatVFS: true,
+		},
+		{
+			name:         "Match",
+			overrides:    []agentssh.SFTPClientOverride{{ClientVersion: regexp.MustCompile(`^SSH-2\.0-Go`), DisabledExtensions: []string{"statvfs@openssh.com"}}},
+			wantDisabled: []string{"statvfs@openssh.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			ended := make(chan agentssh.SessionMetadata, 1)
+			_, addr := newTestServer(t, logger, &agentssh.Config{
+				SFTPClientOverrides: tt.overrides,
+				OnSessionEnd:        func(m agentssh.SessionMetadata) { ended <- m },
+			})
+
+			c := sshtest.Dial(ctx, t, addr)
+			client, err := sftp.NewClient(c)
+			require.NoError(t, err)
+			_, hasStatVFS := client.HasExtension("statvfs@openssh.com")
+			require.Equal(t, tt.wantStatVFS, hasStatVFS)
+			_, hasRename := client.HasExtension("posix-rename@openssh.com")
+			require.True(t, hasRename)
+
+			// The stream must not be corrupted by the sniffing.
+			name := filepath.ToSlash(filepath.Join(t.TempDir(), "file"))
+			data := bytes.Repeat([]byte("hello sftp\n"), 10000)
+			f, err := client.Create(name)
+			require.NoError(t, err)
+			_, err = f.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+			f, err = client.Open(name)
+			require.NoError(t, err)
+			got, err := io.ReadAll(f)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+			require.Equal(t, data, got)
+			require.NoError(t, client.Close())
+
+			meta := testutil.RequireReceive(ctx, t, ended)
+			require.NotNil(t, meta.SFTPClient)
+			require.True(t, strings.HasPrefix(meta.SFTPClient.SSHClientVersion, "SSH-2.0-Go"), meta.SFTPClient.SSHClientVersion)
+			require.EqualValues(t, 3, meta.SFTPClient.Version)
+			require.Equal(t, tt.wantDisabled, meta.SFTPClient.DisabledExtensions)
+		})
+	}
+}
+
+func TestNewServer_SessionUmask(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("umask is not supported on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := testutil.Logger(t)
+	umask := uint32(0o027)
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		SessionUmask: &umask,
+	})
+
+	dir := t.TempDir()
+	requireMode := func(t *testing.T, name string, want os.FileMode) {
+		t.Helper()
+		info, err := os.Stat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, want, info.Mode().Perm(), name)
+	}
+
+	t.Run("Exec", func(t *testing.T) {
+		sess, _ := sshtest.DialSession(ctx, t, addr)
+		out, err := sess.Output("umask && touch " + filepath.Join(dir, "exec"))
+		require.NoError(t, err)
+		require.Equal(t, "0027", strings.TrimSpace(string(out)))
+		requireMode(t, "exec", 0o640)
+	})
+
+	t.Run("PTY", func(t *testing.T) {
+		sess, _ := sshtest.DialSession(ctx, t, addr, sshtest.WithPTY("xterm", 80, 24))
+		out, err := sess.Output("umask && mkdir " + filepath.Join(dir, "pty"))
+		require.NoError(t, err)
+		require.Equal(t, "0027", strings.TrimSpace(string(out)))
+		requireMode(t, "pty", 0o750)
+	})
+
+	t.Run("SFTP", func(t *testing.T) {
+		client := sshtest.Dial(ctx, t, addr)
+		sftpClient, err := sftp.NewClient(client)
+		require.NoError(t, err)
+		defer sftpClient.Close()
+
+		f, err := sftpClient.Create(path.Join(dir, "sftp-file"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		requireMode(t, "sftp-file", 0o640)
+
+		err = sftpClient.Mkdir(path.Join(dir, "sftp-dir"))
+		require.NoError(t, err)
+		requireMode(t, "sftp-dir", 0o750)
+
+		// Existing files are left alone.
+		require.NoError(t, os.Chmod(filepath.Join(dir, "sftp-file"), 0o666))
+		f, err = sftpClient.Create(path.Join(dir, "sftp-file"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		requireMode(t, "sftp-file", 0o666)
+	})
+}
+
+func TestNewServer_ReportConnectionV2(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		v2         bool
+		wantFields map[string]any
+	}{
+		{
+			name: "V2",
+			v2:   true,
+			wantFields: map[string]any{
+				"connection_id": "coderd-connection",
+				"owner":         "alice",
+			},
+		},
+		{
+			// The existing callback is adapted, logs only carry the
+			// generated ID.
+			name: "V1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitShort)
+			sink := &fakeSink{}
+			logger := testutil.Logger(t).AppendSinks(sink)
+			ids := make(chan uuid.UUID, 1)
+			disconnects := make(chan int, 1)
+			cfg := &agentssh.Config{
+				ReportConnection: func(id uuid.UUID, _ agentssh.MagicSessionType, _ string) func(int, string) {
+					ids <- id
+					return func(code int, _ string) { disconnects <- code }
+				},
+			}
+			if tt.v2 {
+				cfg.ReportConnectionV2 = func(id uuid.UUID, _ agentssh.MagicSessionType, _ string) agentssh.ReportedConnection {
+					ids <- id
+					return agentssh.ReportedConnection{
+						ExternalID:   "coderd-connection",
+						LogFields:    []slog.Field{slog.F("owner", "alice")},
+						Disconnected: func(code int, _ string) { disconnects <- code },
+					}
+				}
+			}
+			s, addr := newTestServer(t, logger, cfg)
+
+			sess, _ := sshtest.DialSession(ctx, t, addr)
+			err := sess.Run("exit 3")
+			exitErr := &ssh.ExitError{}
+			require.ErrorAs(t, err, &exitErr)
+			id := testutil.RequireReceive(ctx, t, ids)
+			require.Equal(t, 3, testutil.RequireReceive(ctx, t, disconnects))
+
+			err = s.Close()
+			require.NoError(t, err)
+
+			sink.mu.Lock()
+			defer sink.mu.Unlock()
+			var fields map[string]any
+			for _, e := range sink.entries {
+				if e.Message == "ssh session returned" {
+					fields = map[string]any{}
+					for _, f := range e.Fields {
+						fields[f.Name] = f.Value
+					}
+				}
+			}
+			require.NotNil(t, fields, "session return not logged")
+			// The generated ID is kept as a fallback.
+			require.Equal(t, id.String(), fields["id"])
+			_, ok := fields["connection_id"]
+			require.Equal(t, tt.v2, ok)
+			for k, v := range tt.wantFields {
+				require.Equal(t, v, fields[k], k)
+			}
+		})
+	}
+}
+
+func TestServer_CommandEnvProtected(t *testing.T) {
+	t.Parallel()
+
+	u, err := user.Current()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		key     string
+		environ []string
+		client  string
+		want    string
+	}{
+		{name: "USER", key: "USER", client: "USER=mallory", want: u.Username},
+		{name: "LOGNAME", key: "LOGNAME", client: "LOGNAME=mallory", want: u.Username},
+		{name: "SHELL", key: "SHELL", client: "SHELL=/bin/false", want: "/bin/agent-shell"},
+		{name: "HOME", key: "HOME", environ: []string{"HOME=/home/agent"}, client: "HOME=/tmp", want: "/home/agent"},
+		// HOME is only protected if the agent sets it.
+		{name: "HOMEUnset", key: "HOME", client: "HOME=/tmp", want: "/tmp"},
+		// Extended by Config.ProtectedEnv.
+		{name: "PATH", key: "PATH", environ: []string{"PATH=/agent/bin"}, client: "PATH=/client/bin", want: "/agent/bin"},
+		{name: "Unprotected", key: "EDITOR", environ: []string{"EDITOR=vi"}, client: "EDITOR=nano", want: "nano"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitShort)
+			logger := testutil.Logger(t)
+			s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+				ProtectedEnv: []string{"PATH"},
+			})
+			require.NoError(t, err)
+			defer s.Close()
+
+			ei := &fakeEnvInfoer{
+				CurrentUserFn: user.Current,
+				EnvironFn:     func() []string { return slices.Clone(tt.environ) },
+				UserHomeDirFn: func() (string, error) { return t.TempDir(), nil },
+				UserShellFn:   func(string) (string, error) { return "/bin/agent-shell", nil },
+			}
+			_, _, env, err := s.CommandEnv(ctx, ei, []string{tt.client})
+			require.NoError(t, err)
+
+			// Like exec, the last value of a variable wins.
+			var got string
+			for _, kv := range env {
+				if v, ok := strings.CutPrefix(kv, tt.key+"="); ok {
+					got = v
+				}
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNewServer_ContainersDisabled(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
+
+	for _, reject := range []bool{false, true} {
+		name := "Notice"
+		if reject {
+			name = "Reject"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitShort)
+			logger := testutil.Logger(t)
+			reg := prometheus.NewRegistry()
+			reasons := make(chan string, 1)
+			_, addr := newTestServer(t, logger, &agentssh.Config{
+				RejectDisabledContainers: reject,
+				ReportConnection: func(uuid.UUID, agentssh.MagicSessionType, string) func(int, string) {
+					return func(_ int, reason string) { reasons <- reason }
+				},
+			}, withRegistry(reg))
+
+			sess, _ := sshtest.DialSession(ctx, t, addr, sshtest.WithContainer("my-container", "coder"))
+			var stderr bytes.Buffer
+			sess.Stderr = &stderr
+			out, err := sess.Output("echo host")
+			require.Contains(t, stderr.String(), "CODER_AGENT_DEVCONTAINERS_ENABLE=true")
+			if reject {
+				exitErr := &ssh.ExitError{}
+				require.ErrorAs(t, err, &exitErr)
+				require.Equal(t, agentssh.ContainersDisabledErrorCode, exitErr.ExitStatus())
+				require.Empty(t, out)
+				require.Equal(t, "containers not enabled", testutil.RequireReceive(ctx, t, reasons))
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "host\n", string(out))
+				require.Empty(t, testutil.RequireReceive(ctx, t, reasons))
+			}
+
+			metrics, err := reg.Gather()
+			require.NoError(t, err)
+			var attempts float64
+			for _, m := range metrics {
+				if m.GetName() == "agent_ssh_server_container_requests_disabled_total" {
+					attempts = m.GetMetric()[0].GetCounter().GetValue()
+				}
+			}
+			require.EqualValues(t, 1, attempts)
+		})
+	}
+}
+
+func TestNewServer_RequirePTYForShell(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
+
+	tests := []struct {
+		name     string
+		command  string
+		pty      bool
+		rejected bool
+	}{
+		{name: "ShellWithoutPTY", rejected: true},
+		{name: "ShellWithPTY", pty: true},
+		{name: "Exec", command: "echo hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := testutil.Logger(t)
+			reasons := make(chan string, 1)
+			_, addr := newTestServer(t, logger, &agentssh.Config{
+				Policy: agentssh.Policy{RequirePTYForShell: true},
+				ReportConnection: func(uuid.UUID, agentssh.MagicSessionType, string) func(int, string) {
+					return func(_ int, reason string) { reasons <- reason }
+				},
+			})
+
+			var opts []sshtest.Option
+			if tt.pty {
+				opts = append(opts, sshtest.WithPTY("xterm", 80, 24))
+			}
+			sess, _ := sshtest.DialSession(ctx, t, addr, opts...)
+			var stderr bytes.Buffer
+			sess.Stderr = &stderr
+			sess.Stdin = strings.NewReader("exit\n")
+			var err error
+			if tt.command != "" {
+				err = sess.Run(tt.command)
+			} else {
+				err = sess.Shell()
+				require.NoError(t, err)
+				err = sess.Wait()
+			}
+			if tt.rejected {
+				exitErr := &ssh.ExitError{}
+				require.ErrorAs(t, err, &exitErr)
+				require.Equal(t, agentssh.ShellWithoutPTYErrorCode, exitErr.ExitStatus())
+				require.Contains(t, stderr.String(), "ssh -t")
+				require.Equal(t, "shell without pty rejected", testutil.RequireReceive(ctx, t, reasons))
+			} else {
+				require.NoError(t, err)
+				require.Empty(t, testutil.RequireReceive(ctx, t, reasons))
+			}
+		})
+	}
+}
+
+func TestServer_CommandEnvEnvironmentDirs(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The paths used here are Unix paths")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	sink := &fakeSink{}
+	logger := testutil.Logger(t).AppendSinks(sink)
+	fs := afero.NewMemMapFs()
+	files := map[string]string{
+		"/etc/env.d/10-base.conf": "# Base environment.\n\nFOO=bar\nGREETING=hello ${USER_NAME}\n",
+		"/etc/env.d/20-more.conf": "FOO=override\nnot a variable\n1BAD=x\nPATH=${PATH}:/opt/bin\nCLIENT=file\n",
+		"/etc/env.d/ignored.txt":  "IGNORED=yes\n",
+		"/opt/env.d/a.conf":       "COMBINED=${FOO}-${GREETING}${UNSET}\n",
+	}
+	for name, content := range files {
+		require.NoError(t, afero.WriteFile(fs, name, []byte(content), 0o644))
+	}
+	s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), fs, agentexec.DefaultExecer, &agentssh.Config{
+		EnvironmentDirs: []string{"/etc/env.d", "/opt/env.d"},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	ei := &fakeEnvInfoer{
+		CurrentUserFn: user.Current,
+		EnvironFn:     func() []string { return []string{"PATH=/usr/bin", "USER_NAME=coder"} },
+		UserHomeDirFn: func() (string, error) { return t.TempDir(), nil },
+		UserShellFn:   func(string) (string, error) { return "/bin/sh", nil },
+	}
+	_, _, env, err := s.CommandEnv(ctx, ei, []string{"CLIENT=client"})
+	require.NoError(t, err)
+
+	// Like exec, the last value of a variable wins.
+	got := map[string]string{}
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		got[k] = v
+	}
+	require.Equal(t, "override", got["FOO"])
+	require.Equal(t, "hello coder", got["GREETING"])
+	require.Equal(t, "/usr/bin:/opt/bin", got["PATH"])
+	require.Equal(t, "override-hello coder", got["COMBINED"])
+	// Client variables take precedence over environment files.
+	require.Equal(t, "client", got["CLIENT"])
+	require.NotContains(t, got, "IGNORED")
+
+	warnings := sink.warnings()
+	require.Len(t, warnings, 2)
+	for i, line := range []int{2, 3} {
+		fields := map[string]any{}
+		for _, f := range warnings[i].Fields {
+			fields[f.Name] = f.Value
+		}
+		require.Equal(t, filepath.Join("/etc/env.d", "20-more.conf"), fields["file"])
+		require.Equal(t, line, fields["line"])
+	}
+}
+
+// TestNewServer_CloseServeStress opens connections and sessions while the
+// server is repeatedly closed and served again, run with -race.
+func TestNewServer_CloseReportsShutdown(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("sleep is not available on Windows")
+	}
+
+	tests := []struct {
+		name     string
+		pty      bool
+		wantCode int
+	}{
+		{name: "PTY", pty: true, wantCode: 0},
+		{name: "NoPTY", wantCode: 255},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			type report struct {
+				code   int
+				reason string
+			}
+			reports := make(chan report, 1)
+			s, addr := newTestServer(t, logger, &agentssh.Config{
+				ReportConnection: func(uuid.UUID, agentssh.MagicSessionType, string) func(int, string) {
+					return func(code int, reason string) {
+						reports <- report{code: code, reason: reason}
+					}
+				},
+			})
+
+			var opts []sshtest.Option
+			if tt.pty {
+				opts = append(opts, sshtest.WithPTY("xterm", 80, 24))
+			}
+			sess, _ := sshtest.DialSession(ctx, t, addr, opts...)
+			err := sess.Start("sleep 1000")
+			require.NoError(t, err)
+			require.Eventually(t, func() bool {
+				return s.ConnStats().Sessions == 1
+			}, testutil.WaitShort, testutil.IntervalFast)
+
+			err = s.Close()
+			require.NoError(t, err)
+
+			err = sess.Wait()
+			if tt.pty {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+			got := testutil.RequireReceive(ctx, t, reports)
+			require.Equal(t, report{code: tt.wantCode, reason: "server shutdown"}, got)
+		})
+	}
+}
+
+func TestNewServer_CloseTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	reg := prometheus.NewRegistry()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s, addr := newTestServer(t, logger, &agentssh.Config{
+		CloseTimeout: testutil.IntervalMedium,
+		// The handler ignores the session being closed, like a stuck
+		// session goroutine.
+		SFTPHandler: func(slog.Logger, gliderssh.Session) error {
+			close(started)
+			<-release
+			return nil
+		},
+	}, withRegistry(reg))
+
+	sess, _ := sshtest.DialSession(ctx, t, addr)
+	err := sess.RequestSubsystem("sftp")
+	require.NoError(t, err)
+	testutil.RequireReceive(ctx, t, started)
+
+	err = s.Close()
+	require.ErrorContains(t, err, "close timed out")
+	require.ErrorContains(t, err, "in phase wg_wait")
+	require.ErrorContains(t, err, "sessions=1")
+
+	// The server finishes closing once the session returns, and the last
+	// phase is observed.
+	close(release)
+	phases := func() []string {
+		metrics, err := reg.Gather()
+		require.NoError(t, err)
+		var phases []string
+		for _, m := range metrics {
+			if m.GetName() != "agent_ssh_server_close_phase_seconds" {
+				continue
+			}
+			for _, metric := range m.GetMetric() {
+				require.EqualValues(t, 1, metric.GetSummary().GetSampleCount())
+				phases = append(phases, metric.GetLabel()[0].GetValue())
+			}
+		}
+		return phases
+	}
+	require.Eventually(t, func() bool {
+		return slices.Contains(phases(), "wg_wait")
+	}, testutil.WaitShort, testutil.IntervalFast)
+	require.ElementsMatch(t, []string{"listeners", "sessions", "conns", "processes", "agent_listeners", "srv_close", "x11", "motd", "wg_wait"}, phases())
+}
+
+func TestNewServer_Drain(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("sleep is not available on Windows")
+	}
+
+	const message = "The workspace agent is being updated."
+	drainingGauge := func(t *testing.T, reg *prometheus.Registry) float64 {
+		t.Helper()
+		metrics, err := reg.Gather()
+		require.NoError(t, err)
+		for _, m := range metrics {
+			if m.GetName() == "agent_ssh_server_draining" {
+				return m.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		return 0
+	}
+
+	for _, forced := range []bool{false, true} {
+		name := "NaturalExit"
+		if forced {
+			name = "ForcedClose"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			reg := prometheus.NewRegistry()
+			reasons := make(chan string, 2)
+			s, addr := newTestServer(t, logger, &agentssh.Config{
+				ReportConnection: func(uuid.UUID, agentssh.MagicSessionType, string) func(int, string) {
+					return func(_ int, reason string) { reasons <- reason }
+				},
+			}, withRegistry(reg))
+
+			c := sshtest.Dial(ctx, t, addr)
+			sess := sshtest.NewSession(t, c, sshtest.WithPTY("xterm", 80, 24))
+			stdin, err := sess.StdinPipe()
+			require.NoError(t, err)
+			stdout, err := sess.StdoutPipe()
+			require.NoError(t, err)
+			err = sess.Start("echo started; read -r x")
+			require.NoError(t, err)
+			sc := bufio.NewScanner(stdout)
+			require.True(t, sc.Scan())
+			require.Contains(t, sc.Text(), "started")
+
+			drainCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			drained := make(chan error, 1)
+			go func() {
+				drained <- s.Drain(drainCtx, message)
+			}()
+
+			// The running session is told about the drain.
+			for sc.Scan() {
+				if strings.Contains(sc.Text(), message) {
+					break
+				}
+			}
+			require.NoError(t, sc.Err())
+			require.True(t, s.ConnStats().Draining)
+			require.EqualValues(t, 1, drainingGauge(t, reg))
+
+			// New sessions are rejected with the message.
+			rejected := sshtest.NewSession(t, c)
+			var stderr bytes.Buffer
+			rejected.Stderr = &stderr
+			err = rejected.Run("echo hello")
+			exitErr := &ssh.ExitError{}
+			require.ErrorAs(t, err, &exitErr)
+			require.Equal(t, agentssh.DrainingErrorCode, exitErr.ExitStatus())
+			require.Equal(t, message+"\n", stderr.String())
+			require.Equal(t, "server draining", testutil.RequireReceive(ctx, t, reasons))
+
+			if forced {
+				// Drain doesn't end sessions.
+				cancel()
+				err = testutil.RequireReceive(ctx, t, drained)
+				var incomplete *agentssh.DrainIncompleteError
+				require.ErrorAs(t, err, &incomplete)
+				require.Equal(t, 1, incomplete.Active)
+				require.ErrorIs(t, err, context.Canceled)
+
+				err = s.Close()
+				require.NoError(t, err)
+				require.Equal(t, "server shutdown", testutil.RequireReceive(ctx, t, reasons))
+				require.False(t, s.ConnStats().Draining)
+				require.Zero(t, drainingGauge(t, reg))
+				return
+			}
+
+			_, err = stdin.Write([]byte("\n"))
+			require.NoError(t, err)
+			err = sess.Wait()
+			require.NoError(t, err)
+			err = testutil.RequireReceive(ctx, t, drained)
+			require.NoError(t, err)
+			require.Empty(t, testutil.RequireReceive(ctx, t, reasons))
+		})
+	}
+}
+
+func TestNewServer_DrainConcurrentSessions(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitLong)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.Serve(ln)
+	}()
+
+	// Every session that starts must have ended when Drain returns,
+	// sessions racing Drain are either waited for or rejected.
+	dir := t.TempDir()
+	c := sshtest.Dial(ctx, t, ln.Addr().String())
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess, err := c.NewSession()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer sess.Close()
+			start := filepath.Join(dir, fmt.Sprintf("%d.start", i))
+			end := filepath.Join(dir, fmt.Sprintf("%d.end", i))
+			err = sess.Run(fmt.Sprintf("touch %q; sleep 0.1; touch %q", start, end))
+			if err == nil {
+				return
+			}
+			exitErr := &ssh.ExitError{}
+			if assert.ErrorAs(t, err, &exitErr) {
+				assert.Equal(t, agentssh.DrainingErrorCode, exitErr.ExitStatus())
+			}
+		}()
+	}
+
+	// Drain once sessions are starting, so that it races the rest.
+	require.Eventually(t, func() bool {
+		starts, _ := filepath.Glob(filepath.Join(dir, "*.start"))
+		return len(starts) > 0
+	}, testutil.WaitShort, testutil.IntervalFast)
+	err = s.Drain(ctx, "")
+	require.NoError(t, err)
+	starts, err := filepath.Glob(filepath.Join(dir, "*.start"))
+	require.NoError(t, err)
+	for _, start := range starts {
+		require.FileExists(t, strings.TrimSuffix(start, ".start")+".end", "session started after Drain returned")
+	}
+	wg.Wait()
+
+	err = s.Close()
+	require.NoError(t, err)
+	<-done
+}
+
+// temporaryErrListener fails every Accept with a temporary error.
+type temporaryErrListener struct {
+	net.Listener
+}
+
+func (temporaryErrListener) Accept() (net.Conn, error) {
+	return nil, syscall.EMFILE
+}
+
+func TestNewServer_AcceptBackoffClose(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	mClock := quartz.NewMock(t)
+	trap := mClock.Trap().NewTimer("accept", "backoff")
+	defer trap.Close()
+	s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		Clock: mClock,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(temporaryErrListener{ln})
+	}()
+
+	// The backoff doubles with every error.
+	for _, backoff := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond} {
+		call := trap.MustWait(ctx)
+		require.Equal(t, backoff, call.Duration)
+		call.MustRelease(ctx)
+		mClock.Advance(backoff).MustWait(ctx)
+	}
+
+	// Close doesn't wait for the backoff to elapse.
+	trap.MustWait(ctx).MustRelease(ctx)
+	err = s.Close()
+	require.NoError(t, err)
+	err = testutil.RequireReceive(ctx, t, served)
+	require.ErrorIs(t, err, agentssh.ErrServerClosing)
+}
+
+func TestNewServer_CloseServeStress(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitLong)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	require.NoError(t, err)
+
+	for range 10 {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		served := make(chan struct{})
+		go func() {
+			defer close(served)
+			_ = s.Serve(ln)
+		}()
+
+		// Clients racing Close may fail at any point, only the server
+		// must not.
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				sshConn, chans, reqs, err := ssh.NewClientConn(conn, "localhost:22", sshtest.ClientConfig())
+				if err != nil {
+					return
+				}
+				c := ssh.NewClient(sshConn, chans, reqs)
+				defer c.Close()
+				sess, err := c.NewSession()
+				if err != nil {
+					return
+				}
+				_ = sess.Run("true")
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		_ = s.Close()
+		// Serve may have started after Close.
+		_ = ln.Close()
+		wg.Wait()
+		testutil.TryReceive(ctx, t, served)
+	}
+}
+
+func TestNewServer_State(t *testing.T) {
+	t.Parallel()
+
+	// closingServer returns a server that is draining and then closing,
+	// held there by an SFTP session until release is closed.
+	closingServer := func(ctx context.Context, t *testing.T, wait bool) (s *agentssh.Server, transitions chan string, release chan struct{}) {
+		t.Helper()
+
+		logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+		started := make(chan struct{})
+		release = make(chan struct{})
+		transitions = make(chan string, 10)
+		s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+			CloseTimeout:        testutil.IntervalMedium,
+			WaitForCloseOnServe: wait,
+			OnStateChange: func(from, to agentssh.ServerState) {
+				transitions <- from.String() + "->" + to.String()
+			},
+			SFTPHandler: func(slog.Logger, gliderssh.Session) error {
+				close(started)
+				<-release
+				return nil
+			},
+		})
+		require.NoError(t, err)
+		err = s.UpdateHostSigner(42)
+		require.NoError(t, err)
+		require.Equal(t, agentssh.ServerStateRunning, s.State())
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			err := s.Serve(ln)
+			assert.Error(t, err) // Server is closed.
+		}()
+
+		sess, _ := sshtest.DialSession(ctx, t, ln.Addr().String())
+		err = sess.RequestSubsystem("sftp")
+		require.NoError(t, err)
+		testutil.RequireReceive(ctx, t, started)
+
+		drainCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		var incomplete *agentssh.DrainIncompleteError
+		err = s.Drain(drainCtx, "bye")
+		require.ErrorAs(t, err, &incomplete)
+		require.Equal(t, agentssh.ServerStateDraining, s.State())
+
+		err = s.Close()
+		require.ErrorContains(t, err, "close timed out")
+		<-done
+		require.Equal(t, agentssh.ServerStateClosing, s.State())
+		require.Equal(t, "running->draining", testutil.RequireReceive(ctx, t, transitions))
+		require.Equal(t, "draining->closing", testutil.RequireReceive(ctx, t, transitions))
+		return s, transitions, release
+	}
+	serve := func(t *testing.T, s *agentssh.Server) (served chan error) {
+		t.Helper()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		served = make(chan error, 1)
+		go func() {
+			served <- s.Serve(ln)
+		}()
+		return served
+	}
+
+	t.Run("ServeWhileClosing", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := testutil.Context(t, testutil.WaitMedium)
+		s, transitions, release := closingServer(ctx, t, false)
+
+		err := testutil.RequireReceive(ctx, t, serve(t, s))
+		require.ErrorIs(t, err, agentssh.ErrServerClosing)
+		require.Equal(t, agentssh.ServerStateClosing, s.State())
+
+		close(release)
+		require.Equal(t, "closing->closed", testutil.RequireReceive(ctx, t, transitions))
+		require.Equal(t, agentssh.ServerStateClosed, s.State())
+
+		// A closed server can be served again.
+		served := serve(t, s)
+		require.Equal(t, "closed->running", testutil.RequireReceive(ctx, t, transitions))
+		require.Equal(t, agentssh.ServerStateRunning, s.State())
+		err = s.Close()
+		require.NoError(t, err)
+		err = testutil.RequireReceive(ctx, t, served)
+		require.Error(t, err)
+		require.NotErrorIs(t, err, agentssh.ErrServerClosing)
+	})
+
+	t.Run("WaitForCloseOnServe", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := testutil.Context(t, testutil.WaitMedium)
+		s, transitions, release := closingServer(ctx, t, true)
+
+		served := serve(t, s)
+		select {
+		case err := <-served:
+			t.Fatalf("Serve returned while closing: %v", err)
+		case <-time.After(testutil.IntervalFast):
+		}
+
+		close(release)
+		require.Equal(t, "closing->closed", testutil.RequireReceive(ctx, t, transitions))
+		require.Equal(t, "closed->running", testutil.RequireReceive(ctx, t, transitions))
+		require.Equal(t, agentssh.ServerStateRunning, s.State())
+
+		err := s.Close()
+		require.NoError(t, err)
+		err = testutil.RequireReceive(ctx, t, served)
+		require.Error(t, err)
+		require.NotErrorIs(t, err, agentssh.ErrServerClosing)
+		require.Equal(t, agentssh.ServerStateClosed, s.State())
+	})
+}
+
+func TestNewServer_CommandEnvSize(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no environment size limit")
+	}
+
+	home := t.TempDir()
+	tests := []struct {
+		name     string
+		environ  []string
+		wantWarn bool
+		wantErr  string
+	}{
+		{
+			name:    "Small",
+			environ: []string{"FOO=bar"},
+		},
+		{
+			name:     "SoftLimit",
+			environ:  []string{"FOO=bar", "BIG=" + strings.Repeat("x", 600<<10), "SECRET=" + strings.Repeat("s", 100<<10)},
+			wantWarn: true,
+		},
+		{
+			name:    "HardLimit",
+			environ: []string{"FOO=bar", "SECRET=" + strings.Repeat("s", 100<<10), "HUGE=" + strings.Repeat("x", 3<<20)},
+			wantErr: "largest: HUGE (3.1 MB)",
+		},
+		{
+			name: "HardLimitManyVariables",
+			environ: func() []string {
+				var env []string
+				for i := range 64 {
+					env = append(env, fmt.Sprintf("VAR_%d=%s", i, strings.Repeat("x", 64<<10)))
+				}
+				return env
+			}(),
+			wantErr: "environment too large",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitShort)
+			sink := &fakeSink{}
+			logger := slog.Make(sink).Leveled(slog.LevelDebug)
+			s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+				WorkingDirectory: func() string { return home },
+			})
+			require.NoError(t, err)
+			defer s.Close()
+
+			ei := &fakeEnvInfoer{
+				CurrentUserFn: user.Current,
+				EnvironFn:     func() []string { return tt.environ },
+				UserHomeDirFn: func() (string, error) { return home, nil },
+				UserShellFn:   func(string) (string, error) { return "/bin/sh", nil },
+			}
+			_, err = s.CreateCommand(ctx, "true", nil, ei)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				require.NotContains(t, err.Error(), "xxxx", "values must not be included")
+				return
+			}
+			require.NoError(t, err)
+
+			warnings := sink.warnings()
+			if !tt.wantWarn {
+				require.Empty(t, warnings)
+				return
+			}
+			require.Len(t, warnings, 1)
+			var largest []string
+			for _, f := range warnings[0].Fields {
+				if f.Name == "largest" {
+					largest, _ = f.Value.([]string)
+				}
+			}
+			require.GreaterOrEqual(t, len(largest), 2)
+			require.True(t, strings.HasPrefix(largest[0], "BIG ("), largest[0])
+			require.True(t, strings.HasPrefix(largest[1], "SECRET ("), largest[1])
+		})
+	}
+}
+
+type fakeSink struct {
+	mu      sync.Mutex
+	entries []slog.SinkEntry
+}
+
+func (s *fakeSink) LogEntry(_ context.Context, e slog.SinkEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, e)
+}
+
+func (*fakeSink) Sync() {}
+
+func (s *fakeSink) warnings() []slog.SinkEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var warnings []slog.SinkEntry
+	for _, e := range s.entries {
+		if e.Level == slog.LevelWarn {
+			warnings = append(warnings, e)
+		}
+	}
+	return warnings
+}
+
+type fakeEnvInfoer struct {
+	CurrentUserFn func() (*user.User, error)
+	EnvironFn     func() []string
+	UserHomeDirFn func() (string, error)
+	UserShellFn   func(string) (string, error)
+}
+
+func (f *fakeEnvInfoer) User(context.Context) (u *user.User, err error) {
+	return f.CurrentUserFn()
+}
+
+func (f *fakeEnvInfoer) Environ() []string {
+	return f.EnvironFn()
+}
+
+func (f *fakeEnvInfoer) HomeDir(context.Context) (string, error) {
+	return f.UserHomeDirFn()
+}
+
+func (f *fakeEnvInfoer) Shell(_ context.Context, u string) (string, error) {
+	return f.UserShellFn(u)
+}
+
+func (*fakeEnvInfoer) ModifyCommand(cmd string, args ...string) (string, []string) {
+	return cmd, args
+}
+
+// blockingEnvInfoer blocks looking up the user until the context is done.
+type blockingEnvInfoer struct {
+	usershell.SystemEnvInfo
+}
+
+func (blockingEnvInfoer) User(ctx context.Context) (*user.User, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestNewServer_CloseActiveConnections(t *testing.T) {
+	t.Parallel()
+
+	prepare := func(ctx context.Context, t *testing.T) (*agentssh.Server, func()) {
+		t.Helper()
+		logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true}).Leveled(slog.LevelDebug)
+		s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = s.Close()
+		})
+		err = s.UpdateHostSigner(42)
+		assert.NoError(t, err)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		waitConns := make([]chan struct{}, 4)
+
+		var wg sync.WaitGroup
+		wg.Add(1 + len(waitConns))
+
+		go func() {
+			defer wg.Done()
+			err := s.Serve(ln)
+			assert.Error(t, err) // Server is closed.
+		}()
+
+		for i := 0; i < len(waitConns); i++ {
+			waitConns[i] = make(chan struct{})
+			go func(ch chan struct{}) {
+				defer wg.Done()
+				c := sshtest.Dial(ctx, t, ln.Addr().String())
+				sess, err := c.NewSession()
+				assert.NoError(t, err)
+				pty := ptytest.New(t)
+				sess.Stdin = pty.Input()
+				sess.Stdout = pty.Output()
+				sess.Stderr = pty.Output()
+
+				// Every other session will request a PTY.
+				if i%2 == 0 {
+					err = sess.RequestPty("xterm", 80, 80, nil)
+					assert.NoError(t, err)
+				}
+				// The 60 seconds here is intended to be longer than the
+				// test. The shutdown should propagate.
+				if runtime.GOOS == "windows" {
+					// Best effort to at least partially test this in Windows.
+					err = sess.Start("echo start\"ed\" && sleep 60")
+				} else {
+					err = sess.Start("/bin/bash -c 'trap \"sleep 60\" SIGTERM; echo start\"ed\"; sleep 60'")
+				}
+				assert.NoError(t, err)
+
+				// Allow the session to settle (i.e. reach echo).
+				pty.ExpectMatchContext(ctx, "started")
+				// Sleep a bit to ensure the sleep has started.
+				time.Sleep(testutil.IntervalMedium)
+
+				close(ch)
+
+				err = sess.Wait()
+				assert.Error(t, err)
+			}(waitConns[i])
+		}
+
+		for _, ch := range waitConns {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timeout")
+			case <-ch:
+			}
+		}
+
+		return s, wg.Wait
+	}
+
+	t.Run("Close", func(t *testing.T) {
+		t.Parallel()
+		ctx := testutil.Context(t, testutil.WaitMedium)
+		s, wait := prepare(ctx, t)
+		err := s.Close()
+		require.NoError(t, err)
+		wait()
+	})
+
+	t.Run("Shutdown", func(t *testing.T) {
+		t.Parallel()
+		ctx := testutil.Context(t, testutil.WaitMedium)
+		s, wait := prepare(ctx, t)
+		err := s.Shutdown(ctx)
+		require.NoError(t, err)
+		wait()
+	})
+
+	t.Run("Shutdown Early", func(t *testing.T) {
+		t.Parallel()
+		ctx := testutil.Context(t, testutil.WaitMedium)
+		s, wait := prepare(ctx, t)
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		err := s.Shutdown(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+		wait()
+	})
+}
+
+func TestNewServer_Signal(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Stdout", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		logger := testutil.Logger(t)
+		_, addr := newTestServer(t, logger, nil)
+
+		c := sshtest.Dial(ctx, t, addr)
+
+		sess, err := c.NewSession()
+		require.NoError(t, err)
+		r, err := sess.StdoutPipe()
+		require.NoError(t, err)
+
+		// Perform multiple sleeps since the interrupt signal doesn't propagate to
+		// the process group, this lets us exit early.
+		sleeps := strings.Repeat("sleep 1 && ", int(testutil.WaitMedium.Seconds()))
+		err = sess.Start(fmt.Sprintf("echo hello && %s echo bye", sleeps))
+		require.NoError(t, err)
+
+		sc := bufio.NewScanner(r)
+		for sc.Scan() {
+			t.Log(sc.Text())
+			if strings.Contains(sc.Text(), "hello") {
+				break
+			}
+		}
+		require.NoError(t, sc.Err())
+
+		err = sess.Signal(ssh.SIGKILL)
+		require.NoError(t, err)
+
+		// Assumption, signal propagates and the command exists, closing stdout.
+		for sc.Scan() {
+			t.Log(sc.Text())
+			require.NotContains(t, sc.Text(), "bye")
+		}
+		require.NoError(t, sc.Err())
+
+		err = sess.Wait()
+		exitErr := &ssh.ExitError{}
+		require.ErrorAs(t, err, &exitErr)
+		wantCode := 255
+		if runtime.GOOS == "windows" {
+			wantCode = 1
+		}
+		require.Equal(t, wantCode, exitErr.ExitStatus())
+	})
+	t.Run("PTY", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		logger := testutil.Logger(t)
+		_, addr := newTestServer(t, logger, nil)
+
+		c := sshtest.Dial(ctx, t, addr)
+
+		pty := ptytest.New(t)
+
+		sess, err := c.NewSession()
+		require.NoError(t, err)
+		r, err := sess.StdoutPipe()
+		require.NoError(t, err)
+
+		// Note, we request pty but don't use ptytest here because we can't
+		// easily test for no text before EOF.
+		sess.Stdin = pty.Input()
+		sess.Stderr = pty.Output()
+
+		err = sess.RequestPty("xterm", 80, 80, nil)
 		require.NoError(t, err)
 
 		// Perform multiple sleeps since the interrupt signal doesn't propagate to
@@ -302,124 +4180,1114 @@ func TestNewServer_Signal(t *testing.T) {
 			if strings.Contains(sc.Text(), "hello") {
 				break
 			}
-		}
-		require.NoError(t, sc.Err())
+		}
+		require.NoError(t, sc.Err())
+
+		err = sess.Signal(ssh.SIGKILL)
+		require.NoError(t, err)
+
+		// Assumption, signal propagates and the command exists, closing stdout.
+		for sc.Scan() {
+			t.Log(sc.Text())
+			require.NotContains(t, sc.Text(), "bye")
+		}
+		require.NoError(t, sc.Err())
+
+		err = sess.Wait()
+		exitErr := &ssh.ExitError{}
+		require.ErrorAs(t, err, &exitErr)
+		wantCode := 255
+		if runtime.GOOS == "windows" {
+			wantCode = 1
+		}
+		require.Equal(t, wantCode, exitErr.ExitStatus())
+	})
+}
+
+// refusingExecer refuses to run commands containing "refused".
+type refusingExecer struct {
+	agentexec.Execer
+}
+
+func (refusingExecer) CheckCommand(_ context.Context, cmd string, args ...string) error {
+	if strings.Contains(strings.Join(append([]string{cmd}, args...), " "), "refused") {
+		return &agentexec.ExecRefusedError{
+			Message: "command not allowed in this workspace",
+			Err:     xerrors.New("internal policy detail"),
+		}
+	}
+	return nil
+}
+
+func TestNewServer_ExecRefused(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	reg := prometheus.NewRegistry()
+	_, addr := newTestServer(t, logger, nil, withRegistry(reg), withExecer(refusingExecer{agentexec.DefaultExecer}))
+
+	c := sshtest.Dial(ctx, t, addr)
+
+	// Commands the execer accepts run normally.
+	sess := sshtest.NewSession(t, c)
+	err := sess.Run("echo allowed")
+	require.NoError(t, err)
+
+	sess = sshtest.NewSession(t, c)
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	err = sess.Run("echo refused")
+	exitErr := &ssh.ExitError{}
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, agentssh.ExecRefusedErrorCode, exitErr.ExitStatus())
+	require.Contains(t, stderr.String(), "command not allowed in this workspace")
+	require.NotContains(t, stderr.String(), "internal policy detail")
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	var refused float64
+	for _, m := range metrics {
+		if m.GetName() != "agent_sessions_errors_total" {
+			continue
+		}
+		for _, metric := range m.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "error_type" && label.GetValue() == "exec_refused" {
+					refused += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	require.Equal(t, float64(1), refused)
+}
+
+func TestNewServer_ReverseForwardIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitLong)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	mClock := quartz.NewMock(t)
+	trap := mClock.Trap().AfterFunc("reverse_forward", "idle")
+	defer trap.Close()
+
+	s, addr := newTestServer(t, logger, &agentssh.Config{
+		Clock:  mClock,
+		Policy: agentssh.Policy{ReverseForwardIdleTimeout: 5 * time.Minute},
+	})
+
+	// The first connection binds a port and its session goes away, as
+	// with an IDE whose connection lingers after it reconnected.
+	c1 := sshtest.Dial(ctx, t, addr)
+	sess := sshtest.NewSession(t, c1)
+	rln1, err := c1.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	trap.MustWait(ctx).MustRelease(ctx)
+	trap.Close()
+	addr := rln1.Addr().String()
+	require.NoError(t, sess.Close())
+
+	forwards := s.ReverseForwards()
+	require.Len(t, forwards, 1)
+	require.Equal(t, addr, forwards[0].Addr)
+	require.Equal(t, c1.LocalAddr().String(), forwards[0].RemoteAddr)
+
+	// The port is still bound by the first connection.
+	c2 := sshtest.Dial(ctx, t, addr)
+	_, err = c2.Listen("tcp", addr)
+	require.Error(t, err)
+
+	// Once idle, the port is released and can be bound again.
+	mClock.Advance(5 * time.Minute).MustWait(ctx)
+	require.Empty(t, s.ReverseForwards())
+	rln2, err := c2.Listen("tcp", addr)
+	require.NoError(t, err)
+	defer rln2.Close()
+
+	// Canceling the released forward succeeds and leaves the new one alone.
+	err = rln1.Close()
+	require.NoError(t, err)
+	forwards = s.ReverseForwards()
+	require.Len(t, forwards, 1)
+	require.Equal(t, c2.LocalAddr().String(), forwards[0].RemoteAddr)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := rln2.Accept()
+		if assert.NoError(t, err) {
+			accepted <- conn
+		}
+	}()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	fwdConn := testutil.RequireReceive(ctx, t, accepted)
+	defer fwdConn.Close()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(fwdConn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
+
+func TestNewServer_CLIVersion(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("uses POSIX shell syntax")
+	}
+
+	tests := []struct {
+		name        string
+		env         []string
+		wantVersion string
+		wantClient  string
+	}{
+		{
+			name:        "CLI",
+			env:         []string{agentssh.CLIVersionEnvironmentVariable, "v2.24.1-rc.0+abc123"},
+			wantVersion: "v2.24.1-rc.0+abc123",
+			wantClient:  "cli",
+		},
+		{
+			name:        "Sanitized",
+			env:         []string{agentssh.CLIVersionEnvironmentVariable, "v2.24.1\x1b[31m; rm -rf /"},
+			wantVersion: "v2.24.131mrm-rf",
+			wantClient:  "cli",
+		},
+		{
+			name:        "Empty",
+			env:         []string{agentssh.CLIVersionEnvironmentVariable, ""},
+			wantVersion: "unknown",
+			wantClient:  "cli",
+		},
+		{
+			// Older CLIs and other SSH clients don't set the variable.
+			name:       "OldClient",
+			wantClient: "other",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitShort)
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			reg := prometheus.NewRegistry()
+			infos := make(chan agentssh.ConnectionInfo, 1)
+			s, addr := newTestServer(t, logger, &agentssh.Config{
+				ReportConnectionV3: func(info agentssh.ConnectionInfo) agentssh.ReportedConnection {
+					infos <- info
+					return agentssh.ReportedConnection{}
+				},
+			}, withRegistry(reg))
+			stats, unsubscribe := s.SubscribeStats(8)
+			defer unsubscribe()
+
+			c := sshtest.Dial(ctx, t, addr)
+			var opts []sshtest.Option
+			if tt.env != nil {
+				opts = append(opts, sshtest.WithEnv(tt.env[0], tt.env[1]))
+			}
+			sess := sshtest.NewSession(t, c, opts...)
+			out, err := sess.Output("echo ${" + agentssh.CLIVersionEnvironmentVariable + "-unset}")
+			require.NoError(t, err)
+			// The variable is not passed to the command.
+			require.Equal(t, "unset", strings.TrimSpace(string(out)))
+
+			info := testutil.RequireReceive(ctx, t, infos)
+			require.Equal(t, agentssh.MagicSessionTypeSSH, info.SessionType)
+			require.Equal(t, tt.wantVersion, info.CLIVersion)
+
+			// CLI sessions are counted while they run.
+			var maxCLI int64
+			for sessions := int64(1); sessions > 0; {
+				d := testutil.RequireReceive(ctx, t, stats)
+				sessions = d.Stats.Sessions
+				maxCLI = max(maxCLI, d.Stats.CLI)
+			}
+			if tt.wantClient == "cli" {
+				require.EqualValues(t, 1, maxCLI)
+			} else {
+				require.Zero(t, maxCLI)
+			}
+			require.Zero(t, s.ConnStats().CLI)
+
+			metrics, err := reg.Gather()
+			require.NoError(t, err)
+			clients := map[string]float64{}
+			for _, m := range metrics {
+				if m.GetName() != "agent_sessions_clients_total" {
+					continue
+				}
+				for _, metric := range m.GetMetric() {
+					clients[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+				}
+			}
+			require.Equal(t, map[string]float64{tt.wantClient: 1}, clients)
+		})
+	}
+}
+
+func TestNewServer_SessionTags(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("uses POSIX shell syntax")
+	}
+
+	tests := []struct {
+		name     string
+		tags     string
+		wantTags map[string]string
+	}{
+		{
+			name:     "Valid",
+			tags:     "ticket=ENG-123,job=nightly/42",
+			wantTags: map[string]string{"ticket": "ENG-123", "job": "nightly/42"},
+		},
+		{
+			// Invalid tags are ignored without failing the session.
+			name: "Invalid",
+			tags: "ticket=ENG 123",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitShort)
+			logger := slogtest.Make(t, nil)
+			infos := make(chan agentssh.ConnectionInfo, 1)
+			audits := make(chan agentssh.SessionStartAuditEntry, 1)
+			ended := make(chan agentssh.SessionMetadata, 1)
+			_, addr := newTestServer(t, logger, &agentssh.Config{
+				ReportConnectionV3: func(info agentssh.ConnectionInfo) agentssh.ReportedConnection {
+					infos <- info
+					return agentssh.ReportedConnection{}
+				},
+				SessionStartAudit: func(entry agentssh.SessionStartAuditEntry) { audits <- entry },
+				OnSessionEnd:      func(meta agentssh.SessionMetadata) { ended <- meta },
+			})
+
+			sess, _ := sshtest.DialSession(ctx, t, addr, sshtest.WithEnv(agentssh.SessionTagsEnvironmentVariable, tt.tags))
+			out, err := sess.Output("echo ${" + agentssh.SessionTagsEnvironmentVariable + "-unset}")
+			require.NoError(t, err)
+			// The variable is not passed to the command.
+			require.Equal(t, "unset", strings.TrimSpace(string(out)))
+
+			info := testutil.RequireReceive(ctx, t, infos)
+			require.Equal(t, tt.wantTags, info.Tags)
+			entry := testutil.RequireReceive(ctx, t, audits)
+			require.Equal(t, tt.wantTags, entry.Tags)
+			meta := testutil.RequireReceive(ctx, t, ended)
+			require.Equal(t, tt.wantTags, meta.Tags)
+		})
+	}
+}
+
+func TestNewServer_SSHUser(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		enforce  string
+		wantUser string
+		wantCode int
+	}{
+		{name: "Reported", user: "coder", wantUser: "coder"},
+		{name: "Sanitized", user: "ro ot\x1b[31m", wantUser: "ro?ot?[31m"},
+		{name: "Enforced", user: "coder", enforce: "coder", wantUser: "coder"},
+		{name: "Mismatch", user: "root", enforce: "coder", wantUser: "root", wantCode: agentssh.UsernameRejectedErrorCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitShort)
+			sink := &fakeSink{}
+			logger := testutil.Logger(t).AppendSinks(sink)
+			infos := make(chan agentssh.ConnectionInfo, 1)
+			ended := make(chan agentssh.SessionMetadata, 1)
+			s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+				EnforceUsername: tt.enforce,
+				ReportConnectionV3: func(info agentssh.ConnectionInfo) agentssh.ReportedConnection {
+					infos <- info
+					return agentssh.ReportedConnection{}
+				},
+				OnSessionEnd: func(meta agentssh.SessionMetadata) { ended <- meta },
+			})
+			require.NoError(t, err)
+			defer s.Close()
+			err = s.UpdateHostSigner(42)
+			assert.NoError(t, err)
+
+			ln := agentssh.NewInMemoryListener("test")
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				err := s.Serve(ln)
+				assert.Error(t, err) // Server is closed.
+			}()
+
+			c := sshtest.DialInMemory(ctx, t, ln, sshtest.WithUser(tt.user))
+			sess := sshtest.NewSession(t, c)
+			var stderr bytes.Buffer
+			sess.Stderr = &stderr
+			err = sess.Run("true")
+			info := testutil.RequireReceive(ctx, t, infos)
+			require.Equal(t, tt.wantUser, info.SSHUser)
+			if tt.wantCode != 0 {
+				exitErr := &ssh.ExitError{}
+				require.ErrorAs(t, err, &exitErr)
+				require.Equal(t, tt.wantCode, exitErr.ExitStatus())
+				require.Contains(t, stderr.String(), `connected as SSH user "root", but this workspace expects "coder"`)
+			} else {
+				require.NoError(t, err)
+				meta := testutil.RequireReceive(ctx, t, ended)
+				require.Equal(t, tt.wantUser, meta.SSHUser)
+			}
+
+			err = s.Close()
+			require.NoError(t, err)
+			<-done
+
+			sink.mu.Lock()
+			defer sink.mu.Unlock()
+			var logged bool
+			for _, e := range sink.entries {
+				if e.Message != "handling ssh session" {
+					continue
+				}
+				for _, f := range e.Fields {
+					if f.Name == "ssh_user" {
+						require.Equal(t, tt.wantUser, f.Value)
+						logged = true
+					}
+				}
+			}
+			require.True(t, logged, "ssh user not logged")
+		})
+	}
+}
+
+func TestNewServer_CommandPolicy(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("uses POSIX shell commands")
+	}
+
+	type call struct {
+		argv      []string
+		magicType agentssh.MagicSessionType
+	}
+	calls := make(chan call, 8)
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	reg := prometheus.NewRegistry()
+	s, addr := newTestServer(t, logger, &agentssh.Config{
+		CommandPolicy: func(argv []string, magicType agentssh.MagicSessionType) error {
+			calls <- call{argv: argv, magicType: magicType}
+			if len(argv) == 0 {
+				return xerrors.New("interactive shells are not allowed")
+			}
+			if len(argv) == 2 && argv[0] == "echo" {
+				return nil
+			}
+			return xerrors.Errorf("%s is not allowed", argv[0])
+		},
+	}, withRegistry(reg))
 
-		err = sess.Signal(ssh.SIGKILL)
-		require.NoError(t, err)
+	c := sshtest.Dial(ctx, t, addr)
+	out, err := sshtest.NewSession(t, c, sshtest.WithSessionType(agentssh.MagicSessionTypeVSCode)).Output("echo 'allowed command'")
+	require.NoError(t, err)
+	require.Equal(t, "allowed command", strings.TrimSpace(string(out)))
+	require.Equal(t, call{argv: []string{"echo", "allowed command"}, magicType: agentssh.MagicSessionTypeVSCode}, testutil.RequireReceive(ctx, t, calls))
 
-		// Assumption, signal propagates and the command exists, closing stdout.
-		for sc.Scan() {
-			t.Log(sc.Text())
-			require.NotContains(t, sc.Text(), "bye")
+	rejected := func(command, wantStderr string) {
+		t.Helper()
+		sess := sshtest.NewSession(t, c)
+		var stdout, stderr bytes.Buffer
+		sess.Stdout, sess.Stderr = &stdout, &stderr
+		if command == "" {
+			require.NoError(t, sess.Shell())
+			err = sess.Wait()
+		} else {
+			err = sess.Run(command)
 		}
-		require.NoError(t, sc.Err())
-
-		err = sess.Wait()
 		exitErr := &ssh.ExitError{}
 		require.ErrorAs(t, err, &exitErr)
-		wantCode := 255
-		if runtime.GOOS == "windows" {
-			wantCode = 1
+		require.Equal(t, agentssh.CommandRejectedErrorCode, exitErr.ExitStatus())
+		require.Contains(t, stderr.String(), wantStderr)
+		require.Empty(t, stdout.String())
+	}
+	rejected("touch /tmp/x; echo done", "touch is not allowed")
+	require.Equal(t, []string{"touch", "/tmp/x;", "echo", "done"}, testutil.RequireReceive(ctx, t, calls).argv)
+	// Login shells are passed as an empty argv.
+	rejected("", "interactive shells are not allowed")
+	require.Empty(t, testutil.RequireReceive(ctx, t, calls).argv)
+	// The policy can't decide on commands that can't be split.
+	rejected(`echo "unbalanced`, "command could not be parsed")
+	require.Empty(t, calls)
+
+	err = s.Close()
+	require.NoError(t, err)
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	require.True(t, testutil.PromCounterHasValue(t, metrics, 3, "agent_sessions_rejected_total", "ssh", "command_policy"))
+}
+
+func TestNewServer_SessionAdmission(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	reg := prometheus.NewRegistry()
+	infos := make(chan agentssh.PreSessionInfo, 2)
+	reasons := make(chan string, 2)
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		SessionAdmission: func(ctx gliderssh.Context, info agentssh.PreSessionInfo) error {
+			infos <- info
+			if ctx.User() == "revoked" {
+				return xerrors.New("Your seat was revoked.")
+			}
+			return nil
+		},
+		SessionAdmissionErrorCode: 42,
+		ReportConnectionV3: func(agentssh.ConnectionInfo) agentssh.ReportedConnection {
+			return agentssh.ReportedConnection{Disconnected: func(_ int, reason string) { reasons <- reason }}
+		},
+	}, withRegistry(reg))
+
+	// Admitted sessions run normally.
+	c := sshtest.Dial(ctx, t, addr)
+	sess := sshtest.NewSession(t, c, sshtest.WithEnv(agentssh.MagicSessionTypeEnvironmentVariable, "vscode"))
+	err := sess.Run("exit 0")
+	require.NoError(t, err)
+	info := testutil.RequireReceive(ctx, t, infos)
+	require.Equal(t, agentssh.MagicSessionTypeVSCode, info.SessionType)
+	require.Equal(t, "vscode", info.RawSessionType)
+	require.Equal(t, "exit 0", info.RawCommand)
+	require.Equal(t, []string{"exit", "0"}, info.CommandArgv)
+	require.False(t, info.IsPty)
+	require.Empty(t, testutil.RequireReceive(ctx, t, reasons))
+
+	// Rejected sessions never start the command.
+	c = sshtest.Dial(ctx, t, addr, sshtest.WithUser("revoked"))
+	sess = sshtest.NewSession(t, c)
+	var stdout, stderr bytes.Buffer
+	sess.Stdout, sess.Stderr = &stdout, &stderr
+	err = sess.Run("echo started")
+	exitErr := &ssh.ExitError{}
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, 42, exitErr.ExitStatus())
+	require.Equal(t, "Your seat was revoked.\n", stderr.String())
+	require.Empty(t, stdout.String())
+	info = testutil.RequireReceive(ctx, t, infos)
+	require.Equal(t, "revoked", info.User)
+	require.Equal(t, agentssh.MagicSessionTypeSSH, info.SessionType)
+	require.Equal(t, "Your seat was revoked.", testutil.RequireReceive(ctx, t, reasons))
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	var rejected []string
+	for _, m := range metrics {
+		if m.GetName() != "agent_sessions_rejected_total" {
+			continue
 		}
-		require.Equal(t, wantCode, exitErr.ExitStatus())
-	})
-	t.Run("PTY", func(t *testing.T) {
-		t.Parallel()
+		for _, metric := range m.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range metric.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			rejected = append(rejected, fmt.Sprintf("%s/%s=%v", labels["magic_type"], labels["reason"], metric.GetCounter().GetValue()))
+		}
+	}
+	require.Equal(t, []string{"ssh/admission=1"}, rejected)
+}
+func TestNewServer_SessionCommand(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("uses POSIX shell syntax")
+	}
 
-		ctx := context.Background()
-		logger := testutil.Logger(t)
-		s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
-		require.NoError(t, err)
-		defer s.Close()
-		err = s.UpdateHostSigner(42)
-		assert.NoError(t, err)
+	tests := []struct {
+		name     string
+		command  string
+		wantArgv []string
+		wantOut  string
+	}{
+		{
+			name:     "Quoted",
+			command:  `echo "hello   world"`,
+			wantArgv: []string{"echo", "hello   world"},
+			wantOut:  "hello   world\n",
+		},
+		{
+			// The quote in the heredoc can't be split, which must not
+			// change what the shell runs.
+			name:    "Unparseable",
+			command: "cat <<'EOF'\nit's\nEOF",
+			wantOut: "it's\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
 
-		ln, err := net.Listen("tcp", "127.0.0.1:0")
-		require.NoError(t, err)
+			ctx := testutil.Context(t, testutil.WaitShort)
+			logger := testutil.Logger(t)
+			infos := make(chan agentssh.ConnectionInfo, 1)
+			audits := make(chan agentssh.SessionStartAuditEntry, 1)
+			ended := make(chan agentssh.SessionMetadata, 1)
+			s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+				ReportConnectionV3: func(info agentssh.ConnectionInfo) agentssh.ReportedConnection {
+					infos <- info
+					return agentssh.ReportedConnection{}
+				},
+				SessionStartAudit: func(entry agentssh.SessionStartAuditEntry) { audits <- entry },
+				OnSessionEnd:      func(meta agentssh.SessionMetadata) { ended <- meta },
+			})
+			require.NoError(t, err)
+			defer s.Close()
+			err = s.UpdateHostSigner(42)
+			assert.NoError(t, err)
 
-		done := make(chan struct{})
-		go func() {
-			defer close(done)
-			err := s.Serve(ln)
-			assert.Error(t, err) // Server is closed.
-		}()
-		defer func() {
-			err := s.Close()
+			ln := agentssh.NewInMemoryListener("test")
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				err := s.Serve(ln)
+				assert.Error(t, err) // Server is closed.
+			}()
+
+			c := sshtest.DialInMemory(ctx, t, ln)
+			sess := sshtest.NewSession(t, c)
+			out, err := sess.Output(tt.command)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantOut, string(out))
+
+			want := agentssh.SessionCommand{Raw: tt.command, Argv: tt.wantArgv}
+			require.Equal(t, want, testutil.RequireReceive(ctx, t, infos).Command)
+			require.Equal(t, want, testutil.RequireReceive(ctx, t, audits).Command)
+			require.Equal(t, want, testutil.RequireReceive(ctx, t, ended).Command)
+
+			err = s.Close()
 			require.NoError(t, err)
 			<-done
-		}()
+		})
+	}
+}
 
-		c := sshClient(t, ln.Addr().String())
+func TestNewServer_Localizer(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
 
-		pty := ptytest.New(t)
+	mark := func(key string, args ...any) string {
+		return fmt.Sprintf("<%s>%s</%s>", key, fmt.Sprintf(agentssh.DefaultMessage(key), args...), key)
+	}
+	tests := []struct {
+		name    string
+		policy  agentssh.Policy
+		opts    []sshtest.Option
+		command string
+		// stdout is the expected output, stderr if empty.
+		stdout string
+		stderr string
+	}{
+		{
+			name:    "FileTransferBlocked",
+			policy:  agentssh.Policy{BlockFileTransfer: true},
+			command: "scp -t /tmp",
+			stdout:  "\x02" + mark(agentssh.MessageFileTransferBlocked) + "\n",
+		},
+		{
+			name:   "ShellWithoutPTY",
+			policy: agentssh.Policy{RequirePTYForShell: true},
+			stderr: mark(agentssh.MessageShellWithoutPTY) + "\n",
+		},
+		{
+			name: "SessionTypeRequired",
+			policy: agentssh.Policy{
+				StrictSessionTypes:  true,
+				RequireSessionType:  true,
+				AllowedSessionTypes: []agentssh.MagicSessionType{agentssh.MagicSessionTypeVSCode},
+			},
+			command: "true",
+			stderr:  mark(agentssh.MessageSessionTypeRequired, agentssh.MagicSessionTypeEnvironmentVariable, "vscode") + "\n",
+		},
+		{
+			name: "SessionTypeNotAllowed",
+			policy: agentssh.Policy{
+				StrictSessionTypes:  true,
+				AllowedSessionTypes: []agentssh.MagicSessionType{agentssh.MagicSessionTypeVSCode},
+			},
+			opts:    []sshtest.Option{sshtest.WithSessionType(agentssh.MagicSessionTypeSSH)},
+			command: "true",
+			stderr:  mark(agentssh.MessageSessionTypeNotAllowed, agentssh.MagicSessionTypeEnvironmentVariable, "ssh", "vscode") + "\n",
+		},
+		{
+			name:    "ContainersDisabled",
+			opts:    []sshtest.Option{sshtest.WithContainer("my-container", "coder")},
+			command: "true",
+			stderr:  mark(agentssh.MessageContainersDisabled) + "\n",
+		},
+		{
+			name:    "NamedSessionNotFound",
+			opts:    []sshtest.Option{sshtest.WithEnv(agentssh.ExecInEnvironmentVariable, "missing")},
+			command: "true",
+			stderr:  mark(agentssh.MessageNamedSessionNotFound, "missing") + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
 
-		sess, err := c.NewSession()
-		require.NoError(t, err)
-		r, err := sess.StdoutPipe()
-		require.NoError(t, err)
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			_, addr := newTestServer(t, logger, &agentssh.Config{
+				Policy:    tt.policy,
+				Localizer: mark,
+			})
 
-		// Note, we request pty but don't use ptytest here because we can't
-		// easily test for no text before EOF.
-		sess.Stdin = pty.Input()
-		sess.Stderr = pty.Output()
+			sess, _ := sshtest.DialSession(ctx, t, addr, tt.opts...)
+			var stdout, stderr bytes.Buffer
+			sess.Stdout = &stdout
+			sess.Stderr = &stderr
+			if tt.command != "" {
+				_ = sess.Run(tt.command)
+			} else {
+				err := sess.Shell()
+				require.NoError(t, err)
+				_ = sess.Wait()
+			}
+			if tt.stdout != "" {
+				require.Equal(t, tt.stdout, stdout.String())
+			} else {
+				require.Equal(t, tt.stderr, stderr.String())
+			}
+		})
+	}
+}
 
-		err = sess.RequestPty("xterm", 80, 80, nil)
-		require.NoError(t, err)
+func TestNewServer_LastActivity(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("uses POSIX shell commands")
+	}
 
-		// Perform multiple sleeps since the interrupt signal doesn't propagate to
-		// the process group, this lets us exit early.
-		sleeps := strings.Repeat("sleep 1 && ", int(testutil.WaitMedium.Seconds()))
-		err = sess.Start(fmt.Sprintf("echo hello && %s echo bye", sleeps))
-		require.NoError(t, err)
+	ctx := testutil.Context(t, testutil.WaitLong)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	s, addr := newTestServer(t, logger, nil)
+	require.Zero(t, s.ConnStats().LastSSHActivity)
 
-		sc := bufio.NewScanner(r)
-		for sc.Scan() {
-			t.Log(sc.Text())
-			if strings.Contains(sc.Text(), "hello") {
-				break
+	c := sshtest.Dial(ctx, t, addr)
+	sess := sshtest.NewSession(t, c, sshtest.WithPTY("xterm", 80, 24))
+	stdin, err := sess.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := sess.StdoutPipe()
+	require.NoError(t, err)
+	// Output without input, like tailing a log, followed by echoing input.
+	err = sess.Start(`for i in 1 2 3 4 5; do echo "tick $i"; sleep 0.1; done; echo ready; cat`)
+	require.NoError(t, err)
+	r := bufio.NewReader(stdout)
+	readUntil := func(want string) {
+		for {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			if strings.Contains(line, want) {
+				return
 			}
 		}
-		require.NoError(t, sc.Err())
+	}
 
-		err = sess.Signal(ssh.SIGKILL)
+	// The session starting is activity.
+	readUntil("tick 1")
+	started := s.ConnStats().LastSSHActivity
+	require.NotZero(t, started)
+	readUntil("ready")
+	require.Equal(t, started, s.ConnStats().LastSSHActivity, "output isn't activity")
+
+	_, err = io.WriteString(stdin, "hello\n")
+	require.NoError(t, err)
+	readUntil("hello")
+	stats := s.ConnStats()
+	require.True(t, stats.LastSSHActivity.After(started), "input is activity")
+	require.Zero(t, stats.LastVSCodeActivity)
+	require.Zero(t, stats.LastJetBrainsActivity)
+
+	_ = sess.Close()
+}
+
+func TestNewServer_SetPolicy(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitLong)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	s, addr := newTestServer(t, logger, nil)
+	require.False(t, s.Policy().BlockFileTransfer)
+	require.Equal(t, agentssh.DefaultDeniedUnixSockets, s.Policy().DeniedUnixSockets)
+	require.Equal(t, agentssh.DefaultDeniedUnixSocketPaths, s.Policy().DeniedUnixSocketPaths)
+
+	// A running session keeps the policy it started with.
+	running, _ := sshtest.DialSession(ctx, t, addr)
+	stdin, err := running.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := running.StdoutPipe()
+	require.NoError(t, err)
+	r := bufio.NewReader(stdout)
+	err = running.Start("echo started; read -r x; echo done")
+	require.NoError(t, err)
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "started\n", line)
+
+	s.SetPolicy(agentssh.Policy{BlockFileTransfer: true, MaxSessionLifetime: time.Nanosecond, MaxSessionLifetimeIncludeExec: true})
+	_, err = stdin.Write([]byte("\n"))
+	require.NoError(t, err)
+	line, err = r.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "done\n", line)
+	err = running.Wait()
+	require.NoError(t, err)
+
+	// New sessions get the new policy.
+	s.SetPolicy(agentssh.Policy{BlockFileTransfer: true})
+	sess, _ := sshtest.DialSession(ctx, t, addr)
+	err = sess.Run("scp -t /tmp")
+	exitErr := &ssh.ExitError{}
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, agentssh.BlockedFileTransferErrorCode, exitErr.ExitStatus())
+
+	// Flipping the policy doesn't disturb the sessions.
+	flipped := make(chan struct{})
+	go func() {
+		defer close(flipped)
+		for i := range 1000 {
+			s.SetPolicy(agentssh.Policy{BlockFileTransfer: i%2 == 0, RequirePTYForShell: i%2 == 1})
+		}
+	}()
+	var wg sync.WaitGroup
+	for range 10 {
+		sess, _ := sshtest.DialSession(ctx, t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err := sess.Output("echo hello")
+			assert.NoError(t, err)
+			assert.Equal(t, "hello\n", string(out))
+		}()
+	}
+	wg.Wait()
+	_ = testutil.TryReceive(ctx, t, flipped)
+}
+
+func TestNewServer_InitialWindowSize(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("stty is not available on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	_, addr := newTestServer(t, logger, nil)
+
+	// The client never sends a window change.
+	sess, _ := sshtest.DialSession(ctx, t, addr, sshtest.WithPTY("xterm", 200, 50))
+	out, err := sess.Output("stty size")
+	require.NoError(t, err)
+	require.Equal(t, "50 200", strings.TrimSpace(string(out)))
+}
+
+func TestNewServer_PTYOptions(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("GPG_TTY is not set on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	called := make(chan agentssh.SessionMetadata, 1)
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		PTYOptions: func(meta agentssh.SessionMetadata, _ gliderssh.Pty) []pty.Option {
+			called <- meta
+			return []pty.Option{pty.WithGPGTTY()}
+		},
+	})
+
+	sess, _ := sshtest.DialSession(ctx, t, addr, sshtest.WithPTY("xterm", 80, 24))
+	out, err := sess.Output("echo \"gpg=$GPG_TTY tty=$SSH_TTY\"")
+	require.NoError(t, err)
+	// The option reached the child without dropping the SSH request.
+	require.Regexp(t, `gpg=/dev/\S+ tty=/dev/\S+`, string(out))
+
+	meta := testutil.RequireReceive(ctx, t, called)
+	require.NotEqual(t, uuid.Nil, meta.ID)
+	require.Equal(t, agentssh.MagicSessionTypeSSH, meta.SessionType)
+}
+
+func TestNewServer_MaxPTYs(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("uses POSIX shell commands")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitLong)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	reg := prometheus.NewRegistry()
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		MaxPTYs: 1,
+	}, withRegistry(reg))
+
+	gauge := func(name string) float64 {
+		metrics, err := reg.Gather()
 		require.NoError(t, err)
+		for _, m := range metrics {
+			if m.GetName() == name {
+				return m.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		return -1
+	}
+	require.Equal(t, float64(1), gauge("agent_ssh_server_ptys_max"))
 
-		// Assumption, signal propagates and the command exists, closing stdout.
-		for sc.Scan() {
-			t.Log(sc.Text())
-			require.NotContains(t, sc.Text(), "bye")
+	c := sshtest.Dial(ctx, t, addr)
+	first := sshtest.NewSession(t, c, sshtest.WithPTY("xterm", 80, 24))
+	r, err := first.StdoutPipe()
+	require.NoError(t, err)
+	err = first.Start("echo started; sleep 600")
+	require.NoError(t, err)
+	sc := bufio.NewScanner(r)
+	require.True(t, sc.Scan())
+	require.Contains(t, sc.Text(), "started")
+	require.Equal(t, float64(1), gauge("agent_ssh_server_ptys_open"))
+
+	// The cap is reached, further PTY sessions are rejected.
+	second := sshtest.NewSession(t, c, sshtest.WithPTY("xterm", 80, 24))
+	var stdout, stderr bytes.Buffer
+	second.Stdout, second.Stderr = &stdout, &stderr
+	err = second.Run("echo second")
+	exitErr := &ssh.ExitError{}
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, agentssh.TooManyPTYsErrorCode, exitErr.ExitStatus())
+	require.Contains(t, stderr.String(), "too many interactive sessions")
+	require.NotContains(t, stdout.String(), "second")
+
+	// Sessions without a PTY aren't limited.
+	out, err := sshtest.NewSession(t, c).Output("echo exec")
+	require.NoError(t, err)
+	require.Equal(t, "exec", strings.TrimSpace(string(out)))
+
+	// Closing the first session frees its PTY.
+	_ = first.Close()
+	require.Eventually(t, func() bool {
+		return gauge("agent_ssh_server_ptys_open") == 0
+	}, testutil.WaitShort, testutil.IntervalFast)
+	out, err = sshtest.NewSession(t, c, sshtest.WithPTY("xterm", 80, 24)).Output("echo third")
+	require.NoError(t, err)
+	require.Contains(t, string(out), "third")
+}
+
+func TestNewServer_MaxSessions(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("uses POSIX shell commands")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitLong)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	reg := prometheus.NewRegistry()
+	_, addr := newTestServer(t, logger, &agentssh.Config{
+		MaxSessions: 1,
+	}, withRegistry(reg))
+
+	// A burst of sessions never exceeds the limit, all but one are
+	// rejected.
+	const burst = 5
+	c := sshtest.Dial(ctx, t, addr)
+	sessions := make([]*ssh.Session, burst)
+	stderrs := make([]*bytes.Buffer, burst)
+	exited := make(chan int, burst)
+	var wg sync.WaitGroup
+	for i := range sessions {
+		sessions[i] = sshtest.NewSession(t, c)
+		stderrs[i] = &bytes.Buffer{}
+		sessions[i].Stderr = stderrs[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := sessions[i].Start("sleep 600")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	for i := range sessions {
+		go func() {
+			err := sessions[i].Wait()
+			exitErr := &ssh.ExitError{}
+			if !xerrors.As(err, &exitErr) {
+				return
+			}
+			assert.Equal(t, agentssh.TooManySessionsErrorCode, exitErr.ExitStatus())
+			exited <- i
+		}()
+	}
+	var running *ssh.Session
+	rejected := map[int]bool{}
+	for range burst - 1 {
+		rejected[testutil.RequireReceive(ctx, t, exited)] = true
+	}
+	for i, sess := range sessions {
+		if rejected[i] {
+			require.Contains(t, stderrs[i].String(), "too many concurrent SSH sessions")
+			continue
 		}
-		require.NoError(t, sc.Err())
+		running = sess
+	}
+	require.NotNil(t, running)
 
-		err = sess.Wait()
-		exitErr := &ssh.ExitError{}
-		require.ErrorAs(t, err, &exitErr)
-		wantCode := 255
-		if runtime.GOOS == "windows" {
-			wantCode = 1
+	// JetBrains sessions don't count.
+	out, err := sshtest.NewSession(t, c, sshtest.WithSessionType(agentssh.MagicSessionTypeJetBrains)).Output("echo jetbrains")
+	require.NoError(t, err)
+	require.Equal(t, "jetbrains", strings.TrimSpace(string(out)))
+
+	// Closing the running session frees its slot.
+	_ = running.Close()
+	require.Eventually(t, func() bool {
+		out, err := sshtest.NewSession(t, c).Output("echo again")
+		return err == nil && strings.TrimSpace(string(out)) == "again"
+	}, testutil.WaitShort, testutil.IntervalFast)
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	rejections := 0.0
+	for _, m := range metrics {
+		if m.GetName() != "agent_sessions_rejected_total" {
+			continue
 		}
-		require.Equal(t, wantCode, exitErr.ExitStatus())
+		for _, metric := range m.GetMetric() {
+			if metric.GetLabel()[1].GetValue() == "max_sessions" {
+				rejections += metric.GetCounter().GetValue()
+			}
+		}
+	}
+	// The retries above may be rejected until the slot is freed.
+	require.GreaterOrEqual(t, rejections, float64(burst-1))
+}
+
+func TestNewServer_EnvLookupTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	mClock := quartz.NewMock(t)
+	s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		Clock:            mClock,
+		EnvLookupTimeout: time.Second,
 	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	trap := mClock.Trap().AfterFunc("env_lookup", "get current user")
+	defer trap.Close()
+
+	// A hung lookup fails once the timeout passes.
+	errs := make(chan error, 1)
+	go func() {
+		_, _, _, err := s.CommandEnv(ctx, blockingEnvInfoer{}, nil)
+		errs <- err
+	}()
+	trap.MustWait(ctx).MustRelease(ctx)
+	mClock.Advance(time.Second).MustWait(ctx)
+	err = testutil.RequireReceive(ctx, t, errs)
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorContains(t, err, "get current user: timed out after 1s")
+
+	// Canceling the session stops the lookup too, but isn't a timeout.
+	sessionCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		_, err := s.CreateCommand(sessionCtx, "true", nil, blockingEnvInfoer{})
+		errs <- err
+	}()
+	trap.MustWait(ctx).MustRelease(ctx)
+	cancel()
+	err = testutil.RequireReceive(ctx, t, errs)
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorContains(t, err, "get current user")
+	require.NotContains(t, err.Error(), "timed out")
 }
 
-func sshClient(t *testing.T, addr string) *ssh.Client {
-	conn, err := net.Dial("tcp", addr)
+func TestCoderSignerWithOptions(t *testing.T) {
+	t.Parallel()
+
+	// The host key of an agent must not change across releases for the same
+	// seed and size.
+	tests := []struct {
+		seed        int64
+		opts        []agentssh.SignerOption
+		fingerprint string
+	}{
+		{seed: 42, fingerprint: "SHA256:vU4KObIERgY4g+cf10p739H2p6JZVkfgLxkrSGaGMKA"},
+		{seed: 1234, opts: []agentssh.SignerOption{agentssh.WithKeyBits(2048)}, fingerprint: "SHA256:ZXIB7i/lm4nQyXcYOu0Fx5VxL3SJJ36/M5LL17IAldo"},
+		{seed: 42, opts: []agentssh.SignerOption{agentssh.WithKeyBits(3072)}, fingerprint: "SHA256:Ifn7bKGvyy0bZLxkeTo3ljZcbZOwTHjLB7L37YkE+pg"},
+		{seed: 1234, opts: []agentssh.SignerOption{agentssh.WithKeyBits(3072)}, fingerprint: "SHA256:bmWwl7i4SDM+wlLV8+Dr1kSxHmnU5/aChGcHAzM2tuw"},
+		{seed: 42, opts: []agentssh.SignerOption{agentssh.WithKeyBits(4096)}, fingerprint: "SHA256:lb1Q0Ak+DOghXGQyIeM614TREOJNvS+cPKayfagDTYM"},
+		{seed: 1234, opts: []agentssh.SignerOption{agentssh.WithKeyBits(4096)}, fingerprint: "SHA256:jRQ6jJTN7K2Jbv+erDYifKF/UUA89BVgmrP39K0webk"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fingerprint, func(t *testing.T) {
+			t.Parallel()
+
+			signer, err := agentssh.CoderSignerWithOptions(tt.seed, tt.opts...)
+			require.NoError(t, err)
+			require.Equal(t, tt.fingerprint, agentssh.Fingerprint(signer))
+		})
+	}
+
+	signer, err := agentssh.CoderSigner(42)
 	require.NoError(t, err)
-	t.Cleanup(func() {
-		_ = conn.Close()
-	})
+	require.Equal(t, tests[0].fingerprint, agentssh.Fingerprint(signer))
 
-	sshConn, channels, requests, err := ssh.NewClientConn(conn, "localhost:22", &ssh.ClientConfig{
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint:gosec // This is a test.
-	})
+	_, err = agentssh.CoderSignerWithOptions(42, agentssh.WithKeyBits(1024))
+	require.ErrorContains(t, err, "unsupported RSA key size 1024")
+}
+
+func TestNewServer_HostKeyFingerprints(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitLong)
+	s, err := agentssh.NewServer(ctx, testutil.Logger(t), prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
 	require.NoError(t, err)
-	t.Cleanup(func() {
-		_ = sshConn.Close()
-	})
-	c := ssh.NewClient(sshConn, channels, requests)
-	t.Cleanup(func() {
-		_ = c.Close()
-	})
-	return c
+	defer s.Close()
+	require.Empty(t, s.HostKeyFingerprints())
+
+	err = s.UpdateHostSigner(42)
+	require.NoError(t, err)
+	require.Equal(t, []string{"SHA256:vU4KObIERgY4g+cf10p739H2p6JZVkfgLxkrSGaGMKA"}, s.HostKeyFingerprints())
+
+	// A key of the same algorithm replaces the previous one.
+	err = s.UpdateHostSigner(42, agentssh.WithKeyBits(3072))
+	require.NoError(t, err)
+	require.Equal(t, []string{"SHA256:Ifn7bKGvyy0bZLxkeTo3ljZcbZOwTHjLB7L37YkE+pg"}, s.HostKeyFingerprints())
+}
+
+// BenchmarkCoderSigner measures the generation of host keys of each size.
+func BenchmarkCoderSigner(b *testing.B) {
+	for _, bits := range []int{2048, 3072, 4096} {
+		b.Run(fmt.Sprint(bits), func(b *testing.B) {
+			for i := range b.N {
+				_, err := agentssh.CoderSignerWithOptions(int64(i), agentssh.WithKeyBits(bits))
+				require.NoError(b, err)
+			}
+		})
+	}
 }
@@ -0,0 +1,72 @@
+package agentssh
+
+import (
+	"context"
+	"sync"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/v2/codersdk"
+)
+
+// bannerCache holds the last banners returned by Config.AnnouncementBanners,
+// so that logins don't wait for a slow implementation.
+type bannerCache struct {
+	mu       sync.Mutex
+	last     *[]codersdk.BannerConfig
+	inflight *bannerFetch
+}
+
+// bannerFetch is a call of Config.AnnouncementBanners, shared by the logins
+// waiting for it.
+type bannerFetch struct {
+	done    chan struct{}
+	banners *[]codersdk.BannerConfig
+	err     error
+}
+
+// globalAnnouncementBanners returns the banners of Config.AnnouncementBanners.
+// If it doesn't return within Config.BannerFetchTimeout or panics, the last
+// banners it returned are used instead, or none.
+func (s *Server) globalAnnouncementBanners(ctx context.Context, logger slog.Logger) *[]codersdk.BannerConfig {
+	s.banners.mu.Lock()
+	f := s.banners.inflight
+	if f == nil {
+		f = &bannerFetch{done: make(chan struct{})}
+		s.banners.inflight = f
+		go s.fetchBanners(f)
+	}
+	s.banners.mu.Unlock()
+
+	t := s.config.Clock.NewTimer(s.config.BannerFetchTimeout, "banners", "fetch")
+	defer t.Stop()
+	select {
+	case <-f.done:
+		if f.err == nil {
+			return f.banners
+		}
+	case <-t.C:
+		logger.Debug(ctx, "announcement banners not fetched in time, using last known banners",
+			slog.F("timeout", s.config.BannerFetchTimeout))
+	}
+
+	s.banners.mu.Lock()
+	defer s.banners.mu.Unlock()
+	return s.banners.last
+}
+
+// fetchBanners calls Config.AnnouncementBanners and caches the result.
+func (s *Server) fetchBanners(f *bannerFetch) {
+	defer func() {
+		if r := recover(); r != nil {
+			f.err = s.callbackPanicked(context.Background(), s.logger, "AnnouncementBanners", r)
+		}
+		s.banners.mu.Lock()
+		if f.err == nil {
+			s.banners.last = f.banners
+		}
+		s.banners.inflight = nil
+		s.banners.mu.Unlock()
+		close(f.done)
+	}()
+	f.banners = s.config.AnnouncementBanners()
+}
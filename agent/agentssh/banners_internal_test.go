@@ -0,0 +1,106 @@
+package agentssh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"cdr.dev/slog/sloggers/slogtest"
+
+	"github.com/coder/coder/v2/agent/agentexec"
+	"github.com/coder/coder/v2/codersdk"
+	"github.com/coder/coder/v2/testutil"
+	"github.com/coder/quartz"
+)
+
+func Test_globalAnnouncementBanners(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	// The panic is logged as an error.
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	clk := quartz.NewMock(t)
+
+	var mode atomic.String
+	release := make(chan struct{})
+	s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &Config{
+		Clock:              clk,
+		BannerFetchTimeout: time.Second,
+		AnnouncementBanners: func() *[]codersdk.BannerConfig {
+			switch mode.Load() {
+			case "slow":
+				<-release
+				return &[]codersdk.BannerConfig{{Enabled: true, Message: "slow"}}
+			case "panic":
+				panic("boom")
+			default:
+				return &[]codersdk.BannerConfig{{Enabled: true, Message: "fast"}}
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	message := func(banners *[]codersdk.BannerConfig) string {
+		if banners == nil {
+			return ""
+		}
+		return (*banners)[0].Message
+	}
+
+	// A callback that panics before anything was cached shows no banners.
+	mode.Store("panic")
+	require.Nil(t, s.globalAnnouncementBanners(ctx, logger))
+
+	mode.Store("fast")
+	require.Equal(t, "fast", message(s.globalAnnouncementBanners(ctx, logger)))
+
+	// A slow callback doesn't delay logins past the timeout, the last
+	// banners are used instead.
+	mode.Store("slow")
+	trap := clk.Trap().NewTimer("banners", "fetch")
+	defer trap.Close()
+	result := make(chan *[]codersdk.BannerConfig, 1)
+	go func() {
+		result <- s.globalAnnouncementBanners(ctx, logger)
+	}()
+	trap.MustWait(ctx).MustRelease(ctx)
+	clk.Advance(time.Second).MustWait(ctx)
+	require.Equal(t, "fast", message(testutil.RequireReceive(ctx, t, result)))
+
+	// Logins during the fetch wait for the same call.
+	go func() {
+		result <- s.globalAnnouncementBanners(ctx, logger)
+	}()
+	trap.MustWait(ctx).MustRelease(ctx)
+	close(release)
+	require.Equal(t, "slow", message(testutil.RequireReceive(ctx, t, result)))
+
+	// A panic keeps the last banners.
+	trap.Close()
+	mode.Store("panic")
+	require.Equal(t, "slow", message(s.globalAnnouncementBanners(ctx, logger)))
+}
+
+func Test_sanitizeBanner(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := slogtest.Make(t, nil)
+	s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &Config{
+		MOTDMaxBytes: 16,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	banner := s.sanitizeBanner(ctx, logger, codersdk.BannerConfig{Enabled: true, Message: "\x1b[1mMaintenance\x1b[0m tonight"})
+	require.Equal(t, "Maintenance\n", banner.Message)
+	require.True(t, banner.Enabled)
+
+	banner = s.sanitizeBanner(ctx, logger, codersdk.BannerConfig{Enabled: true, Message: "\x00\x01\x02"})
+	require.Equal(t, "Announcement banner not shown: it appears to be binary.", banner.Message)
+}
@@ -0,0 +1,63 @@
+package agentssh
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"unicode/utf8"
+
+	"cdr.dev/slog"
+)
+
+// maxCallbackPanicBytes limits the panic value of a Config callback in the
+// error and log, it may be arbitrarily large.
+const maxCallbackPanicBytes = 256
+
+// callbackPanicError is returned by recoverCallback if the callback panicked.
+type callbackPanicError struct {
+	callback string
+	value    string
+}
+
+func (e *callbackPanicError) Error() string {
+	return fmt.Sprintf("%s callback panicked: %s", e.callback, e.value)
+}
+
+// recoverCallback calls fn, which calls the Config callback named callback,
+// and returns a panic of fn as a *callbackPanicError instead of crashing the
+// agent.
+func recoverCallback[T any](ctx context.Context, s *Server, logger slog.Logger, callback string, fn func() (T, error)) (v T, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.callbackPanicked(ctx, logger, callback, r)
+		}
+	}()
+	return fn()
+}
+
+// callbackPanicked logs the panic r of the Config callback named callback
+// with the stack of the panicking goroutine, counts it and returns it as an
+// error. It must be called from the deferred function that recovered r.
+func (s *Server) callbackPanicked(ctx context.Context, logger slog.Logger, callback string, r any) error {
+	value := truncateCallbackPanic(fmt.Sprint(r))
+	logger.Error(ctx, "config callback panicked",
+		slog.F("callback", callback),
+		slog.F("panic", value),
+		slog.F("stack", string(debug.Stack())),
+	)
+	s.metrics.callbackPanics.WithLabelValues(callback).Add(1)
+	return &callbackPanicError{callback: callback, value: value}
+}
+
+// truncateCallbackPanic truncates value to maxCallbackPanicBytes, without
+// splitting a UTF-8 character.
+func truncateCallbackPanic(value string) string {
+	if len(value) <= maxCallbackPanicBytes {
+		return value
+	}
+	n := maxCallbackPanicBytes
+	for n > 0 && !utf8.RuneStart(value[n]) {
+		n--
+	}
+	return value[:n] + "...(truncated)"
+}
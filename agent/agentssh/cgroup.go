@@ -0,0 +1,106 @@
+package agentssh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+// SessionResourceUsage is the resource usage of the processes of a session,
+// read from its cgroup when the session ends.
+type SessionResourceUsage struct {
+	// CPUTime is the user and system CPU time used.
+	CPUTime time.Duration
+	// MemoryPeakBytes is the peak memory usage, or zero if the memory
+	// controller isn't enabled for the cgroup.
+	MemoryPeakBytes int64
+}
+
+// cgroupShimScript moves the shell into the cgroup before executing the
+// command passed as arguments, so that all processes of the session are
+// created in it. Failing to move is ignored, the command still runs.
+const cgroupShimScript = `{ echo 0 > '%s'; } 2>/dev/null; exec "$0" "$@"`
+
+// sessionCgroupsDir is the directory below the cgroup of the agent in which
+// the cgroups of sessions are created.
+const sessionCgroupsDir = "coder-ssh-sessions"
+
+// sessionCgroups creates a cgroup v2 per session below the cgroup of the
+// agent, which must be writable, e.g. delegated by systemd.
+type sessionCgroups struct {
+	logger slog.Logger
+	dir    string
+}
+
+// create creates the cgroup of a session.
+func (c *sessionCgroups) create(id uuid.UUID) (*sessionCgroup, error) {
+	path := filepath.Join(c.dir, id.String())
+	if err := os.Mkdir(path, 0o755); err != nil {
+		return nil, xerrors.Errorf("create session cgroup: %w", err)
+	}
+	return &sessionCgroup{logger: c.logger, path: path}, nil
+}
+
+// removeStale removes the empty cgroups left behind by previous agents.
+// Cgroups that still contain processes can't be removed.
+func (c *sessionCgroups) removeStale() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			_ = os.Remove(filepath.Join(c.dir, e.Name()))
+		}
+	}
+}
+
+type sessionCgroup struct {
+	logger slog.Logger
+	path   string
+}
+
+// wrap wraps the command in a shell moving itself into the cgroup.
+func (g *sessionCgroup) wrap(path string, args []string) (string, []string) {
+	shim := fmt.Sprintf(cgroupShimScript, filepath.Join(g.path, "cgroup.procs"))
+	return "/bin/sh", append([]string{"/bin/sh", "-c", shim, path}, args[1:]...)
+}
+
+// usage reads the resource usage of the cgroup.
+func (g *sessionCgroup) usage() *SessionResourceUsage {
+	var u SessionResourceUsage
+	if b, err := os.ReadFile(filepath.Join(g.path, "cpu.stat")); err == nil {
+		for _, line := range bytes.Split(b, []byte("\n")) {
+			if v, ok := bytes.CutPrefix(line, []byte("usage_usec ")); ok {
+				usec, _ := strconv.ParseInt(string(v), 10, 64)
+				u.CPUTime = time.Duration(usec) * time.Microsecond
+			}
+		}
+	}
+	// memory.peak was added in Linux 5.19.
+	for _, name := range []string{"memory.peak", "memory.current"} {
+		if b, err := os.ReadFile(filepath.Join(g.path, name)); err == nil {
+			u.MemoryPeakBytes, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+			break
+		}
+	}
+	return &u
+}
+
+// remove removes the cgroup, which fails if processes are still running
+// in it.
+func (g *sessionCgroup) remove(ctx context.Context) {
+	if err := os.Remove(g.path); err != nil {
+		g.logger.Debug(ctx, "session cgroup not removed", slog.F("cgroup", g.path), slog.Error(err))
+	}
+}
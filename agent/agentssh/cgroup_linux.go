@@ -0,0 +1,98 @@
+package agentssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// newSessionCgroups returns nil if the cgroup of the agent isn't a writable
+// cgroup v2, in which case sessions aren't placed in cgroups.
+func newSessionCgroups(ctx context.Context, logger slog.Logger) *sessionCgroups {
+	own, err := ownCgroup()
+	if err != nil {
+		logger.Debug(ctx, "session cgroups unavailable", slog.Error(err))
+		return nil
+	}
+	dir := filepath.Join(cgroupRoot, own, sessionCgroupsDir)
+	if err := os.Mkdir(dir, 0o755); err != nil && !os.IsExist(err) {
+		logger.Debug(ctx, "session cgroups unavailable", slog.Error(err))
+		return nil
+	}
+	// Accounting of memory requires the controller, which can only be
+	// enabled if the parent enables it for us.
+	_ = os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+memory"), 0)
+
+	c := &sessionCgroups{logger: logger, dir: dir}
+	c.removeStale()
+	return c
+}
+
+// ownCgroup returns the cgroup v2 path of the agent process.
+func ownCgroup() (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", xerrors.Errorf("cgroup v2 not mounted: %w", err)
+	}
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", xerrors.Errorf("read own cgroup: %w", err)
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		if path, ok := strings.CutPrefix(sc.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", xerrors.New("no cgroup v2 entry in /proc/self/cgroup")
+}
+
+// kill kills all processes in the cgroup. cgroup.kill was added in Linux
+// 5.14, older kernels kill the processes listed in cgroup.procs until none
+// are left.
+func (g *sessionCgroup) kill(ctx context.Context) {
+	if err := os.WriteFile(filepath.Join(g.path, "cgroup.kill"), []byte("1"), 0); err == nil {
+		g.waitEmpty()
+		return
+	}
+	for range 10 {
+		b, err := os.ReadFile(filepath.Join(g.path, "cgroup.procs"))
+		if err != nil {
+			g.logger.Warn(ctx, "failed to read session cgroup processes", slog.F("cgroup", g.path), slog.Error(err))
+			return
+		}
+		pids := strings.Fields(string(b))
+		if len(pids) == 0 {
+			return
+		}
+		for _, p := range pids {
+			if pid, err := strconv.Atoi(p); err == nil {
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitEmpty waits briefly for killed processes to leave the cgroup, so
+// that it can be removed.
+func (g *sessionCgroup) waitEmpty() {
+	for range 10 {
+		b, err := os.ReadFile(filepath.Join(g.path, "cgroup.events"))
+		if err != nil || bytes.Contains(b, []byte("populated 0")) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,86 @@
+package agentssh_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+
+	"github.com/coder/coder/v2/agent/agentexec"
+	"github.com/coder/coder/v2/agent/agentssh"
+	"github.com/coder/coder/v2/agent/agentssh/sshtest"
+	"github.com/coder/coder/v2/testutil"
+)
+
+func TestNewServer_SessionCgroup(t *testing.T) {
+	t.Parallel()
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		t.Skip("cgroup v2 is not mounted")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	ended := make(chan agentssh.SessionMetadata, 1)
+	s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		SessionCgroup: true,
+		OnSessionEnd:  func(m agentssh.SessionMetadata) { ended <- m },
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	assert.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := s.Serve(ln)
+		assert.Error(t, err) // Server is closed.
+	}()
+
+	// The background process leaves the process group of the shell, so
+	// only the cgroup can kill it.
+	sess, _ := sshtest.DialSession(ctx, t, ln.Addr().String(), sshtest.WithPTY("xterm", 80, 24))
+	var stdout bytes.Buffer
+	sess.Stdout = &stdout
+	sess.Stdin = strings.NewReader("setsid sh -c 'echo PID=$$; exec sleep 1000' &\nsleep 1; exit\n")
+	err = sess.Shell()
+	require.NoError(t, err)
+	_ = sess.Wait()
+
+	meta := testutil.RequireReceive(ctx, t, ended)
+	if meta.ResourceUsage == nil {
+		t.Skip("the cgroup of the test is not writable")
+	}
+
+	m := regexp.MustCompile(`PID=(\d+)`).FindStringSubmatch(stdout.String())
+	require.NotNil(t, m, "output: %q", stdout.String())
+	pid, err := strconv.Atoi(m[1])
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			return true
+		}
+		// Killed processes may not be reaped yet.
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		return len(fields) > 0 && fields[0] == "Z"
+	}, testutil.WaitShort, testutil.IntervalFast)
+
+	err = s.Close()
+	require.NoError(t, err)
+	<-done
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package agentssh
+
+import (
+	"context"
+
+	"cdr.dev/slog"
+)
+
+// newSessionCgroups returns nil, cgroups are only supported on Linux.
+func newSessionCgroups(context.Context, slog.Logger) *sessionCgroups {
+	return nil
+}
+
+func (*sessionCgroup) kill(context.Context) {}
@@ -0,0 +1,112 @@
+package agentssh
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"cdr.dev/slog"
+
+	"github.com/coder/quartz"
+)
+
+// maxCloseStackBytes limits the goroutine stacks logged when Close times
+// out.
+const maxCloseStackBytes = 1 << 20
+
+// closePhases times the phases of Server.Close. The phases run one after
+// another, but the current one is read when Close times out.
+type closePhases struct {
+	logger  slog.Logger
+	clock   quartz.Clock
+	summary *prometheus.SummaryVec
+
+	mu        sync.Mutex
+	current   string
+	startedAt time.Time
+	fields    []slog.Field
+}
+
+func newClosePhases(logger slog.Logger, clock quartz.Clock, summary *prometheus.SummaryVec) *closePhases {
+	return &closePhases{logger: logger, clock: clock, summary: summary}
+}
+
+// start ends the current phase, if any, and starts the next one.
+func (p *closePhases) start(phase string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endLocked()
+	p.current = phase
+	p.startedAt = p.clock.Now()
+}
+
+// end ends the current phase.
+func (p *closePhases) end() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endLocked()
+}
+
+func (p *closePhases) endLocked() {
+	if p.current == "" {
+		return
+	}
+	d := p.clock.Since(p.startedAt)
+	p.logger.Debug(context.Background(), "close phase done", slog.F("phase", p.current), slog.F("duration", d))
+	p.summary.WithLabelValues(p.current).Observe(d.Seconds())
+	p.fields = append(p.fields, slog.F(p.current, d))
+	p.current = ""
+}
+
+// running returns the phase that didn't end yet, or an empty string.
+func (p *closePhases) running() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current
+}
+
+// durations returns the duration of each phase that ended, as log fields.
+func (p *closePhases) durations() []slog.Field {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]slog.Field(nil), p.fields...)
+}
+
+// trackedCounts describes what the server still tracks, e.g.
+// "sessions=1, conns=2". Empty categories are omitted.
+func (s *Server) trackedCounts() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var counts []string
+	for _, c := range []struct {
+		name string
+		n    int
+	}{
+		{"listeners", len(s.listeners)},
+		{"conns", len(s.conns)},
+		{"sessions", len(s.sessions)},
+		{"processes", len(s.processes)},
+		{"agent_listeners", len(s.agentListeners)},
+	} {
+		if c.n > 0 {
+			counts = append(counts, fmt.Sprintf("%s=%d", c.name, c.n))
+		}
+	}
+	if len(counts) == 0 {
+		// E.g. a pre-warmed shell or a drained session.
+		return "untracked goroutines"
+	}
+	return strings.Join(counts, ", ")
+}
+
+// goroutineStacks returns the stacks of all goroutines of the process,
+// truncated to maxCloseStackBytes.
+func goroutineStacks() string {
+	buf := make([]byte, maxCloseStackBytes)
+	return string(buf[:runtime.Stack(buf, true)])
+}
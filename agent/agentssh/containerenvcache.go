@@ -0,0 +1,130 @@
+package agentssh
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coder/coder/v2/agent/agentexec"
+	"github.com/coder/coder/v2/agent/usershell"
+	"github.com/coder/quartz"
+)
+
+// DefaultContainerEnvCacheTTL is the default value of
+// Config.ContainerEnvCacheTTL.
+const DefaultContainerEnvCacheTTL = 5 * time.Minute
+
+type containerEnvKey struct {
+	container string
+	user      string
+}
+
+type containerEnvEntry struct {
+	// done is closed once the lookup finished, ei and err are only set
+	// then.
+	done      chan struct{}
+	ei        usershell.EnvInfoer
+	err       error
+	instance  string
+	expiresAt time.Time
+}
+
+// containerEnvCache caches the environment of containers across sessions,
+// since looking it up runs several commands in the container. An entry is
+// used until its TTL expires or the container is recreated or restarted,
+// which is detected by inspecting the container for each session.
+// Concurrent sessions share a single lookup.
+type containerEnvCache struct {
+	clock quartz.Clock
+	ttl   time.Duration
+	// lookup and instance are agentcontainers.EnvInfo and
+	// agentcontainers.ContainerInstance.
+	lookup   func(ctx context.Context, execer agentexec.Execer, container, containerUser string) (usershell.EnvInfoer, error)
+	instance func(ctx context.Context, execer agentexec.Execer, container string) (string, error)
+
+	mu      sync.Mutex
+	entries map[containerEnvKey]*containerEnvEntry
+}
+
+func newContainerEnvCache(
+	clock quartz.Clock,
+	ttl time.Duration,
+	lookup func(ctx context.Context, execer agentexec.Execer, container, containerUser string) (usershell.EnvInfoer, error),
+	instance func(ctx context.Context, execer agentexec.Execer, container string) (string, error),
+) *containerEnvCache {
+	return &containerEnvCache{
+		clock:    clock,
+		ttl:      ttl,
+		lookup:   lookup,
+		instance: instance,
+		entries:  make(map[containerEnvKey]*containerEnvEntry),
+	}
+}
+
+// get returns the environment of the user in the container. Failed lookups
+// aren't cached, but are returned to the sessions that waited for them.
+func (c *containerEnvCache) get(ctx context.Context, execer agentexec.Execer, container, containerUser string) (usershell.EnvInfoer, error) {
+	if c.ttl < 0 {
+		return c.lookup(ctx, execer, container, containerUser)
+	}
+	instance, err := c.instance(ctx, execer, container)
+	if err != nil {
+		// The lookup fails the same way if the container is gone.
+		c.invalidate(container)
+		return c.lookup(ctx, execer, container, containerUser)
+	}
+
+	key := containerEnvKey{container: container, user: containerUser}
+	c.mu.Lock()
+	now := c.clock.Now()
+	for k, e := range c.entries {
+		if e.isDone() && (!now.Before(e.expiresAt) || k.container == container && e.instance != instance) {
+			delete(c.entries, k)
+		}
+	}
+	e, ok := c.entries[key]
+	if !ok {
+		e = &containerEnvEntry{done: make(chan struct{}), instance: instance}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+
+	if ok {
+		select {
+		case <-e.done:
+			return e.ei, e.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	e.ei, e.err = c.lookup(ctx, execer, container, containerUser)
+	c.mu.Lock()
+	e.expiresAt = c.clock.Now().Add(c.ttl)
+	if e.err != nil && c.entries[key] == e {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	close(e.done)
+	return e.ei, e.err
+}
+
+// invalidate removes the finished entries of the container.
+func (c *containerEnvCache) invalidate(container string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if k.container == container && e.isDone() {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func (e *containerEnvEntry) isDone() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,236 @@
+package agentssh
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/v2/agent/agentcontainers"
+	"github.com/coder/coder/v2/agent/agentexec"
+	"github.com/coder/coder/v2/agent/usershell"
+	"github.com/coder/coder/v2/pty"
+	"github.com/coder/coder/v2/testutil"
+	"github.com/coder/quartz"
+)
+
+// dockerExecer fakes the docker commands run to look up the environment of
+// a container, and counts them.
+type dockerExecer struct {
+	mu       sync.Mutex
+	instance string
+	calls    map[string]int
+}
+
+func newDockerExecer() *dockerExecer {
+	return &dockerExecer{instance: "abc123 2025-01-01T00:00:00Z", calls: map[string]int{}}
+}
+
+func (d *dockerExecer) CommandContext(ctx context.Context, cmd string, args ...string) *exec.Cmd {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	line := strings.Join(append([]string{cmd}, args...), " ")
+	var kind, out string
+	switch {
+	case strings.HasPrefix(line, "docker container inspect"):
+		kind, out = "instance", d.instance
+	case strings.HasSuffix(line, "whoami"):
+		kind, out = "whoami", "coder"
+	case strings.HasSuffix(line, "cat /etc/passwd"):
+		kind, out = "passwd", "coder:x:1000:1000::/home/coder:/bin/bash"
+	case strings.HasPrefix(line, "docker inspect"):
+		kind, out = "inspect", `[{"Id":"abc123"}]`
+	default:
+		kind, out = line, ""
+	}
+	d.calls[kind]++
+	return exec.CommandContext(ctx, "echo", out)
+}
+
+func (*dockerExecer) PTYCommandContext(ctx context.Context, cmd string, args ...string) *pty.Cmd {
+	return pty.CommandContext(ctx, cmd, args...)
+}
+
+func (d *dockerExecer) setInstance(instance string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.instance = instance
+}
+
+// probes returns the number of probes run in the container.
+func (d *dockerExecer) probes() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls["whoami"] + d.calls["passwd"] + d.calls["inspect"]
+}
+
+func newTestContainerEnvCache(clock quartz.Clock, ttl time.Duration) *containerEnvCache {
+	return newContainerEnvCache(clock, ttl, func(ctx context.Context, execer agentexec.Execer, container, containerUser string) (usershell.EnvInfoer, error) {
+		return agentcontainers.EnvInfo(ctx, execer, container, containerUser)
+	}, agentcontainers.ContainerInstance)
+}
+
+func Test_containerEnvCache(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("fakes docker with echo")
+	}
+
+	t.Run("Reused", func(t *testing.T) {
+		t.Parallel()
+		ctx := testutil.Context(t, testutil.WaitShort)
+		execer := newDockerExecer()
+		cache := newTestContainerEnvCache(quartz.NewMock(t), time.Minute)
+
+		ei, err := cache.get(ctx, execer, "dev", "")
+		require.NoError(t, err)
+		u, err := ei.User(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "coder", u.Username)
+		require.Equal(t, 3, execer.probes())
+
+		// The second session only checks that the container is the same.
+		ei2, err := cache.get(ctx, execer, "dev", "")
+		require.NoError(t, err)
+		require.Same(t, ei, ei2)
+		require.Equal(t, 3, execer.probes())
+		require.Equal(t, 2, execer.calls["instance"])
+
+		// Other users are looked up separately.
+		_, err = cache.get(ctx, execer, "dev", "coder")
+		require.NoError(t, err)
+		require.Equal(t, 5, execer.probes())
+	})
+
+	t.Run("Restarted", func(t *testing.T) {
+		t.Parallel()
+		ctx := testutil.Context(t, testutil.WaitShort)
+		execer := newDockerExecer()
+		cache := newTestContainerEnvCache(quartz.NewMock(t), time.Minute)
+
+		_, err := cache.get(ctx, execer, "dev", "")
+		require.NoError(t, err)
+		execer.setInstance("abc123 2025-01-01T01:00:00Z")
+		_, err = cache.get(ctx, execer, "dev", "")
+		require.NoError(t, err)
+		require.Equal(t, 6, execer.probes())
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		t.Parallel()
+		ctx := testutil.Context(t, testutil.WaitShort)
+		clock := quartz.NewMock(t)
+		execer := newDockerExecer()
+		cache := newTestContainerEnvCache(clock, time.Minute)
+
+		_, err := cache.get(ctx, execer, "dev", "")
+		require.NoError(t, err)
+		clock.Advance(time.Minute)
+		_, err = cache.get(ctx, execer, "dev", "")
+		require.NoError(t, err)
+		require.Equal(t, 6, execer.probes())
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Parallel()
+		ctx := testutil.Context(t, testutil.WaitShort)
+		execer := newDockerExecer()
+		cache := newTestContainerEnvCache(quartz.NewMock(t), -1)
+
+		for range 2 {
+			_, err := cache.get(ctx, execer, "dev", "")
+			require.NoError(t, err)
+		}
+		require.Equal(t, 6, execer.probes())
+		require.Zero(t, execer.calls["instance"])
+	})
+
+	t.Run("SingleFlight", func(t *testing.T) {
+		t.Parallel()
+		ctx := testutil.Context(t, testutil.WaitShort)
+		var lookups int
+		release := make(chan struct{})
+		cache := newContainerEnvCache(quartz.NewMock(t), time.Minute, func(context.Context, agentexec.Execer, string, string) (usershell.EnvInfoer, error) {
+			lookups++
+			<-release
+			return &usershell.SystemEnvInfo{}, nil
+		}, func(context.Context, agentexec.Execer, string) (string, error) {
+			return "abc123", nil
+		})
+
+		const sessions = 10
+		results := make(chan usershell.EnvInfoer, sessions)
+		for range sessions {
+			go func() {
+				ei, err := cache.get(ctx, nil, "dev", "")
+				if err == nil {
+					results <- ei
+				}
+			}()
+		}
+		require.Eventually(t, func() bool {
+			cache.mu.Lock()
+			defer cache.mu.Unlock()
+			return len(cache.entries) == 1
+		}, testutil.WaitShort, testutil.IntervalFast)
+		close(release)
+		for range sessions {
+			require.NotNil(t, testutil.RequireReceive(ctx, t, results))
+		}
+		require.Equal(t, 1, lookups)
+	})
+
+	t.Run("ErrorNotCached", func(t *testing.T) {
+		t.Parallel()
+		ctx := testutil.Context(t, testutil.WaitShort)
+		var lookups int
+		cache := newContainerEnvCache(quartz.NewMock(t), time.Minute, func(context.Context, agentexec.Execer, string, string) (usershell.EnvInfoer, error) {
+			lookups++
+			if lookups == 1 {
+				return nil, xerrors.New("no such user")
+			}
+			return &usershell.SystemEnvInfo{}, nil
+		}, func(context.Context, agentexec.Execer, string) (string, error) {
+			return "abc123", nil
+		})
+
+		_, err := cache.get(ctx, nil, "dev", "")
+		require.Error(t, err)
+		_, err = cache.get(ctx, nil, "dev", "")
+		require.NoError(t, err)
+		require.Equal(t, 2, lookups)
+	})
+}
+
+func BenchmarkContainerEnvCache(b *testing.B) {
+	if runtime.GOOS == "windows" {
+		b.Skip("fakes docker with echo")
+	}
+
+	for _, bb := range []struct {
+		name string
+		ttl  time.Duration
+	}{
+		{name: "Cached", ttl: time.Minute},
+		{name: "Uncached", ttl: -1},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			ctx := context.Background()
+			execer := newDockerExecer()
+			cache := newTestContainerEnvCache(quartz.NewReal(), bb.ttl)
+			b.ResetTimer()
+			for range b.N {
+				_, err := cache.get(ctx, execer, "dev", "")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package agentssh
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufferPool reuses the buffers copying data between sessions and
+// processes, which would otherwise be allocated per session and direction.
+type copyBufferPool struct {
+	pool sync.Pool
+	// poison, if set, overwrites buffers returned to the pool, so that
+	// tests catch buffers used after the copy returned.
+	poison bool
+}
+
+func newCopyBufferPool(size int) *copyBufferPool {
+	return &copyBufferPool{
+		pool: sync.Pool{
+			New: func() any {
+				buf := make([]byte, size)
+				return &buf
+			},
+		},
+	}
+}
+
+// copy is like io.Copy, but uses a buffer from the pool.
+func (p *copyBufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf, _ := p.pool.Get().(*[]byte)
+	defer p.put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+func (p *copyBufferPool) put(buf *[]byte) {
+	if p.poison {
+		for i := range *buf {
+			(*buf)[i] = 0xde
+		}
+	}
+	p.pool.Put(buf)
+}
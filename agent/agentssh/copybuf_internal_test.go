@@ -0,0 +1,59 @@
+package agentssh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Hide io.WriterTo and io.ReaderFrom so that the copy uses the buffer.
+type (
+	onlyReader struct{ io.Reader }
+	onlyWriter struct{ io.Writer }
+)
+
+func Test_copyBufferPool_poison(t *testing.T) {
+	t.Parallel()
+
+	// Poisoned buffers corrupt the output of any copy still using them
+	// after they were returned to the pool, which -race also catches.
+	p := newCopyBufferPool(64)
+	p.poison = true
+
+	var wg sync.WaitGroup
+	for i := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := bytes.Repeat([]byte(fmt.Sprintf("copy %d\n", i)), 1000)
+			var out bytes.Buffer
+			n, err := p.copy(onlyWriter{&out}, onlyReader{bytes.NewReader(data)})
+			assert.NoError(t, err)
+			assert.EqualValues(t, len(data), n)
+			assert.Equal(t, data, out.Bytes())
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkCopyBuffers compares the allocations of copying the output of a
+// short-lived session with and without pooled buffers.
+func BenchmarkCopyBuffers(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 4<<10)
+	copies := map[string]func(io.Writer, io.Reader) (int64, error){
+		"Unpooled": io.Copy,
+		"Pooled":   newCopyBufferPool(32 << 10).copy,
+	}
+	for _, name := range []string{"Unpooled", "Pooled"} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				_, _ = copies[name](onlyWriter{io.Discard}, onlyReader{bytes.NewReader(data)})
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package agentssh
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+// serverDrain is the state of a draining server, see Drain.
+type serverDrain struct {
+	message string
+	// idle is closed once no session is left.
+	idle chan struct{}
+}
+
+// DrainIncompleteError is returned by Drain when its context is done before
+// all sessions ended.
+type DrainIncompleteError struct {
+	// Active is the number of sessions still running.
+	Active int
+	Err    error
+}
+
+func (e *DrainIncompleteError) Error() string {
+	return fmt.Sprintf("%d sessions still active: %s", e.Active, e.Err)
+}
+
+func (e *DrainIncompleteError) Unwrap() error {
+	return e.Err
+}
+
+// Drain prepares the server for a planned shutdown: new sessions are
+// rejected with message, which is also written to the active PTY sessions,
+// and Drain waits until the sessions end on their own. If ctx is done first,
+// a *DrainIncompleteError with the number of sessions still running is
+// returned. Sessions are never closed by Drain, use Close or Shutdown for
+// that. The server keeps draining until it is closed.
+func (s *Server) Drain(ctx context.Context, message string) error {
+	s.stateMu.Lock()
+	s.mu.Lock()
+	if s.closing != nil {
+		s.mu.Unlock()
+		s.stateMu.Unlock()
+		return xerrors.New("server is closed")
+	}
+	report := func() {}
+	if s.drain == nil {
+		s.drain = &serverDrain{idle: make(chan struct{})}
+		s.metrics.draining.Set(1)
+		report = s.setStateLocked(ServerStateDraining)
+	}
+	s.drain.message = message
+	idle := s.drain.idle
+	if len(s.sessions) == 0 {
+		s.drain.signalIdle()
+	}
+	s.logger.Info(ctx, "draining server", slog.F("sessions", len(s.sessions)))
+
+	// Clients may not read the output, so the notice is written in the
+	// background. Close unblocks the writes by closing the sessions.
+	for ss := range s.sessions {
+		if _, _, isPty := ss.Pty(); !isPty || !s.addTrackedLocked() {
+			continue
+		}
+		go func() {
+			defer s.wg.Done()
+			_, _ = fmt.Fprintf(ss, "\r\n%s\r\n", message)
+		}()
+	}
+	s.mu.Unlock()
+	report()
+	s.stateMu.Unlock()
+
+	select {
+	case <-idle:
+		s.logger.Info(ctx, "server drained")
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.RLock()
+	active := len(s.sessions)
+	s.mu.RUnlock()
+	if active == 0 {
+		return nil
+	}
+	s.logger.Info(ctx, "sessions still active after draining", slog.F("sessions", active))
+	return &DrainIncompleteError{Active: active, Err: ctx.Err()}
+}
+
+// draining returns the message of Drain, and whether the server is draining.
+func (s *Server) draining() (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.drain == nil {
+		return "", false
+	}
+	return s.drain.message, true
+}
+
+// signalIdle closes idle, unless it already is. It must be called with the
+// mu of the server held.
+func (d *serverDrain) signalIdle() {
+	select {
+	case <-d.idle:
+	default:
+		close(d.idle)
+	}
+}
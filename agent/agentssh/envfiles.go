@@ -0,0 +1,80 @@
+package agentssh
+
+import (
+	"bufio"
+	"context"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"cdr.dev/slog"
+)
+
+// DefaultEnvironmentDirs are the directories searched for environment
+// files by default, see Config.EnvironmentDirs.
+var DefaultEnvironmentDirs = []string{"/etc/coder/environment.d"}
+
+var (
+	envNameRegex      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	envReferenceRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// environmentFiles returns the variables set by the *.conf files in the
+// environment directories, in lexical order of the files per directory.
+// Each file contains KEY=VALUE lines, blank lines and lines starting with #
+// are ignored. ${VAR} in values is expanded using env and the variables
+// set before. Malformed lines are logged and skipped.
+func (s *Server) environmentFiles(env []string) []string {
+	ctx := context.Background()
+	var vars []string
+	lookup := func(name string) string {
+		for _, kvs := range [][]string{vars, env} {
+			for i := len(kvs) - 1; i >= 0; i-- {
+				if v, ok := strings.CutPrefix(kvs[i], name+"="); ok {
+					return v
+				}
+			}
+		}
+		return ""
+	}
+	for _, dir := range s.config.EnvironmentDirs {
+		files, err := afero.Glob(s.fs, filepath.Join(dir, "*.conf"))
+		if err != nil {
+			s.logger.Warn(ctx, "list environment files failed", slog.F("dir", dir), slog.Error(err))
+			continue
+		}
+		slices.Sort(files)
+		for _, name := range files {
+			f, err := s.fs.Open(name)
+			if err != nil {
+				s.logger.Warn(ctx, "open environment file failed", slog.F("file", name), slog.Error(err))
+				continue
+			}
+			sc := bufio.NewScanner(f)
+			for line := 1; sc.Scan(); line++ {
+				text := strings.TrimSpace(sc.Text())
+				if text == "" || strings.HasPrefix(text, "#") {
+					continue
+				}
+				key, value, ok := strings.Cut(text, "=")
+				key = strings.TrimSpace(key)
+				if !ok || !envNameRegex.MatchString(key) {
+					s.logger.Warn(ctx, "skipping malformed line in environment file", slog.F("file", name), slog.F("line", line))
+					continue
+				}
+				value = envReferenceRegex.ReplaceAllStringFunc(strings.TrimSpace(value), func(ref string) string {
+					return lookup(ref[2 : len(ref)-1])
+				})
+				vars = append(vars, key+"="+value)
+			}
+			if err := sc.Err(); err != nil {
+				s.logger.Warn(ctx, "read environment file failed", slog.F("file", name), slog.Error(err))
+			}
+			_ = f.Close()
+		}
+	}
+	return vars
+}
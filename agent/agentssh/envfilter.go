@@ -0,0 +1,96 @@
+package agentssh
+
+import (
+	"slices"
+	"strings"
+)
+
+// DefaultAcceptEnv are the client environment variables accepted when
+// Config.FilterClientEnv is set without Config.AcceptEnv: the locale and time
+// zone OpenSSH clients send by default, and the terminal capabilities some
+// terminals send. Embedders can extend a copy of it.
+var DefaultAcceptEnv = []string{"LANG", "LC_*", "TZ", "COLORTERM", "TERM_PROGRAM"}
+
+// agentEnvVars are the client environment variables the server interprets
+// itself and removes before commands start, which are never filtered.
+var agentEnvVars = []string{
+	MagicSessionTypeEnvironmentVariable,
+	ContainerEnvironmentVariable,
+	ContainerUserEnvironmentVariable,
+	ProfileInitEnvironmentVariable,
+	CLIVersionEnvironmentVariable,
+	SessionNameEnvironmentVariable,
+	ExecInEnvironmentVariable,
+	SessionTagsEnvironmentVariable,
+	X11DisplayOffsetEnvironmentVariable,
+	TeeOutputEnvironmentVariable,
+}
+
+// envMatcher matches environment variable names against patterns that are
+// either exact names or prefixes followed by "*".
+type envMatcher struct {
+	exact    map[string]struct{}
+	prefixes []string
+}
+
+func newEnvMatcher(patterns []string) *envMatcher {
+	m := &envMatcher{exact: make(map[string]struct{}, len(patterns))}
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			m.prefixes = append(m.prefixes, prefix)
+			continue
+		}
+		m.exact[p] = struct{}{}
+	}
+	// A prefix covered by a shorter one is redundant, and sorted prefixes
+	// follow the shorter ones covering them.
+	slices.Sort(m.prefixes)
+	prefixes := m.prefixes[:0]
+	for _, p := range m.prefixes {
+		if len(prefixes) == 0 || !strings.HasPrefix(p, prefixes[len(prefixes)-1]) {
+			prefixes = append(prefixes, p)
+		}
+	}
+	m.prefixes = prefixes
+	return m
+}
+
+func (m *envMatcher) match(name string) bool {
+	if _, ok := m.exact[name]; ok {
+		return true
+	}
+	for _, p := range m.prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the variables of env whose names match, and the names of
+// the others.
+func (m *envMatcher) filter(env []string) (accepted []string, dropped []string) {
+	accepted = make([]string, 0, len(env))
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if m.match(name) {
+			accepted = append(accepted, kv)
+		} else {
+			dropped = append(dropped, name)
+		}
+	}
+	return accepted, dropped
+}
+
+// newClientEnvMatcher returns the matcher of the client environment
+// variables accepted with Config.FilterClientEnv, nil if all are accepted.
+func newClientEnvMatcher(config *Config) *envMatcher {
+	if !config.FilterClientEnv {
+		return nil
+	}
+	accept := config.AcceptEnv
+	if accept == nil {
+		accept = DefaultAcceptEnv
+	}
+	return newEnvMatcher(append(slices.Clone(accept), agentEnvVars...))
+}
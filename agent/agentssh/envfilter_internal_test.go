@@ -0,0 +1,115 @@
+package agentssh
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_envMatcher(t *testing.T) {
+	t.Parallel()
+
+	m := newEnvMatcher([]string{"LANG", "LC_*", "LC_ALL*", "GIT_*", "TZ"})
+	require.Equal(t, []string{"GIT_", "LC_"}, m.prefixes)
+
+	for name, want := range map[string]bool{
+		"LANG":        true,
+		"LANGUAGE":    false,
+		"LC_ALL":      true,
+		"LC_":         true,
+		"LC":          false,
+		"GIT_DIR":     true,
+		"TZ":          true,
+		"TZDIR":       false,
+		"":            false,
+		"lang":        false,
+		"LD_PRELOAD":  false,
+		"XLC_MESSAGE": false,
+	} {
+		require.Equal(t, want, m.match(name), name)
+	}
+
+	accepted, dropped := m.filter([]string{"LANG=C.UTF-8", "FOO=bar", "LC_TIME=en_GB.UTF-8", "BAR"})
+	require.Equal(t, []string{"LANG=C.UTF-8", "LC_TIME=en_GB.UTF-8"}, accepted)
+	require.Equal(t, []string{"FOO", "BAR"}, dropped)
+}
+
+func Test_newClientEnvMatcher(t *testing.T) {
+	t.Parallel()
+
+	env := []string{
+		"LANG=en_US.UTF-8",
+		"LC_ALL=en_US.UTF-8",
+		"LC_CTYPE=en_US.UTF-8",
+		"TZ=Europe/Berlin",
+		"COLORTERM=truecolor",
+		"TERM_PROGRAM=iTerm.app",
+		"FOO=bar",
+		"LD_PRELOAD=/tmp/evil.so",
+		MagicSessionTypeEnvironmentVariable + "=vscode",
+		CLIVersionEnvironmentVariable + "=v2.20.0",
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Parallel()
+		require.Nil(t, newClientEnvMatcher(&Config{AcceptEnv: []string{"FOO"}}))
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		t.Parallel()
+		m := newClientEnvMatcher(&Config{FilterClientEnv: true})
+		accepted, dropped := m.filter(env)
+		require.Equal(t, []string{
+			"LANG=en_US.UTF-8",
+			"LC_ALL=en_US.UTF-8",
+			"LC_CTYPE=en_US.UTF-8",
+			"TZ=Europe/Berlin",
+			"COLORTERM=truecolor",
+			"TERM_PROGRAM=iTerm.app",
+			MagicSessionTypeEnvironmentVariable + "=vscode",
+			CLIVersionEnvironmentVariable + "=v2.20.0",
+		}, accepted)
+		require.Equal(t, []string{"FOO", "LD_PRELOAD"}, dropped)
+	})
+
+	t.Run("Extended", func(t *testing.T) {
+		t.Parallel()
+		accept := append([]string{"FOO"}, DefaultAcceptEnv...)
+		m := newClientEnvMatcher(&Config{FilterClientEnv: true, AcceptEnv: accept})
+		_, dropped := m.filter(env)
+		require.Equal(t, []string{"LD_PRELOAD"}, dropped)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		t.Parallel()
+		// A non-nil empty list accepts none but the agent's own variables.
+		m := newClientEnvMatcher(&Config{FilterClientEnv: true, AcceptEnv: []string{}})
+		accepted, _ := m.filter(env)
+		require.Equal(t, []string{
+			MagicSessionTypeEnvironmentVariable + "=vscode",
+			CLIVersionEnvironmentVariable + "=v2.20.0",
+		}, accepted)
+	})
+}
+
+func BenchmarkEnvMatcher_filter(b *testing.B) {
+	env := make([]string, 0, 1000)
+	for i := range 1000 {
+		switch i % 4 {
+		case 0:
+			env = append(env, fmt.Sprintf("LC_VAR%d=en_US.UTF-8", i))
+		case 1:
+			env = append(env, "LANG=en_US.UTF-8")
+		default:
+			env = append(env, fmt.Sprintf("CUSTOM_VAR_%d=value", i))
+		}
+	}
+	m := newClientEnvMatcher(&Config{FilterClientEnv: true})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		_, _ = m.filter(env)
+	}
+}
@@ -0,0 +1,60 @@
+package agentssh_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	gossh "golang.org/x/crypto/ssh"
+
+	"cdr.dev/slog"
+
+	"github.com/coder/coder/v2/agent/agentexec"
+	"github.com/coder/coder/v2/agent/agentssh"
+)
+
+//nolint:revive // Unchecked fmt.Print, as in other examples.
+func ExampleInMemoryListener() {
+	ctx := context.Background()
+	s, err := agentssh.NewServer(ctx, slog.Make(), prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	if err := s.UpdateHostSigner(42); err != nil {
+		panic(err)
+	}
+
+	ln := agentssh.NewInMemoryListener("example")
+	go func() {
+		// Returns once the server is closed.
+		_ = s.Serve(ln)
+	}()
+
+	conn, err := ln.Dial(ctx)
+	if err != nil {
+		panic(err)
+	}
+	sshConn, chans, reqs, err := gossh.NewClientConn(conn, "example", &gossh.ClientConfig{
+		User:            "coder",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(), //nolint:gosec // The example server has a deterministic host key.
+	})
+	if err != nil {
+		panic(err)
+	}
+	client := gossh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		panic(err)
+	}
+	defer sess.Close()
+	out, err := sess.Output("echo hello")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Print(string(out))
+	// Output: hello
+}
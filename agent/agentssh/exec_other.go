@@ -5,11 +5,22 @@ package agentssh
 import (
 	"context"
 	"os"
+	"runtime"
 	"syscall"
 
 	"cdr.dev/slog"
 )
 
+// envSizeHardLimit is the size of the arguments and environment of a command
+// above which exec fails with E2BIG. This is ARG_MAX on macOS, and a quarter
+// of the default 8 MiB stack size limit on Linux.
+var envSizeHardLimit = func() int {
+	if runtime.GOOS == "darwin" {
+		return 1 << 20
+	}
+	return 2 << 20
+}()
+
 func cmdSysProcAttr() *syscall.SysProcAttr {
 	return &syscall.SysProcAttr{
 		Setsid: true,
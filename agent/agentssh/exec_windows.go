@@ -8,6 +8,10 @@ import (
 	"cdr.dev/slog"
 )
 
+// envSizeHardLimit is the size of the arguments and environment of a command
+// above which exec fails. Windows has no such limit for the environment.
+const envSizeHardLimit = 0
+
 func cmdSysProcAttr() *syscall.SysProcAttr {
 	return &syscall.SysProcAttr{}
 }
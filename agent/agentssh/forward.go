@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 	"syscall"
 
@@ -214,7 +215,50 @@ type directStreamLocalPayload struct {
 	Reserved2 uint32
 }
 
-func directStreamLocalHandler(_ *ssh.Server, _ *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+// DefaultDeniedUnixSockets contains the names of sockets that can't be
+// forwarded to by default since they typically grant access to a container
+// runtime shared with the host. Matching names is a heuristic, a socket can
+// be reached under any other name.
+var DefaultDeniedUnixSockets = []string{"docker.sock", "containerd.sock"}
+
+// DefaultDeniedUnixSocketPaths contains the well-known paths of the sockets
+// in DefaultDeniedUnixSockets, which can't be forwarded to by default under
+// any name.
+var DefaultDeniedUnixSocketPaths = []string{"/var/run/docker.sock", "/run/containerd/containerd.sock"}
+
+// defaultUnixSocketForwardPolicy denies forwarding to sockets whose name, or
+// the name of the socket they link to, is in denied, or that are the same
+// file as one of deniedPaths, unless the path is in allowed.
+func defaultUnixSocketForwardPolicy(denied, deniedPaths, allowed []string) func(path string) bool {
+	return func(path string) bool {
+		paths := []string{filepath.Clean(path)}
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			paths = append(paths, resolved)
+		}
+		for _, p := range paths {
+			if slices.Contains(allowed, p) {
+				return true
+			}
+		}
+		for _, p := range paths {
+			if slices.Contains(denied, filepath.Base(p)) {
+				return false
+			}
+		}
+		// The denied paths are looked up every time, since the sockets
+		// may be created after the server starts.
+		if fi, err := os.Stat(path); err == nil {
+			for _, p := range deniedPaths {
+				if dfi, err := os.Stat(p); err == nil && os.SameFile(fi, dfi) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+}
+
+func (s *Server) directStreamLocalHandler(_ *ssh.Server, _ *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
 	var reqPayload directStreamLocalPayload
 	err := gossh.Unmarshal(newChan.ExtraData(), &reqPayload)
 	if err != nil {
@@ -222,6 +266,17 @@ func directStreamLocalHandler(_ *ssh.Server, _ *gossh.ServerConn, newChan gossh.
 		return
 	}
 
+	// A panic of the policy denies the forward.
+	allowed, _ := recoverCallback(ctx, s, s.logger, "UnixSocketForwardPolicy", func() (bool, error) {
+		return s.currentPolicy().unixSocketForwardPolicy(reqPayload.SocketPath), nil
+	})
+	if !allowed {
+		s.logger.Warn(ctx, "unix socket forward denied by policy", slog.F("socket_path", reqPayload.SocketPath))
+		s.metrics.unixForwardsDenied.Add(1)
+		_ = newChan.Reject(gossh.Prohibited, fmt.Sprintf("forwarding to unix socket %q is not allowed", reqPayload.SocketPath))
+		return
+	}
+
 	var dialer net.Dialer
 	dconn, err := dialer.DialContext(ctx, "unix", reqPayload.SocketPath)
 	if err != nil {
@@ -0,0 +1,101 @@
+package agentssh
+
+import (
+	"context"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+const (
+	// greetingTimeout is how long the prompt of a login shell may be
+	// delayed by Config.Greeting.
+	greetingTimeout = 500 * time.Millisecond
+	// greetingMaxBytes is the maximum length of a greeting, longer
+	// greetings are truncated.
+	greetingMaxBytes = 4 << 10
+)
+
+var errGreetingTimeout = xerrors.New("greeting timed out")
+
+// GreetingTemplate returns a Config.Greeting rendering the text/template
+// text with the data returned by data.
+func GreetingTemplate[T any](text string, data func(ctx context.Context) (T, error)) (func(ctx context.Context) (string, error), error) {
+	tmpl, err := template.New("greeting").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, xerrors.Errorf("parse greeting template: %w", err)
+	}
+	return func(ctx context.Context) (string, error) {
+		d, err := data(ctx)
+		if err != nil {
+			return "", xerrors.Errorf("get greeting data: %w", err)
+		}
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, d); err != nil {
+			return "", xerrors.Errorf("render greeting: %w", err)
+		}
+		return sb.String(), nil
+	}, nil
+}
+
+// showGreeting writes the greeting returned by Config.Greeting to the
+// session. Errors and timeouts are logged, but never shown to the user.
+func (s *Server) showGreeting(ctx context.Context, logger slog.Logger, session ptySession, magicTypeLabel string) LoginNotice {
+	text, err := s.renderGreeting(ctx, logger)
+	if err != nil {
+		reason := noticeSkippedGreetingError
+		if xerrors.Is(err, errGreetingTimeout) {
+			reason = noticeSkippedGreetingTimeout
+		}
+		logger.Warn(ctx, "agent failed to render greeting", slog.Error(err))
+		s.metrics.sessionErrors.WithLabelValues(magicTypeLabel, "yes", "greeting").Add(1)
+		return LoginNotice{Kind: LoginNoticeGreeting, SkippedReason: reason}
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return LoginNotice{Kind: LoginNoticeGreeting, SkippedReason: noticeSkippedEmptyGreeting}
+	}
+	if len(text) > greetingMaxBytes {
+		text = strings.ToValidUTF8(text[:greetingMaxBytes], "") + "…"
+	}
+
+	rec := s.newNoticeRecorder(session)
+	err = writeWithCarriageReturn(strings.NewReader(text+"\n\n"), rec, true)
+	if err != nil {
+		logger.Error(ctx, "agent failed to show greeting", slog.Error(err))
+		s.metrics.sessionErrors.WithLabelValues(magicTypeLabel, "yes", "greeting").Add(1)
+	}
+	return rec.notice(LoginNoticeGreeting, err)
+}
+
+// renderGreeting calls Config.Greeting, giving up after greetingTimeout. A
+// panic of the callback is returned as an error.
+func (s *Server) renderGreeting(ctx context.Context, logger slog.Logger) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		text string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		text, err := recoverCallback(ctx, s, logger, "Greeting", func() (string, error) {
+			return s.config.Greeting(ctx)
+		})
+		done <- result{text: text, err: err}
+	}()
+
+	t := s.config.Clock.NewTimer(greetingTimeout, "greeting")
+	defer t.Stop()
+	select {
+	case r := <-done:
+		return r.text, r.err
+	case <-t.C:
+		return "", errGreetingTimeout
+	}
+}
@@ -0,0 +1,73 @@
+package agentssh
+
+import (
+	"context"
+
+	"github.com/gliderlabs/ssh"
+	"go.uber.org/atomic"
+
+	"cdr.dev/slog"
+
+	"github.com/coder/quartz"
+)
+
+// idleTimeoutReason is the close cause of sessions ended by
+// Config.IdleTimeout.
+const idleTimeoutReason = "idle timeout"
+
+// idleTimer cancels the context of a session once the session had no input
+// or output for Config.IdleTimeout.
+type idleTimer struct {
+	clock quartz.Clock
+	// last is the time of the last input or output in Unix nanoseconds.
+	last    atomic.Int64
+	expired atomic.Bool
+}
+
+// enforceIdleTimeout returns a context that is canceled along with parent, or
+// once the session had no activity for Config.IdleTimeout. The idle timer
+// is nil if there is no timeout.
+func (s *Server) enforceIdleTimeout(parent context.Context, logger slog.Logger, session ssh.Session, magicType MagicSessionType) (context.Context, *idleTimer, func()) {
+	timeout := s.config.IdleTimeout
+	if timeout <= 0 {
+		return parent, nil, func() {}
+	}
+	ptyLabel := "no"
+	if _, _, isPty := session.Pty(); isPty {
+		ptyLabel = "yes"
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	t := &idleTimer{clock: s.config.Clock}
+	touchActivity(t.clock, &t.last)
+	timer := t.clock.NewTimer(timeout, "session", "idle")
+	go func() {
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			// The timer isn't reset on every read and write, the idle time
+			// is checked when it fires instead.
+			if idle := t.clock.Since(activityTime(&t.last)); idle < timeout {
+				timer.Reset(timeout-idle, "session", "idle")
+				continue
+			}
+			logger.Info(ctx, "terminating session, idle timeout exceeded",
+				slog.F("idle_timeout", timeout))
+			s.metrics.sessionIdleTimeouts.WithLabelValues(magicType.MetricLabel(), ptyLabel).Add(1)
+			t.expired.Store(true)
+			cancel()
+			return
+		}
+	}()
+
+	return ctx, t, cancel
+}
+
+// timedOut reports whether the session was ended for being idle.
+func (t *idleTimer) timedOut() bool {
+	return t != nil && t.expired.Load()
+}
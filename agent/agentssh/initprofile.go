@@ -0,0 +1,172 @@
+package agentssh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/coder/v2/pty"
+	"github.com/coder/quartz"
+)
+
+// SessionInitProfile measures how long the login shell of a session took to
+// initialize, see ProfileInitEnvironmentVariable.
+type SessionInitProfile struct {
+	// Shell is the name of the shell that was started.
+	Shell string
+	// FirstOutput is the time from starting the shell until its first
+	// output, zero if it never wrote anything.
+	FirstOutput time.Duration
+	// Prompt is the time from starting the shell until its first prompt,
+	// zero if no prompt was detected.
+	Prompt time.Duration
+	// PromptDetection is how the prompt was detected: "sentinel" if bash
+	// ran the PROMPT_COMMAND we injected, "pattern" if the output looked
+	// like a prompt, or empty if the prompt wasn't detected. Prompts are
+	// only detected for bash and zsh.
+	PromptDetection string
+}
+
+// Summary returns a one line description of the profile.
+func (p SessionInitProfile) Summary() string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "Shell init (%s): ", p.Shell)
+	if p.FirstOutput == 0 {
+		b.WriteString("no output")
+		return b.String()
+	}
+	_, _ = fmt.Fprintf(&b, "first output after %s", p.FirstOutput.Round(time.Millisecond))
+	if p.PromptDetection != "" {
+		_, _ = fmt.Fprintf(&b, ", prompt after %s", p.Prompt.Round(time.Millisecond))
+	}
+	return b.String()
+}
+
+// initProfileSentinel is an OSC sequence printed by the PROMPT_COMMAND
+// injected into bash. Terminals ignore unknown OSC sequences, but it is
+// stripped from the output when it arrives in a single write.
+const initProfileSentinel = "\x1b]6973;coder-init-done\a"
+
+// initProfilePromptCommand prints initProfileSentinel before the first prompt
+// and removes itself.
+const initProfilePromptCommand = `printf '\033]6973;coder-init-done\a'; unset PROMPT_COMMAND`
+
+// initProfiler records the SessionInitProfile of a login shell from its
+// output.
+type initProfiler struct {
+	clock quartz.Clock
+
+	mu          sync.Mutex
+	start       time.Time
+	knownShell  bool
+	sentinel    bool
+	profile     SessionInitProfile
+	promptFound bool
+}
+
+// newInitProfiler returns a profiler for the login shell cmd. For bash, a
+// PROMPT_COMMAND printing a sentinel is added to the environment, unless
+// one is already set.
+func newInitProfiler(clock quartz.Clock, cmd *pty.Cmd) *initProfiler {
+	shell := strings.TrimPrefix(filepath.Base(unwrapShims(cmd.Path, cmd.Args)), "-")
+	p := &initProfiler{
+		clock:   clock,
+		profile: SessionInitProfile{Shell: shell},
+	}
+	switch shell {
+	case "bash":
+		p.knownShell = true
+		if !envHas(cmd.Env, "PROMPT_COMMAND") {
+			cmd.Env = setEnv(cmd.Env, "PROMPT_COMMAND", initProfilePromptCommand)
+			p.sentinel = true
+		}
+	case "zsh":
+		p.knownShell = true
+	}
+	return p
+}
+
+// begin marks the time the shell is started.
+func (p *initProfiler) begin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.start = p.clock.Now()
+}
+
+// wrap returns a writer recording the output written to w.
+func (p *initProfiler) wrap(w io.Writer) io.Writer {
+	return &initProfileWriter{p: p, w: w}
+}
+
+// observe records output of the shell, returning it without the sentinel.
+func (p *initProfiler) observe(b []byte) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.promptFound || len(b) == 0 {
+		return b
+	}
+	elapsed := p.clock.Since(p.start)
+	if p.profile.FirstOutput == 0 {
+		p.profile.FirstOutput = elapsed
+	}
+	if !p.knownShell {
+		p.promptFound = true
+		return b
+	}
+	if p.sentinel {
+		if i := bytes.Index(b, []byte(initProfileSentinel)); i >= 0 {
+			p.found(elapsed, "sentinel")
+			return slices.Concat(b[:i], b[i+len(initProfileSentinel):])
+		}
+	}
+	if looksLikePrompt(b) {
+		p.found(elapsed, "pattern")
+	}
+	return b
+}
+
+func (p *initProfiler) found(elapsed time.Duration, detection string) {
+	p.promptFound = true
+	p.profile.Prompt = elapsed
+	p.profile.PromptDetection = detection
+}
+
+// result returns the profile recorded so far.
+func (p *initProfiler) result() SessionInitProfile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.profile
+}
+
+// looksLikePrompt reports whether output ends like a typical shell prompt,
+// e.g. "user@host:~$ ".
+func looksLikePrompt(b []byte) bool {
+	s := string(b)
+	for _, suffix := range []string{"$ ", "# ", "% ", "> "} {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+type initProfileWriter struct {
+	p *initProfiler
+	w io.Writer
+}
+
+func (w *initProfileWriter) Write(b []byte) (int, error) {
+	out := w.p.observe(b)
+	if len(out) == 0 {
+		return len(b), nil
+	}
+	if _, err := w.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,181 @@
+package agentssh
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+
+	"go.uber.org/atomic"
+)
+
+// InMemoryNetwork is the network of the addresses of an InMemoryListener and
+// its connections.
+const InMemoryNetwork = "memory"
+
+// InMemoryListener is a net.Listener whose connections are created in memory
+// by Dial, for embedding the server without a network stack, e.g. behind a
+// custom transport. Pass it to Server.Serve.
+//
+// Its address and those of its connections aren't host:port pairs, see
+// InMemoryNetwork. The server reports them as is, e.g. as
+// ConnectionInfo.IP.
+type InMemoryListener struct {
+	name      string
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	dialed    atomic.Uint64
+}
+
+var _ net.Listener = &InMemoryListener{}
+
+// NewInMemoryListener creates a listener whose address is name, and whose
+// connections are named after it.
+func NewInMemoryListener(name string) *InMemoryListener {
+	return &InMemoryListener{
+		name:   name,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept waits for the next call to Dial and returns the server end of the
+// connection.
+func (l *InMemoryListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Dial returns the client end of a new connection once the server has
+// accepted it.
+func (l *InMemoryListener) Dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	remote := inMemoryAddr(l.name + "#" + strconv.FormatUint(l.dialed.Inc(), 10))
+	select {
+	case l.conns <- &inMemoryConn{Conn: server, local: l.Addr(), remote: remote}:
+		return newBufferedConn(&inMemoryConn{Conn: client, local: remote, remote: l.Addr()}), nil
+	case <-l.closed:
+		_ = client.Close()
+		_ = server.Close()
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		_ = client.Close()
+		_ = server.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops accepting connections, pending calls to Dial fail. Connections
+// that were accepted are left open.
+func (l *InMemoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *InMemoryListener) Addr() net.Addr {
+	return inMemoryAddr(l.name)
+}
+
+type inMemoryAddr string
+
+func (inMemoryAddr) Network() string  { return InMemoryNetwork }
+func (a inMemoryAddr) String() string { return string(a) }
+
+type inMemoryConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *inMemoryConn) LocalAddr() net.Addr  { return c.local }
+func (c *inMemoryConn) RemoteAddr() net.Addr { return c.remote }
+
+// bufferedConn buffers writes to one end of a net.Pipe. Both sides of an SSH
+// handshake start by writing their version, which deadlocks on an unbuffered
+// net.Pipe.
+type bufferedConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	closed bool
+	err    error
+}
+
+func newBufferedConn(c net.Conn) *bufferedConn {
+	b := &bufferedConn{Conn: c}
+	b.cond = sync.NewCond(&b.mu)
+	go b.flush()
+	return b
+}
+
+func (b *bufferedConn) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, net.ErrClosed
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	b.buf = append(b.buf, p...)
+	b.cond.Signal()
+	return len(p), nil
+}
+
+func (b *bufferedConn) flush() {
+	for {
+		b.mu.Lock()
+		for len(b.buf) == 0 && !b.closed {
+			b.cond.Wait()
+		}
+		if len(b.buf) == 0 {
+			b.mu.Unlock()
+			return
+		}
+		data := b.buf
+		b.buf = nil
+		b.mu.Unlock()
+
+		if _, err := b.Conn.Write(data); err != nil {
+			b.mu.Lock()
+			b.err = err
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (b *bufferedConn) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Signal()
+	b.mu.Unlock()
+	return b.Conn.Close()
+}
+
+// splitAddr returns the host and port of addr. Addresses that aren't
+// host:port pairs, like those of an InMemoryListener, are returned whole
+// with port 0.
+func splitAddr(addr net.Addr) (host string, port uint32) {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		// #nosec G115 - Safe conversion as TCP port numbers are within uint32 range (0-65535)
+		return tcpAddr.IP.String(), uint32(tcpAddr.Port)
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), 0
+	}
+	p, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return host, 0
+	}
+	return host, uint32(p)
+}
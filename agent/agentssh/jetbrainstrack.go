@@ -4,13 +4,18 @@ import (
 	"context"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/atomic"
 	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
 
 	"cdr.dev/slog"
+
+	"github.com/coder/quartz"
 )
 
 // localForwardChannelData is copied from the ssh package.
@@ -22,18 +27,61 @@ type localForwardChannelData struct {
 	OriginPort uint32
 }
 
+// JetbrainsLivenessOptions configures how a JetbrainsChannelWatcher detects
+// channels whose Gateway backend has gone away without closing them.
+type JetbrainsLivenessOptions struct {
+	// Clock is used for the liveness ticker. Defaults to a real clock.
+	Clock quartz.Clock
+	// StaleThreshold is how long a channel may be stale (no backend process
+	// and no traffic) before it is closed. Zero disables liveness checking.
+	StaleThreshold time.Duration
+	// InspectPort returns the process listening on the given port, or the
+	// zero PortProcess if there is none. Defaults to inspecting the local
+	// process table.
+	InspectPort func(port uint32) (PortProcess, error)
+	// WatchedChannels, if set, tracks the number of watched channels by
+	// "state" ("alive" or "stale").
+	WatchedChannels *prometheus.GaugeVec
+	// LastActivity, if set, is updated with the time of the last traffic
+	// on any watched channel, in Unix nanoseconds.
+	LastActivity *atomic.Int64
+	// Backends, if set, deduplicates channels forwarded to the same
+	// backend process, see JetbrainsBackends.
+	Backends *JetbrainsBackends
+}
+
+// PortProcess is the process listening on a port.
+type PortProcess struct {
+	PID int
+	// StartTime tells processes reusing a PID apart, in clock ticks since
+	// boot on Linux. Zero if unknown.
+	StartTime uint64
+	Cmdline   string
+}
+
 // JetbrainsChannelWatcher is used to track JetBrains port forwarded (Gateway)
 // channels. If the port forward is something other than JetBrains, this struct
 // is a noop.
 type JetbrainsChannelWatcher struct {
 	gossh.NewChannel
+	ctx              context.Context
 	jetbrainsCounter *atomic.Int64
 	logger           slog.Logger
 	originAddr       string
+	destPort         uint32
 	reportConnection reportConnectionFunc
+	liveness         JetbrainsLivenessOptions
+	backend          jetbrainsBackendKey
 }
 
-func NewJetbrainsChannelWatcher(ctx ssh.Context, logger slog.Logger, reportConnection reportConnectionFunc, newChannel gossh.NewChannel, counter *atomic.Int64) gossh.NewChannel {
+func NewJetbrainsChannelWatcher(ctx ssh.Context, logger slog.Logger, reportConnection reportConnectionFunc, newChannel gossh.NewChannel, counter *atomic.Int64, liveness JetbrainsLivenessOptions) gossh.NewChannel {
+	if liveness.Clock == nil {
+		liveness.Clock = quartz.NewReal()
+	}
+	if liveness.InspectPort == nil {
+		liveness.InspectPort = getListeningPortProcess
+	}
+
 	d := localForwardChannelData{}
 	if err := gossh.Unmarshal(newChannel.ExtraData(), &d); err != nil {
 		// If the data fails to unmarshal, do nothing.
@@ -43,7 +91,7 @@ func NewJetbrainsChannelWatcher(ctx ssh.Context, logger slog.Logger, reportConne
 
 	// If we do get a port, we should be able to get the matching PID and from
 	// there look up the invocation.
-	cmdline, err := getListeningPortProcessCmdline(d.DestPort)
+	proc, err := liveness.InspectPort(d.DestPort)
 	if err != nil {
 		logger.Warn(ctx, "failed to inspect port",
 			slog.F("destination_port", d.DestPort),
@@ -53,24 +101,38 @@ func NewJetbrainsChannelWatcher(ctx ssh.Context, logger slog.Logger, reportConne
 
 	// If this is not JetBrains, then we do not need to do anything special.  We
 	// attempt to match on something that appears unique to JetBrains software.
-	if !strings.Contains(strings.ToLower(cmdline), strings.ToLower(MagicProcessCmdlineJetBrains)) {
+	if !isJetbrainsCmdline(proc.Cmdline) {
 		return newChannel
 	}
 
 	logger.Debug(ctx, "discovered forwarded JetBrains process",
-		slog.F("destination_port", d.DestPort))
+		slog.F("destination_port", d.DestPort), slog.F("pid", proc.PID))
+
+	backend := jetbrainsBackendKey{pid: proc.PID, startTime: proc.StartTime}
+	if proc.PID == 0 {
+		// Without an identity every channel is its own backend.
+		backend.channel = uuid.New()
+	}
 
 	return &JetbrainsChannelWatcher{
 		NewChannel:       newChannel,
+		ctx:              ctx,
 		jetbrainsCounter: counter,
 		logger:           logger.With(slog.F("destination_port", d.DestPort)),
 		originAddr:       d.OriginAddr,
+		destPort:         d.DestPort,
 		reportConnection: reportConnection,
+		liveness:         liveness,
+		backend:          backend,
 	}
 }
 
+func isJetbrainsCmdline(cmdline string) bool {
+	return strings.Contains(strings.ToLower(cmdline), strings.ToLower(MagicProcessCmdlineJetBrains))
+}
+
 func (w *JetbrainsChannelWatcher) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
-	disconnected := w.reportConnection(uuid.New(), MagicSessionTypeJetBrains, w.originAddr)
+	disconnected := w.connect()
 
 	c, r, err := w.NewChannel.Accept()
 	if err != nil {
@@ -81,15 +143,216 @@ func (w *JetbrainsChannelWatcher) Accept() (gossh.Channel, <-chan *gossh.Request
 	// nolint: gocritic // JetBrains is a proper noun and should be capitalized
 	w.logger.Debug(context.Background(), "JetBrains watcher accepted channel")
 
-	return &ChannelOnClose{
-		Channel: c,
+	if w.liveness.StaleThreshold <= 0 {
+		if w.liveness.LastActivity != nil {
+			ac := &activityChannel{Channel: c, clock: w.liveness.Clock, shared: w.liveness.LastActivity}
+			ac.touch()
+			c = ac
+		}
+		return &ChannelOnClose{
+			Channel: c,
+			done: func() {
+				w.jetbrainsCounter.Add(-1)
+				disconnected(0, "")
+				// nolint: gocritic // JetBrains is a proper noun and should be capitalized
+				w.logger.Debug(context.Background(), "JetBrains watcher channel closed")
+			},
+		}, r, err
+	}
+
+	ctx, cancel := context.WithCancel(w.ctx)
+	ac := &activityChannel{Channel: c, clock: w.liveness.Clock, shared: w.liveness.LastActivity}
+	ac.touch()
+	state := &jetbrainsChannelState{gauge: w.liveness.WatchedChannels}
+	state.set(jetbrainsChannelAlive)
+	var reason atomic.String
+	wrapped := &ChannelOnClose{
+		Channel: ac,
 		done: func() {
+			cancel()
+			state.set("")
 			w.jetbrainsCounter.Add(-1)
-			disconnected(0, "")
+			disconnected(0, reason.Load())
 			// nolint: gocritic // JetBrains is a proper noun and should be capitalized
 			w.logger.Debug(context.Background(), "JetBrains watcher channel closed")
 		},
-	}, r, err
+	}
+
+	interval := w.liveness.StaleThreshold / 2
+	var staleSince time.Time
+	w.liveness.Clock.TickerFunc(ctx, interval, func() error {
+		now := w.liveness.Clock.Now()
+		proc, err := w.liveness.InspectPort(w.destPort)
+		alive := err == nil && isJetbrainsCmdline(proc.Cmdline)
+		if alive || now.Sub(ac.lastActivity()) < interval {
+			staleSince = time.Time{}
+			state.set(jetbrainsChannelAlive)
+			return nil
+		}
+		if staleSince.IsZero() {
+			staleSince = now
+			state.set(jetbrainsChannelStale)
+			// nolint: gocritic // JetBrains is a proper noun and should be capitalized
+			w.logger.Debug(ctx, "JetBrains watched channel is stale", slog.Error(err))
+		}
+		if now.Sub(staleSince) < w.liveness.StaleThreshold {
+			return nil
+		}
+		// nolint: gocritic // JetBrains is a proper noun and should be capitalized
+		w.logger.Info(ctx, "closing stale JetBrains channel",
+			slog.F("stale_since", staleSince))
+		reason.Store(errJetbrainsChannelStale.Error())
+		_ = wrapped.Close()
+		return errJetbrainsChannelStale
+	}, "jetbrains", "liveness")
+
+	return wrapped, r, err
+}
+
+// connect reports the connection of the channel, or joins the connection of
+// other channels to the same backend.
+func (w *JetbrainsChannelWatcher) connect() func(int, string) {
+	report := func() func(int, string) {
+		return w.reportConnection(uuid.New(), MagicSessionTypeJetBrains, w.originAddr)
+	}
+	if w.liveness.Backends == nil {
+		return report()
+	}
+	return w.liveness.Backends.join(w.backend, report)
+}
+
+// JetbrainsBackends deduplicates watched channels forwarded to the same
+// Gateway backend process. Gateway reconnects often and the channels of the
+// old and new connection overlap, so a backend is reported as connected
+// when its first channel is accepted and as disconnected when its last
+// channel closes.
+type JetbrainsBackends struct {
+	mu       sync.Mutex
+	backends map[jetbrainsBackendKey]*jetbrainsBackend
+	count    atomic.Int64
+}
+
+// jetbrainsBackendKey identifies a backend process, or a channel to a
+// process that couldn't be identified.
+type jetbrainsBackendKey struct {
+	pid       int
+	startTime uint64
+	channel   uuid.UUID
+}
+
+type jetbrainsBackend struct {
+	channels     int
+	disconnected func(int, string)
+}
+
+func NewJetbrainsBackends() *JetbrainsBackends {
+	return &JetbrainsBackends{backends: make(map[jetbrainsBackendKey]*jetbrainsBackend)}
+}
+
+// Count returns the number of backends with open channels.
+func (b *JetbrainsBackends) Count() int64 {
+	return b.count.Load()
+}
+
+// join adds a channel to the backend, calling report if it is the first.
+// The returned func removes the channel, and reports the backend as
+// disconnected if it was the last.
+func (b *JetbrainsBackends) join(key jetbrainsBackendKey, report func() func(int, string)) func(int, string) {
+	b.mu.Lock()
+	backend, ok := b.backends[key]
+	if !ok {
+		backend = &jetbrainsBackend{disconnected: report()}
+		b.backends[key] = backend
+		b.count.Inc()
+	}
+	backend.channels++
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func(code int, reason string) {
+		once.Do(func() {
+			b.mu.Lock()
+			backend.channels--
+			last := backend.channels == 0
+			if last {
+				delete(b.backends, key)
+				b.count.Dec()
+			}
+			b.mu.Unlock()
+			if last {
+				backend.disconnected(code, reason)
+			}
+		})
+	}
+}
+
+const (
+	jetbrainsChannelAlive = "alive"
+	jetbrainsChannelStale = "stale"
+)
+
+var errJetbrainsChannelStale = xerrors.New("stale JetBrains channel")
+
+// jetbrainsChannelState keeps the watched channels gauge in sync with the
+// state of a single channel.
+type jetbrainsChannelState struct {
+	mu    sync.Mutex
+	gauge *prometheus.GaugeVec
+	state string
+}
+
+// set moves the channel to the given state, an empty state removes it.
+func (s *jetbrainsChannelState) set(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gauge == nil || s.state == state {
+		s.state = state
+		return
+	}
+	if s.state != "" {
+		s.gauge.WithLabelValues(s.state).Dec()
+	}
+	if state != "" {
+		s.gauge.WithLabelValues(state).Inc()
+	}
+	s.state = state
+}
+
+// activityChannel records the last time data was read from or written to
+// the channel, also in shared if set.
+type activityChannel struct {
+	gossh.Channel
+	clock  quartz.Clock
+	last   atomic.Int64
+	shared *atomic.Int64
+}
+
+func (c *activityChannel) touch() {
+	now := c.clock.Now().UnixNano()
+	c.last.Store(now)
+	if c.shared != nil {
+		c.shared.Store(now)
+	}
+}
+
+func (c *activityChannel) lastActivity() time.Time {
+	return time.Unix(0, c.last.Load())
+}
+
+func (c *activityChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *activityChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
 }
 
 type ChannelOnClose struct {
@@ -0,0 +1,255 @@
+//go:build !windows
+
+package agentssh
+
+import (
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/coder/coder/v2/testutil"
+	"github.com/coder/quartz"
+)
+
+func TestJetbrainsChannelWatcher_Liveness(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := testutil.Logger(t)
+	clk := quartz.NewMock(t)
+
+	// Fake process table, the JetBrains backend listens on port 5990
+	// until it "hangs".
+	var procMu sync.Mutex
+	procs := map[uint32]PortProcess{5990: {PID: 42, Cmdline: "java -D" + MagicProcessCmdlineJetBrains}}
+	inspect := func(port uint32) (PortProcess, error) {
+		procMu.Lock()
+		defer procMu.Unlock()
+		return procs[port], nil
+	}
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test"}, []string{"state"})
+	var counter atomic.Int64
+	disconnected := make(chan string, 1)
+	report := func(uuid.UUID, MagicSessionType, string) func(int, string) {
+		return func(_ int, reason string) { disconnected <- reason }
+	}
+
+	newChan := &fakeNewChannel{
+		extraData: gossh.Marshal(localForwardChannelData{DestAddr: "127.0.0.1", DestPort: 5990}),
+		channel:   &fakeChannel{},
+	}
+	w := NewJetbrainsChannelWatcher(testSSHContext{ctx}, logger, report, newChan, &counter, JetbrainsLivenessOptions{
+		Clock:           clk,
+		StaleThreshold:  2 * time.Minute,
+		InspectPort:     inspect,
+		WatchedChannels: gauge,
+	})
+	require.IsType(t, &JetbrainsChannelWatcher{}, w)
+
+	ch, _, err := w.Accept()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, counter.Load())
+	require.EqualValues(t, 1, promtestutil.ToFloat64(gauge.WithLabelValues(jetbrainsChannelAlive)))
+
+	// The backend is still running, so the channel stays alive.
+	clk.Advance(time.Minute).MustWait(ctx)
+	require.EqualValues(t, 1, counter.Load())
+	require.EqualValues(t, 1, promtestutil.ToFloat64(gauge.WithLabelValues(jetbrainsChannelAlive)))
+
+	// The backend goes away, the channel becomes stale but is kept open
+	// until the threshold passes.
+	procMu.Lock()
+	delete(procs, 5990)
+	procMu.Unlock()
+	clk.Advance(time.Minute).MustWait(ctx)
+	require.EqualValues(t, 1, counter.Load())
+	require.EqualValues(t, 0, promtestutil.ToFloat64(gauge.WithLabelValues(jetbrainsChannelAlive)))
+	require.EqualValues(t, 1, promtestutil.ToFloat64(gauge.WithLabelValues(jetbrainsChannelStale)))
+
+	clk.Advance(time.Minute).MustWait(ctx)
+	require.EqualValues(t, 1, counter.Load())
+
+	clk.Advance(time.Minute).MustWait(ctx)
+	require.EqualValues(t, 0, counter.Load())
+	require.EqualValues(t, 0, promtestutil.ToFloat64(gauge.WithLabelValues(jetbrainsChannelStale)))
+	require.Equal(t, errJetbrainsChannelStale.Error(), testutil.RequireReceive(ctx, t, disconnected))
+
+	// Closing again is a no-op.
+	_ = ch.Close()
+	require.EqualValues(t, 0, counter.Load())
+}
+
+func TestJetbrainsChannelWatcher_LastActivity(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	clk := quartz.NewMock(t)
+	var counter, lastActivity atomic.Int64
+	report := func(uuid.UUID, MagicSessionType, string) func(int, string) {
+		return func(int, string) {}
+	}
+	newChan := &fakeNewChannel{
+		extraData: gossh.Marshal(localForwardChannelData{DestAddr: "127.0.0.1", DestPort: 5990}),
+		channel:   &fakeChannel{},
+	}
+	w := NewJetbrainsChannelWatcher(testSSHContext{ctx}, testutil.Logger(t), report, newChan, &counter, JetbrainsLivenessOptions{
+		Clock: clk,
+		InspectPort: func(uint32) (PortProcess, error) {
+			return PortProcess{PID: 42, Cmdline: "java -D" + MagicProcessCmdlineJetBrains}, nil
+		},
+		LastActivity: &lastActivity,
+	})
+
+	ch, _, err := w.Accept()
+	require.NoError(t, err)
+	require.Equal(t, clk.Now().UnixNano(), lastActivity.Load())
+
+	// Only traffic is activity.
+	clk.Advance(time.Minute).MustWait(ctx)
+	_, err = ch.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, clk.Now().Add(-time.Minute).UnixNano(), lastActivity.Load())
+	_, err = ch.Write([]byte("x"))
+	require.NoError(t, err)
+	require.Equal(t, clk.Now().UnixNano(), lastActivity.Load())
+	_ = ch.Close()
+}
+
+func TestJetbrainsChannelWatcher_Backends(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := testutil.Logger(t)
+
+	// Fake process table, Gateway forwards port 5990 and 5991 to the same
+	// backend, and port 5992 to another one.
+	backend := PortProcess{PID: 42, StartTime: 1000, Cmdline: "java -D" + MagicProcessCmdlineJetBrains}
+	other := PortProcess{PID: 43, StartTime: 1000, Cmdline: "java -D" + MagicProcessCmdlineJetBrains}
+	procs := map[uint32]PortProcess{5990: backend, 5991: backend, 5992: other}
+	inspect := func(port uint32) (PortProcess, error) {
+		return procs[port], nil
+	}
+
+	var (
+		mu           sync.Mutex
+		connected    []uuid.UUID
+		disconnected []string
+	)
+	report := func(id uuid.UUID, _ MagicSessionType, _ string) func(int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		connected = append(connected, id)
+		return func(_ int, reason string) {
+			mu.Lock()
+			defer mu.Unlock()
+			disconnected = append(disconnected, reason)
+		}
+	}
+	reports := func() (int, []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(connected), slices.Clone(disconnected)
+	}
+
+	var counter atomic.Int64
+	backends := NewJetbrainsBackends()
+	accept := func(port uint32) gossh.Channel {
+		t.Helper()
+		newChan := &fakeNewChannel{
+			extraData: gossh.Marshal(localForwardChannelData{DestAddr: "127.0.0.1", DestPort: port}),
+			channel:   &fakeChannel{},
+		}
+		w := NewJetbrainsChannelWatcher(testSSHContext{ctx}, logger, report, newChan, &counter, JetbrainsLivenessOptions{
+			InspectPort: inspect,
+			Backends:    backends,
+		})
+		ch, _, err := w.Accept()
+		require.NoError(t, err)
+		return ch
+	}
+
+	// Gateway reconnects, the channels of both connections overlap.
+	first := accept(5990)
+	second := accept(5991)
+	require.EqualValues(t, 2, counter.Load())
+	require.EqualValues(t, 1, backends.Count())
+	n, reasons := reports()
+	require.Equal(t, 1, n)
+	require.Empty(t, reasons)
+
+	_ = first.Close()
+	require.EqualValues(t, 1, counter.Load())
+	require.EqualValues(t, 1, backends.Count())
+	_, reasons = reports()
+	require.Empty(t, reasons)
+
+	// Another backend is counted separately.
+	third := accept(5992)
+	require.EqualValues(t, 2, backends.Count())
+	n, _ = reports()
+	require.Equal(t, 2, n)
+
+	// The backend disconnects once its last channel closes.
+	_ = second.Close()
+	require.EqualValues(t, 1, backends.Count())
+	_, reasons = reports()
+	require.Len(t, reasons, 1)
+
+	// A restarted backend reusing the PID is a new backend.
+	procs[5990] = PortProcess{PID: 42, StartTime: 2000, Cmdline: backend.Cmdline}
+	fourth := accept(5990)
+	require.EqualValues(t, 2, backends.Count())
+	n, _ = reports()
+	require.Equal(t, 3, n)
+
+	_ = third.Close()
+	_ = fourth.Close()
+	require.Zero(t, counter.Load())
+	require.Zero(t, backends.Count())
+	_, reasons = reports()
+	require.Len(t, reasons, 3)
+}
+
+type fakeNewChannel struct {
+	extraData []byte
+	channel   gossh.Channel
+}
+
+func (*fakeNewChannel) ChannelType() string { return "direct-tcpip" }
+
+func (c *fakeNewChannel) ExtraData() []byte { return c.extraData }
+
+func (*fakeNewChannel) Reject(gossh.RejectionReason, string) error { return nil }
+
+func (c *fakeNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	return c.channel, make(chan *gossh.Request), nil
+}
+
+type fakeChannel struct {
+	closed atomic.Bool
+}
+
+func (*fakeChannel) Read([]byte) (int, error) { return 0, io.EOF }
+
+func (*fakeChannel) Write(p []byte) (int, error) { return len(p), nil }
+
+func (c *fakeChannel) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func (*fakeChannel) CloseWrite() error { return nil }
+
+func (*fakeChannel) SendRequest(string, bool, []byte) (bool, error) { return false, nil }
+
+func (*fakeChannel) Stderr() io.ReadWriter { return nil }
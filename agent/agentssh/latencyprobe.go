@@ -0,0 +1,272 @@
+package agentssh
+
+import (
+	"io"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/coder/quartz"
+)
+
+// latencyProbeRequest is the device status report asking the terminal for
+// the cursor position, which doesn't display anything.
+const latencyProbeRequest = "\x1b[6n"
+
+// latencyProbeMaxMisses is the number of consecutive unanswered probes after
+// which a session isn't probed anymore, since its terminal doesn't reply.
+const latencyProbeMaxMisses = 3
+
+// cursorPositionReport matches the reply of the terminal to
+// latencyProbeRequest.
+var cursorPositionReport = regexp.MustCompile(`\x1b\[\d+;\d+R`)
+
+// latencyProbe measures the round trip to the terminal of a PTY session, see
+// Config.LatencyProbe. Replies are removed from the input, as long as they
+// aren't split across reads.
+type latencyProbe struct {
+	clock    quartz.Clock
+	interval time.Duration
+	// observe, if set, is called with the round trip of each reply.
+	observe func(time.Duration)
+
+	// writeMu serializes the output and the probes, which are only written
+	// between escape sequences and characters.
+	writeMu sync.Mutex
+	w       io.Writer
+	escape  escapeState
+
+	mu      sync.Mutex
+	timer   *quartz.Timer
+	stopped bool
+	// due is set when a probe should be written.
+	due bool
+	// sentAt is when the unanswered probe was written, if any.
+	sentAt  time.Time
+	misses  int
+	replies int
+	// average is the moving average of the round trips.
+	average time.Duration
+}
+
+func newLatencyProbe(clock quartz.Clock, interval time.Duration, observe func(time.Duration)) *latencyProbe {
+	return &latencyProbe{clock: clock, interval: interval, observe: observe}
+}
+
+// wrapOutput returns a writer to the terminal probes are written to between
+// the output written to it.
+func (p *latencyProbe) wrapOutput(w io.Writer) io.Writer {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	p.w = w
+	return &latencyProbeWriter{p: p}
+}
+
+// wrapInput returns a reader removing replies to probes from r.
+func (p *latencyProbe) wrapInput(r io.Reader) io.Reader {
+	return &latencyProbeReader{p: p, r: r}
+}
+
+// start schedules the first probe.
+func (p *latencyProbe) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.stopped {
+		p.timer = p.clock.AfterFunc(p.interval, p.tick, "latency_probe")
+	}
+}
+
+// stop cancels the next probe.
+func (p *latencyProbe) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
+
+// latency returns the moving average of the round trips, zero if the
+// terminal never replied.
+func (p *latencyProbe) latency() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.average
+}
+
+func (p *latencyProbe) tick() {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	if !p.sentAt.IsZero() {
+		p.sentAt = time.Time{}
+		p.misses++
+		if p.misses >= latencyProbeMaxMisses {
+			p.stopped = true
+			p.mu.Unlock()
+			return
+		}
+	}
+	p.due = true
+	p.timer = p.clock.AfterFunc(p.interval, p.tick, "latency_probe")
+	p.mu.Unlock()
+
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	p.sendIfDue()
+}
+
+// sendIfDue writes a probe if one is due and the output isn't in the middle
+// of an escape sequence or character. writeMu must be held.
+func (p *latencyProbe) sendIfDue() {
+	if p.w == nil || p.escape.inSequence() {
+		return
+	}
+	p.mu.Lock()
+	if !p.due || p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	p.due = false
+	p.sentAt = p.clock.Now()
+	p.mu.Unlock()
+	// Errors writing to the session also fail the output copy.
+	_, _ = io.WriteString(p.w, latencyProbeRequest)
+}
+
+// stripReply removes the reply to the unanswered probe from b, returning
+// the new length of b.
+func (p *latencyProbe) stripReply(b []byte) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sentAt.IsZero() {
+		return len(b)
+	}
+	loc := cursorPositionReport.FindIndex(b)
+	if loc == nil {
+		return len(b)
+	}
+	rtt := p.clock.Since(p.sentAt)
+	p.sentAt = time.Time{}
+	p.misses = 0
+	if p.replies == 0 {
+		p.average = rtt
+	} else {
+		p.average = (3*p.average + rtt) / 4
+	}
+	p.replies++
+	if p.observe != nil {
+		p.observe(rtt)
+	}
+	return loc[0] + copy(b[loc[0]:], b[loc[1]:])
+}
+
+type latencyProbeWriter struct {
+	p *latencyProbe
+}
+
+func (w *latencyProbeWriter) Write(b []byte) (int, error) {
+	w.p.writeMu.Lock()
+	defer w.p.writeMu.Unlock()
+	n, err := w.p.w.Write(b)
+	w.p.escape.feed(b[:n])
+	if err == nil {
+		w.p.sendIfDue()
+	}
+	return n, err
+}
+
+type latencyProbeReader struct {
+	p *latencyProbe
+	r io.Reader
+}
+
+func (r *latencyProbeReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		n = r.p.stripReply(b[:n])
+	}
+	return n, err
+}
+
+// escapeState tracks whether output written to a terminal ends in the middle
+// of an escape sequence or UTF-8 encoded character, where nothing else may
+// be inserted.
+type escapeState struct {
+	state int
+	// continuation is the number of continuation bytes of a UTF-8 encoded
+	// character still to come.
+	continuation int
+}
+
+const (
+	escapeGround = iota
+	escapeEscape
+	escapeCSI
+	// escapeString is in an OSC, DCS, SOS, PM or APC string, ended by BEL or
+	// ST.
+	escapeString
+	escapeStringEscape
+)
+
+func (e *escapeState) inSequence() bool {
+	return e.state != escapeGround || e.continuation > 0
+}
+
+func (e *escapeState) feed(b []byte) {
+	for _, c := range b {
+		switch e.state {
+		case escapeGround:
+			switch {
+			case c == 0x1b:
+				e.state = escapeEscape
+				e.continuation = 0
+			case c&0xc0 == 0x80:
+				if e.continuation > 0 {
+					e.continuation--
+				}
+			case c&0xe0 == 0xc0:
+				e.continuation = 1
+			case c&0xf0 == 0xe0:
+				e.continuation = 2
+			case c&0xf8 == 0xf0:
+				e.continuation = 3
+			default:
+				e.continuation = 0
+			}
+		case escapeEscape:
+			switch {
+			case c == '[':
+				e.state = escapeCSI
+			case c == ']' || c == 'P' || c == 'X' || c == '^' || c == '_':
+				e.state = escapeString
+			case c >= 0x20 && c <= 0x2f:
+				// Intermediate bytes, e.g. ESC ( B.
+			default:
+				e.state = escapeGround
+			}
+		case escapeCSI:
+			switch {
+			case c == 0x1b:
+				e.state = escapeEscape
+			case c >= 0x40 && c <= 0x7e:
+				e.state = escapeGround
+			}
+		case escapeString:
+			switch c {
+			case 0x07:
+				e.state = escapeGround
+			case 0x1b:
+				e.state = escapeStringEscape
+			}
+		case escapeStringEscape:
+			if c == '\\' {
+				e.state = escapeGround
+			} else {
+				e.state = escapeString
+			}
+		}
+	}
+}
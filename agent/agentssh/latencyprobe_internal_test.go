@@ -0,0 +1,61 @@
+package agentssh
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/v2/testutil"
+	"github.com/coder/quartz"
+)
+
+func Test_latencyProbe(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	clock := quartz.NewMock(t)
+	var rtts []time.Duration
+	p := newLatencyProbe(clock, 30*time.Second, func(d time.Duration) { rtts = append(rtts, d) })
+	var out bytes.Buffer
+	w := p.wrapOutput(&out)
+	p.start()
+	defer p.stop()
+
+	// The probe waits for the end of the escape sequence.
+	_, err := w.Write([]byte("\x1b]0;title"))
+	require.NoError(t, err)
+	clock.Advance(30 * time.Second).MustWait(ctx)
+	require.Equal(t, "\x1b]0;title", out.String())
+	_, err = w.Write([]byte("\a\xe2\x82"))
+	require.NoError(t, err)
+	require.Equal(t, "\x1b]0;title\a\xe2\x82", out.String())
+	_, err = w.Write([]byte("\xacprompt$ "))
+	require.NoError(t, err)
+	require.Equal(t, "\x1b]0;title\a\xe2\x82\xacprompt$ "+latencyProbeRequest, out.String())
+
+	// The reply is removed from the input.
+	clock.Advance(40 * time.Millisecond)
+	input := []byte("a\x1b[3;5Rb")
+	n := p.stripReply(input)
+	require.Equal(t, "ab", string(input[:n]))
+	require.Equal(t, []time.Duration{40 * time.Millisecond}, rtts)
+	require.Equal(t, 40*time.Millisecond, p.latency())
+	// Without an outstanding probe, the input is left alone.
+	input = []byte("\x1b[3;5R")
+	require.Equal(t, len(input), p.stripReply(input))
+
+	// Unanswered probes stop after a few attempts.
+	out.Reset()
+	for range latencyProbeMaxMisses + 1 {
+		_, wait := clock.AdvanceNext()
+		wait.MustWait(ctx)
+	}
+	require.Equal(t, latencyProbeMaxMisses, strings.Count(out.String(), latencyProbeRequest))
+	p.mu.Lock()
+	require.True(t, p.stopped)
+	p.mu.Unlock()
+	require.Equal(t, 40*time.Millisecond, p.latency())
+}
@@ -0,0 +1,176 @@
+package agentssh
+
+import "fmt"
+
+// Keys of the messages the server writes to sessions, see Config.Localizer.
+// The arguments of each message are listed with its key.
+const (
+	// MessageFileTransferBlocked is shown when a file transfer command is
+	// blocked.
+	MessageFileTransferBlocked = "file_transfer_blocked"
+	// MessageSessionTypeRequired is shown when a session is rejected for
+	// not setting its type. Args: the environment variable, the accepted
+	// types joined with ", ".
+	MessageSessionTypeRequired = "session_type_required"
+	// MessageSessionTypeNotAllowed is shown when a session is rejected for
+	// its type. Args: the environment variable, the requested type, the
+	// accepted types joined with ", ".
+	MessageSessionTypeNotAllowed = "session_type_not_allowed"
+	// MessageUsernameMismatch is shown when a session is rejected because of
+	// Config.EnforceUsername. Args: the sanitized SSH user name, the
+	// expected one.
+	MessageUsernameMismatch = "username_mismatch"
+	// MessageShellWithoutPTY is shown when a shell is requested without a
+	// PTY and Policy.RequirePTYForShell is set.
+	MessageShellWithoutPTY = "shell_without_pty"
+	// MessageTooManyPTYs is shown when Config.MaxPTYs PTYs are in use.
+	MessageTooManyPTYs = "too_many_ptys"
+	// MessageTooManySessions is shown when Config.MaxSessions sessions are
+	// open.
+	MessageTooManySessions = "too_many_sessions"
+	// MessageOutOfPTYs is shown when the system has no pseudo-terminal
+	// left.
+	MessageOutOfPTYs = "out_of_ptys"
+	// MessageContainersDisabled is shown when a session targets a container
+	// but containers are not enabled.
+	MessageContainersDisabled = "containers_disabled"
+	// MessageSFTPWithPTY is shown when SFTP is requested with a PTY and
+	// Policy.RejectPTYSFTP is set.
+	MessageSFTPWithPTY = "sftp_with_pty"
+	// MessageSFTPWithoutHome is shown when SFTP is refused because the home
+	// directory is unusable. Args: the error.
+	MessageSFTPWithoutHome = "sftp_without_home"
+	// MessageExecRefused is shown when the Execer refused to run the
+	// command. Args: the message of the agentexec.ExecRefusedError.
+	MessageExecRefused = "exec_refused"
+	// MessageNamedSessionNotFound is shown when the command falls back to a
+	// new shell because the named session doesn't exist. Args: the session
+	// name.
+	MessageNamedSessionNotFound = "named_session_not_found"
+	// MessageNamedSessionNotReady is shown when the command falls back to a
+	// new shell because the named session can't run commands, e.g. because
+	// its rc files replace PROMPT_COMMAND. Args: the session name.
+	MessageNamedSessionNotReady = "named_session_not_ready"
+	// MessageNamedSessionBusy is shown when the command falls back to a new
+	// shell because the named session is running a command. Args: the
+	// session name.
+	MessageNamedSessionBusy = "named_session_busy"
+	// MessageAgentForwardingUnavailable is shown in PTY sessions when agent
+	// forwarding couldn't be set up. Args: the error.
+	MessageAgentForwardingUnavailable = "agent_forwarding_unavailable"
+	// MessageAgentForwardingDisabled is shown when agent forwarding was
+	// requested but Config.DisableAgentForwarding is set.
+	MessageAgentForwardingDisabled = "agent_forwarding_disabled"
+	// MessageTeeOutputFailed is shown when the file requested with
+	// TeeOutputEnvironmentVariable couldn't be opened. Args: the path, the
+	// error.
+	MessageTeeOutputFailed = "tee_output_failed"
+	// MessagePAMFailed is shown when the session is rejected because its
+	// PAM session couldn't be opened, see Config.PAM. Args: the error.
+	MessagePAMFailed = "pam_failed"
+	// MessagePAMSkipped is shown when the session runs without the PAM
+	// session that couldn't be opened, see PAMConfig.FailOpen. Args: the
+	// error.
+	MessagePAMSkipped = "pam_skipped"
+	// MessageTooManyProcesses is shown when a command is refused because
+	// too many background processes are running.
+	MessageTooManyProcesses = "too_many_processes"
+	// MessageSessionLifetimeWarning is shown before a session is terminated
+	// for reaching Policy.MaxSessionLifetime. Args: the lifetime and the
+	// time left, as time.Duration.
+	MessageSessionLifetimeWarning = "session_lifetime_warning"
+	// MessageX11NoDisplays is shown when X11 forwarding failed because
+	// every display is in use. Args: the display offset and the maximum
+	// display number.
+	MessageX11NoDisplays = "x11_no_displays"
+	// MessageX11Listen is shown when X11 forwarding failed because no
+	// listener could be created. Args: the error.
+	MessageX11Listen = "x11_listen"
+	// MessageX11Xauthority is shown when X11 forwarding failed because the
+	// auth cookie couldn't be written. Args: the error.
+	MessageX11Xauthority = "x11_xauthority"
+	// MessageX11Hostname is shown when X11 forwarding failed because the
+	// hostname is unknown. Args: the error.
+	MessageX11Hostname = "x11_hostname"
+	// MessageX11Closing is shown when X11 forwarding failed because the
+	// server is closing.
+	MessageX11Closing = "x11_closing"
+	// MessageX11Disabled is shown when X11 forwarding was requested but
+	// Config.DisableX11 is set.
+	MessageX11Disabled = "x11_disabled"
+	// MessageX11Internal is shown when X11 forwarding failed for an
+	// unexpected reason.
+	MessageX11Internal = "x11_internal"
+	// MessageX11InvalidDisplayOffset is shown when the display offset
+	// requested by the session is ignored. Args: the environment variable,
+	// the error, the offset used instead.
+	MessageX11InvalidDisplayOffset = "x11_invalid_display_offset"
+	// MessageMOTDBinary replaces a MOTD file that appears to be binary.
+	// Args: the path of the file.
+	MessageMOTDBinary = "motd_binary"
+	// MessageBannerBinary replaces an announcement banner that appears to
+	// be binary.
+	MessageBannerBinary = "banner_binary"
+)
+
+// defaultMessages are the English format strings of the messages.
+var defaultMessages = map[string]string{
+	MessageFileTransferBlocked:        BlockedFileTransferErrorMessage,
+	MessageSessionTypeRequired:        "Session rejected: %s must be set, accepted values: %s.",
+	MessageSessionTypeNotAllowed:      "Session rejected: %s=%q is not allowed, accepted values: %s.",
+	MessageUsernameMismatch:           "Session rejected: connected as SSH user %q, but this workspace expects %q. Check the User of this host in your SSH config.",
+	MessageShellWithoutPTY:            "Interactive shells require a PTY, use `ssh -t` or provide a command to run.",
+	MessageTooManyPTYs:                "There are too many interactive sessions in this workspace, close one or run a command without a PTY.",
+	MessageTooManySessions:            "Session rejected: too many concurrent SSH sessions in this workspace, close one and try again.",
+	MessageOutOfPTYs:                  "Workspace is out of pseudo-terminals, try again later.",
+	MessageContainersDisabled:         "Container targeting was requested but is not enabled on this agent, set CODER_AGENT_DEVCONTAINERS_ENABLE=true to enable it.",
+	MessageSFTPWithPTY:                "SFTP is not supported with a PTY, remove RequestTTY from the SSH config for this host.",
+	MessageSFTPWithoutHome:            "SFTP is not available without a home directory: %s",
+	MessageExecRefused:                "coder: %s",
+	MessageNamedSessionNotFound:       "coder: session %q not found, running command in a new shell",
+	MessageNamedSessionNotReady:       "coder: session %q isn't ready to run commands (is PROMPT_COMMAND replaced by your shell config?), running command in a new shell",
+	MessageNamedSessionBusy:           "coder: session %q is busy, running command in a new shell",
+	MessageAgentForwardingUnavailable: "agent forwarding unavailable: %s",
+	MessageAgentForwardingDisabled:    "agent forwarding disabled by administrator",
+	MessageTeeOutputFailed:            "Not teeing output to %s: %s",
+	MessagePAMFailed:                  "Session rejected, failed to open PAM session: %s",
+	MessagePAMSkipped:                 "Failed to open PAM session, continuing without it: %s",
+	MessageTooManyProcesses:           "Too many background processes are running, try again later.",
+	MessageSessionLifetimeWarning:     "This session has reached the maximum session lifetime of %s and will be terminated in %s.",
+	MessageX11NoDisplays:              "X11 forwarding failed: no free displays (offset %d, max %d)",
+	MessageX11Listen:                  "X11 forwarding failed: unable to listen for X11 connections: %s",
+	MessageX11Xauthority:              "X11 forwarding failed: unable to add the auth cookie to ~/.Xauthority: %s",
+	MessageX11Hostname:                "X11 forwarding failed: unable to get the hostname: %s",
+	MessageX11Closing:                 "X11 forwarding failed: the agent is shutting down",
+	MessageX11Disabled:                "X11 forwarding disabled by administrator",
+	MessageX11Internal:                "X11 forwarding failed: internal error",
+	MessageX11InvalidDisplayOffset:    "Ignoring invalid %s: %s, using X11 display offset %d.",
+	MessageMOTDBinary:                 "MOTD not shown: %s appears to be a binary file.",
+	MessageBannerBinary:               "Announcement banner not shown: it appears to be binary.",
+}
+
+// DefaultMessage returns the English format string of the message with the
+// given key, or an empty string if the key is unknown.
+func DefaultMessage(key string) string {
+	return defaultMessages[key]
+}
+
+// localizeDefault formats the default message of key.
+func localizeDefault(key string, args ...any) string {
+	format := defaultMessages[key]
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// localize returns the message of key, from Config.Localizer if set. Line
+// endings and other framing are added by the caller.
+func (s *Server) localize(key string, args ...any) string {
+	if s.config.Localizer != nil {
+		if msg := s.config.Localizer(key, args...); msg != "" {
+			return msg
+		}
+	}
+	return localizeDefault(key, args...)
+}
@@ -0,0 +1,167 @@
+package agentssh
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/sloggers/slogtest"
+
+	"github.com/coder/coder/v2/agent/agentexec"
+	"github.com/coder/coder/v2/codersdk"
+	"github.com/coder/coder/v2/testutil"
+)
+
+// markLocalizer wraps the default messages in markers, to check that they
+// go through Config.Localizer.
+func markLocalizer(key string, args ...any) string {
+	return fmt.Sprintf("<%s>%s</%s>", key, fmt.Sprintf(DefaultMessage(key), args...), key)
+}
+
+func Test_localize(t *testing.T) {
+	t.Parallel()
+
+	// The English messages are unchanged from before they could be
+	// localized.
+	tests := []struct {
+		key  string
+		args []any
+		want string
+	}{
+		{key: MessageFileTransferBlocked, want: "File transfer has been disabled."},
+		{
+			key:  MessageSessionTypeRequired,
+			args: []any{MagicSessionTypeEnvironmentVariable, "ssh, vscode"},
+			want: "Session rejected: CODER_SSH_SESSION_TYPE must be set, accepted values: ssh, vscode.",
+		},
+		{
+			key:  MessageSessionTypeNotAllowed,
+			args: []any{MagicSessionTypeEnvironmentVariable, "jetbrains", "ssh"},
+			want: `Session rejected: CODER_SSH_SESSION_TYPE="jetbrains" is not allowed, accepted values: ssh.`,
+		},
+		{
+			key:  MessageUsernameMismatch,
+			args: []any{"root", "coder"},
+			want: `Session rejected: connected as SSH user "root", but this workspace expects "coder". Check the User of this host in your SSH config.`,
+		},
+		{key: MessageShellWithoutPTY, want: "Interactive shells require a PTY, use `ssh -t` or provide a command to run."},
+		{key: MessageTooManyPTYs, want: "There are too many interactive sessions in this workspace, close one or run a command without a PTY."},
+		{key: MessageTooManySessions, want: "Session rejected: too many concurrent SSH sessions in this workspace, close one and try again."},
+		{key: MessageOutOfPTYs, want: "Workspace is out of pseudo-terminals, try again later."},
+		{key: MessageContainersDisabled, want: "Container targeting was requested but is not enabled on this agent, set CODER_AGENT_DEVCONTAINERS_ENABLE=true to enable it."},
+		{key: MessageSFTPWithPTY, want: "SFTP is not supported with a PTY, remove RequestTTY from the SSH config for this host."},
+		{
+			key:  MessageSFTPWithoutHome,
+			args: []any{xerrors.New("stat /home/coder: no such file or directory")},
+			want: "SFTP is not available without a home directory: stat /home/coder: no such file or directory",
+		},
+		{key: MessageExecRefused, args: []any{"not allowed"}, want: "coder: not allowed"},
+		{key: MessageNamedSessionNotFound, args: []any{"main"}, want: `coder: session "main" not found, running command in a new shell`},
+		{
+			key:  MessageNamedSessionNotReady,
+			args: []any{"main"},
+			want: `coder: session "main" isn't ready to run commands (is PROMPT_COMMAND replaced by your shell config?), running command in a new shell`,
+		},
+		{key: MessageNamedSessionBusy, args: []any{"main"}, want: `coder: session "main" is busy, running command in a new shell`},
+		{key: MessageAgentForwardingUnavailable, args: []any{xerrors.New("no socket")}, want: "agent forwarding unavailable: no socket"},
+		{key: MessageAgentForwardingDisabled, want: "agent forwarding disabled by administrator"},
+		{key: MessageTeeOutputFailed, args: []any{"build.log", xerrors.New("permission denied")}, want: "Not teeing output to build.log: permission denied"},
+		{key: MessagePAMFailed, args: []any{xerrors.New("pam_acct_mgmt: Permission denied")}, want: "Session rejected, failed to open PAM session: pam_acct_mgmt: Permission denied"},
+		{key: MessagePAMSkipped, args: []any{xerrors.New("pam_acct_mgmt: Permission denied")}, want: "Failed to open PAM session, continuing without it: pam_acct_mgmt: Permission denied"},
+		{key: MessageTooManyProcesses, want: "Too many background processes are running, try again later."},
+		{
+			key:  MessageSessionLifetimeWarning,
+			args: []any{time.Hour, 5 * time.Minute},
+			want: "This session has reached the maximum session lifetime of 1h0m0s and will be terminated in 5m0s.",
+		},
+		{key: MessageX11NoDisplays, args: []any{10, 200}, want: "X11 forwarding failed: no free displays (offset 10, max 200)"},
+		{
+			key:  MessageX11Listen,
+			args: []any{xerrors.New("permission denied")},
+			want: "X11 forwarding failed: unable to listen for X11 connections: permission denied",
+		},
+		{
+			key:  MessageX11Xauthority,
+			args: []any{xerrors.New("read-only file system")},
+			want: "X11 forwarding failed: unable to add the auth cookie to ~/.Xauthority: read-only file system",
+		},
+		{key: MessageX11Hostname, args: []any{xerrors.New("no hostname")}, want: "X11 forwarding failed: unable to get the hostname: no hostname"},
+		{key: MessageX11Closing, want: "X11 forwarding failed: the agent is shutting down"},
+		{key: MessageX11Disabled, want: "X11 forwarding disabled by administrator"},
+		{key: MessageX11Internal, want: "X11 forwarding failed: internal error"},
+		{
+			key:  MessageX11InvalidDisplayOffset,
+			args: []any{X11DisplayOffsetEnvironmentVariable, xerrors.New(`not a number: "x"`), 10},
+			want: `Ignoring invalid CODER_SSH_X11_OFFSET: not a number: "x", using X11 display offset 10.`,
+		},
+		{key: MessageMOTDBinary, args: []any{"/etc/motd"}, want: "MOTD not shown: /etc/motd appears to be a binary file."},
+		{key: MessageBannerBinary, want: "Announcement banner not shown: it appears to be binary."},
+	}
+	// Every message is covered.
+	require.Len(t, tests, len(defaultMessages))
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := slogtest.Make(t, nil)
+	plain, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+	require.NoError(t, err)
+	defer plain.Close()
+	marked, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &Config{
+		Localizer: markLocalizer,
+	})
+	require.NoError(t, err)
+	defer marked.Close()
+	partial, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &Config{
+		Localizer: func(string, ...any) string { return "" },
+	})
+	require.NoError(t, err)
+	defer partial.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.want, plain.localize(tt.key, tt.args...))
+			require.Equal(t, "<"+tt.key+">"+tt.want+"</"+tt.key+">", marked.localize(tt.key, tt.args...))
+			// Messages the localizer doesn't know are shown in English.
+			require.Equal(t, tt.want, partial.localize(tt.key, tt.args...))
+		})
+	}
+}
+
+func Test_localizeNotices(t *testing.T) {
+	t.Parallel()
+
+	t.Run("MOTD", func(t *testing.T) {
+		t.Parallel()
+
+		fs := afero.NewMemMapFs()
+		require.NoError(t, afero.WriteFile(fs, "/etc/motd", []byte("\x00\x01\x02"), 0o644))
+		c := newMOTDCache(context.Background(), slogtest.Make(t, &slogtest.Options{IgnoreErrors: true}), fs, nil)
+		defer c.close()
+		c.localize = markLocalizer
+
+		got, err := c.get("/etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, "<motd_binary>MOTD not shown: /etc/motd appears to be a binary file.</motd_binary>\r\n", string(got))
+	})
+
+	t.Run("Banner", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := testutil.Context(t, testutil.WaitShort)
+		logger := slogtest.Make(t, nil)
+		s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &Config{
+			Localizer: markLocalizer,
+		})
+		require.NoError(t, err)
+		defer s.Close()
+
+		banner := s.sanitizeBanner(ctx, logger, codersdk.BannerConfig{Enabled: true, Message: "\x00\x01\x02"})
+		require.Equal(t, "<banner_binary>Announcement banner not shown: it appears to be binary.</banner_binary>", banner.Message)
+	})
+}
@@ -1,18 +1,53 @@
 package agentssh
 
 import (
-	"strings"
+	"maps"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/xerrors"
 )
 
 type sshServerMetrics struct {
-	failedConnectionsTotal prometheus.Counter
-	sftpConnectionsTotal   prometheus.Counter
-	sftpServerErrors       prometheus.Counter
-	x11HandlerErrors       *prometheus.CounterVec
-	sessionsTotal          *prometheus.CounterVec
-	sessionErrors          *prometheus.CounterVec
+	failedConnectionsTotal   prometheus.Counter
+	connectionsDeniedCIDR    prometheus.Counter
+	publicKeyAuthFailures    prometheus.Counter
+	acceptBackoffsTotal      prometheus.Counter
+	unixForwardsDenied       prometheus.Counter
+	reverseForwardsDenied    *prometheus.CounterVec
+	reverseForwardsReleased  prometheus.Counter
+	agentForwardsDenied      prometheus.Counter
+	callbackPanics           *prometheus.CounterVec
+	sftpConnectionsTotal     prometheus.Counter
+	sftpServerErrors         prometheus.Counter
+	sftpPTYRequestsTotal     prometheus.Counter
+	sftpHomeFallbacks        *prometheus.CounterVec
+	x11HandlerErrors         *prometheus.CounterVec
+	x11RequestsRejected      *prometheus.CounterVec
+	x11Connections           prometheus.Gauge
+	x11ConnectionsRefused    prometheus.Counter
+	sessionsTotal            *prometheus.CounterVec
+	sessionClients           *prometheus.CounterVec
+	sessionsRejected         *prometheus.CounterVec
+	sessionErrors            *prometheus.CounterVec
+	sessionLifetimeExceeded  *prometheus.CounterVec
+	sessionIdleTimeouts      *prometheus.CounterVec
+	shellReadySeconds        *prometheus.HistogramVec
+	terminalLatencySeconds   *prometheus.HistogramVec
+	sessionCPUPercent        *prometheus.GaugeVec
+	sessionRSSBytes          *prometheus.GaugeVec
+	jetbrainsWatchedChannels *prometheus.GaugeVec
+	prewarmedShells          *prometheus.CounterVec
+	trackedProcesses         prometheus.Gauge
+	statsDeltasDropped       prometheus.Counter
+	ptyStartRetries          prometheus.Counter
+	ptysOpen                 prometheus.Gauge
+	ptysMax                  prometheus.Gauge
+	containerRequestsOff     prometheus.Counter
+	draining                 prometheus.Gauge
+	tunnelsTotal             *prometheus.CounterVec
+	tunnelBytes              *prometheus.CounterVec
+	tunnelSeconds            *prometheus.CounterVec
+	closePhaseSeconds        *prometheus.SummaryVec
 }
 
 func newSSHServerMetrics(registerer prometheus.Registerer) *sshServerMetrics {
@@ -21,6 +56,65 @@ func newSSHServerMetrics(registerer prometheus.Registerer) *sshServerMetrics {
 	})
 	registerer.MustRegister(failedConnectionsTotal)
 
+	// Connections dropped before the handshake as their remote address is
+	// not in Config.AllowedCIDRs.
+	connectionsDeniedCIDR := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "connections_denied_cidr_total",
+	})
+	registerer.MustRegister(connectionsDeniedCIDR)
+
+	// Public keys rejected by Config.PublicKeyCallback. Clients usually
+	// try several keys, so this can grow faster than failed connections.
+	publicKeyAuthFailures := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "public_key_auth_failures_total",
+	})
+	registerer.MustRegister(publicKeyAuthFailures)
+
+	acceptBackoffsTotal := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "accept_backoffs_total",
+	})
+	registerer.MustRegister(acceptBackoffsTotal)
+
+	unixForwardsDenied := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "unix_forwards_denied_total",
+	})
+	registerer.MustRegister(unixForwardsDenied)
+
+	// Reverse forwarding requests denied by
+	// Config.DisableReversePortForwarding, by request type.
+	reverseForwardsDenied := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "agent",
+			Subsystem: "ssh_server",
+			Name:      "reverse_forwards_denied_total",
+		},
+		[]string{"type"},
+	)
+	registerer.MustRegister(reverseForwardsDenied)
+
+	// Agent forwarding requests ignored because of
+	// Config.DisableAgentForwarding.
+	agentForwardsDenied := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "agent_forwards_denied_total",
+	})
+	registerer.MustRegister(agentForwardsDenied)
+
+	// Panics of Config callbacks, by callback.
+	callbackPanics := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "agent",
+			Subsystem: "ssh_server",
+			Name:      "callback_panics_total",
+		},
+		[]string{"callback"},
+	)
+	registerer.MustRegister(callbackPanics)
+
+	reverseForwardsReleased := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "reverse_forwards_idle_released_total",
+	})
+	registerer.MustRegister(reverseForwardsReleased)
+
 	sftpConnectionsTotal := prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "agent", Subsystem: "ssh_server", Name: "sftp_connections_total",
 	})
@@ -31,6 +125,16 @@ func newSSHServerMetrics(registerer prometheus.Registerer) *sshServerMetrics {
 	})
 	registerer.MustRegister(sftpServerErrors)
 
+	sftpPTYRequestsTotal := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "sftp_pty_requests_total",
+	})
+	registerer.MustRegister(sftpPTYRequestsTotal)
+
+	sftpHomeFallbacks := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "sftp_home_fallbacks_total",
+	}, []string{"fallback"})
+	registerer.MustRegister(sftpHomeFallbacks)
+
 	x11HandlerErrors := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "agent",
@@ -41,16 +145,57 @@ func newSSHServerMetrics(registerer prometheus.Registerer) *sshServerMetrics {
 	)
 	registerer.MustRegister(x11HandlerErrors)
 
+	x11RequestsRejected := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "agent",
+			Subsystem: "x11_handler",
+			Name:      "requests_rejected_total",
+		},
+		[]string{"reason"},
+	)
+	registerer.MustRegister(x11RequestsRejected)
+
+	x11Connections := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "agent", Subsystem: "x11_handler", Name: "connections",
+	})
+	registerer.MustRegister(x11Connections)
+	x11ConnectionsRefused := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agent", Subsystem: "x11_handler", Name: "connections_refused_total",
+	})
+	registerer.MustRegister(x11ConnectionsRefused)
+
 	sessionsTotal := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "agent",
 			Subsystem: "sessions",
 			Name:      "total",
 		},
-		[]string{"magic_type", "pty"},
+		[]string{"magic_type", "pty", "container"},
 	)
 	registerer.MustRegister(sessionsTotal)
 
+	// The client is "cli" for sessions started by the Coder CLI, and
+	// "other" for other SSH clients.
+	sessionClients := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "agent",
+			Subsystem: "sessions",
+			Name:      "clients_total",
+		},
+		[]string{"client"},
+	)
+	registerer.MustRegister(sessionClients)
+
+	sessionsRejected := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "agent",
+			Subsystem: "sessions",
+			Name:      "rejected_total",
+		},
+		[]string{"magic_type", "reason"},
+	)
+	registerer.MustRegister(sessionsRejected)
+
 	sessionErrors := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "agent",
@@ -61,25 +206,248 @@ func newSSHServerMetrics(registerer prometheus.Registerer) *sshServerMetrics {
 	)
 	registerer.MustRegister(sessionErrors)
 
+	sessionLifetimeExceeded := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "agent",
+			Subsystem: "sessions",
+			Name:      "lifetime_exceeded_total",
+		},
+		[]string{"magic_type", "pty"},
+	)
+	registerer.MustRegister(sessionLifetimeExceeded)
+
+	sessionIdleTimeouts := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "agent",
+			Subsystem: "sessions",
+			Name:      "idle_timeouts_total",
+		},
+		[]string{"magic_type", "pty"},
+	)
+	registerer.MustRegister(sessionIdleTimeouts)
+
+	shellReadySeconds := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "agent",
+			Subsystem: "sessions",
+			Name:      "shell_ready_seconds",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"shell"},
+	)
+	registerer.MustRegister(shellReadySeconds)
+
+	terminalLatencySeconds := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "agent",
+			Subsystem: "sessions",
+			Name:      "terminal_latency_seconds",
+			Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		},
+		[]string{"magic_type"},
+	)
+	registerer.MustRegister(terminalLatencySeconds)
+
+	// The sampled usage of the running sessions of each type, see
+	// Config.SessionResourceSampling.
+	sessionCPUPercent := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "agent",
+			Subsystem: "sessions",
+			Name:      "cpu_percent",
+		},
+		[]string{"magic_type"},
+	)
+	registerer.MustRegister(sessionCPUPercent)
+	sessionRSSBytes := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "agent",
+			Subsystem: "sessions",
+			Name:      "rss_bytes",
+		},
+		[]string{"magic_type"},
+	)
+	registerer.MustRegister(sessionRSSBytes)
+
+	jetbrainsWatchedChannels := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "agent",
+			Subsystem: "ssh_server",
+			Name:      "jetbrains_watched_channels",
+		},
+		[]string{"state"},
+	)
+	registerer.MustRegister(jetbrainsWatchedChannels)
+
+	prewarmedShells := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "agent",
+			Subsystem: "ssh_server",
+			Name:      "prewarmed_shells_total",
+		},
+		[]string{"result"},
+	)
+	registerer.MustRegister(prewarmedShells)
+
+	trackedProcesses := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "tracked_processes",
+	})
+	registerer.MustRegister(trackedProcesses)
+
+	statsDeltasDropped := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "stats_deltas_dropped_total",
+	})
+	registerer.MustRegister(statsDeltasDropped)
+
+	ptyStartRetries := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "pty_start_retries_total",
+	})
+	registerer.MustRegister(ptyStartRetries)
+
+	ptysOpen := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "ptys_open",
+	})
+	registerer.MustRegister(ptysOpen)
+
+	ptysMax := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "ptys_max",
+	})
+	registerer.MustRegister(ptysMax)
+
+	containerRequestsOff := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "container_requests_disabled_total",
+	})
+	registerer.MustRegister(containerRequestsOff)
+
+	// Set to 1 while the server is draining, see Server.Drain.
+	draining := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "agent", Subsystem: "ssh_server", Name: "draining",
+	})
+	registerer.MustRegister(draining)
+
+	tunnelsTotal := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "agent",
+			Subsystem: "ssh_server",
+			Name:      "tunnels_total",
+		},
+		[]string{"kind"},
+	)
+	registerer.MustRegister(tunnelsTotal)
+
+	tunnelBytes := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "agent",
+			Subsystem: "ssh_server",
+			Name:      "tunnel_bytes_total",
+		},
+		[]string{"kind", "direction"},
+	)
+	registerer.MustRegister(tunnelBytes)
+
+	tunnelSeconds := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "agent",
+			Subsystem: "ssh_server",
+			Name:      "tunnel_seconds_total",
+		},
+		[]string{"kind"},
+	)
+	registerer.MustRegister(tunnelSeconds)
+
+	// Durations of the phases of Server.Close, observed once per Close.
+	closePhaseSeconds := prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace: "agent",
+			Subsystem: "ssh_server",
+			Name:      "close_phase_seconds",
+		},
+		[]string{"phase"},
+	)
+	registerer.MustRegister(closePhaseSeconds)
+
 	return &sshServerMetrics{
-		failedConnectionsTotal: failedConnectionsTotal,
-		sftpConnectionsTotal:   sftpConnectionsTotal,
-		sftpServerErrors:       sftpServerErrors,
-		x11HandlerErrors:       x11HandlerErrors,
-		sessionsTotal:          sessionsTotal,
-		sessionErrors:          sessionErrors,
+		failedConnectionsTotal:   failedConnectionsTotal,
+		connectionsDeniedCIDR:    connectionsDeniedCIDR,
+		publicKeyAuthFailures:    publicKeyAuthFailures,
+		acceptBackoffsTotal:      acceptBackoffsTotal,
+		unixForwardsDenied:       unixForwardsDenied,
+		reverseForwardsDenied:    reverseForwardsDenied,
+		reverseForwardsReleased:  reverseForwardsReleased,
+		agentForwardsDenied:      agentForwardsDenied,
+		callbackPanics:           callbackPanics,
+		sftpConnectionsTotal:     sftpConnectionsTotal,
+		sftpServerErrors:         sftpServerErrors,
+		sftpPTYRequestsTotal:     sftpPTYRequestsTotal,
+		sftpHomeFallbacks:        sftpHomeFallbacks,
+		x11HandlerErrors:         x11HandlerErrors,
+		x11RequestsRejected:      x11RequestsRejected,
+		x11Connections:           x11Connections,
+		x11ConnectionsRefused:    x11ConnectionsRefused,
+		sessionsTotal:            sessionsTotal,
+		sessionClients:           sessionClients,
+		sessionsRejected:         sessionsRejected,
+		sessionErrors:            sessionErrors,
+		sessionLifetimeExceeded:  sessionLifetimeExceeded,
+		sessionIdleTimeouts:      sessionIdleTimeouts,
+		shellReadySeconds:        shellReadySeconds,
+		terminalLatencySeconds:   terminalLatencySeconds,
+		sessionCPUPercent:        sessionCPUPercent,
+		sessionRSSBytes:          sessionRSSBytes,
+		jetbrainsWatchedChannels: jetbrainsWatchedChannels,
+		prewarmedShells:          prewarmedShells,
+		trackedProcesses:         trackedProcesses,
+		statsDeltasDropped:       statsDeltasDropped,
+		ptyStartRetries:          ptyStartRetries,
+		ptysOpen:                 ptysOpen,
+		ptysMax:                  ptysMax,
+		containerRequestsOff:     containerRequestsOff,
+		draining:                 draining,
+		tunnelsTotal:             tunnelsTotal,
+		tunnelBytes:              tunnelBytes,
+		tunnelSeconds:            tunnelSeconds,
+		closePhaseSeconds:        closePhaseSeconds,
+	}
+}
+
+// sessionTypeLabels are the canonical values of the magic_type label of
+// metrics. Every session type must have its own, see
+// validateSessionTypeLabels.
+var sessionTypeLabels = map[MagicSessionType]string{
+	MagicSessionTypeSSH:       "ssh",
+	MagicSessionTypeVSCode:    "vscode",
+	MagicSessionTypeJetBrains: "jetbrains",
+	MagicSessionTypeUnknown:   "unknown",
+}
+
+// SessionTypeLabels returns the value of the magic_type label of metrics for
+// each session type.
+func SessionTypeLabels() map[MagicSessionType]string {
+	return maps.Clone(sessionTypeLabels)
+}
+
+// MetricLabel returns the value of the magic_type label of metrics for the
+// session type. Undeclared types share the label of MagicSessionTypeUnknown.
+func (t MagicSessionType) MetricLabel() string {
+	if label, ok := sessionTypeLabels[t]; ok {
+		return label
 	}
+	return sessionTypeLabels[MagicSessionTypeUnknown]
 }
 
-func magicTypeMetricLabel(magicType MagicSessionType) string {
-	switch magicType {
-	case MagicSessionTypeVSCode:
-	case MagicSessionTypeJetBrains:
-	case MagicSessionTypeSSH:
-	case MagicSessionTypeUnknown:
-	default:
-		magicType = MagicSessionTypeUnknown
+// validateSessionTypeLabels checks that each of the session types has a
+// label of its own, so that no two types share a series.
+func validateSessionTypeLabels(types []MagicSessionType, labels map[MagicSessionType]string) error {
+	seen := make(map[string]MagicSessionType, len(types))
+	for _, t := range types {
+		label := labels[t]
+		if label == "" {
+			return xerrors.Errorf("session type %q has no label", t)
+		}
+		if other, ok := seen[label]; ok {
+			return xerrors.Errorf("session types %q and %q have the same label %q", other, t, label)
+		}
+		seen[label] = t
 	}
-	// Always be case insensitive
-	return strings.ToLower(string(magicType))
+	return nil
 }
@@ -0,0 +1,36 @@
+package agentssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_validateSessionTypeLabels(t *testing.T) {
+	t.Parallel()
+
+	// Adding a session type without a label fails here.
+	require.NoError(t, validateSessionTypeLabels(magicSessionTypes, sessionTypeLabels))
+	require.Len(t, sessionTypeLabels, len(magicSessionTypes))
+
+	err := validateSessionTypeLabels(append(magicSessionTypes, "cursor"), sessionTypeLabels)
+	require.ErrorContains(t, err, `"cursor" has no label`)
+
+	labels := SessionTypeLabels()
+	labels["cursor"] = "vscode"
+	err = validateSessionTypeLabels(append(magicSessionTypes, "cursor"), labels)
+	require.ErrorContains(t, err, `same label "vscode"`)
+}
+
+func Test_MagicSessionType_MetricLabel(t *testing.T) {
+	t.Parallel()
+
+	for _, magicType := range magicSessionTypes {
+		require.Equal(t, sessionTypeLabels[magicType], magicType.MetricLabel())
+	}
+	// Undeclared types, including the raw values of clients, never create
+	// a series of their own.
+	for _, magicType := range []MagicSessionType{"", "VSCODE", "cursor"} {
+		require.Equal(t, "unknown", magicType.MetricLabel(), magicType)
+	}
+}
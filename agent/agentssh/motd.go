@@ -0,0 +1,215 @@
+package agentssh
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+
+	"github.com/coder/coder/v2/agent/agentcontainers/watcher"
+)
+
+// motdCache caches the rendered MOTD files, so that they aren't read for
+// every login, e.g. from slow network filesystems. Entries are validated
+// with a stat of the file, unless a watcher is watching the file, in which
+// case they are used until the watcher reports a change.
+type motdCache struct {
+	fs      afero.Fs
+	logger  slog.Logger
+	watcher watcher.Watcher
+	cancel  context.CancelFunc
+	done    chan struct{}
+	// maxBytes and allowANSI are used to sanitize files, see
+	// sanitizeLoginNotice.
+	maxBytes  int
+	allowANSI bool
+	// localize returns the notice shown instead of binary files.
+	localize func(key string, args ...any) string
+
+	mu      sync.Mutex
+	entries map[string]motdEntry
+	watched map[string]bool
+	// events counts the events of the watcher, to detect changes made
+	// while a file is read.
+	events uint64
+}
+
+type motdEntry struct {
+	modTime  time.Time
+	size     int64
+	rendered []byte
+}
+
+// newMOTDCache returns a cache, w may be nil. The cache stops consuming
+// events from w when closed, but doesn't close w.
+func newMOTDCache(ctx context.Context, logger slog.Logger, fs afero.Fs, w watcher.Watcher) *motdCache {
+	c := &motdCache{
+		fs:       fs,
+		logger:   logger,
+		watcher:  w,
+		done:     make(chan struct{}),
+		maxBytes: defaultMOTDMaxBytes,
+		localize: localizeDefault,
+		entries:  make(map[string]motdEntry),
+		watched:  make(map[string]bool),
+	}
+	if w == nil {
+		close(c.done)
+		c.cancel = func() {}
+		return c
+	}
+	ctx, c.cancel = context.WithCancel(ctx)
+	go c.watch(ctx)
+	return c
+}
+
+// watch invalidates the entries of changed files.
+func (c *motdCache) watch(ctx context.Context) {
+	defer close(c.done)
+	for {
+		event, err := c.watcher.Next(ctx)
+		if err != nil {
+			return
+		}
+		if event == nil {
+			continue
+		}
+		c.mu.Lock()
+		delete(c.entries, filepath.Clean(event.Name))
+		c.events++
+		c.mu.Unlock()
+	}
+}
+
+// close stops watching for changes.
+func (c *motdCache) close() {
+	c.cancel()
+	<-c.done
+}
+
+// show writes the MOTD file to dest, with line endings normalized as
+// described by writeWithCarriageReturn and lines wrapped to width unless it
+// is 0. A missing file is not an error, there simply isn't a MOTD to show.
+//
+// https://github.com/openssh/openssh-portable/blob/25bd659cc72268f2858c5415740c442ee950049f/session.c#L784
+func (c *motdCache) show(dest io.Writer, filename string, width int) error {
+	rendered, err := c.get(filename)
+	if err != nil {
+		return err
+	}
+	if width > 0 {
+		wrapped := wrapLines(string(rendered), width)
+		if wrapped != string(rendered) {
+			if err := writeWithCarriageReturn(strings.NewReader(wrapped), dest, true); err != nil {
+				return xerrors.Errorf("write MOTD: %w", err)
+			}
+			return nil
+		}
+	}
+	if _, err := dest.Write(rendered); err != nil {
+		return xerrors.Errorf("write MOTD: %w", err)
+	}
+	return nil
+}
+
+func (c *motdCache) get(filename string) ([]byte, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	filename = filepath.Clean(filename)
+
+	c.mu.Lock()
+	entry, ok := c.entries[filename]
+	trusted := ok && c.watched[filename]
+	c.mu.Unlock()
+	if trusted {
+		return entry.rendered, nil
+	}
+
+	info, err := c.fs.Stat(filename)
+	if err != nil {
+		if xerrors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, xerrors.Errorf("stat MOTD: %w", err)
+	}
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.rendered, nil
+	}
+
+	// Start watching before reading the file, so that changes made while
+	// reading aren't missed.
+	watched := c.startWatching(filename)
+	c.mu.Lock()
+	events := c.events
+	c.mu.Unlock()
+	f, err := c.fs.Open(filename)
+	if err != nil {
+		if xerrors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, xerrors.Errorf("open MOTD: %w", err)
+	}
+	defer f.Close()
+	// Read one byte more than is shown, to know whether the file is cut off.
+	raw, err := io.ReadAll(io.LimitReader(f, int64(c.maxBytes)+1))
+	if err != nil {
+		return nil, xerrors.Errorf("read MOTD: %w", err)
+	}
+	var buf bytes.Buffer
+	text, binary, truncated := sanitizeLoginNotice(raw, c.maxBytes, c.allowANSI)
+	if binary {
+		// Warnings are only logged when the file is read, not for every
+		// login.
+		c.logger.Warn(context.Background(), "not showing MOTD file, it appears to be binary", slog.F("path", filename))
+		_, _ = buf.WriteString(c.localize(MessageMOTDBinary, filename) + "\r\n")
+	} else {
+		if truncated {
+			c.logger.Warn(context.Background(), "MOTD file is too large, truncating it",
+				slog.F("path", filename), slog.F("max_bytes", c.maxBytes))
+		}
+		if err := writeWithCarriageReturn(bytes.NewReader(text), &buf, true); err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	c.entries[filename] = motdEntry{
+		modTime:  info.ModTime(),
+		size:     info.Size(),
+		rendered: buf.Bytes(),
+	}
+	// If the file may have changed while it was read, the entry is
+	// validated with a stat the next time.
+	c.watched[filename] = watched && c.events == events
+	c.mu.Unlock()
+	return buf.Bytes(), nil
+}
+
+// startWatching reports whether the watcher watches the file, which isn't
+// possible e.g. on some network filesystems.
+func (c *motdCache) startWatching(filename string) bool {
+	if c.watcher == nil {
+		return false
+	}
+	c.mu.Lock()
+	watched := c.watched[filename]
+	c.mu.Unlock()
+	if watched {
+		return true
+	}
+	if err := c.watcher.Add(filename); err != nil {
+		c.logger.Debug(context.Background(), "not watching MOTD file for changes", slog.F("path", filename), slog.Error(err))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,214 @@
+package agentssh
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+
+	"github.com/coder/coder/v2/testutil"
+)
+
+func Test_motdCache(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Stat", func(t *testing.T) {
+		t.Parallel()
+
+		fs := afero.NewMemMapFs()
+		c := newMOTDCache(context.Background(), slogtest.Make(t, nil), fs, nil)
+		defer c.close()
+
+		got, err := c.get("/etc/motd")
+		require.NoError(t, err)
+		require.Empty(t, got)
+
+		require.NoError(t, afero.WriteFile(fs, "/etc/motd", []byte("one\n"), 0o644))
+		got, err = c.get("/etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, "one\r\n", string(got))
+
+		require.NoError(t, afero.WriteFile(fs, "/etc/motd", []byte("two\n"), 0o644))
+		require.NoError(t, fs.Chtimes("/etc/motd", time.Now(), time.Now().Add(time.Minute)))
+		got, err = c.get("/etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, "two\r\n", string(got))
+
+		require.NoError(t, fs.Remove("/etc/motd"))
+		got, err = c.get("/etc/motd")
+		require.NoError(t, err)
+		require.Empty(t, got)
+	})
+
+	t.Run("Watcher", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := testutil.Context(t, testutil.WaitShort)
+		fs := afero.NewMemMapFs()
+		w := &fakeWatcher{events: make(chan *fsnotify.Event)}
+		c := newMOTDCache(ctx, slogtest.Make(t, nil), fs, w)
+		defer c.close()
+
+		require.NoError(t, afero.WriteFile(fs, "/etc/motd", []byte("one\n"), 0o644))
+		got, err := c.get("/etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, "one\r\n", string(got))
+		require.Equal(t, []string{filepath.Clean("/etc/motd")}, w.added)
+
+		// Watched files are not checked until the watcher reports a
+		// change.
+		require.NoError(t, afero.WriteFile(fs, "/etc/motd", []byte("two\n"), 0o644))
+		require.NoError(t, fs.Chtimes("/etc/motd", time.Now(), time.Now().Add(time.Minute)))
+		got, err = c.get("/etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, "one\r\n", string(got))
+
+		testutil.RequireSend(ctx, t, w.events, &fsnotify.Event{Name: "/etc/motd", Op: fsnotify.Write})
+		require.Eventually(t, func() bool {
+			got, err := c.get("/etc/motd")
+			return err == nil && string(got) == "two\r\n"
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.Equal(t, []string{filepath.Clean("/etc/motd")}, w.added)
+	})
+
+	t.Run("Sanitize", func(t *testing.T) {
+		t.Parallel()
+
+		fs := afero.NewMemMapFs()
+		c := newMOTDCache(context.Background(), slogtest.Make(t, nil), fs, nil)
+		defer c.close()
+		c.maxBytes = 1024
+
+		binary := append([]byte("\x7fELF\x02\x01\x01"), make([]byte, 64)...)
+		require.NoError(t, afero.WriteFile(fs, "/etc/motd", binary, 0o644))
+		got, err := c.get("/etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, "MOTD not shown: "+filepath.Clean("/etc/motd")+" appears to be a binary file.\r\n", string(got))
+
+		huge := bytes.Repeat([]byte("0123456789abcde\n"), 1<<16)
+		require.NoError(t, afero.WriteFile(fs, "/etc/motd", huge, 0o644))
+		got, err = c.get("/etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, strings.Repeat("0123456789abcde\r\n", 64), string(got))
+
+		require.NoError(t, afero.WriteFile(fs, "/etc/motd", []byte("\x1b[1;31mWelcome\x1b[0m\x1b]0;title\a\n"), 0o644))
+		got, err = c.get("/etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, "Welcome\r\n", string(got))
+	})
+}
+
+func Test_sanitizeLoginNotice(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		input     string
+		maxBytes  int
+		allowANSI bool
+		want      string
+		binary    bool
+		truncated bool
+	}{
+		{name: "Text", input: "hello\n", maxBytes: 10, want: "hello\n"},
+		{name: "Binary", input: "MZ\x90\x00\x03", maxBytes: 10, binary: true},
+		{name: "StripANSI", input: "\x1b[32mok\x1b[0m \x1b]8;;https://coder.com\x1b\\link\x1b]8;;\x1b\\", maxBytes: 100, want: "ok link"},
+		{name: "AllowANSI", input: "\x1b[32mok\x1b[0m", maxBytes: 100, allowANSI: true, want: "\x1b[32mok\x1b[0m"},
+		{name: "Truncated", input: "abcdefgh", maxBytes: 4, want: "abcd\n", truncated: true},
+		// Text isn't cut off in the middle of a character or escape
+		// sequence.
+		{name: "TruncatedRune", input: "abc\u00e9", maxBytes: 4, want: "abc\n", truncated: true},
+		{name: "TruncatedEscape", input: "ab\x1b[31mred", maxBytes: 5, allowANSI: true, want: "ab\n", truncated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, binary, truncated := sanitizeLoginNotice([]byte(tt.input), tt.maxBytes, tt.allowANSI)
+			require.Equal(t, tt.want, string(got))
+			require.Equal(t, tt.binary, binary)
+			require.Equal(t, tt.truncated, truncated)
+		})
+	}
+}
+
+type fakeWatcher struct {
+	events chan *fsnotify.Event
+	added  []string
+}
+
+func (w *fakeWatcher) Add(file string) error {
+	w.added = append(w.added, file)
+	return nil
+}
+
+func (*fakeWatcher) Remove(string) error { return nil }
+
+func (w *fakeWatcher) Next(ctx context.Context) (*fsnotify.Event, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case e := <-w.events:
+		return e, nil
+	}
+}
+
+func (*fakeWatcher) Close() error { return nil }
+
+// slowFs adds latency to opening and checking files, like a network
+// filesystem.
+type slowFs struct {
+	afero.Fs
+	latency time.Duration
+}
+
+func (fs slowFs) Open(name string) (afero.File, error) {
+	time.Sleep(fs.latency)
+	return fs.Fs.Open(name)
+}
+
+func (fs slowFs) Stat(name string) (os.FileInfo, error) {
+	time.Sleep(fs.latency)
+	return fs.Fs.Stat(name)
+}
+
+// BenchmarkMOTD compares reading the MOTD for every login with the cache,
+// validated by a stat or by a watcher.
+func BenchmarkMOTD(b *testing.B) {
+	mem := afero.NewMemMapFs()
+	require.NoError(b, afero.WriteFile(mem, "/etc/motd", []byte("Welcome to your workspace!\nHave fun.\n"), 0o644))
+	fs := slowFs{Fs: mem, latency: time.Millisecond}
+	logger := slogtest.Make(b, nil)
+
+	b.Run("Uncached", func(b *testing.B) {
+		for range b.N {
+			f, err := fs.Open("/etc/motd")
+			require.NoError(b, err)
+			require.NoError(b, writeWithCarriageReturn(f, io.Discard, true))
+			_ = f.Close()
+		}
+	})
+	b.Run("Stat", func(b *testing.B) {
+		c := newMOTDCache(context.Background(), logger, fs, nil)
+		defer c.close()
+		for range b.N {
+			require.NoError(b, c.show(io.Discard, "/etc/motd", 0))
+		}
+	})
+	b.Run("Watcher", func(b *testing.B) {
+		c := newMOTDCache(context.Background(), logger, fs, &fakeWatcher{events: make(chan *fsnotify.Event)})
+		defer c.close()
+		for range b.N {
+			require.NoError(b, c.show(io.Discard, "/etc/motd", 0))
+		}
+	})
+}
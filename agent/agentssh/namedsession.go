@@ -0,0 +1,359 @@
+package agentssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kballard/go-shellquote"
+	"go.uber.org/atomic"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+
+	"github.com/coder/coder/v2/pty"
+	"github.com/coder/quartz"
+)
+
+const (
+	// SessionNameEnvironmentVariable names a PTY bash login shell, so that
+	// later exec sessions can run commands in its context by setting
+	// ExecInEnvironmentVariable. This is stripped from any commands being
+	// executed.
+	SessionNameEnvironmentVariable = "CODER_SSH_SESSION_NAME"
+	// ExecInEnvironmentVariable runs the command of an exec session in the
+	// live shell of the named session, with its environment, working
+	// directory, functions, aliases and shell options. The command runs in
+	// a subshell, so it can't change the named shell, and its input is
+	// /dev/null. Its output and exit status are those of the exec session.
+	// Unless Policy.ExecInSessionCrossConnection is set, only sessions of
+	// the same connection can be used. This is stripped from any commands
+	// being executed.
+	//
+	// The command is injected at the prompt of the named shell, through a
+	// key binding installed by PROMPT_COMMAND, see namedSessionHook. Only
+	// supported on Linux. If there is no such session, its rc files replace
+	// PROMPT_COMMAND instead of appending to it, or it is running a command,
+	// the command runs normally after a warning.
+	ExecInEnvironmentVariable = "CODER_SSH_EXEC_IN"
+)
+
+// execInKeySequence is written to the PTY of a named session to run the
+// pending requests. No terminal sends it, and readline doesn't echo it.
+const execInKeySequence = "\x1b[9001~"
+
+// execInClaimTimeout is how long the named shell has to pick up a request
+// before the command runs in a new shell.
+const execInClaimTimeout = 5 * time.Second
+
+// namedSessionHook is sourced by the PROMPT_COMMAND of a named session, with
+// the exit status of the last command as $1, which is restored for the rest
+// of PROMPT_COMMAND. At the first prompt, it binds execInKeySequence to a
+// function running the requests in the session directory (%[1]s) and
+// records the PID of the shell, which tells the server the shell is ready.
+//
+// A request req-ID is claimed by renaming it, so that the server can take
+// it back if the shell doesn't pick it up. It runs in the background,
+// writing to the FIFOs out-ID and err-ID, which stay open until the exit
+// status is in status-ID. The subshells of an interactive shell don't
+// expand aliases, so the setting of the shell is applied.
+const namedSessionHook = `if [[ -z ${__coder_exec_in_dir-} && ( -o emacs || -o vi ) ]]; then
+	export -n PROMPT_COMMAND
+	__coder_exec_in_dir=%[1]s
+	__coder_exec_in() {
+		local req id aliases
+		aliases=$(shopt -p expand_aliases)
+		for req in "$__coder_exec_in_dir"/req-*; do
+			id=${req##*/req-}
+			command mv -- "$req" "$__coder_exec_in_dir/run-$id" 2>/dev/null || continue
+			( (
+				exec 3>"$__coder_exec_in_dir/out-$id" 4>"$__coder_exec_in_dir/err-$id"
+				( eval "$aliases"; . "$__coder_exec_in_dir/run-$id" ) >&3 2>&4 3>&- 4>&- </dev/null
+				printf '%%s\n' "$?" >"$__coder_exec_in_dir/status-$id.tmp"
+				command mv -- "$__coder_exec_in_dir/status-$id.tmp" "$__coder_exec_in_dir/status-$id"
+			) & )
+		done
+	}
+	bind -m emacs -x '"\e[9001~": __coder_exec_in'
+	bind -m vi-insert -x '"\e[9001~": __coder_exec_in'
+	bind -m vi-command -x '"\e[9001~": __coder_exec_in'
+	printf '%%s\n' "$$" >"$__coder_exec_in_dir/ready"
+fi
+return "$1"
+`
+
+var (
+	// errNamedSessionNotFound is returned when there is no named session.
+	errNamedSessionNotFound = xerrors.New("named session not found")
+	// errNamedSessionNotReady is returned when the named session hasn't
+	// installed its hook.
+	errNamedSessionNotReady = xerrors.New("named session not ready")
+	// errNamedSessionBusy is returned when the named session isn't at its
+	// prompt.
+	errNamedSessionBusy = xerrors.New("named session busy")
+)
+
+// namedSessionExitError is returned when a command run in a named session
+// exits with a non-zero status.
+type namedSessionExitError struct {
+	code int
+}
+
+func (e *namedSessionExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// namedSessionKey identifies a named session. The connection is empty if
+// named sessions can be used across connections.
+type namedSessionKey struct {
+	conn string
+	name string
+}
+
+// namedSession is the state of a named session.
+type namedSession struct {
+	dir string
+
+	mu sync.Mutex
+	// input is the input of the PTY of the shell, once started.
+	input io.Writer
+}
+
+// attach sets the input of the PTY of the shell, nil once it's closed.
+func (n *namedSession) attach(input io.Writer) {
+	n.mu.Lock()
+	n.input = input
+	n.mu.Unlock()
+}
+
+// extractNamedSession returns the session name and the name of the session
+// to execute in, if set.
+func extractNamedSession(env []string) (name, execIn string, filteredEnv []string) {
+	filteredEnv = env[:0:0]
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, SessionNameEnvironmentVariable+"="); ok {
+			name = v
+			continue
+		}
+		if v, ok := strings.CutPrefix(kv, ExecInEnvironmentVariable+"="); ok {
+			execIn = v
+			continue
+		}
+		filteredEnv = append(filteredEnv, kv)
+	}
+	return name, execIn, filteredEnv
+}
+
+// namedSessionKey returns the key of the named session name of the
+// connection conn under the policy p.
+func (p *Policy) namedSessionKey(conn, name string) namedSessionKey {
+	if p.ExecInSessionCrossConnection {
+		conn = ""
+	}
+	return namedSessionKey{conn: conn, name: name}
+}
+
+// registerNamedSession makes the shell started by cmd accept commands of
+// exec sessions, its PTY must be attached once started. Only bash is
+// supported, and names must be unique. The returned function unregisters
+// the session.
+func (s *Server) registerNamedSession(ctx context.Context, logger slog.Logger, policy *Policy, conn, name string, cmd *pty.Cmd) (named *namedSession, unregister func(), err error) {
+	if shell := strings.TrimPrefix(filepath.Base(unwrapShims(cmd.Path, cmd.Args)), "-"); shell != "bash" {
+		return nil, nil, xerrors.Errorf("named sessions are not supported for %q, only bash", shell)
+	}
+	key := policy.namedSessionKey(conn, name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.namedSessions[key]; ok {
+		return nil, nil, xerrors.Errorf("session name %q is already in use", name)
+	}
+	dir, err := os.MkdirTemp("", "coder-ssh-session-")
+	if err != nil {
+		return nil, nil, xerrors.Errorf("create session directory: %w", err)
+	}
+	hook := filepath.Join(dir, "hook")
+	err = os.WriteFile(hook, []byte(fmt.Sprintf(namedSessionHook, shellquote.Join(dir))), 0o600)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, nil, xerrors.Errorf("write session hook: %w", err)
+	}
+	named = &namedSession{dir: dir}
+	s.namedSessions[key] = named
+
+	promptCommand := fmt.Sprintf(`. %s "$?"`, shellquote.Join(hook))
+	if existing, ok := envValue(cmd.Env, "PROMPT_COMMAND"); ok && existing != "" {
+		promptCommand += "; " + existing
+	}
+	cmd.Env = setEnv(cmd.Env, "PROMPT_COMMAND", promptCommand)
+	logger.Debug(ctx, "registered named session", slog.F("session_name", name))
+
+	return named, func() {
+		s.mu.Lock()
+		delete(s.namedSessions, key)
+		s.mu.Unlock()
+		_ = os.RemoveAll(dir)
+	}, nil
+}
+
+// execInNamedSession runs script in the named session, see
+// ExecInEnvironmentVariable. errNamedSessionNotFound, errNamedSessionNotReady
+// and errNamedSessionBusy are returned if the script didn't run, a
+// *namedSessionExitError if it exited with a non-zero status.
+func (s *Server) execInNamedSession(ctx context.Context, policy *Policy, conn, name, script string, stdout, stderr io.Writer) error {
+	s.mu.RLock()
+	named, ok := s.namedSessions[policy.namedSessionKey(conn, name)]
+	s.mu.RUnlock()
+	if !ok {
+		return errNamedSessionNotFound
+	}
+	return named.exec(ctx, s.config.Clock, script, stdout, stderr)
+}
+
+func (n *namedSession) exec(ctx context.Context, clock quartz.Clock, script string, stdout, stderr io.Writer) error {
+	ready, err := os.ReadFile(filepath.Join(n.dir, "ready"))
+	if err != nil {
+		return errNamedSessionNotReady
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(ready)))
+	if err != nil {
+		return errNamedSessionNotReady
+	}
+	// The key sequence would go to the command otherwise.
+	if !shellAtPrompt(pid) {
+		return errNamedSessionBusy
+	}
+
+	id := uuid.NewString()
+	file := func(kind string) string {
+		return filepath.Join(n.dir, kind+"-"+id)
+	}
+	defer func() {
+		// The FIFOs are held open while they are removed, so that the
+		// shell never blocks opening them.
+		for _, kind := range []string{"out", "err"} {
+			if f, err := os.OpenFile(file(kind), os.O_RDWR, 0); err == nil {
+				defer f.Close()
+			}
+		}
+		files, _ := filepath.Glob(filepath.Join(n.dir, "*-"+id+"*"))
+		for _, f := range files {
+			_ = os.Remove(f)
+		}
+	}()
+	for _, kind := range []string{"out", "err"} {
+		if err := mkfifo(file(kind)); err != nil {
+			return xerrors.Errorf("create %s fifo: %w", kind, err)
+		}
+	}
+	// Renamed once complete, so that the shell never runs part of it.
+	if err := os.WriteFile(file("script"), []byte(script+"\n"), 0o600); err != nil {
+		return xerrors.Errorf("write script: %w", err)
+	}
+	if err := os.Rename(file("script"), file("req")); err != nil {
+		return xerrors.Errorf("submit script: %w", err)
+	}
+	n.mu.Lock()
+	if n.input == nil {
+		n.mu.Unlock()
+		return errNamedSessionNotReady
+	}
+	_, err = io.WriteString(n.input, execInKeySequence)
+	n.mu.Unlock()
+	if err != nil {
+		return xerrors.Errorf("write to session: %w", err)
+	}
+
+	// Either the shell claims the request, or it is taken back here.
+	claimCtx, cancelClaim := context.WithCancel(ctx)
+	defer cancelClaim()
+	var unclaimed atomic.Bool
+	timeout := clock.AfterFunc(execInClaimTimeout, func() {
+		if os.Remove(file("req")) == nil {
+			unclaimed.Store(true)
+			cancelClaim()
+		}
+	}, "exec_in", "claim")
+	out, err := openFIFO(claimCtx, file("out"))
+	timeout.Stop()
+	if err != nil {
+		if unclaimed.Load() {
+			return errNamedSessionBusy
+		}
+		return err
+	}
+	defer out.Close()
+	errOut, err := openFIFO(ctx, file("err"))
+	if err != nil {
+		return err
+	}
+	defer errOut.Close()
+	stop := context.AfterFunc(ctx, func() {
+		_ = out.Close()
+		_ = errOut.Close()
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(stderr, errOut)
+	}()
+	_, _ = io.Copy(stdout, out)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	status, err := os.ReadFile(file("status"))
+	if err != nil {
+		return xerrors.Errorf("read exit status: %w", err)
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(string(status)))
+	if err != nil {
+		return xerrors.Errorf("parse exit status: %w", err)
+	}
+	if code != 0 {
+		return &namedSessionExitError{code: code}
+	}
+	return nil
+}
+
+// openFIFO opens the FIFO at path for reading, which blocks until the shell
+// opens it for writing. If ctx is done first, the open is abandoned.
+func openFIFO(ctx context.Context, path string) (*os.File, error) {
+	type result struct {
+		f   *os.File
+		err error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		f, err := os.OpenFile(path, os.O_RDONLY, 0)
+		opened <- result{f: f, err: err}
+	}()
+	select {
+	case r := <-opened:
+		if r.err != nil {
+			return nil, xerrors.Errorf("open %s: %w", filepath.Base(path), r.err)
+		}
+		return r.f, nil
+	case <-ctx.Done():
+		// Opening both ends completes the pending opens, also those of
+		// the shell, whose writes then fail.
+		if f, err := os.OpenFile(path, os.O_RDWR, 0); err == nil {
+			_ = f.Close()
+		}
+		if r := <-opened; r.f != nil {
+			_ = r.f.Close()
+		}
+		return nil, ctx.Err()
+	}
+}
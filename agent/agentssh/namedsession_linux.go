@@ -0,0 +1,30 @@
+package agentssh
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// shellAtPrompt reports whether the shell with the given PID is in the
+// foreground of its terminal, i.e. it isn't running a command.
+func shellAtPrompt(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The command name may contain spaces and parentheses.
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return false
+	}
+	// state ppid pgrp session tty_nr tpgid
+	fields := bytes.Fields(stat[i+1:])
+	return len(fields) > 5 && bytes.Equal(fields[2], fields[5])
+}
+
+func mkfifo(path string) error {
+	return unix.Mkfifo(path, 0o600)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package agentssh
+
+import "golang.org/x/xerrors"
+
+// shellAtPrompt reports whether the shell with the given PID is in the
+// foreground of its terminal. It can't be determined on this platform, so
+// commands are never injected.
+func shellAtPrompt(int) bool {
+	return false
+}
+
+func mkfifo(string) error {
+	return xerrors.New("fifos are not supported on this platform")
+}
@@ -0,0 +1,474 @@
+package agentssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"cdr.dev/slog"
+
+	"github.com/coder/coder/v2/codersdk"
+)
+
+// LoginNoticeKind is the kind of notice shown to a session before its command
+// starts.
+type LoginNoticeKind string
+
+const (
+	LoginNoticeBanner   LoginNoticeKind = "banner"
+	LoginNoticeMOTD     LoginNoticeKind = "motd"
+	LoginNoticeGreeting LoginNoticeKind = "greeting"
+)
+
+// LoginNotice records an announcement banner or MOTD written to a session,
+// or why it was skipped.
+type LoginNotice struct {
+	Kind LoginNoticeKind
+	// SHA256 is the hex encoded hash of the bytes written to the session.
+	SHA256 string
+	// Bytes is the number of bytes written to the session.
+	Bytes int
+	// Text is the text written to the session, only set if
+	// Config.SessionStartAuditIncludeText is enabled.
+	Text string
+	// Completed is false if writing to the session failed part way.
+	Completed bool
+	// SkippedReason is set if the notice wasn't shown.
+	SkippedReason string
+}
+
+// SessionStartAuditEntry is passed to Config.SessionStartAudit when a session
+// starts.
+type SessionStartAuditEntry struct {
+	ID          uuid.UUID
+	SessionType MagicSessionType
+	RemoteAddr  string
+	// Container and ContainerUser are set if the session runs in a
+	// container, ContainerUser is empty if the container's default user
+	// is used.
+	Container     string
+	ContainerUser string
+	// Tags are the tags of the session, see
+	// SessionTagsEnvironmentVariable.
+	Tags    map[string]string
+	Command SessionCommand
+	Notices []LoginNotice
+}
+
+const (
+	noticeSkippedNoPTY       = "no pty"
+	noticeSkippedNotLogin    = "not a login shell"
+	noticeSkippedHushLogin   = ".hushlogin present"
+	noticeSkippedNoMOTDFile  = "no motd file configured"
+	noticeSkippedSessionType = "suppressed for session type"
+
+	noticeSkippedNoGreeting      = "no greeting configured"
+	noticeSkippedEmptyGreeting   = "empty greeting"
+	noticeSkippedGreetingTimeout = "greeting timed out"
+	noticeSkippedGreetingError   = "greeting failed"
+)
+
+// sessionStartAuditor returns a function recording entry with the login
+// notices of a session, or nil if no audit is configured.
+func (s *Server) sessionStartAuditor(logger slog.Logger, entry SessionStartAuditEntry) func([]LoginNotice) {
+	if s.config.SessionStartAudit == nil {
+		return nil
+	}
+	return func(notices []LoginNotice) {
+		entry.Notices = notices
+		_, _ = recoverCallback(context.Background(), s, logger, "SessionStartAudit", func() (struct{}, error) {
+			s.config.SessionStartAudit(entry)
+			return struct{}{}, nil
+		})
+	}
+}
+
+// showLoginNotices writes the announcement banners, MOTD and greeting to the
+// session of a login shell and returns what was written. Banners and the
+// MOTD are wrapped to ptyWidth, and skipped if noBanners is set. An error is
+// only returned if Config.MOTDFile panicked.
+func (s *Server) showLoginNotices(ctx context.Context, logger slog.Logger, session ptySession, magicTypeLabel string, ptyWidth int, noBanners bool) ([]LoginNotice, error) {
+	var notices []LoginNotice
+	width := s.loginNoticeWidth(ptyWidth)
+
+	switch {
+	case noBanners:
+		logger.Debug(ctx, "not showing announcement banners and motd to session type", slog.F("magic_type", magicTypeLabel))
+		notices = append(notices, LoginNotice{Kind: LoginNoticeBanner, SkippedReason: noticeSkippedSessionType})
+	case isLoginShell(session.RawCommand()):
+		for _, banner := range s.announcementBanners(ctx, logger, magicTypeLabel, true) {
+			if !banner.Enabled || banner.Message == "" {
+				continue
+			}
+			rec := s.newNoticeRecorder(session)
+			err := showAnnouncementBanner(rec, s.sanitizeBanner(ctx, logger, banner), true, width)
+			notices = append(notices, rec.notice(LoginNoticeBanner, err))
+			if err != nil {
+				logger.Error(ctx, "agent failed to show announcement banner", slog.Error(err))
+				s.metrics.sessionErrors.WithLabelValues(magicTypeLabel, "yes", "announcement_banner").Add(1)
+				break
+			}
+		}
+	default:
+		notices = append(notices, LoginNotice{Kind: LoginNoticeBanner, SkippedReason: noticeSkippedNotLogin})
+	}
+
+	quietReason := quietLoginReason(s.fs, session.RawCommand())
+	var motdFile string
+	if !noBanners && quietReason == "" {
+		var err error
+		motdFile, err = recoverCallback(ctx, s, logger, "MOTDFile", func() (string, error) {
+			return s.config.MOTDFile(), nil
+		})
+		if err != nil {
+			return notices, err
+		}
+	}
+	switch {
+	case noBanners:
+		notices = append(notices, LoginNotice{Kind: LoginNoticeMOTD, SkippedReason: noticeSkippedSessionType})
+	case quietReason != "":
+		notices = append(notices, LoginNotice{Kind: LoginNoticeMOTD, SkippedReason: quietReason})
+	case motdFile == "":
+		notices = append(notices, LoginNotice{Kind: LoginNoticeMOTD, SkippedReason: noticeSkippedNoMOTDFile})
+	default:
+		rec := s.newNoticeRecorder(session)
+		err := s.motd.show(rec, motdFile, width)
+		notices = append(notices, rec.notice(LoginNoticeMOTD, err))
+		if err != nil {
+			logger.Error(ctx, "agent failed to show MOTD", slog.Error(err))
+			s.metrics.sessionErrors.WithLabelValues(magicTypeLabel, "yes", "motd").Add(1)
+		}
+	}
+
+	switch {
+	case quietReason != "":
+		notices = append(notices, LoginNotice{Kind: LoginNoticeGreeting, SkippedReason: quietReason})
+	case s.config.Greeting == nil:
+		notices = append(notices, LoginNotice{Kind: LoginNoticeGreeting, SkippedReason: noticeSkippedNoGreeting})
+	default:
+		notices = append(notices, s.showGreeting(ctx, logger, session, magicTypeLabel))
+	}
+
+	return notices, nil
+}
+
+// defaultLoginNoticeWidth is the width login notices are wrapped to if the
+// PTY doesn't report one.
+const defaultLoginNoticeWidth = 80
+
+// loginNoticeWidth returns the width to wrap login notices to for a PTY of
+// ptyWidth columns, or 0 if they aren't wrapped.
+func (s *Server) loginNoticeWidth(ptyWidth int) int {
+	switch {
+	case s.config.NoWrapLoginNotices:
+		return 0
+	case ptyWidth > 0:
+		return ptyWidth
+	default:
+		return defaultLoginNoticeWidth
+	}
+}
+
+// defaultMOTDMaxBytes is the default of Config.MOTDMaxBytes.
+const defaultMOTDMaxBytes = 256 << 10
+
+// binarySniffBytes is how much of a login notice is checked for NUL bytes,
+// which text files don't contain.
+const binarySniffBytes = 8 << 10
+
+// sanitizeLoginNotice prepares the text of the MOTD or an announcement banner
+// to be written to a terminal. Text that is likely binary isn't shown at
+// all. Longer text is cut off after maxBytes, but not in the middle of an
+// escape sequence or character, and ends with a newline. ANSI escape
+// sequences are removed unless allowANSI is set.
+func sanitizeLoginNotice(text []byte, maxBytes int, allowANSI bool) (sanitized []byte, binary, truncated bool) {
+	if bytes.IndexByte(text[:min(len(text), binarySniffBytes)], 0) >= 0 {
+		return nil, true, false
+	}
+	if len(text) > maxBytes {
+		truncated = true
+		text = text[:maxBytes]
+		var e escapeState
+		end := 0
+		for i, c := range text {
+			e.feed([]byte{c})
+			if !e.inSequence() {
+				end = i + 1
+			}
+		}
+		text = text[:end:end]
+		if !bytes.HasSuffix(text, []byte("\n")) {
+			text = append(text, '\n')
+		}
+	}
+	if !allowANSI {
+		text = stripANSI(text)
+	}
+	return text, false, truncated
+}
+
+// stripANSI returns text without escape sequences.
+func stripANSI(text []byte) []byte {
+	if bytes.IndexByte(text, 0x1b) < 0 {
+		return text
+	}
+	var e escapeState
+	stripped := make([]byte, 0, len(text))
+	for _, c := range text {
+		inEscape := e.state != escapeGround
+		e.feed([]byte{c})
+		if !inEscape && e.state == escapeGround {
+			stripped = append(stripped, c)
+		}
+	}
+	return stripped
+}
+
+// sanitizeBanner applies sanitizeLoginNotice to the message of banner.
+func (s *Server) sanitizeBanner(ctx context.Context, logger slog.Logger, banner codersdk.BannerConfig) codersdk.BannerConfig {
+	message, binary, truncated := sanitizeLoginNotice([]byte(banner.Message), s.config.MOTDMaxBytes, s.config.MOTDAllowANSI)
+	if binary {
+		logger.Warn(ctx, "not showing announcement banner, it appears to be binary")
+		banner.Message = s.localize(MessageBannerBinary)
+		return banner
+	}
+	if truncated {
+		logger.Warn(ctx, "announcement banner is too large, truncating it", slog.F("max_bytes", s.config.MOTDMaxBytes))
+	}
+	banner.Message = string(message)
+	return banner
+}
+
+// wrapLines wraps the lines of text that are longer than width at word
+// boundaries, breaking words longer than width, and keeps the indentation of
+// the first line. Breaks are inserted as "\n" in place of the whitespace at
+// the break, existing line endings and the spacing between the words of a
+// line are kept. Widths are counted in runes, escape sequences don't count
+// and are never split. A width of 0 disables wrapping.
+func wrapLines(text string, width int) string {
+	if width <= 0 {
+		return text
+	}
+	lines := strings.SplitAfter(text, "\n")
+	var b strings.Builder
+	for _, line := range lines {
+		content := strings.TrimRight(line, "\r\n")
+		b.WriteString(strings.Join(wrapLine(content, width), "\n"))
+		b.WriteString(line[len(content):])
+	}
+	return b.String()
+}
+
+func wrapLine(line string, width int) []string {
+	segments := splitSegments(line)
+	total := 0
+	for _, seg := range segments {
+		total += seg.width
+	}
+	if total <= width {
+		return []string{line}
+	}
+
+	var (
+		wrapped []string
+		cur     strings.Builder
+		curLen  int
+		hasWord bool
+	)
+	flush := func() {
+		wrapped = append(wrapped, cur.String())
+		cur.Reset()
+		curLen, hasWord = 0, false
+	}
+	if len(segments) > 0 && segments[0].space {
+		indent := segments[0]
+		segments = segments[1:]
+		if indent.width < width {
+			cur.WriteString(indent.text)
+			curLen = indent.width
+		} else {
+			cur.WriteString(escapeSequences(indent.text))
+		}
+	}
+	var gap wrapSegment
+	for _, word := range segments {
+		if word.space {
+			gap = word
+			continue
+		}
+		if hasWord {
+			if curLen+gap.width+word.width <= width {
+				cur.WriteString(gap.text + word.text)
+				curLen += gap.width + word.width
+				gap = wrapSegment{}
+				continue
+			}
+			cur.WriteString(escapeSequences(gap.text))
+			flush()
+		}
+		gap = wrapSegment{}
+		for curLen+word.width > width {
+			var head string
+			head, word = word.split(width - curLen)
+			cur.WriteString(head)
+			flush()
+		}
+		cur.WriteString(word.text)
+		curLen += word.width
+		hasWord = true
+	}
+	if curLen+gap.width <= width {
+		cur.WriteString(gap.text)
+	} else {
+		cur.WriteString(escapeSequences(gap.text))
+	}
+	if hasWord || cur.Len() > 0 {
+		flush()
+	}
+	return wrapped
+}
+
+// wrapSegment is a word, or the whitespace between words, of a line. Escape
+// sequences belong to the segment they appear in, and don't count toward
+// its width in runes.
+type wrapSegment struct {
+	text  string
+	width int
+	space bool
+}
+
+// split returns the first n runes of the segment, and the rest. Escape
+// sequences following the last rune of the head are part of the rest.
+func (w wrapSegment) split(n int) (head string, rest wrapSegment) {
+	i, runes := 0, 0
+	for i < len(w.text) && runes < n {
+		size, visible := nextTerminalUnit(w.text[i:])
+		i += size
+		if visible {
+			runes++
+		}
+	}
+	return w.text[:i], wrapSegment{text: w.text[i:], width: w.width - runes}
+}
+
+// splitSegments splits line into words and whitespace. Escape sequences
+// before the first rune are part of the first segment.
+func splitSegments(line string) []wrapSegment {
+	var (
+		segments []wrapSegment
+		leading  string
+	)
+	for len(line) > 0 {
+		n, visible := nextTerminalUnit(line)
+		unit := line[:n]
+		line = line[n:]
+		if !visible && len(segments) == 0 {
+			leading += unit
+			continue
+		}
+		space := unit == " " || unit == "\t"
+		last := len(segments) - 1
+		if last < 0 || (visible && segments[last].space != space) {
+			segments = append(segments, wrapSegment{text: leading, space: space})
+			leading = ""
+			last++
+		}
+		segments[last].text += unit
+		if visible {
+			segments[last].width++
+		}
+	}
+	if leading != "" {
+		segments = append(segments, wrapSegment{text: leading})
+	}
+	return segments
+}
+
+// nextTerminalUnit returns the length of the escape sequence or rune that s
+// starts with, and whether it is visible.
+func nextTerminalUnit(s string) (n int, visible bool) {
+	if s[0] != 0x1b {
+		_, size := utf8.DecodeRuneInString(s)
+		return size, true
+	}
+	var e escapeState
+	for n < len(s) {
+		e.feed([]byte{s[n]})
+		n++
+		if e.state == escapeGround {
+			break
+		}
+	}
+	return n, false
+}
+
+// escapeSequences returns the escape sequences of s, which are kept when
+// the whitespace they appear in is replaced by a break.
+func escapeSequences(s string) string {
+	var b strings.Builder
+	for len(s) > 0 {
+		n, visible := nextTerminalUnit(s)
+		if !visible {
+			b.WriteString(s[:n])
+		}
+		s = s[n:]
+	}
+	return b.String()
+}
+
+// skippedLoginNotices returns the notices for a session without a PTY, which
+// never shows banners, the MOTD or the greeting.
+func skippedLoginNotices() []LoginNotice {
+	return []LoginNotice{
+		{Kind: LoginNoticeBanner, SkippedReason: noticeSkippedNoPTY},
+		{Kind: LoginNoticeMOTD, SkippedReason: noticeSkippedNoPTY},
+		{Kind: LoginNoticeGreeting, SkippedReason: noticeSkippedNoPTY},
+	}
+}
+
+// noticeRecorder hashes, and optionally keeps, the bytes written through it.
+type noticeRecorder struct {
+	w    io.Writer
+	hash hash.Hash
+	n    int
+	text *strings.Builder
+}
+
+func (s *Server) newNoticeRecorder(w io.Writer) *noticeRecorder {
+	r := &noticeRecorder{w: w, hash: sha256.New()}
+	if s.config.SessionStartAuditIncludeText {
+		r.text = &strings.Builder{}
+	}
+	return r
+}
+
+func (r *noticeRecorder) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	_, _ = r.hash.Write(p[:n])
+	r.n += n
+	if r.text != nil {
+		_, _ = r.text.Write(p[:n])
+	}
+	return n, err
+}
+
+func (r *noticeRecorder) notice(kind LoginNoticeKind, err error) LoginNotice {
+	n := LoginNotice{
+		Kind:      kind,
+		SHA256:    hex.EncodeToString(r.hash.Sum(nil)),
+		Bytes:     r.n,
+		Completed: err == nil,
+	}
+	if r.text != nil {
+		n.Text = r.text.String()
+	}
+	return n
+}
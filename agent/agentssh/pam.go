@@ -0,0 +1,114 @@
+package agentssh
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+// defaultPAMServiceName is the default of PAMConfig.ServiceName, so that the
+// policies configured for sshd apply.
+const defaultPAMServiceName = "sshd"
+
+// pamTTY is the PAM_TTY of sessions without a PTY, like sshd. PTY sessions
+// use the path of their terminal, which the PAM helper runs on.
+const pamTTY = "ssh"
+
+// PAMSessionCommand is the subcommand of the agent binary that runs the
+// command of a session in a PAM session, see PAMSessionCLI.
+const PAMSessionCommand = "agent-pam-session"
+
+// pamErrorPlaceholder is replaced with the error in the messages passed to
+// the PAM helper, which can't call Config.Localizer itself.
+const pamErrorPlaceholder = "{error}"
+
+// PAMConfig configures running sessions through PAM, like sshd with UsePAM.
+type PAMConfig struct {
+	// Enabled runs the account and session phases of the PAM service
+	// before the command of a session starts, and closes the PAM session
+	// once the session ends. There is no authentication phase. The
+	// environment set by the modules is added to the session, and the
+	// resource limits they set (e.g. pam_limits) apply to the command. The
+	// PAM session is opened by the agent binary running as a helper process
+	// between the agent and the command (see PAMSessionCLI), never by the
+	// agent itself. Modules run as the user of the agent, those requiring
+	// root may fail. Only supported by agents built for Linux with cgo and
+	// the pam build tag, NewServer fails otherwise.
+	Enabled bool
+	// ServiceName is the PAM service, i.e. the file in /etc/pam.d. Default
+	// is "sshd".
+	ServiceName string
+	// FailOpen runs sessions without PAM after a warning when their PAM
+	// session can't be opened, instead of rejecting them.
+	FailOpen bool
+}
+
+// pamHandle is an open PAM session.
+type pamHandle interface {
+	// env returns the environment set by the PAM modules.
+	env() []string
+	// close closes the PAM session.
+	close() error
+}
+
+// pamHelperPath returns the path of the agent binary, which runs the
+// commands of sessions in PAM sessions.
+func pamHelperPath() (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", xerrors.Errorf("get executable: %w", err)
+	}
+	bin, err := filepath.EvalSymlinks(executable)
+	if err != nil {
+		return "", xerrors.Errorf("eval symlinks: %w", err)
+	}
+	return bin, nil
+}
+
+// pamSession runs the command of a session in a PAM session, see
+// Config.PAM.
+type pamSession struct {
+	helper string
+	args   []string
+}
+
+// pamSession returns the PAM session of a session, or nil if PAM is
+// disabled or doesn't apply to the session.
+func (s *Server) pamSession(ctx context.Context, logger slog.Logger, remoteAddr net.Addr, inContainer bool) *pamSession {
+	if !s.config.PAM.Enabled {
+		return nil
+	}
+	if inContainer {
+		// The PAM configuration of the host doesn't apply to containers.
+		logger.Debug(ctx, "not opening PAM session for container session")
+		return nil
+	}
+	rhost := remoteAddr.String()
+	if host, _, err := net.SplitHostPort(rhost); err == nil {
+		rhost = host
+	}
+	args := []string{
+		"--service=" + s.config.PAM.ServiceName,
+		"--rhost=" + rhost,
+		"--failed-message=" + s.localize(MessagePAMFailed, pamErrorPlaceholder),
+		"--skipped-message=" + s.localize(MessagePAMSkipped, pamErrorPlaceholder),
+	}
+	if s.config.PAM.FailOpen {
+		args = append(args, "--fail-open")
+	}
+	return &pamSession{helper: s.pamHelper, args: args}
+}
+
+// wrap wraps the command in the PAM helper, which opens the PAM session in
+// its own process and runs the command as its child. Unlike the agent, the
+// child inherits the resource limits set by the modules before it starts.
+func (p *pamSession) wrap(path string, args []string) (string, []string) {
+	wrapped := append([]string{p.helper, PAMSessionCommand}, p.args...)
+	wrapped = append(wrapped, "--", path)
+	return p.helper, append(wrapped, args[1:]...)
+}
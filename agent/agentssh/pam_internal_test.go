@@ -0,0 +1,55 @@
+package agentssh
+
+import (
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+
+	"github.com/coder/coder/v2/agent/agentexec"
+	"github.com/coder/coder/v2/testutil"
+)
+
+func Test_pamSession(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := slogtest.Make(t, nil)
+	if !pamSupported {
+		_, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &Config{
+			PAM: PAMConfig{Enabled: true},
+		})
+		require.ErrorContains(t, err, "PAM is not supported by this build")
+	}
+
+	s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, "sshd", s.config.PAM.ServiceName)
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	require.Nil(t, s.pamSession(ctx, logger, remote, false))
+
+	s.config.PAM.Enabled = true
+	s.config.PAM.FailOpen = true
+	s.pamHelper = "/opt/coder"
+	require.Nil(t, s.pamSession(ctx, logger, remote, true), "containers are skipped")
+
+	// The PAM session is opened by the helper, which runs the command.
+	p := s.pamSession(ctx, logger, remote, false)
+	require.NotNil(t, p)
+	path, args := p.wrap("/bin/bash", []string{"/bin/bash", "-l"})
+	require.Equal(t, "/opt/coder", path)
+	require.Equal(t, []string{
+		"/opt/coder", PAMSessionCommand,
+		"--service=sshd",
+		"--rhost=127.0.0.1",
+		"--failed-message=Session rejected, failed to open PAM session: {error}",
+		"--skipped-message=Failed to open PAM session, continuing without it: {error}",
+		"--fail-open",
+		"--", "/bin/bash", "-l",
+	}, args)
+}
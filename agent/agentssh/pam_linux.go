@@ -0,0 +1,261 @@
+//go:build linux && cgo && pam
+
+package agentssh
+
+/*
+#cgo LDFLAGS: -lpam
+#include <stdlib.h>
+#include <security/pam_appl.h>
+
+// coder_pam_conv accepts the messages of modules, e.g. from pam_motd, and
+// fails prompts since there is no one to answer them.
+static int coder_pam_conv(int n, const struct pam_message **msg, struct pam_response **resp, void *data) {
+	for (int i = 0; i < n; i++) {
+		if (msg[i]->msg_style != PAM_TEXT_INFO && msg[i]->msg_style != PAM_ERROR_MSG) {
+			return PAM_CONV_ERR;
+		}
+	}
+	*resp = calloc(n, sizeof(struct pam_response));
+	return *resp == NULL ? PAM_BUF_ERR : PAM_SUCCESS;
+}
+
+static const struct pam_conv coder_pam_conversation = { coder_pam_conv, NULL };
+
+static int coder_pam_start(const char *service, const char *user, pam_handle_t **pamh) {
+	return pam_start(service, user, &coder_pam_conversation, pamh);
+}
+
+static int coder_pam_set_item(pam_handle_t *pamh, int item, const char *value) {
+	return pam_set_item(pamh, item, value);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+// pamSupported reports whether this build supports PAM, see Config.PAM.
+const pamSupported = true
+
+// pamForwardedSignals are forwarded by the PAM helper to the command, e.g.
+// those of signal requests of the session.
+var pamForwardedSignals = []os.Signal{
+	syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM,
+	syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGALRM,
+}
+
+// PAMSessionCLI runs the agent-pam-session command, which opens a PAM
+// session, runs the command given after "--" in it and closes the session
+// once the command exits. It exits with the status of the command, and only
+// returns if the command couldn't be run. It should only be called by the
+// cli package.
+func PAMSessionCLI() error {
+	if len(os.Args) < 3 {
+		return xerrors.Errorf("malformed command %+v", os.Args)
+	}
+	code, err := runPAMSession(os.Args[2:])
+	if err != nil {
+		return err
+	}
+	os.Exit(code)
+	return nil
+}
+
+// runPAMSession implements PAMSessionCLI, returning the exit code.
+func runPAMSession(args []string) (int, error) {
+	var (
+		fs             = flag.NewFlagSet(PAMSessionCommand, flag.ContinueOnError)
+		service        = fs.String("service", defaultPAMServiceName, "")
+		rhost          = fs.String("rhost", "", "")
+		failOpen       = fs.Bool("fail-open", false, "")
+		failedMessage  = fs.String("failed-message", localizeDefault(MessagePAMFailed, pamErrorPlaceholder), "")
+		skippedMessage = fs.String("skipped-message", localizeDefault(MessagePAMSkipped, pamErrorPlaceholder), "")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 0, xerrors.Errorf("parse flags: %w", err)
+	}
+	argv := fs.Args()
+	if len(argv) == 0 {
+		return 0, xerrors.Errorf("no command provided %+v", args)
+	}
+
+	h, err := func() (pamHandle, error) {
+		u, err := user.Current()
+		if err != nil {
+			return nil, xerrors.Errorf("current user: %w", err)
+		}
+		return pamStart(*service, u.Username, *rhost, pamTTYOf(os.Stdin))
+	}()
+	if err != nil && !*failOpen {
+		_, _ = fmt.Fprintln(os.Stderr, strings.ReplaceAll(*failedMessage, pamErrorPlaceholder, err.Error()))
+		return PAMFailedErrorCode, nil
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, strings.ReplaceAll(*skippedMessage, pamErrorPlaceholder, err.Error()))
+	}
+
+	// The command inherits the resource limits the modules set for this
+	// process.
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = os.Environ()
+	if h != nil {
+		for _, kv := range h.env() {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				cmd.Env = setEnv(cmd.Env, k, v)
+			}
+		}
+	}
+	if _, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS); err == nil {
+		// Signals of the terminal, e.g. on ^C, only go to the command,
+		// like without the helper.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Foreground: true, Ctty: 0}
+	}
+
+	// Registered before the command starts, the command still gets the
+	// default handlers.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, pamForwardedSignals...)
+	defer signal.Stop(signals)
+	if err := cmd.Start(); err != nil {
+		if h != nil {
+			_ = h.close()
+		}
+		return 0, xerrors.Errorf("start command: %w", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				_ = cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+
+	if h != nil {
+		if err := h.close(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "failed to close PAM session: %v\n", err)
+		}
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			// Like shells, as the helper can't safely die of the same
+			// signal.
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 0, xerrors.Errorf("wait for command: %w", err)
+	}
+	return 0, nil
+}
+
+// pamTTYOf returns the PAM_TTY of a session with the given stdin: the path
+// of its terminal for PTY sessions, like sshd, and pamTTY otherwise.
+func pamTTYOf(stdin *os.File) string {
+	if _, err := unix.IoctlGetTermios(int(stdin.Fd()), unix.TCGETS); err != nil {
+		return pamTTY
+	}
+	name, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", stdin.Fd()))
+	if err != nil || !strings.HasPrefix(name, "/dev/") {
+		return pamTTY
+	}
+	return name
+}
+
+type cgoPAMHandle struct {
+	h    *C.pam_handle_t
+	envs []string
+}
+
+// pamStart opens a PAM session. Modules like pam_limits change the resource
+// limits of the calling process, so it must only be called by the PAM
+// helper, never by the agent.
+func pamStart(service, username, rhost, tty string) (pamHandle, error) {
+	cService := C.CString(service)
+	defer C.free(unsafe.Pointer(cService))
+	cUser := C.CString(username)
+	defer C.free(unsafe.Pointer(cUser))
+
+	var h *C.pam_handle_t
+	rv := C.coder_pam_start(cService, cUser, &h)
+	p := &cgoPAMHandle{h: h}
+	if rv != C.PAM_SUCCESS {
+		return nil, xerrors.Errorf("pam_start: %s", p.strerror(rv))
+	}
+	for item, value := range map[C.int]string{C.PAM_RHOST: rhost, C.PAM_TTY: tty} {
+		cValue := C.CString(value)
+		rv := C.coder_pam_set_item(p.h, item, cValue)
+		C.free(unsafe.Pointer(cValue))
+		if rv != C.PAM_SUCCESS {
+			err := xerrors.Errorf("pam_set_item: %s", p.strerror(rv))
+			C.pam_end(p.h, rv)
+			return nil, err
+		}
+	}
+	if rv := C.pam_acct_mgmt(p.h, 0); rv != C.PAM_SUCCESS {
+		err := xerrors.Errorf("pam_acct_mgmt: %s", p.strerror(rv))
+		C.pam_end(p.h, rv)
+		return nil, err
+	}
+	if rv := C.pam_open_session(p.h, 0); rv != C.PAM_SUCCESS {
+		err := xerrors.Errorf("pam_open_session: %s", p.strerror(rv))
+		C.pam_end(p.h, rv)
+		return nil, err
+	}
+	p.envs = p.getenvlist()
+	return p, nil
+}
+
+func (p *cgoPAMHandle) env() []string {
+	return p.envs
+}
+
+func (p *cgoPAMHandle) close() error {
+	rv := C.pam_close_session(p.h, 0)
+	var err error
+	if rv != C.PAM_SUCCESS {
+		err = xerrors.Errorf("pam_close_session: %s", p.strerror(rv))
+	}
+	C.pam_end(p.h, rv)
+	return err
+}
+
+func (p *cgoPAMHandle) strerror(rv C.int) string {
+	return C.GoString(C.pam_strerror(p.h, rv))
+}
+
+// getenvlist returns the PAM environment, freeing the list returned by PAM.
+func (p *cgoPAMHandle) getenvlist() []string {
+	list := C.pam_getenvlist(p.h)
+	if list == nil {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(list))
+	var env []string
+	for entry := list; *entry != nil; entry = (**C.char)(unsafe.Add(unsafe.Pointer(entry), unsafe.Sizeof(*entry))) {
+		env = append(env, C.GoString(*entry))
+		C.free(unsafe.Pointer(*entry))
+	}
+	return env
+}
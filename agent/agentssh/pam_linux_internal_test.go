@@ -0,0 +1,71 @@
+//go:build linux && cgo && pam
+
+package agentssh
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/coder/coder/v2/pty"
+)
+
+// testPAMService is the PAM service Test_runPAMSession runs against, the
+// test is skipped unless it is installed. /etc/pam.d/coder-agent-test:
+//
+//	account required pam_permit.so
+//	session required pam_limits.so conf=/etc/security/coder-agent-test-limits.conf
+//	session required pam_env.so readenv=1 envfile=/etc/security/coder-agent-test-env
+//
+// With /etc/security/coder-agent-test-limits.conf lowering the soft limit of
+// open files of everyone ("* soft nofile 512") and
+// /etc/security/coder-agent-test-env setting "CODER_PAM_TEST=1".
+const testPAMService = "coder-agent-test"
+
+func Test_runPAMSession(t *testing.T) {
+	t.Parallel()
+	if _, err := os.Stat("/etc/pam.d/" + testPAMService); err != nil {
+		t.Skipf("PAM service %s isn't installed", testPAMService)
+	}
+	var before unix.Rlimit
+	err := unix.Getrlimit(unix.RLIMIT_NOFILE, &before)
+	require.NoError(t, err)
+
+	// The test binary runs the helper, see TestMain.
+	//nolint:gosec // The test binary and arguments are fixed.
+	out, err := exec.Command(os.Args[0], PAMSessionCommand, "--service="+testPAMService, "--rhost=127.0.0.1", "--",
+		"/bin/sh", "-c", `ulimit -Sn; echo "$CODER_PAM_TEST"; exit 3`).Output()
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, 3, exitErr.ExitCode())
+	// The limits set by pam_limits only apply to the command.
+	require.Equal(t, []string{"512", "1"}, strings.Fields(string(out)))
+	var after unix.Rlimit
+	err = unix.Getrlimit(unix.RLIMIT_NOFILE, &after)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+func Test_pamTTYOf(t *testing.T) {
+	t.Parallel()
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+	require.Equal(t, pamTTY, pamTTYOf(r))
+
+	// PTY sessions are recorded with their terminal, e.g. by pam_lastlog.
+	ptty, err := pty.New()
+	require.NoError(t, err)
+	defer ptty.Close()
+	tty, err := os.OpenFile(ptty.Name(), os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer tty.Close()
+	require.True(t, strings.HasPrefix(ptty.Name(), "/dev/pts/"), ptty.Name())
+	require.Equal(t, ptty.Name(), pamTTYOf(tty))
+}
@@ -0,0 +1,14 @@
+//go:build !(linux && cgo && pam)
+
+package agentssh
+
+import "golang.org/x/xerrors"
+
+// pamSupported reports whether this build supports PAM, see Config.PAM.
+const pamSupported = false
+
+// PAMSessionCLI runs the agent-pam-session command, which isn't supported by
+// this build, see Config.PAM.
+func PAMSessionCLI() error {
+	return xerrors.New("PAM is not supported by this build")
+}
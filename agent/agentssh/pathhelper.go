@@ -0,0 +1,69 @@
+package agentssh
+
+import (
+	"bufio"
+	"bytes"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	pathHelperPaths    = "/etc/paths"
+	pathHelperPathsDir = "/etc/paths.d"
+)
+
+// pathHelperPATH builds PATH like path_helper(8) on macOS, which login
+// shells run from /etc/zprofile: the directories listed in /etc/paths,
+// then those listed in the files of /etc/paths.d in lexical order, then the
+// directories of current that aren't listed. If nothing is listed, current
+// is returned as is.
+func pathHelperPATH(fs afero.Fs, current string) string {
+	files := []string{pathHelperPaths}
+	if entries, err := afero.ReadDir(fs, pathHelperPathsDir); err == nil {
+		for _, e := range entries {
+			if !e.IsDir() {
+				files = append(files, filepath.Join(pathHelperPathsDir, e.Name()))
+			}
+		}
+	}
+
+	var dirs []string
+	for _, name := range files {
+		data, err := afero.ReadFile(fs, name)
+		if err != nil {
+			continue
+		}
+		for _, dir := range parsePathHelperFile(data) {
+			if !slices.Contains(dirs, dir) {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	if len(dirs) == 0 {
+		return current
+	}
+	for _, dir := range strings.Split(current, ":") {
+		if dir != "" && !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return strings.Join(dirs, ":")
+}
+
+// parsePathHelperFile returns the directories listed one per line in a
+// path_helper file, ignoring blank lines and comments.
+func parsePathHelperFile(data []byte) []string {
+	var dirs []string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		dirs = append(dirs, line)
+	}
+	return dirs
+}
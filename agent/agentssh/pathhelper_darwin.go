@@ -0,0 +1,32 @@
+//go:build darwin
+
+package agentssh
+
+import (
+	"context"
+	"slices"
+
+	"cdr.dev/slog"
+)
+
+// darwinFallbackShell is used for users whose shell is a placeholder, the
+// default shell of macOS.
+const darwinFallbackShell = "/bin/zsh"
+
+// withPlatformPATH sets PATH for commands that aren't run by a login shell
+// the way path_helper does for login shells, so that e.g. Homebrew and the
+// Xcode tools are found.
+func (s *Server) withPlatformPATH(env []string) []string {
+	return setEnv(env, "PATH", pathHelperPATH(s.fs, envPATH(env)))
+}
+
+// platformShell replaces shells that can't run commands, which users
+// created by MDM sometimes have, with zsh.
+func (s *Server) platformShell(shell string) string {
+	if !slices.Contains([]string{"/bin/false", "/usr/bin/false"}, shell) {
+		return shell
+	}
+	s.logger.Warn(context.Background(), "user shell can't run commands, falling back to zsh",
+		slog.F("shell", shell), slog.F("fallback", darwinFallbackShell))
+	return darwinFallbackShell
+}
@@ -0,0 +1,95 @@
+package agentssh
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_pathHelperPATH(t *testing.T) {
+	t.Parallel()
+
+	writeFiles := func(t *testing.T, files map[string]string) afero.Fs {
+		t.Helper()
+		fs := afero.NewMemMapFs()
+		for name, content := range files {
+			require.NoError(t, afero.WriteFile(fs, name, []byte(content), 0o644))
+		}
+		return fs
+	}
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		current string
+		want    string
+	}{
+		{
+			name:    "NoFiles",
+			current: "/usr/bin:/bin",
+			want:    "/usr/bin:/bin",
+		},
+		{
+			name: "Paths",
+			files: map[string]string{
+				"/etc/paths": "/usr/local/bin\n/usr/bin\n/bin\n",
+			},
+			want: "/usr/local/bin:/usr/bin:/bin",
+		},
+		{
+			name: "PathsDLexicalOrder",
+			files: map[string]string{
+				"/etc/paths":                     "/usr/bin\n/bin\n",
+				"/etc/paths.d/100-rvictl":        "/Library/Apple/usr/bin\n",
+				"/etc/paths.d/10-cryptex":        "/System/Cryptexes/App/usr/bin\n",
+				"/etc/paths.d/homebrew":          "/opt/homebrew/bin\n",
+				"/etc/paths.d/nested/not-listed": "/nested/bin\n",
+			},
+			want: "/usr/bin:/bin:/System/Cryptexes/App/usr/bin:/Library/Apple/usr/bin:/opt/homebrew/bin",
+		},
+		{
+			name: "BlankLinesAndComments",
+			files: map[string]string{
+				"/etc/paths":          "\n  /usr/bin  \n# comment\n\n/bin",
+				"/etc/paths.d/tools":  "\r\n/opt/tools/bin\r\n",
+				"/etc/paths.d/empty":  "",
+				"/etc/paths.d/spaces": "   \n\t\n",
+			},
+			want: "/usr/bin:/bin:/opt/tools/bin",
+		},
+		{
+			name: "Duplicates",
+			files: map[string]string{
+				"/etc/paths":       "/usr/bin\n/bin\n/usr/bin\n",
+				"/etc/paths.d/dup": "/bin\n/opt/homebrew/bin\n",
+			},
+			want: "/usr/bin:/bin:/opt/homebrew/bin",
+		},
+		{
+			name: "MergeCurrent",
+			files: map[string]string{
+				"/etc/paths":            "/usr/bin\n/bin\n",
+				"/etc/paths.d/homebrew": "/opt/homebrew/bin\n",
+			},
+			current: "/Users/coder/bin:/bin::/usr/bin:/Users/coder/go/bin",
+			want:    "/usr/bin:/bin:/opt/homebrew/bin:/Users/coder/bin:/Users/coder/go/bin",
+		},
+		{
+			name: "OnlyPathsD",
+			files: map[string]string{
+				"/etc/paths.d/homebrew": "/opt/homebrew/bin\n",
+			},
+			current: "/usr/bin",
+			want:    "/opt/homebrew/bin:/usr/bin",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			fs := writeFiles(t, tt.files)
+			require.Equal(t, tt.want, pathHelperPATH(fs, tt.current))
+		})
+	}
+}
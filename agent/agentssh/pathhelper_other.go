@@ -0,0 +1,13 @@
+//go:build !darwin
+
+package agentssh
+
+// withPlatformPATH returns env unchanged, path_helper only exists on macOS.
+func (*Server) withPlatformPATH(env []string) []string {
+	return env
+}
+
+// platformShell returns shell unchanged.
+func (*Server) platformShell(shell string) string {
+	return shell
+}
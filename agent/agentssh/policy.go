@@ -0,0 +1,133 @@
+package agentssh
+
+import (
+	"context"
+	"time"
+)
+
+// Policy is the part of the configuration of the server that can be changed
+// while it runs with Server.SetPolicy. Changes apply to sessions, commands
+// and forwards started afterwards, never to those already running.
+type Policy struct {
+	// BlockFileTransfer restricts use of file transfer applications.
+	BlockFileTransfer bool
+	// StrictAgentForwarding fails the session if agent forwarding was
+	// requested but could not be set up. By default, like OpenSSH, the
+	// session continues without agent forwarding.
+	StrictAgentForwarding bool
+	// MaxSessionLifetime is the maximum duration of a PTY session,
+	// regardless of activity. Sessions are warned a minute before they are
+	// terminated. Unlike Config.MaxTimeout, this applies to individual sessions
+	// rather than connections. Zero means no limit.
+	MaxSessionLifetime time.Duration
+	// MaxSessionLifetimeIncludeExec also applies MaxSessionLifetime to
+	// sessions without a PTY.
+	MaxSessionLifetimeIncludeExec bool
+	// UnixSocketForwardPolicy decides whether clients may connect to the Unix
+	// socket at the given path via direct-streamlocal forwarding. Defaults to
+	// a policy denying DeniedUnixSockets and DeniedUnixSocketPaths unless
+	// listed in AllowedUnixSockets. The default policy keeps clients from
+	// reaching well-known sockets by accident, it is not a security
+	// boundary: users with a shell can connect to any socket they can
+	// access, e.g. with socat.
+	UnixSocketForwardPolicy func(path string) bool
+	// DeniedUnixSockets is a list of socket file names that can't be
+	// forwarded to by the default UnixSocketForwardPolicy. Defaults to
+	// DefaultDeniedUnixSockets.
+	DeniedUnixSockets []string
+	// DeniedUnixSocketPaths is a list of socket paths that can't be
+	// forwarded to by the default UnixSocketForwardPolicy under any name,
+	// including hard links. Defaults to DefaultDeniedUnixSocketPaths.
+	DeniedUnixSocketPaths []string
+	// AllowedUnixSockets is a list of socket paths that may be forwarded to
+	// even if their name is in DeniedUnixSockets.
+	AllowedUnixSockets []string
+	// ReverseForwardIdleTimeout releases ports bound by tcpip-forward
+	// requests that haven't forwarded a connection for this long, so that
+	// a client reconnecting while its previous connection lingers can bind
+	// them again. Default is 0 (forwards last until canceled or the
+	// connection closes).
+	ReverseForwardIdleTimeout time.Duration
+	// StrictSessionTypes rejects sessions whose magic session type is not in
+	// AllowedSessionTypes, instead of treating them as regular sessions.
+	StrictSessionTypes bool
+	// AllowedSessionTypes are the session types accepted in strict mode.
+	// Defaults to ssh, vscode and jetbrains.
+	AllowedSessionTypes []MagicSessionType
+	// RequireSessionType additionally rejects sessions that don't set the
+	// magic session type in strict mode.
+	RequireSessionType bool
+	// ExecInSessionCrossConnection allows exec sessions to run in named
+	// sessions of other connections, see ExecInEnvironmentVariable.
+	ExecInSessionCrossConnection bool
+	// RejectPTYSFTP refuses the sftp subsystem on sessions that requested
+	// a PTY, which is always a client misconfiguration (e.g. `RequestTTY
+	// force`) that breaks some SFTP clients.
+	RejectPTYSFTP bool
+	// SFTPRequireHome refuses SFTP sessions when the home directory of the
+	// user doesn't exist, instead of starting them in a fallback directory
+	// where relative uploads may land somewhere unexpected.
+	SFTPRequireHome bool
+	// RequirePTYForShell rejects sessions requesting a shell without a
+	// PTY, which is usually a misconfigured script. Such login shells have
+	// no working job control and may wait for input forever. Sessions
+	// running a command and subsystems are not affected.
+	RequirePTYForShell bool
+
+	// unixSocketForwardPolicy is UnixSocketForwardPolicy or the default
+	// policy for the socket lists.
+	unixSocketForwardPolicy func(path string) bool
+}
+
+// withDefaults returns a copy of p with the defaults applied.
+func (p Policy) withDefaults() *Policy {
+	if p.DeniedUnixSockets == nil {
+		p.DeniedUnixSockets = DefaultDeniedUnixSockets
+	}
+	if p.DeniedUnixSocketPaths == nil {
+		p.DeniedUnixSocketPaths = DefaultDeniedUnixSocketPaths
+	}
+	p.unixSocketForwardPolicy = p.UnixSocketForwardPolicy
+	if p.unixSocketForwardPolicy == nil {
+		p.unixSocketForwardPolicy = defaultUnixSocketForwardPolicy(p.DeniedUnixSockets, p.DeniedUnixSocketPaths, p.AllowedUnixSockets)
+	}
+	if p.AllowedSessionTypes == nil {
+		p.AllowedSessionTypes = []MagicSessionType{MagicSessionTypeSSH, MagicSessionTypeVSCode, MagicSessionTypeJetBrains}
+	}
+	return &p
+}
+
+// SetPolicy replaces the policy of the server. It's safe to call while
+// sessions are running, which keep the policy they started with.
+func (s *Server) SetPolicy(p Policy) {
+	s.policy.Store(p.withDefaults())
+}
+
+// Policy returns the current policy of the server, with defaults applied.
+func (s *Server) Policy() Policy {
+	return *s.currentPolicy()
+}
+
+// currentPolicy returns the current policy of the server. Handlers read it
+// once and pass it on, so that a session sees a consistent policy.
+func (s *Server) currentPolicy() *Policy {
+	return s.policy.Load()
+}
+
+// policyKey is the context key of the policy of a session, see withPolicy.
+type policyKey struct{}
+
+// withPolicy returns ctx carrying the policy of a session, so that commands
+// created for the session use it instead of the current policy.
+func withPolicy(ctx context.Context, p *Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, p)
+}
+
+// policyFromContext returns the policy set by withPolicy, or the current
+// policy if ctx has none.
+func (s *Server) policyFromContext(ctx context.Context) *Policy {
+	if p, ok := ctx.Value(policyKey{}).(*Policy); ok {
+		return p
+	}
+	return s.currentPolicy()
+}
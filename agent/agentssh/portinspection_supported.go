@@ -3,15 +3,18 @@
 package agentssh
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/cakturk/go-netstat/netstat"
 	"golang.org/x/xerrors"
 )
 
-func getListeningPortProcessCmdline(port uint32) (string, error) {
+func getListeningPortProcess(port uint32) (PortProcess, error) {
 	acceptFn := func(s *netstat.SockTabEntry) bool {
 		return s.LocalAddr != nil && uint32(s.LocalAddr.Port) == port
 	}
@@ -24,7 +27,7 @@ func getListeningPortProcessCmdline(port uint32) (string, error) {
 	// interested in the err4 (and vice versa).  So return both errors (at least 1
 	// is non-nil) if the other list is empty.
 	if (err4 != nil && len(tabs6) == 0) || (err6 != nil && len(tabs4) == 0) {
-		return "", xerrors.Errorf("inspect port %d: %w", port, errors.Join(err4, err6))
+		return PortProcess{}, xerrors.Errorf("inspect port %d: %w", port, errors.Join(err4, err6))
 	}
 
 	var proc *netstat.Process
@@ -37,7 +40,7 @@ func getListeningPortProcessCmdline(port uint32) (string, error) {
 		// Either nothing is listening on this port or we were unable to read the
 		// process details (permission issues reading /proc/$pid/* potentially).
 		// Or, perhaps /proc/net/tcp{,6} is not listing the port for some reason.
-		return "", nil
+		return PortProcess{}, nil
 	}
 
 	// The process name provided by go-netstat does not include the full command
@@ -45,7 +48,35 @@ func getListeningPortProcessCmdline(port uint32) (string, error) {
 	pid := proc.Pid
 	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
 	if err != nil {
-		return "", xerrors.Errorf("read /proc/%d/cmdline: %w", pid, err)
+		return PortProcess{}, xerrors.Errorf("read /proc/%d/cmdline: %w", pid, err)
 	}
-	return string(data), nil
+	// The start time tells a restarted process reusing the PID apart, it is
+	// best effort.
+	startTime, _ := procStartTime(pid)
+	return PortProcess{PID: pid, StartTime: startTime, Cmdline: string(data)}, nil
+}
+
+// procStartTime returns the start time of the process in clock ticks since
+// boot, field 22 of /proc/<pid>/stat.
+func procStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, xerrors.Errorf("read /proc/%d/stat: %w", pid, err)
+	}
+	// The command name in field 2 may contain spaces and parentheses, the
+	// fields after it start after the last ")".
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return 0, xerrors.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	// fields[0] is field 3.
+	if len(fields) < 20 {
+		return 0, xerrors.Errorf("malformed /proc/%d/stat", pid)
+	}
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, xerrors.Errorf("parse start time: %w", err)
+	}
+	return startTime, nil
 }
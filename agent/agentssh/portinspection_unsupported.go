@@ -2,8 +2,8 @@
 
 package agentssh
 
-func getListeningPortProcessCmdline(uint32) (string, error) {
+func getListeningPortProcess(uint32) (PortProcess, error) {
 	// We are not worrying about other platforms at the moment because Gateway
 	// only supports Linux anyway.
-	return "", nil
+	return PortProcess{}, nil
 }
@@ -0,0 +1,293 @@
+package agentssh
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.uber.org/atomic"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+
+	"github.com/coder/coder/v2/pty"
+	"github.com/coder/quartz"
+)
+
+// defaultPrewarmTerm is the TERM pre-warmed shells are started with until an
+// interactive session requests a different one.
+const defaultPrewarmTerm = "xterm-256color"
+
+// prewarmMaxHashChanges is how often the command of new shells may change
+// during a refill before pre-warming is disabled, e.g. because UpdateEnv
+// returns a different environment every time.
+const prewarmMaxHashChanges = 3
+
+// prewarmedShell is an idle login shell started ahead of time so that
+// interactive sessions don't have to wait for the shell to initialize.
+type prewarmedShell struct {
+	hash    string
+	ptty    pty.PTYCmd
+	process pty.Process
+	cancel  context.CancelFunc
+	idle    *quartz.Timer
+}
+
+// discard kills the shell and releases its PTY.
+func (sh *prewarmedShell) discard() {
+	if sh.idle != nil {
+		sh.idle.Stop()
+	}
+	_ = sh.process.Kill()
+	_ = sh.ptty.Close()
+	_ = sh.process.Wait()
+	sh.cancel()
+}
+
+// shellPool keeps up to Config.PrewarmShells idle login shells around. A
+// shell is only handed to a session if the session would have started the
+// exact same command (path, arguments, directory and environment, including
+// the output of UpdateEnv and TERM), so pre-warming is transparent to the
+// user. Sessions with client provided environment, agent or X11 forwarding
+// therefore always start a new shell. If the command isn't deterministic,
+// no shell would ever match and pre-warming is disabled.
+type shellPool struct {
+	s        *Server
+	disabled atomic.Bool
+
+	mu      sync.Mutex
+	term    string
+	shells  []*prewarmedShell
+	filling bool
+}
+
+func newShellPool(s *Server) *shellPool {
+	return &shellPool{s: s, term: defaultPrewarmTerm}
+}
+
+func (p *shellPool) enabled() bool {
+	return p.s.config.PrewarmShells > 0 && !p.disabled.Load()
+}
+
+// take returns a pre-warmed shell matching cmd, or nil if there is none. The
+// pool is refilled in the background either way.
+func (p *shellPool) take(cmd *pty.Cmd, term string) *prewarmedShell {
+	if !p.enabled() {
+		return nil
+	}
+	defer p.refill(term)
+
+	hash := commandHash(cmd)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, sh := range p.shells {
+		if sh.hash != hash {
+			continue
+		}
+		p.shells = append(p.shells[:i], p.shells[i+1:]...)
+		sh.idle.Stop()
+		p.s.metrics.prewarmedShells.WithLabelValues("handoff").Add(1)
+		return sh
+	}
+	p.s.metrics.prewarmedShells.WithLabelValues("miss").Add(1)
+	return nil
+}
+
+// refill starts shells in the background until the pool is full, using the
+// given TERM for new shells.
+func (p *shellPool) refill(term string) {
+	if !p.enabled() {
+		return
+	}
+	p.mu.Lock()
+	p.term = term
+	if p.filling {
+		p.mu.Unlock()
+		return
+	}
+	p.filling = true
+	p.mu.Unlock()
+
+	p.s.mu.Lock()
+	if !p.s.addTrackedLocked() {
+		p.s.mu.Unlock()
+		p.mu.Lock()
+		p.filling = false
+		p.mu.Unlock()
+		return
+	}
+	p.s.mu.Unlock()
+
+	go func() {
+		defer p.s.wg.Done()
+
+		// Every attempt starts at most one shell, and the last one finds the
+		// pool full. Changes of the command discard the shells started so
+		// far, some are allowed for inputs changing during the refill.
+		var lastHash string
+		changes := 0
+		for range p.s.config.PrewarmShells + 1 + prewarmMaxHashChanges {
+			done, hash, err := p.fillOne()
+			if err != nil {
+				p.s.logger.Warn(context.Background(), "failed to pre-warm shell", slog.Error(err))
+				p.s.metrics.prewarmedShells.WithLabelValues("error").Add(1)
+				p.stopFilling()
+				return
+			}
+			if done {
+				return
+			}
+			if hash == "" {
+				continue
+			}
+			if lastHash != "" && hash != lastHash {
+				changes++
+			}
+			lastHash = hash
+			if changes >= prewarmMaxHashChanges {
+				p.s.logger.Warn(context.Background(), "disabling shell pre-warming, the shell command changes every time, check that the environment and UpdateEnv are deterministic",
+					slog.F("changes", changes))
+				p.s.metrics.prewarmedShells.WithLabelValues("disabled").Add(1)
+				p.disabled.Store(true)
+				p.stopFilling()
+				p.drain()
+				return
+			}
+		}
+		p.s.logger.Warn(context.Background(), "gave up pre-warming shells, the pool didn't fill up",
+			slog.F("changes", changes))
+		p.s.metrics.prewarmedShells.WithLabelValues("gave_up").Add(1)
+		p.stopFilling()
+	}()
+}
+
+// stopFilling clears the filling flag, so that the next refill starts over.
+func (p *shellPool) stopFilling() {
+	p.mu.Lock()
+	p.filling = false
+	p.mu.Unlock()
+}
+
+// fillOne discards shells started with outdated inputs and starts a new shell
+// if the pool isn't full. It reports whether filling is done, in which case
+// the filling flag has been cleared, and the hash of the command of new
+// shells, if it got that far.
+func (p *shellPool) fillOne() (done bool, hash string, err error) {
+	p.s.mu.RLock()
+	closing := p.s.closing != nil
+	p.s.mu.RUnlock()
+	if closing {
+		p.stopFilling()
+		return true, "", nil
+	}
+
+	p.mu.Lock()
+	term := p.term
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd, err := p.s.CreateCommand(ctx, "", nil, nil)
+	if err != nil {
+		cancel()
+		return false, "", xerrors.Errorf("create command: %w", err)
+	}
+	cmd.Env = setEnv(cmd.Env, "TERM", term)
+	hash = commandHash(cmd)
+
+	p.mu.Lock()
+	if p.term != term {
+		// TERM changed while creating the command, try again.
+		p.mu.Unlock()
+		cancel()
+		return false, "", nil
+	}
+	var stale []*prewarmedShell
+	current := p.shells[:0]
+	for _, sh := range p.shells {
+		if sh.hash == hash {
+			current = append(current, sh)
+		} else {
+			stale = append(stale, sh)
+		}
+	}
+	p.shells = current
+	full := len(p.shells) >= p.s.config.PrewarmShells
+	if full {
+		// Cleared while holding the lock so that a concurrent take
+		// either sees the flag cleared or its shell missing here.
+		p.filling = false
+	}
+	p.mu.Unlock()
+
+	for _, sh := range stale {
+		p.s.metrics.prewarmedShells.WithLabelValues("stale").Add(1)
+		sh.discard()
+	}
+	if full {
+		cancel()
+		return true, hash, nil
+	}
+
+	ptty, process, err := p.s.startPTY(ctx, p.s.logger, cmd)
+	if err != nil {
+		cancel()
+		return false, hash, xerrors.Errorf("start shell: %w", err)
+	}
+	sh := &prewarmedShell{
+		hash:    hash,
+		ptty:    ptty,
+		process: process,
+		cancel:  cancel,
+	}
+	// Shells that aren't used for a while are killed so that they don't
+	// hold on to outdated state (e.g. credentials loaded by the profile).
+	// They are replaced by the next interactive session.
+	sh.idle = p.s.config.Clock.AfterFunc(p.s.config.PrewarmIdleTimeout, func() {
+		if p.remove(sh) {
+			p.s.metrics.prewarmedShells.WithLabelValues("idle").Add(1)
+			sh.discard()
+		}
+	}, "prewarm", "idle")
+
+	p.mu.Lock()
+	p.shells = append(p.shells, sh)
+	p.mu.Unlock()
+	return false, hash, nil
+}
+
+// remove removes sh from the pool, reporting whether it was present.
+func (p *shellPool) remove(sh *prewarmedShell) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, other := range p.shells {
+		if other == sh {
+			p.shells = append(p.shells[:i], p.shells[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// drain kills all pre-warmed shells.
+func (p *shellPool) drain() {
+	p.mu.Lock()
+	shells := p.shells
+	p.shells = nil
+	p.mu.Unlock()
+	for _, sh := range shells {
+		sh.discard()
+	}
+}
+
+// commandHash identifies the inputs of a command.
+func commandHash(cmd *pty.Cmd) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\x00%s\x00%s\x00", cmd.Path, strings.Join(cmd.Args, "\x00"), cmd.Dir)
+	for _, e := range cmd.Env {
+		_, _ = fmt.Fprintf(h, "%s\x00", e)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
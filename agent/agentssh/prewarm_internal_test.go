@@ -0,0 +1,332 @@
+//go:build !windows
+
+package agentssh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/v2/agent/agentexec"
+	"github.com/coder/coder/v2/pty"
+	"github.com/coder/coder/v2/testutil"
+	"github.com/coder/quartz"
+)
+
+func TestPrewarmShells_Handoff(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := testutil.Logger(t)
+	s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &Config{
+		PrewarmShells: 1,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	require.NoError(t, err)
+
+	sh := requirePrewarmedShell(t, s)
+	// Mark the pre-warmed shell so that we can tell it apart from a shell
+	// started for the session.
+	_, err = io.WriteString(sh.ptty.InputWriter(), "PREWARM_MARKER=yes\n")
+	require.NoError(t, err)
+
+	c, stop := servePrewarmTest(t, s)
+	defer stop()
+
+	out := runPrewarmSession(ctx, t, c, defaultPrewarmTerm, "echo marker=$PREWARM_MARKER; exit\n")
+	require.Contains(t, out, "marker=yes")
+	require.EqualValues(t, 1, promtestutil.ToFloat64(s.metrics.prewarmedShells.WithLabelValues("handoff")))
+
+	// A session with a different TERM doesn't match the pool, and the pool
+	// is refilled using the new TERM.
+	out = runPrewarmSession(ctx, t, c, "vt100", "echo marker=$PREWARM_MARKER term=$TERM; exit\n")
+	require.NotContains(t, out, "marker=yes")
+	require.Contains(t, out, "term=vt100")
+	require.EqualValues(t, 1, promtestutil.ToFloat64(s.metrics.prewarmedShells.WithLabelValues("miss")))
+	require.Eventually(t, func() bool {
+		s.prewarm.mu.Lock()
+		defer s.prewarm.mu.Unlock()
+		return len(s.prewarm.shells) == 1 && s.prewarm.term == "vt100"
+	}, testutil.WaitShort, testutil.IntervalFast)
+
+	// Exec sessions never use the pool.
+	sess, err := c.NewSession()
+	require.NoError(t, err)
+	err = sess.Run("true")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, promtestutil.ToFloat64(s.metrics.prewarmedShells.WithLabelValues("handoff")))
+	require.EqualValues(t, 1, promtestutil.ToFloat64(s.metrics.prewarmedShells.WithLabelValues("miss")))
+}
+
+func TestPrewarmShells_IdleAndStale(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := testutil.Logger(t)
+	clk := quartz.NewMock(t)
+	idleTrap := clk.Trap().AfterFunc("prewarm", "idle")
+	defer idleTrap.Close()
+
+	var envValue atomic.String
+	envValue.Store("one")
+	s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &Config{
+		PrewarmShells:      1,
+		PrewarmIdleTimeout: time.Minute,
+		Clock:              clk,
+		UpdateEnv: func(current []string) ([]string, error) {
+			return append(current, "PREWARM_TEST="+envValue.Load()), nil
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	idleTrap.MustWait(ctx).MustRelease(ctx)
+	_ = requirePrewarmedShell(t, s)
+
+	// Unused shells are killed once idle, and not replaced until the pool
+	// is used again.
+	clk.Advance(time.Minute).MustWait(ctx)
+	require.EqualValues(t, 1, promtestutil.ToFloat64(s.metrics.prewarmedShells.WithLabelValues("idle")))
+	s.prewarm.mu.Lock()
+	require.Empty(t, s.prewarm.shells)
+	s.prewarm.mu.Unlock()
+
+	s.prewarm.refill(defaultPrewarmTerm)
+	idleTrap.MustWait(ctx).MustRelease(ctx)
+	_ = requirePrewarmedShell(t, s)
+
+	// Shells started with outdated environment inputs are replaced.
+	envValue.Store("two")
+	s.prewarm.refill(defaultPrewarmTerm)
+	idleTrap.MustWait(ctx).MustRelease(ctx)
+	require.Eventually(t, func() bool {
+		return promtestutil.ToFloat64(s.metrics.prewarmedShells.WithLabelValues("stale")) == 1
+	}, testutil.WaitShort, testutil.IntervalFast)
+	_ = requirePrewarmedShell(t, s)
+}
+
+func TestPrewarmShells_Unstable(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := testutil.Logger(t)
+	var calls atomic.Int64
+	s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &Config{
+		PrewarmShells: 2,
+		// No two shells would ever match.
+		UpdateEnv: func(current []string) ([]string, error) {
+			return append(current, fmt.Sprintf("PREWARM_TEST=%d", calls.Inc())), nil
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.Eventually(t, func() bool {
+		return promtestutil.ToFloat64(s.metrics.prewarmedShells.WithLabelValues("disabled")) == 1
+	}, testutil.WaitShort, testutil.IntervalFast)
+	require.False(t, s.prewarm.enabled())
+	require.EqualValues(t, prewarmMaxHashChanges+1, calls.Load())
+	s.prewarm.mu.Lock()
+	require.Empty(t, s.prewarm.shells)
+	require.False(t, s.prewarm.filling)
+	s.prewarm.mu.Unlock()
+
+	// Sessions don't start pre-warming again.
+	s.prewarm.refill(defaultPrewarmTerm)
+	require.EqualValues(t, prewarmMaxHashChanges+1, calls.Load())
+}
+
+func TestPrewarmShells_Retry(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := testutil.Logger(t)
+	clk := quartz.NewMock(t)
+	idleTrap := clk.Trap().AfterFunc("prewarm", "idle")
+	defer idleTrap.Close()
+	retryTrap := clk.Trap().NewTimer("pty", "retry")
+	defer retryTrap.Close()
+
+	s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &Config{
+		PrewarmShells:      1,
+		PrewarmIdleTimeout: time.Minute,
+		Clock:              clk,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	idleTrap.MustWait(ctx).MustRelease(ctx)
+	_ = requirePrewarmedShell(t, s)
+	require.Eventually(t, func() bool {
+		s.prewarm.mu.Lock()
+		defer s.prewarm.mu.Unlock()
+		return !s.prewarm.filling
+	}, testutil.WaitShort, testutil.IntervalFast)
+	clk.Advance(time.Minute).MustWait(ctx)
+
+	// Nothing starts shells until the next refill, so the start can be
+	// replaced.
+	var attempts atomic.Int64
+	s.ptyStart = func(cmd *pty.Cmd, opts ...pty.StartOption) (pty.PTYCmd, pty.Process, error) {
+		if attempts.Inc() == 1 {
+			return nil, nil, xerrors.Errorf("newPty failed: %w", &os.PathError{Op: "open", Path: "/dev/ptmx", Err: syscall.EAGAIN})
+		}
+		return pty.Start(cmd, opts...)
+	}
+	s.prewarm.refill(defaultPrewarmTerm)
+	retryTrap.MustWait(ctx).MustRelease(ctx)
+	_, w := clk.AdvanceNext()
+	w.MustWait(ctx)
+	idleTrap.MustWait(ctx).MustRelease(ctx)
+	_ = requirePrewarmedShell(t, s)
+	require.EqualValues(t, 2, attempts.Load())
+	require.EqualValues(t, 1, promtestutil.ToFloat64(s.metrics.ptyStartRetries))
+	require.Zero(t, promtestutil.ToFloat64(s.metrics.prewarmedShells.WithLabelValues("error")))
+}
+
+// BenchmarkPrewarmShells measures the time until the first output of an
+// interactive login shell, with and without a pre-warmed shell.
+func BenchmarkPrewarmShells(b *testing.B) {
+	for _, prewarm := range []int{0, 1} {
+		name := "Cold"
+		if prewarm > 0 {
+			name = "Prewarmed"
+		}
+		b.Run(name, func(b *testing.B) {
+			ctx := testutil.Context(b, testutil.WaitSuperLong)
+			s, err := NewServer(ctx, testutil.Logger(b), prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &Config{
+				PrewarmShells: prewarm,
+			})
+			require.NoError(b, err)
+			defer s.Close()
+			err = s.UpdateHostSigner(42)
+			require.NoError(b, err)
+
+			c, stop := servePrewarmTest(b, s)
+			defer stop()
+
+			b.ResetTimer()
+			for range b.N {
+				b.StopTimer()
+				if prewarm > 0 {
+					_ = requirePrewarmedShell(b, s)
+				}
+				sess, err := c.NewSession()
+				require.NoError(b, err)
+				err = sess.RequestPty(defaultPrewarmTerm, 24, 80, gossh.TerminalModes{})
+				require.NoError(b, err)
+				stdin, err := sess.StdinPipe()
+				require.NoError(b, err)
+				stdout, err := sess.StdoutPipe()
+				require.NoError(b, err)
+				b.StartTimer()
+
+				err = sess.Shell()
+				require.NoError(b, err)
+				_, err = io.WriteString(stdin, "echo prompt-$((1+1))\n")
+				require.NoError(b, err)
+				waitForOutput(b, stdout, "prompt-2")
+
+				b.StopTimer()
+				_, _ = io.WriteString(stdin, "exit\n")
+				_ = sess.Wait()
+				_ = sess.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// requirePrewarmedShell waits for the pool to contain a shell and returns it.
+func requirePrewarmedShell(t testing.TB, s *Server) *prewarmedShell {
+	t.Helper()
+	var sh *prewarmedShell
+	require.Eventually(t, func() bool {
+		s.prewarm.mu.Lock()
+		defer s.prewarm.mu.Unlock()
+		if len(s.prewarm.shells) == 0 {
+			return false
+		}
+		sh = s.prewarm.shells[0]
+		return true
+	}, testutil.WaitShort, testutil.IntervalFast)
+	return sh
+}
+
+func servePrewarmTest(t testing.TB, s *Server) (*gossh.Client, func()) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := s.Serve(ln)
+		assert.Error(t, err) // Server is closed.
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	sshConn, channels, requests, err := gossh.NewClientConn(conn, "localhost:22", &gossh.ClientConfig{
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(), //nolint:gosec // This is a test.
+	})
+	require.NoError(t, err)
+	c := gossh.NewClient(sshConn, channels, requests)
+	return c, func() {
+		_ = c.Close()
+		_ = s.Close()
+		<-done
+	}
+}
+
+func runPrewarmSession(ctx context.Context, t *testing.T, c *gossh.Client, term, input string) string {
+	t.Helper()
+
+	sess, err := c.NewSession()
+	require.NoError(t, err)
+	defer sess.Close()
+	err = sess.RequestPty(term, 24, 80, gossh.TerminalModes{})
+	require.NoError(t, err)
+	var out bytes.Buffer
+	sess.Stdout = &out
+	sess.Stdin = bytes.NewBufferString(input)
+	err = sess.Shell()
+	require.NoError(t, err)
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- sess.Wait() }()
+	select {
+	case <-waitErr:
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for session")
+	}
+	return out.String()
+}
+
+func waitForOutput(t testing.TB, r io.Reader, want string) {
+	t.Helper()
+	var out []byte
+	buf := make([]byte, 1024)
+	for !bytes.Contains(out, []byte(want)) {
+		n, err := r.Read(buf)
+		require.NoError(t, err)
+		out = append(out, buf[:n]...)
+	}
+}
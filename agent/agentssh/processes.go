@@ -0,0 +1,106 @@
+package agentssh
+
+import (
+	"context"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"cdr.dev/slog"
+)
+
+const (
+	// processCancelWorkers is the maximum number of processes canceled
+	// concurrently when the server is closed.
+	processCancelWorkers = 16
+	// processCancelTimeout bounds the time spent canceling processes when
+	// the server is closed.
+	processCancelTimeout = 10 * time.Second
+)
+
+// TrackedProcess describes a process started by a session without a PTY,
+// which is tracked so that it can be terminated when the server is closed.
+type TrackedProcess struct {
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	Argv    []string  `json:"argv"`
+}
+
+type processInfo struct {
+	started time.Time
+	argv    []string
+}
+
+// TrackedProcesses returns the processes currently tracked by the server,
+// oldest first.
+func (s *Server) TrackedProcesses() []TrackedProcess {
+	s.mu.RLock()
+	procs := make([]TrackedProcess, 0, len(s.processes))
+	for p, info := range s.processes {
+		procs = append(procs, TrackedProcess{
+			PID:     p.Pid,
+			Started: info.started,
+			Argv:    slices.Clone(info.argv),
+		})
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(procs, func(a, b TrackedProcess) int {
+		return a.Started.Compare(b.Started)
+	})
+	return procs
+}
+
+// tooManyProcesses reports whether MaxTrackedProcesses has been reached.
+func (s *Server) tooManyProcesses() bool {
+	if s.config.MaxTrackedProcesses <= 0 {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.processes) >= s.config.MaxTrackedProcesses
+}
+
+// cancelProcesses cancels procs using a bounded number of workers. It returns
+// once all processes have been canceled or the timeout is reached, in which
+// case the remaining processes are skipped.
+func cancelProcesses(logger slog.Logger, procs []*os.Process, cancel func(slog.Logger, *os.Process) error, workers int, timeout time.Duration) {
+	ctx, stop := context.WithTimeout(context.Background(), timeout)
+	defer stop()
+
+	queue := make(chan *os.Process)
+	var wg sync.WaitGroup
+	for range min(workers, len(procs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				_ = cancel(logger, p)
+			}
+		}()
+	}
+	defer func() {
+		close(queue)
+		// Workers may still be canceling a process if the timeout was
+		// reached, don't wait for them.
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}()
+
+	for i, p := range procs {
+		select {
+		case queue <- p:
+		case <-ctx.Done():
+			logger.Warn(ctx, "timed out canceling processes", slog.F("skipped", len(procs)-i))
+			return
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package agentssh
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"cdr.dev/slog"
+
+	"github.com/coder/coder/v2/testutil"
+)
+
+func Test_cancelProcesses(t *testing.T) {
+	t.Parallel()
+
+	procs := make([]*os.Process, 200)
+	for i := range procs {
+		procs[i] = &os.Process{Pid: i + 1}
+	}
+
+	t.Run("Parallel", func(t *testing.T) {
+		t.Parallel()
+
+		var canceled atomic.Int64
+		slowCancel := func(slog.Logger, *os.Process) error {
+			time.Sleep(20 * time.Millisecond)
+			canceled.Add(1)
+			return nil
+		}
+		start := time.Now()
+		cancelProcesses(testutil.Logger(t), procs, slowCancel, processCancelWorkers, testutil.WaitLong)
+		// Serially this would take 4 seconds.
+		require.Less(t, time.Since(start), 2*time.Second)
+		require.EqualValues(t, len(procs), canceled.Load())
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		t.Parallel()
+
+		release := make(chan struct{})
+		defer close(release)
+		var canceled atomic.Int64
+		stuckCancel := func(slog.Logger, *os.Process) error {
+			canceled.Add(1)
+			<-release
+			return nil
+		}
+		start := time.Now()
+		cancelProcesses(testutil.Logger(t), procs, stuckCancel, 4, 100*time.Millisecond)
+		require.Less(t, time.Since(start), testutil.WaitShort)
+		require.EqualValues(t, 4, canceled.Load())
+	})
+}
@@ -0,0 +1,87 @@
+package agentssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"cdr.dev/slog"
+)
+
+const (
+	kernelPTYMaxFile = "/proc/sys/kernel/pty/max"
+	mountsFile       = "/proc/self/mounts"
+)
+
+// acquirePTY reserves one of Config.MaxPTYs for a PTY session, the returned
+// func releases it. ok is false if all are in use.
+func (s *Server) acquirePTY() (release func(), ok bool) {
+	n := s.openPTYs.Inc()
+	if limit := s.config.MaxPTYs; limit > 0 && n > int64(limit) {
+		s.openPTYs.Dec()
+		return nil, false
+	}
+	s.metrics.ptysOpen.Inc()
+	return func() {
+		s.openPTYs.Dec()
+		s.metrics.ptysOpen.Dec()
+	}, true
+}
+
+// logPTYLimit logs how many pseudo-terminals the kernel allows, so that
+// operators can tell why PTY sessions fail, and reports the effective
+// maximum.
+func (s *Server) logPTYLimit(ctx context.Context, fs afero.Fs) {
+	kernelMax, devptsMax := kernelPTYLimit(fs)
+	limit := kernelMax
+	if devptsMax > 0 && (limit == 0 || devptsMax < limit) {
+		limit = devptsMax
+	}
+	if limit > 0 {
+		s.logger.Info(ctx, "pseudo-terminal limit",
+			slog.F("kernel_max", kernelMax),
+			slog.F("devpts_max", devptsMax),
+			slog.F("max_ptys", s.config.MaxPTYs))
+	}
+	if s.config.MaxPTYs > 0 {
+		limit = s.config.MaxPTYs
+	}
+	s.metrics.ptysMax.Set(float64(limit))
+}
+
+// kernelPTYLimit returns the maximum number of pseudo-terminals of the
+// kernel and of the devpts mount at /dev/pts, or zero if unknown (e.g. not
+// on Linux).
+func kernelPTYLimit(fs afero.Fs) (kernelMax, devptsMax int) {
+	if data, err := afero.ReadFile(fs, kernelPTYMaxFile); err == nil {
+		kernelMax, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	if data, err := afero.ReadFile(fs, mountsFile); err == nil {
+		devptsMax = parseDevptsMax(data)
+	}
+	return kernelMax, devptsMax
+}
+
+// parseDevptsMax returns the max= option of the devpts mount at /dev/pts in
+// the contents of /proc/self/mounts, or zero if it is unset.
+func parseDevptsMax(mounts []byte) int {
+	s := bufio.NewScanner(bytes.NewReader(mounts))
+	for s.Scan() {
+		// devpts /dev/pts devpts rw,nosuid,noexec,gid=5,mode=620,max=1024 0 0
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || fields[1] != "/dev/pts" || fields[2] != "devpts" {
+			continue
+		}
+		for _, opt := range strings.Split(fields[3], ",") {
+			if v, ok := strings.CutPrefix(opt, "max="); ok {
+				n, _ := strconv.Atoi(v)
+				return n
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,29 @@
+package agentssh
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_kernelPTYLimit(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewMemMapFs()
+	kernelMax, devptsMax := kernelPTYLimit(fs)
+	require.Zero(t, kernelMax)
+	require.Zero(t, devptsMax)
+
+	require.NoError(t, afero.WriteFile(fs, kernelPTYMaxFile, []byte("4096\n"), 0o644))
+	require.NoError(t, afero.WriteFile(fs, mountsFile, []byte(
+		"overlay / overlay rw,relatime,lowerdir=/a,upperdir=/b,workdir=/c 0 0\n"+
+			"devpts /dev/pts devpts rw,nosuid,noexec,relatime,gid=5,mode=620,ptmxmode=666,max=128 0 0\n"+
+			"devpts /other/pts devpts rw,max=1 0 0\n",
+	), 0o644))
+	kernelMax, devptsMax = kernelPTYLimit(fs)
+	require.Equal(t, 4096, kernelMax)
+	require.Equal(t, 128, devptsMax)
+
+	require.Zero(t, parseDevptsMax([]byte("devpts /dev/pts devpts rw,gid=5,mode=620 0 0\n")))
+}
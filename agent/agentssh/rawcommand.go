@@ -0,0 +1,134 @@
+package agentssh
+
+import (
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kballard/go-shellquote"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+// maxLoggedCommandBytes is the length commands are truncated to in logs.
+const maxLoggedCommandBytes = 2 << 10
+
+// SessionCommand is the command requested by the client of a session.
+type SessionCommand struct {
+	// Raw is the command as sent by the client, which is what the shell
+	// runs. It is empty for login shells and subsystems.
+	Raw string
+	// Argv is Raw split into words like a shell would, without expanding
+	// anything. It is only informational and nil if Raw couldn't be split,
+	// e.g. because of unbalanced quotes.
+	Argv []string
+}
+
+func (c SessionCommand) clone() SessionCommand {
+	c.Argv = slices.Clone(c.Argv)
+	return c
+}
+
+// parseSessionCommand splits the raw command of a session into words on a
+// best-effort basis, the error only tells why Argv is nil.
+func parseSessionCommand(rawCommand string) (SessionCommand, error) {
+	command := SessionCommand{Raw: rawCommand}
+	if isLoginShell(rawCommand) {
+		return command, nil
+	}
+	argv, err := shellquote.Split(rawCommand)
+	if err != nil {
+		return command, xerrors.Errorf("split command: %w", err)
+	}
+	if len(argv) > 0 {
+		command.Argv = argv
+	}
+	return command, nil
+}
+
+// logFields returns the program and the number of arguments of the command,
+// which are short enough to be logged for every session.
+func (c SessionCommand) logFields() []slog.Field {
+	if len(c.Argv) == 0 {
+		return nil
+	}
+	return []slog.Field{
+		slog.F("command", truncateLoggedCommand(c.Argv[0])),
+		slog.F("command_args", len(c.Argv)-1),
+	}
+}
+
+// truncateLoggedCommand truncates the command to maxLoggedCommandBytes,
+// without splitting a UTF-8 character.
+func truncateLoggedCommand(command string) string {
+	if len(command) <= maxLoggedCommandBytes {
+		return command
+	}
+	n := maxLoggedCommandBytes
+	for n > 0 && !utf8.RuneStart(command[n]) {
+		n--
+	}
+	return command[:n] + "...(truncated)"
+}
+
+// commandLine is the command started for the raw command of a session, see
+// parseRawCommand.
+type commandLine struct {
+	// Name is the program to execute.
+	Name string
+	// Args are the arguments passed to Name, excluding Name itself.
+	Args []string
+	// Login is set when the shell is started as a login shell.
+	Login bool
+}
+
+// isLoginShell reports whether a session with the raw command starts a login
+// shell. gliderlabs/ssh returns an empty command when a shell is requested,
+// and some clients send an exec request with an empty command instead, which
+// is treated the same. A command of only whitespace also starts a login
+// shell, rather than a shell running nothing that exits right away.
+func isLoginShell(rawCommand string) bool {
+	return strings.TrimSpace(rawCommand) == ""
+}
+
+// parseRawCommand interprets the raw command of a session. Like OpenSSH, the
+// command is executed by the user's shell, and a blank command starts the
+// shell itself. On Linux and macOS the shell is started as a login shell
+// to consume juicy environment variables!
+//
+// A command starting with a shebang is instead passed to the interpreter of
+// the shebang, which is useful for running scripts that aren't executable.
+// A preceding space is generally not idiomatic for a shebang, but in
+// Terraform it's quite standard to use <<EOF for a multi-line string which
+// would indent with spaces, so we accept it for user-ease.
+func parseRawCommand(shell, rawCommand string, windows bool) (commandLine, error) {
+	caller := "-c"
+	if windows {
+		caller = "/c"
+	}
+
+	if isLoginShell(rawCommand) {
+		args := []string{}
+		if !windows {
+			args = append(args, "-l")
+		}
+		return commandLine{Name: shell, Args: args, Login: true}, nil
+	}
+
+	trimmed := strings.TrimSpace(rawCommand)
+	if !strings.HasPrefix(trimmed, "#!") {
+		return commandLine{Name: shell, Args: []string{caller, rawCommand}}, nil
+	}
+	shebang, _, _ := strings.Cut(trimmed, "\n")
+	shebang = strings.TrimSpace(strings.TrimPrefix(shebang, "#!"))
+	words, err := shellquote.Split(shebang)
+	if err != nil {
+		return commandLine{}, xerrors.Errorf("split shebang: %w", err)
+	}
+	if len(words) == 0 || words[0] == "" {
+		return commandLine{}, xerrors.New("shebang has no interpreter")
+	}
+	words = append(words, caller, rawCommand)
+	return commandLine{Name: words[0], Args: words[1:]}, nil
+}
@@ -0,0 +1,186 @@
+package agentssh
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseRawCommand(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name    string
+		command string
+		windows bool
+		want    commandLine
+		wantErr string
+	}{
+		{
+			name: "Login",
+			want: commandLine{Name: "/bin/bash", Args: []string{"-l"}, Login: true},
+		},
+		{
+			name:    "LoginWindows",
+			windows: true,
+			want:    commandLine{Name: "/bin/bash", Args: []string{}, Login: true},
+		},
+		{
+			name:    "Command",
+			command: "echo hello",
+			want:    commandLine{Name: "/bin/bash", Args: []string{"-c", "echo hello"}},
+		},
+		{
+			name:    "CommandWindows",
+			command: "echo hello",
+			windows: true,
+			want:    commandLine{Name: "/bin/bash", Args: []string{"/c", "echo hello"}},
+		},
+		{
+			name:    "Whitespace",
+			command: " \t\r\n",
+			want:    commandLine{Name: "/bin/bash", Args: []string{"-l"}, Login: true},
+		},
+		{
+			name:    "Comment",
+			command: "# nothing to do",
+			want:    commandLine{Name: "/bin/bash", Args: []string{"-c", "# nothing to do"}},
+		},
+		{
+			name:    "Shebang",
+			command: "#!/usr/bin/env python3\nprint(1)",
+			want:    commandLine{Name: "/usr/bin/env", Args: []string{"python3", "-c", "#!/usr/bin/env python3\nprint(1)"}},
+		},
+		{
+			name:    "IndentedShebangCRLF",
+			command: "\n    #!/bin/sh -e\r\necho hi\r\n",
+			want:    commandLine{Name: "/bin/sh", Args: []string{"-e", "-c", "\n    #!/bin/sh -e\r\necho hi\r\n"}},
+		},
+		{
+			name:    "QuotedShebang",
+			command: `#!"/opt/my interpreter" 'a b'`,
+			want:    commandLine{Name: "/opt/my interpreter", Args: []string{"a b", "-c", `#!"/opt/my interpreter" 'a b'`}},
+		},
+		{
+			name:    "EmptyShebang",
+			command: "#!",
+			wantErr: "no interpreter",
+		},
+		{
+			name:    "EmptyQuotedShebang",
+			command: "#!'' -x",
+			wantErr: "no interpreter",
+		},
+		{
+			name:    "UnterminatedQuote",
+			command: `#!/bin/sh "-e`,
+			wantErr: "split shebang",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseRawCommand("/bin/bash", tt.command, tt.windows)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func FuzzParseRawCommand(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"echo hello",
+		"#!",
+		"#!\n",
+		"   #!",
+		"#!/bin/bash\r\necho hi\r\n",
+		"#!/usr/bin/env python3\nprint(1)",
+		" #!/bin/sh -e\necho hi",
+		`#!"/bin/sh`,
+		`#!'/bin/sh -e`,
+		`#!/bin/sh \`,
+		"#!''",
+		"#!\x00",
+		"#!/bin/sh\x00-e\n",
+		"#!#!#!",
+		"#!\u00a0/bin/sh\u2003-e\n",
+		"\u3000#!/bin/sh",
+	} {
+		f.Add(seed, false)
+		f.Add(seed, true)
+	}
+	f.Fuzz(func(t *testing.T, command string, windows bool) {
+		got, err := parseRawCommand("/bin/sh", command, windows)
+		if err != nil {
+			// Only shebangs can be invalid.
+			require.True(t, strings.HasPrefix(strings.TrimSpace(command), "#!"), "unexpected error: %v", err)
+			return
+		}
+		require.NotEmpty(t, got.Name)
+		require.Equal(t, strings.TrimSpace(command) == "", got.Login)
+		if got.Login {
+			return
+		}
+		// The raw command is always passed to the shell or interpreter
+		// as is, after the caller flag.
+		require.GreaterOrEqual(t, len(got.Args), 2)
+		require.Equal(t, command, got.Args[len(got.Args)-1])
+		require.True(t, slices.Contains([]string{"-c", "/c"}, got.Args[len(got.Args)-2]))
+	})
+}
+
+func Test_parseSessionCommand(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name     string
+		raw      string
+		wantArgv []string
+		wantErr  bool
+	}{
+		{name: "LoginShell", raw: ""},
+		{name: "Whitespace", raw: " \n"},
+		{name: "Simple", raw: "ls -la /tmp", wantArgv: []string{"ls", "-la", "/tmp"}},
+		{name: "Quoted", raw: `sh -c 'echo "$HOME"'`, wantArgv: []string{"sh", "-c", `echo "$HOME"`}},
+		{name: "Escaped", raw: `touch a\ b`, wantArgv: []string{"touch", "a b"}},
+		// Operators aren't interpreted, the command is only split.
+		{name: "Operators", raw: "cd /src && make", wantArgv: []string{"cd", "/src", "&&", "make"}},
+		{name: "UnbalancedQuote", raw: `echo "hello`, wantErr: true},
+		{name: "TrailingBackslash", raw: `echo \`, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseSessionCommand(tt.raw)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			// The raw command is always kept as is.
+			require.Equal(t, tt.raw, got.Raw)
+			require.Equal(t, tt.wantArgv, got.Argv)
+		})
+	}
+}
+
+func Test_truncateLoggedCommand(t *testing.T) {
+	t.Parallel()
+
+	short := strings.Repeat("a", maxLoggedCommandBytes)
+	require.Equal(t, short, truncateLoggedCommand(short))
+
+	// A character crossing the limit is dropped whole.
+	long := strings.Repeat("a", maxLoggedCommandBytes-1) + "é" + "b"
+	got := truncateLoggedCommand(long)
+	require.Equal(t, strings.Repeat("a", maxLoggedCommandBytes-1)+"...(truncated)", got)
+	require.True(t, utf8.ValidString(got))
+}
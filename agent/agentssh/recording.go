@@ -0,0 +1,198 @@
+package agentssh
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"cdr.dev/slog"
+)
+
+// RecordingSanitizerOptions configures how terminal escape sequences in the
+// output sent to Config.SessionRecorder are filtered. The output sent to the
+// client is never modified.
+type RecordingSanitizerOptions struct {
+	// KeepClipboard keeps OSC 52 (clipboard) sequences. They are stripped
+	// by default since they contain data copied by the user.
+	KeepClipboard bool
+	// StripTitles strips OSC 0, 1 and 2 (icon and window title) sequences.
+	StripTitles bool
+	// MaxSequenceLength is the maximum length of a single OSC sequence,
+	// longer sequences are dropped. Default is 4096.
+	MaxSequenceLength int
+}
+
+const defaultMaxSequenceLength = 4096
+
+const (
+	recordingStateText = iota
+	recordingStateEsc
+	recordingStateOSC
+	recordingStateOSCEsc
+)
+
+// recordingSanitizer filters PTY output before it is recorded. It strips
+// configured OSC sequence classes, drops oversized sequences and replaces
+// invalid UTF-8 with U+FFFD. Sequences may span multiple writes.
+type recordingSanitizer struct {
+	w    io.WriteCloser
+	opts RecordingSanitizerOptions
+
+	state    int
+	osc      []byte
+	dropping bool
+	pending  []byte // Text, possibly ending in an incomplete rune.
+	out      bytes.Buffer
+}
+
+func newRecordingSanitizer(w io.WriteCloser, opts RecordingSanitizerOptions) *recordingSanitizer {
+	if opts.MaxSequenceLength <= 0 {
+		opts.MaxSequenceLength = defaultMaxSequenceLength
+	}
+	return &recordingSanitizer{w: w, opts: opts}
+}
+
+func (r *recordingSanitizer) Write(p []byte) (int, error) {
+	for _, b := range p {
+		switch r.state {
+		case recordingStateText:
+			if b == 0x1b {
+				r.flushText(true)
+				r.state = recordingStateEsc
+				continue
+			}
+			r.pending = append(r.pending, b)
+		case recordingStateEsc:
+			r.escape(b)
+		case recordingStateOSC:
+			switch b {
+			case 0x07: // BEL
+				r.finishOSC("\a")
+			case 0x1b:
+				r.state = recordingStateOSCEsc
+			default:
+				r.appendOSC(b)
+			}
+		case recordingStateOSCEsc:
+			if b == '\\' { // ST
+				r.finishOSC("\x1b\\")
+				continue
+			}
+			// Any other escape aborts the OSC sequence.
+			r.osc = r.osc[:0]
+			r.escape(b)
+		}
+	}
+	r.flushText(false)
+
+	_, err := r.w.Write(r.out.Bytes())
+	r.out.Reset()
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// escape handles the byte following ESC.
+func (r *recordingSanitizer) escape(b byte) {
+	if b == ']' {
+		r.state = recordingStateOSC
+		r.osc = r.osc[:0]
+		r.dropping = false
+		return
+	}
+	r.out.WriteByte(0x1b)
+	r.state = recordingStateText
+	if b == 0x1b {
+		r.state = recordingStateEsc
+		return
+	}
+	r.out.WriteByte(b)
+}
+
+func (r *recordingSanitizer) appendOSC(b byte) {
+	if len(r.osc) >= r.opts.MaxSequenceLength {
+		r.dropping = true
+		return
+	}
+	r.osc = append(r.osc, b)
+}
+
+func (r *recordingSanitizer) finishOSC(terminator string) {
+	r.state = recordingStateText
+	if r.dropping {
+		return
+	}
+	code, _, _ := strings.Cut(string(r.osc), ";")
+	switch code {
+	case "52":
+		if !r.opts.KeepClipboard {
+			return
+		}
+	case "0", "1", "2":
+		if r.opts.StripTitles {
+			return
+		}
+	}
+	r.out.WriteString("\x1b]")
+	r.out.WriteString(strings.ToValidUTF8(string(r.osc), "\uFFFD"))
+	r.out.WriteString(terminator)
+}
+
+// flushText writes pending text with invalid UTF-8 replaced. Unless final is
+// set, an incomplete rune at the end is kept for the next write.
+func (r *recordingSanitizer) flushText(final bool) {
+	text := r.pending
+	for len(text) > 0 {
+		if !final && !utf8.FullRune(text) {
+			break
+		}
+		c, size := utf8.DecodeRune(text)
+		if c == utf8.RuneError && size <= 1 {
+			r.out.WriteString("\uFFFD")
+			size = 1
+		} else {
+			r.out.Write(text[:size])
+		}
+		text = text[size:]
+	}
+	r.pending = append(r.pending[:0], text...)
+}
+
+// Close flushes remaining text, drops an unterminated sequence and closes
+// the underlying writer.
+func (r *recordingSanitizer) Close() error {
+	r.flushText(true)
+	if r.state == recordingStateEsc {
+		r.out.WriteByte(0x1b)
+	}
+	_, err := r.w.Write(r.out.Bytes())
+	r.out.Reset()
+	closeErr := r.w.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// recordingWriter writes to a session recorder, but never fails so that a
+// broken recorder doesn't affect the session.
+type recordingWriter struct {
+	ctx    context.Context
+	logger slog.Logger
+	w      io.Writer
+	failed bool
+}
+
+func (r *recordingWriter) Write(p []byte) (int, error) {
+	if r.failed {
+		return len(p), nil
+	}
+	if _, err := r.w.Write(p); err != nil {
+		r.logger.Warn(r.ctx, "session recorder failed, recording stopped", slog.Error(err))
+		r.failed = true
+	}
+	return len(p), nil
+}
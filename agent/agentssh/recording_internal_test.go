@@ -0,0 +1,125 @@
+package agentssh
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/v2/testutil"
+)
+
+func Test_recordingSanitizer(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		opts  RecordingSanitizerOptions
+		input string
+		want  string
+	}{
+		{
+			name:  "PlainText",
+			input: "hello \x1b[31mworld\x1b[0m\r\n",
+			want:  "hello \x1b[31mworld\x1b[0m\r\n",
+		},
+		{
+			name:  "ClipboardStripped",
+			input: "a\x1b]52;c;c2VjcmV0\ab\x1b]52;c;c2VjcmV0\x1b\\c",
+			want:  "abc",
+		},
+		{
+			name:  "ClipboardKept",
+			opts:  RecordingSanitizerOptions{KeepClipboard: true},
+			input: "a\x1b]52;c;c2VjcmV0\ab",
+			want:  "a\x1b]52;c;c2VjcmV0\ab",
+		},
+		{
+			name:  "TitleKept",
+			input: "\x1b]0;my title\a$ ",
+			want:  "\x1b]0;my title\a$ ",
+		},
+		{
+			name:  "TitleStripped",
+			opts:  RecordingSanitizerOptions{StripTitles: true},
+			input: "\x1b]2;my title\x1b\\$ ",
+			want:  "$ ",
+		},
+		{
+			name:  "TitleInvalidUTF8",
+			input: "\x1b]0;bad\xff\a",
+			want:  "\x1b]0;bad�\a",
+		},
+		{
+			name:  "InvalidUTF8",
+			input: "ok\xffok\xc3",
+			want:  "ok�ok�",
+		},
+		{
+			name:  "ValidUTF8",
+			input: "héllo 世界",
+			want:  "héllo 世界",
+		},
+		{
+			name:  "Oversized",
+			opts:  RecordingSanitizerOptions{MaxSequenceLength: 8},
+			input: "a\x1b]0;0123456789\ab\x1b]0;short\ac",
+			want:  "ab\x1b]0;short\ac",
+		},
+		{
+			name:  "AbortedSequence",
+			input: "a\x1b]52;c;c2Vj\x1b[0mb",
+			want:  "a\x1b[0mb",
+		},
+		{
+			name:  "Unterminated",
+			input: "a\x1b]52;c;c2VjcmV0",
+			want:  "a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Writing all at once and one byte at a time must give the
+			// same result.
+			for _, chunk := range []int{len(tt.input), 1} {
+				var out bytes.Buffer
+				r := newRecordingSanitizer(nopWriteCloser{&out}, tt.opts)
+				for input := tt.input; input != ""; {
+					n := min(chunk, len(input))
+					_, err := io.WriteString(r, input[:n])
+					require.NoError(t, err)
+					input = input[n:]
+				}
+				err := r.Close()
+				require.NoError(t, err)
+				require.Equal(t, tt.want, out.String(), "chunk size %d", chunk)
+			}
+		})
+	}
+}
+
+func Test_recordingSanitizer_ClientUnchanged(t *testing.T) {
+	t.Parallel()
+
+	input := "\x1b]52;c;c2VjcmV0\aoutput\xff\r\n"
+	var client, recording bytes.Buffer
+	rec := newRecordingSanitizer(nopWriteCloser{&recording}, RecordingSanitizerOptions{})
+	w := io.MultiWriter(&client, &recordingWriter{logger: testutil.Logger(t), w: rec})
+	_, err := io.Copy(w, strings.NewReader(input))
+	require.NoError(t, err)
+	err = rec.Close()
+	require.NoError(t, err)
+
+	require.Equal(t, input, client.String())
+	require.Equal(t, "output�\r\n", recording.String())
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
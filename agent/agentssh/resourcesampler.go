@@ -0,0 +1,152 @@
+package agentssh
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coder/quartz"
+)
+
+// SessionResourceSampling configures the sampling of the CPU and memory usage
+// of the processes of each session, see Config.SessionResourceSampling.
+type SessionResourceSampling struct {
+	// Interval is the time between samples. Sampling is disabled if it is
+	// zero.
+	Interval time.Duration
+}
+
+// SessionResourceSample is the sampled CPU and memory usage of the processes
+// of a session.
+type SessionResourceSample struct {
+	// CPUPercent is the CPU usage between the last two samples, where 100
+	// is one fully used core.
+	CPUPercent     float64
+	PeakCPUPercent float64
+	// RSSBytes is the resident memory at the last sample.
+	RSSBytes     int64
+	PeakRSSBytes int64
+	SampledAt    time.Time
+}
+
+// processUsage is the total CPU time used by the processes of a session,
+// including exited processes, and their current resident memory.
+type processUsage struct {
+	cpuTime  time.Duration
+	rssBytes int64
+}
+
+// resourceSampler samples the usage of the processes of a session. The last
+// sample is added to the gauges of the session type until the sampler is
+// stopped.
+type resourceSampler struct {
+	clock    quartz.Clock
+	interval time.Duration
+	cgroup   *sessionCgroup
+	cpuGauge prometheus.Gauge
+	rssGauge prometheus.Gauge
+	// read is readProcessUsage, replaced in tests.
+	read func(pid int, cgroup *sessionCgroup) (processUsage, error)
+
+	mu      sync.Mutex
+	pid     int
+	timer   *quartz.Timer
+	stopped bool
+	last    processUsage
+	sample  *SessionResourceSample
+}
+
+func newResourceSampler(clock quartz.Clock, interval time.Duration, cgroup *sessionCgroup, cpuGauge, rssGauge prometheus.Gauge) *resourceSampler {
+	return &resourceSampler{
+		clock:    clock,
+		interval: interval,
+		cgroup:   cgroup,
+		cpuGauge: cpuGauge,
+		rssGauge: rssGauge,
+		read:     readProcessUsage,
+	}
+}
+
+// start takes the first sample of the process and its descendants, and
+// schedules the next.
+func (r *resourceSampler) start(pid int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	r.pid = pid
+	if r.sampleLocked() {
+		r.timer = r.clock.AfterFunc(r.interval, r.tick, "resource_sampler")
+	}
+}
+
+// stop stops sampling, removes the last sample from the gauges and returns
+// it, nil if there wasn't any.
+func (r *resourceSampler) stop() *SessionResourceSample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.stopped {
+		r.stopped = true
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		if r.sample != nil {
+			r.cpuGauge.Sub(r.sample.CPUPercent)
+			r.rssGauge.Sub(float64(r.sample.RSSBytes))
+		}
+	}
+	return r.currentLocked()
+}
+
+// current returns the last sample, nil if there isn't any yet.
+func (r *resourceSampler) current() *SessionResourceSample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.currentLocked()
+}
+
+func (r *resourceSampler) currentLocked() *SessionResourceSample {
+	if r.sample == nil {
+		return nil
+	}
+	sample := *r.sample
+	return &sample
+}
+
+func (r *resourceSampler) tick() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	if r.sampleLocked() {
+		r.timer = r.clock.AfterFunc(r.interval, r.tick, "resource_sampler")
+	}
+}
+
+// sampleLocked reports whether sampling should go on, which it doesn't once
+// the process is gone.
+func (r *resourceSampler) sampleLocked() bool {
+	usage, err := r.read(r.pid, r.cgroup)
+	if err != nil {
+		return false
+	}
+	now := r.clock.Now()
+	next := SessionResourceSample{RSSBytes: usage.rssBytes, SampledAt: now}
+	var prev SessionResourceSample
+	if r.sample != nil {
+		prev = *r.sample
+		if elapsed := now.Sub(prev.SampledAt); elapsed > 0 && usage.cpuTime > r.last.cpuTime {
+			next.CPUPercent = 100 * float64(usage.cpuTime-r.last.cpuTime) / float64(elapsed)
+		}
+	}
+	next.PeakCPUPercent = max(prev.PeakCPUPercent, next.CPUPercent)
+	next.PeakRSSBytes = max(prev.PeakRSSBytes, next.RSSBytes)
+	r.cpuGauge.Add(next.CPUPercent - prev.CPUPercent)
+	r.rssGauge.Add(float64(next.RSSBytes - prev.RSSBytes))
+	r.last = usage
+	r.sample = &next
+	return true
+}
@@ -0,0 +1,67 @@
+package agentssh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/quartz"
+)
+
+func Test_resourceSampler(t *testing.T) {
+	t.Parallel()
+
+	clock := quartz.NewMock(t)
+	cpuGauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "cpu"})
+	rssGauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "rss"})
+	r := newResourceSampler(clock, time.Second, nil, cpuGauge, rssGauge)
+	var (
+		usage processUsage
+		err   error
+	)
+	r.read = func(pid int, _ *sessionCgroup) (processUsage, error) {
+		require.Equal(t, 42, pid)
+		return usage, err
+	}
+
+	usage = processUsage{cpuTime: time.Second, rssBytes: 1000}
+	r.start(42)
+	sample := r.current()
+	require.NotNil(t, sample)
+	require.Zero(t, sample.CPUPercent)
+	require.EqualValues(t, 1000, sample.RSSBytes)
+
+	// Two cores are used in full.
+	usage = processUsage{cpuTime: 3 * time.Second, rssBytes: 3000}
+	clock.Advance(time.Second).MustWait()
+	sample = r.current()
+	require.InDelta(t, 200, sample.CPUPercent, 0.001)
+	require.EqualValues(t, 3000, sample.RSSBytes)
+	require.InDelta(t, 200, promtestutil.ToFloat64(cpuGauge), 0.001)
+	require.EqualValues(t, 3000, promtestutil.ToFloat64(rssGauge))
+
+	// Half a core.
+	usage = processUsage{cpuTime: 3500 * time.Millisecond, rssBytes: 2000}
+	clock.Advance(time.Second).MustWait()
+	sample = r.current()
+	require.InDelta(t, 50, sample.CPUPercent, 0.001)
+	require.InDelta(t, 200, sample.PeakCPUPercent, 0.001)
+	require.EqualValues(t, 2000, sample.RSSBytes)
+	require.EqualValues(t, 3000, sample.PeakRSSBytes)
+	require.InDelta(t, 50, promtestutil.ToFloat64(cpuGauge), 0.001)
+
+	// Sampling stops once the process is gone, the last sample is kept.
+	err = xerrors.New("no such process")
+	clock.Advance(time.Second).MustWait()
+	_, ok := clock.Peek()
+	require.False(t, ok)
+	require.Equal(t, sample, r.current())
+
+	require.Equal(t, sample, r.stop())
+	require.Zero(t, promtestutil.ToFloat64(cpuGauge))
+	require.Zero(t, promtestutil.ToFloat64(rssGauge))
+}
@@ -0,0 +1,128 @@
+package agentssh
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// resourceSamplingSupported reports whether Config.SessionResourceSampling is
+// supported on this platform.
+const resourceSamplingSupported = true
+
+// clockTicks is the unit of the CPU times in /proc/<pid>/stat, USER_HZ,
+// which is 100 on all architectures supported by Go.
+const clockTicks = 100
+
+// maxSampledProcesses bounds the number of processes of a session read for
+// each sample when the session doesn't have a cgroup.
+const maxSampledProcesses = 256
+
+// readProcessUsage reads the usage of the session from its cgroup if it has
+// one, and of the process and its descendants otherwise.
+func readProcessUsage(pid int, cgroup *sessionCgroup) (processUsage, error) {
+	if cgroup != nil {
+		if usage, err := cgroup.currentUsage(); err == nil {
+			return usage, nil
+		}
+	}
+	return readProcessTreeUsage(pid)
+}
+
+// currentUsage reads the CPU time and current memory usage of the cgroup,
+// which fails if the memory controller isn't enabled for it.
+func (g *sessionCgroup) currentUsage() (processUsage, error) {
+	var usage processUsage
+	b, err := os.ReadFile(filepath.Join(g.path, "cpu.stat"))
+	if err != nil {
+		return usage, xerrors.Errorf("read cpu.stat: %w", err)
+	}
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if v, ok := bytes.CutPrefix(line, []byte("usage_usec ")); ok {
+			usec, _ := strconv.ParseInt(string(v), 10, 64)
+			usage.cpuTime = time.Duration(usec) * time.Microsecond
+		}
+	}
+	b, err = os.ReadFile(filepath.Join(g.path, "memory.current"))
+	if err != nil {
+		return usage, xerrors.Errorf("read memory.current: %w", err)
+	}
+	usage.rssBytes, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return usage, xerrors.Errorf("parse memory.current: %w", err)
+	}
+	return usage, nil
+}
+
+// readProcessTreeUsage sums the usage of the process and its descendants,
+// which takes two reads per process. Descendants that were started by
+// threads other than the main thread of their parent are missed.
+func readProcessTreeUsage(pid int) (processUsage, error) {
+	var usage processUsage
+	pids := []int{pid}
+	for i := 0; i < len(pids) && i < maxSampledProcesses; i++ {
+		p, err := readProcStat(pids[i])
+		if err != nil {
+			if i == 0 {
+				return usage, err
+			}
+			// The process exited since its parent was read.
+			continue
+		}
+		usage.cpuTime += p.cpuTime
+		usage.rssBytes += p.rssBytes
+		b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pids[i]), "task", strconv.Itoa(pids[i]), "children"))
+		if err != nil {
+			continue
+		}
+		for _, f := range strings.Fields(string(b)) {
+			if child, err := strconv.Atoi(f); err == nil {
+				pids = append(pids, child)
+			}
+		}
+	}
+	return usage, nil
+}
+
+// readProcStat reads the CPU time of the process, including that of its
+// exited children it has waited for, and its resident memory from
+// /proc/<pid>/stat, so that statm doesn't need to be read as well.
+func readProcStat(pid int) (processUsage, error) {
+	var usage processUsage
+	b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return usage, xerrors.Errorf("read process stat: %w", err)
+	}
+	// The command name may contain spaces and parentheses, the fields
+	// follow the last parenthesis, starting with the state (field 3).
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return usage, xerrors.Errorf("malformed process stat: %q", b)
+	}
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 22 {
+		return usage, xerrors.Errorf("malformed process stat: %q", b)
+	}
+	// utime, stime, cutime and cstime are fields 14 to 17.
+	var ticks int64
+	for _, f := range fields[11:15] {
+		v, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return usage, xerrors.Errorf("parse process stat: %w", err)
+		}
+		ticks += v
+	}
+	usage.cpuTime = time.Duration(ticks) * time.Second / clockTicks
+	// rss (field 24) is in pages.
+	pages, err := strconv.ParseInt(fields[21], 10, 64)
+	if err != nil {
+		return usage, xerrors.Errorf("parse process stat: %w", err)
+	}
+	usage.rssBytes = pages * int64(os.Getpagesize())
+	return usage, nil
+}
@@ -0,0 +1,66 @@
+package agentssh_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+
+	"github.com/coder/coder/v2/agent/agentexec"
+	"github.com/coder/coder/v2/agent/agentssh"
+	"github.com/coder/coder/v2/agent/agentssh/sshtest"
+	"github.com/coder/coder/v2/testutil"
+)
+
+func TestNewServer_SessionResourceSampling(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := slogtest.Make(t, nil)
+	ended := make(chan agentssh.SessionMetadata, 1)
+	s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		SessionResourceSampling: agentssh.SessionResourceSampling{Interval: 100 * time.Millisecond},
+		OnSessionEnd:            func(m agentssh.SessionMetadata) { ended <- m },
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	assert.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := s.Serve(ln)
+		assert.Error(t, err) // Server is closed.
+	}()
+
+	// The busy loop runs in a child of the command, which is sampled
+	// along with it.
+	sess, _ := sshtest.DialSession(ctx, t, ln.Addr().String())
+	err = sess.Start("timeout 3 sh -c 'while :; do :; done'")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		sessions := s.Sessions()
+		return len(sessions) == 1 && sessions[0].ResourceSample != nil &&
+			sessions[0].ResourceSample.CPUPercent > 20 && sessions[0].ResourceSample.RSSBytes > 0
+	}, testutil.WaitShort, testutil.IntervalFast)
+	_ = sess.Wait()
+
+	meta := testutil.RequireReceive(ctx, t, ended)
+	require.NotNil(t, meta.ResourceSample)
+	require.Greater(t, meta.ResourceSample.PeakCPUPercent, 20.0)
+	require.Positive(t, meta.ResourceSample.PeakRSSBytes)
+
+	err = s.Close()
+	require.NoError(t, err)
+	<-done
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package agentssh
+
+import "golang.org/x/xerrors"
+
+// resourceSamplingSupported reports whether Config.SessionResourceSampling is
+// supported on this platform.
+const resourceSamplingSupported = false
+
+// readProcessUsage fails, sampling is only supported on Linux.
+func readProcessUsage(int, *sessionCgroup) (processUsage, error) {
+	return processUsage{}, xerrors.New("resource sampling is only supported on Linux")
+}
@@ -0,0 +1,309 @@
+package agentssh
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/quartz"
+)
+
+// reverseForwardPayload is the payload of tcpip-forward and
+// cancel-tcpip-forward requests.
+type reverseForwardPayload struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// reverseForwardSuccess is the reply to a tcpip-forward request, containing
+// the bound port for requests of port 0.
+type reverseForwardSuccess struct {
+	BindPort uint32
+}
+
+// forwardedTCPPayload describes the data sent as the payload in the new
+// channel request when a connection is accepted by the listener.
+type forwardedTCPPayload struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// ReverseForward describes a port bound for a client by a tcpip-forward
+// request.
+type ReverseForward struct {
+	// Addr is the address the client requested, with the bound port.
+	Addr string
+	// RemoteAddr is the address of the connection that requested it.
+	RemoteAddr string
+	// CreatedAt is when the port was bound.
+	CreatedAt time.Time
+	// LastActiveAt is when a forwarded connection was last accepted or
+	// closed, or CreatedAt if there were none.
+	LastActiveAt time.Time
+}
+
+// reverseForwardHandler is a replacement of ssh.ForwardedTCPHandler that
+// keeps track of the connection that requested each forward, so that a
+// connection can't cancel the forwards of another one, and optionally
+// releases forwards that are idle for Policy.ReverseForwardIdleTimeout.
+type reverseForwardHandler struct {
+	s *Server
+
+	mu       sync.Mutex
+	forwards map[reverseForwardKey]*reverseForward
+	// released contains the forwards released by the server, which the
+	// client still believes are active and may cancel.
+	released map[reverseForwardKey]struct{}
+}
+
+type reverseForwardKey struct {
+	conn *gossh.ServerConn
+	addr string
+}
+
+type reverseForward struct {
+	ctx        context.Context
+	ln         net.Listener
+	remoteAddr string
+	createdAt  time.Time
+	// idleTimeout is the Policy.ReverseForwardIdleTimeout when the forward
+	// was created.
+	idleTimeout time.Duration
+	idle        *quartz.Timer
+
+	// Guarded by reverseForwardHandler.mu.
+	lastActive time.Time
+	active     int
+}
+
+func newReverseForwardHandler(s *Server) *reverseForwardHandler {
+	return &reverseForwardHandler{
+		s:        s,
+		forwards: make(map[reverseForwardKey]*reverseForward),
+		released: make(map[reverseForwardKey]struct{}),
+	}
+}
+
+func (h *reverseForwardHandler) HandleSSHRequest(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	if !ok {
+		h.s.logger.Warn(ctx, "SSH reverse forward request from client with no gossh connection")
+		return false, nil
+	}
+	logger := h.s.logger.With(slog.F("session_id", ctx.SessionID()), slog.F("remote_addr", conn.RemoteAddr()))
+
+	var reqPayload reverseForwardPayload
+	if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+		logger.Warn(ctx, "parse reverse forward request payload from client", slog.F("type", req.Type), slog.Error(err))
+		return false, nil
+	}
+	addr := net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort)))
+	logger = logger.With(slog.F("addr", addr))
+
+	switch req.Type {
+	case "tcpip-forward":
+		if srv.ReversePortForwardingCallback == nil || !srv.ReversePortForwardingCallback(ctx, reqPayload.BindAddr, reqPayload.BindPort) {
+			return false, []byte("port forwarding is disabled")
+		}
+		port, err := h.listen(ctx, logger, conn, reqPayload.BindAddr, addr)
+		if err != nil {
+			logger.Warn(ctx, "listen for reverse forward request", slog.Error(err))
+			return false, nil
+		}
+		return true, gossh.Marshal(&reverseForwardSuccess{BindPort: port})
+
+	case "cancel-tcpip-forward":
+		key := reverseForwardKey{conn: conn, addr: addr}
+		h.mu.Lock()
+		fwd, ok := h.forwards[key]
+		delete(h.forwards, key)
+		_, released := h.released[key]
+		delete(h.released, key)
+		h.mu.Unlock()
+		switch {
+		case ok:
+			logger.Debug(ctx, "reverse forward canceled")
+			fwd.close()
+			return true, nil
+		case released:
+			// The client doesn't know that the forward was released, it
+			// was canceled as far as it is concerned.
+			logger.Debug(ctx, "reverse forward canceled after it was released")
+			return true, nil
+		default:
+			logger.Warn(ctx, "cancel of unknown reverse forward")
+			return false, nil
+		}
+
+	default:
+		return false, nil
+	}
+}
+
+// listen binds addr for the client on conn and forwards the connections it
+// accepts until the forward is canceled or released, or ctx is done. It
+// returns the bound port.
+func (h *reverseForwardHandler) listen(ctx ssh.Context, logger slog.Logger, conn *gossh.ServerConn, bindAddr, addr string) (uint32, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return 0, xerrors.Errorf("listen: %w", err)
+	}
+	_, port := splitAddr(ln.Addr())
+	portStr := strconv.FormatUint(uint64(port), 10)
+
+	// Requests for port 0 are canceled with the bound port.
+	key := reverseForwardKey{conn: conn, addr: net.JoinHostPort(bindAddr, portStr)}
+	now := h.s.config.Clock.Now()
+	fwd := &reverseForward{
+		ctx:         ctx,
+		ln:          ln,
+		remoteAddr:  conn.RemoteAddr().String(),
+		createdAt:   now,
+		lastActive:  now,
+		idleTimeout: h.s.currentPolicy().ReverseForwardIdleTimeout,
+	}
+	h.mu.Lock()
+	delete(h.released, key)
+	h.forwards[key] = fwd
+	if fwd.idleTimeout > 0 {
+		fwd.idle = h.s.config.Clock.AfterFunc(fwd.idleTimeout, func() {
+			h.releaseIdle(logger, key, fwd)
+		}, "reverse_forward", "idle")
+	}
+	h.mu.Unlock()
+	logger.Debug(ctx, "reverse forward listening", slog.F("bound_addr", ln.Addr()))
+
+	stop := context.AfterFunc(ctx, func() {
+		h.remove(key, fwd)
+		fwd.close()
+	})
+	go func() {
+		defer stop()
+		defer h.remove(key, fwd)
+
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				logger.Debug(ctx, "reverse forward listener closed", slog.Error(err))
+				return
+			}
+			h.touch(fwd, 1)
+			originAddr, originPort := splitAddr(c.RemoteAddr())
+			payload := gossh.Marshal(&forwardedTCPPayload{
+				DestAddr:   bindAddr,
+				DestPort:   port,
+				OriginAddr: originAddr,
+				OriginPort: originPort,
+			})
+			go func() {
+				defer h.touch(fwd, -1)
+				ch, reqs, err := conn.OpenChannel("forwarded-tcpip", payload)
+				if err != nil {
+					logger.Warn(ctx, "open reverse forward channel to client", slog.Error(err))
+					_ = c.Close()
+					return
+				}
+				go gossh.DiscardRequests(reqs)
+				Bicopy(ctx, ch, c)
+			}()
+		}
+	}()
+	return port, nil
+}
+
+// touch records a forwarded connection being accepted (delta 1) or closed
+// (delta -1).
+func (h *reverseForwardHandler) touch(fwd *reverseForward, delta int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fwd.active += delta
+	fwd.lastActive = h.s.config.Clock.Now()
+}
+
+// remove removes fwd, unless it was already canceled or released.
+func (h *reverseForwardHandler) remove(key reverseForwardKey, fwd *reverseForward) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.forwards[key] == fwd {
+		delete(h.forwards, key)
+	}
+}
+
+// releaseIdle releases fwd if it has no forwarded connections and none were
+// accepted or closed for the idle timeout, and otherwise checks again once
+// it could be idle.
+func (h *reverseForwardHandler) releaseIdle(logger slog.Logger, key reverseForwardKey, fwd *reverseForward) {
+	timeout := fwd.idleTimeout
+	h.mu.Lock()
+	if h.forwards[key] != fwd {
+		h.mu.Unlock()
+		return
+	}
+	if fwd.active > 0 {
+		fwd.idle.Reset(timeout, "reverse_forward", "idle")
+		h.mu.Unlock()
+		return
+	}
+	if idle := h.s.config.Clock.Since(fwd.lastActive); idle < timeout {
+		fwd.idle.Reset(timeout-idle, "reverse_forward", "idle")
+		h.mu.Unlock()
+		return
+	}
+	delete(h.forwards, key)
+	h.released[key] = struct{}{}
+	h.mu.Unlock()
+
+	logger.Info(fwd.ctx, "releasing idle reverse forward", slog.F("idle_timeout", timeout))
+	h.s.metrics.reverseForwardsReleased.Add(1)
+	fwd.close()
+	// The client can cancel the forward until it disconnects.
+	context.AfterFunc(fwd.ctx, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.released, key)
+	})
+}
+
+func (fwd *reverseForward) close() {
+	if fwd.idle != nil {
+		fwd.idle.Stop()
+	}
+	_ = fwd.ln.Close()
+}
+
+// list returns the active forwards, oldest first.
+func (h *reverseForwardHandler) list() []ReverseForward {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	forwards := make([]ReverseForward, 0, len(h.forwards))
+	for key, fwd := range h.forwards {
+		forwards = append(forwards, ReverseForward{
+			Addr:         key.addr,
+			RemoteAddr:   fwd.remoteAddr,
+			CreatedAt:    fwd.createdAt,
+			LastActiveAt: fwd.lastActive,
+		})
+	}
+	slices.SortFunc(forwards, func(a, b ReverseForward) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), strings.Compare(a.Addr, b.Addr))
+	})
+	return forwards
+}
+
+// ReverseForwards returns the ports bound for clients by tcpip-forward
+// requests, oldest first.
+func (s *Server) ReverseForwards() []ReverseForward {
+	return s.reverseForwards.list()
+}
@@ -0,0 +1,76 @@
+package agentssh
+
+import (
+	"context"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+// ErrServerClosing is returned by Serve when it is called while Close is
+// still completing, unless Config.WaitForCloseOnServe is set. Unlike a
+// closed server, the server can be served again once Close returned.
+var ErrServerClosing = xerrors.New("server is closing")
+
+// ServerState is the lifecycle state of a Server, see Server.State.
+type ServerState int
+
+const (
+	// ServerStateRunning is the state of a new server, and of a closed
+	// server that is served again.
+	ServerStateRunning ServerState = iota
+	// ServerStateDraining is the state after Drain, until Close.
+	ServerStateDraining
+	// ServerStateClosing is the state while Close is completing, Serve
+	// fails with ErrServerClosing.
+	ServerStateClosing
+	// ServerStateClosed is the state once Close completed, until Serve is
+	// called again.
+	ServerStateClosed
+)
+
+func (st ServerState) String() string {
+	switch st {
+	case ServerStateRunning:
+		return "running"
+	case ServerStateDraining:
+		return "draining"
+	case ServerStateClosing:
+		return "closing"
+	case ServerStateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// State returns the lifecycle state of the server.
+func (s *Server) State() ServerState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state
+}
+
+// setStateLocked sets the state of the server. It must be called with
+// stateMu and mu held, and the returned function, which reports the
+// transition to Config.OnStateChange, must be called once mu is released
+// but before stateMu is, so that transitions are reported in order.
+func (s *Server) setStateLocked(to ServerState) (report func()) {
+	from := s.state
+	if from == to {
+		return func() {}
+	}
+	s.state = to
+	return func() {
+		ctx := context.Background()
+		s.logger.Debug(ctx, "server state changed", slog.F("from", from), slog.F("to", to))
+		if s.config.OnStateChange == nil {
+			return
+		}
+		_, _ = recoverCallback(ctx, s, s.logger, "OnStateChange", func() (struct{}, error) {
+			s.config.OnStateChange(from, to)
+			return struct{}{}, nil
+		})
+	}
+}
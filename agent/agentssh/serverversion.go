@@ -0,0 +1,61 @@
+package agentssh
+
+import (
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	serverVersionPrefix = "SSH-2.0-"
+	// maxServerVersionLength is the maximum length of the identification
+	// string, which is 255 characters including the trailing CR LF.
+	maxServerVersionLength = 253
+)
+
+// AgentServerVersion returns the identification string of an agent of the
+// given version, e.g. "SSH-2.0-CoderAgent_v2.24.1". Characters not allowed in
+// the software version, like '-', are replaced with '_'.
+func AgentServerVersion(version string) string {
+	version = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '-' {
+			return '_'
+		}
+		return r
+	}, version)
+	v := serverVersionPrefix + "CoderAgent_" + version
+	if len(v) > maxServerVersionLength {
+		v = v[:maxServerVersionLength]
+	}
+	return v
+}
+
+// validateServerVersion checks that v is an identification string as defined
+// by RFC 4253: "SSH-2.0-softwareversion SP comments", where the comments are
+// optional, made of printable ASCII characters. The software version can't
+// contain spaces or '-'.
+func validateServerVersion(v string) error {
+	rest, ok := strings.CutPrefix(v, serverVersionPrefix)
+	if !ok {
+		return xerrors.Errorf("must start with %q", serverVersionPrefix)
+	}
+	if len(v) > maxServerVersionLength {
+		return xerrors.Errorf("longer than %d characters", maxServerVersionLength)
+	}
+	for _, r := range v {
+		if r < ' ' || r > '~' {
+			return xerrors.Errorf("invalid character %q, only printable ASCII is allowed", r)
+		}
+	}
+	software, comments, hasComments := strings.Cut(rest, " ")
+	if software == "" {
+		return xerrors.New("empty software version")
+	}
+	if strings.Contains(software, "-") {
+		return xerrors.Errorf("software version %q contains '-'", software)
+	}
+	if hasComments && comments == "" {
+		return xerrors.New("empty comments")
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package agentssh
+
+import (
+	"runtime"
+	"slices"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// EnvInputs are the sources of the environment of a session, see
+// BuildSessionEnv.
+type EnvInputs struct {
+	// Base is the environment of the agent, or of the container.
+	Base []string
+	// Files are the variables set by environment files, see
+	// Config.EnvironmentDirs.
+	Files []string
+	// Client are the variables requested by the client.
+	Client []string
+	// User sets the login variables USER and LOGNAME, and Shell sets
+	// SHELL, unless empty.
+	User  string
+	Shell string
+	// Update, if set, returns the changed environment, see
+	// Config.UpdateEnv.
+	Update func(current []string) ([]string, error)
+	// DefaultLocale sets LANG and LC_ALL if neither is set, see
+	// Config.DefaultLocale.
+	DefaultLocale string
+	// Overrides are set last, so that no other input can change them.
+	Overrides []string
+}
+
+// BuildSessionEnv merges the inputs into the environment of a session, in
+// order of increasing precedence:
+//
+//   - Base,
+//   - Files,
+//   - Client,
+//   - the login variables of User and Shell,
+//   - the changes made by Update,
+//   - DefaultLocale,
+//   - Overrides.
+//
+// Each variable is set once, to its value of highest precedence, at the
+// position it first appeared. Variables added by Update follow in order of
+// name, so the result doesn't depend on the order Update returns them in.
+// Entries without '=' are dropped. On Windows, variable names are case
+// insensitive, so e.g. PATH replaces Path.
+//
+// Other agent components use it to start commands with the same
+// environment as SSH sessions.
+func BuildSessionEnv(in EnvInputs) ([]string, error) {
+	return buildSessionEnv(in, runtime.GOOS == "windows")
+}
+
+func buildSessionEnv(in EnvInputs, foldCase bool) ([]string, error) {
+	var login []string
+	if in.User != "" {
+		// See `man login`.
+		login = append(login, "USER="+in.User, "LOGNAME="+in.User)
+	}
+	if in.Shell != "" {
+		login = append(login, "SHELL="+in.Shell)
+	}
+	env := mergeEnv(foldCase, in.Base, in.Files, in.Client, login)
+	if in.Update != nil {
+		updated, err := in.Update(slices.Clone(env))
+		if err != nil {
+			return nil, xerrors.Errorf("update env: %w", err)
+		}
+		env = reorderEnv(foldCase, env, mergeEnv(foldCase, updated))
+	}
+	if in.DefaultLocale != "" {
+		env = withDefaultLocale(env, in.DefaultLocale)
+	}
+	return mergeEnv(foldCase, env, in.Overrides), nil
+}
+
+// mergeEnv concatenates the environments, keeping the last value of each
+// variable at the position of its first occurrence.
+func mergeEnv(foldCase bool, envs ...[]string) []string {
+	var merged []string
+	index := make(map[string]int)
+	for _, env := range envs {
+		for _, kv := range env {
+			key, ok := envKey(kv, foldCase)
+			if !ok {
+				continue
+			}
+			if i, ok := index[key]; ok {
+				merged[i] = kv
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, kv)
+		}
+	}
+	return merged
+}
+
+// reorderEnv orders the variables of updated like those of env, followed by
+// the variables that are only in updated, sorted by name. Both must be free
+// of duplicates.
+func reorderEnv(foldCase bool, env, updated []string) []string {
+	position := make(map[string]int, len(env))
+	for i, kv := range env {
+		key, _ := envKey(kv, foldCase)
+		position[key] = i
+	}
+	ordered := make([]string, 0, len(updated))
+	var added []string
+	for _, kv := range updated {
+		key, _ := envKey(kv, foldCase)
+		if _, ok := position[key]; ok {
+			ordered = append(ordered, kv)
+		} else {
+			added = append(added, kv)
+		}
+	}
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		ka, _ := envKey(a, foldCase)
+		kb, _ := envKey(b, foldCase)
+		return position[ka] - position[kb]
+	})
+	slices.SortFunc(added, func(a, b string) int {
+		ka, _ := envKey(a, foldCase)
+		kb, _ := envKey(b, foldCase)
+		return strings.Compare(ka, kb)
+	})
+	return append(ordered, added...)
+}
+
+// envKey returns the name of the variable kv, upper cased if foldCase is
+// set. On Windows, names of hidden variables like "=C:" start with '='.
+func envKey(kv string, foldCase bool) (string, bool) {
+	start := 0
+	if strings.HasPrefix(kv, "=") {
+		start = 1
+	}
+	i := strings.IndexByte(kv[start:], '=')
+	if i < 0 {
+		return "", false
+	}
+	name := kv[:start+i]
+	if foldCase {
+		name = strings.ToUpper(name)
+	}
+	return name, true
+}
+
+// setEnv sets the variable name of env to value, replacing an existing
+// variable in place so that env stays free of duplicates.
+func setEnv(env []string, name, value string) []string {
+	return mergeEnv(runtime.GOOS == "windows", env, []string{name + "=" + value})
+}
@@ -0,0 +1,183 @@
+package agentssh
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func Test_buildSessionEnv(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		in       EnvInputs
+		foldCase bool
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name: "Precedence",
+			in: EnvInputs{
+				Base:   []string{"A=base", "B=base", "C=base", "D=base", "USER=root", "E=base", "F=base"},
+				Files:  []string{"B=files", "C=files", "D=files", "E=files", "F=files"},
+				Client: []string{"C=client", "D=client", "E=client", "F=client"},
+				User:   "coder",
+				Shell:  "/bin/bash",
+				Update: func(current []string) ([]string, error) {
+					return append(current, "D=update", "E=update", "F=update"), nil
+				},
+				Overrides: []string{"E=override"},
+			},
+			want: []string{"A=base", "B=files", "C=client", "D=update", "USER=coder", "E=override", "F=update", "LOGNAME=coder", "SHELL=/bin/bash"},
+		},
+		{
+			name: "Duplicates",
+			in: EnvInputs{
+				Base:   []string{"A=1", "B=1", "A=2"},
+				Client: []string{"B=2", "B=3"},
+			},
+			want: []string{"A=2", "B=3"},
+		},
+		{
+			name: "UpdateOrder",
+			in: EnvInputs{
+				Base: []string{"B=base", "A=base"},
+				Update: func(current []string) ([]string, error) {
+					// Returned in random order, like the agent does.
+					return []string{"Z=update", "A=update", "Y=update", "B=base"}, nil
+				},
+			},
+			want: []string{"B=base", "A=update", "Y=update", "Z=update"},
+		},
+		{
+			name: "UpdateRemoves",
+			in: EnvInputs{
+				Base: []string{"A=base", "SECRET=base"},
+				Update: func(current []string) ([]string, error) {
+					return slices.DeleteFunc(current, func(kv string) bool { return kv == "SECRET=base" }), nil
+				},
+			},
+			want: []string{"A=base"},
+		},
+		{
+			name: "UpdateError",
+			in: EnvInputs{
+				Update: func([]string) ([]string, error) { return nil, xerrors.New("no manifest") },
+			},
+			wantErr: true,
+		},
+		{
+			name: "DefaultLocale",
+			in: EnvInputs{
+				Base:          []string{"A=base"},
+				DefaultLocale: "C.UTF-8",
+			},
+			want: []string{"A=base", "LANG=C.UTF-8", "LC_ALL=C.UTF-8"},
+		},
+		{
+			name: "DefaultLocaleAfterUpdate",
+			in: EnvInputs{
+				Update: func(current []string) ([]string, error) {
+					return append(current, "LANG=de_DE.UTF-8"), nil
+				},
+				DefaultLocale: "C.UTF-8",
+			},
+			want: []string{"LANG=de_DE.UTF-8"},
+		},
+		{
+			name: "Malformed",
+			in: EnvInputs{
+				Base:   []string{"A=1", "NOVALUE", "", "EMPTY="},
+				Client: []string{"=", "B==x"},
+			},
+			want: []string{"A=1", "EMPTY=", "B==x"},
+		},
+		{
+			name: "CaseSensitive",
+			in: EnvInputs{
+				Base:   []string{"Path=base"},
+				Client: []string{"PATH=client"},
+			},
+			want: []string{"Path=base", "PATH=client"},
+		},
+		{
+			name: "CaseInsensitive",
+			in: EnvInputs{
+				Base:   []string{"Path=base", "=C:=C:\\Users", "TEMP=base"},
+				Files:  []string{"path=files"},
+				Client: []string{"PATH=client", "temp=client"},
+			},
+			foldCase: true,
+			want:     []string{"PATH=client", "=C:=C:\\Users", "temp=client"},
+		},
+		{
+			name: "CaseInsensitiveUpdate",
+			in: EnvInputs{
+				Base: []string{"Path=base", "A=base"},
+				Update: func(current []string) ([]string, error) {
+					return append(current, "PATH=update"), nil
+				},
+				Overrides: []string{"a=override"},
+			},
+			foldCase: true,
+			want:     []string{"PATH=update", "a=override"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := buildSessionEnv(tt.in, tt.foldCase)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_buildSessionEnvDeterministic(t *testing.T) {
+	t.Parallel()
+
+	// The agent returns the updated environment in map order.
+	update := func(current []string) ([]string, error) {
+		vars := map[string]string{"CODER": "true", "CODER_WORKSPACE_NAME": "dev", "GIT_SSH_COMMAND": "coder gitssh --"}
+		for _, kv := range current {
+			name, value, _ := cutEnv(kv)
+			vars[name] = value
+		}
+		var updated []string
+		for name, value := range vars {
+			updated = append(updated, name+"="+value)
+		}
+		return updated, nil
+	}
+	in := EnvInputs{Base: []string{"HOME=/home/coder", "PATH=/usr/bin"}, User: "coder", Update: update}
+	want, err := buildSessionEnv(in, false)
+	require.NoError(t, err)
+	for range 20 {
+		got, err := buildSessionEnv(in, false)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+}
+
+func cutEnv(kv string) (name, value string, ok bool) {
+	key, ok := envKey(kv, false)
+	return key, kv[len(key)+1:], ok
+}
+
+func Test_setEnv(t *testing.T) {
+	t.Parallel()
+
+	env := []string{"A=1", "TERM=xterm", "B=2"}
+	env = setEnv(env, "TERM", "dumb")
+	require.Equal(t, []string{"A=1", "TERM=dumb", "B=2"}, env)
+	env = setEnv(env, "C", "3")
+	require.Equal(t, []string{"A=1", "TERM=dumb", "B=2", "C=3"}, env)
+}
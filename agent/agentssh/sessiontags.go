@@ -0,0 +1,89 @@
+package agentssh
+
+import (
+	"slices"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// SessionTagsEnvironmentVariable attaches tags to a session for attribution,
+// e.g. "ticket=ENG-123,job=nightly-42". The tags are reported in
+// ConnectionInfo, SessionMetadata, SessionStartAuditEntry and
+// Server.Sessions. Invalid tags are ignored. This is stripped from any
+// commands being executed.
+const SessionTagsEnvironmentVariable = "CODER_SSH_SESSION_TAGS"
+
+const (
+	// maxSessionTags is the maximum number of tags of a session.
+	maxSessionTags = 8
+	// maxSessionTagLength is the maximum length of the keys and values of
+	// tags.
+	maxSessionTagLength = 64
+)
+
+// extractSessionTags returns the raw tags of the session, or an empty string
+// if it has none, see SessionTagsEnvironmentVariable.
+func extractSessionTags(env []string) (string, []string) {
+	var raw string
+	env = slices.DeleteFunc(env, func(kv string) bool {
+		v, ok := strings.CutPrefix(kv, SessionTagsEnvironmentVariable+"=")
+		if ok {
+			// Use the last instance, like the magic session type.
+			raw = v
+		}
+		return ok
+	})
+	return raw, env
+}
+
+// parseSessionTags parses comma-separated key=value tags. Keys are made of
+// letters, digits, '.', '_' and '-', values may also contain ':' and '/', so
+// that tags are safe to log and report. Neither may be empty.
+func parseSessionTags(raw string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	pairs := strings.Split(raw, ",")
+	if len(pairs) > maxSessionTags {
+		return nil, xerrors.Errorf("%d tags, the maximum is %d", len(pairs), maxSessionTags)
+	}
+	tags := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, xerrors.Errorf("tag %q is not key=value", pair)
+		}
+		if err := validateSessionTag(key, isSessionTagKeyRune); err != nil {
+			return nil, xerrors.Errorf("key %q: %w", key, err)
+		}
+		if err := validateSessionTag(value, isSessionTagValueRune); err != nil {
+			return nil, xerrors.Errorf("value of %q: %w", key, err)
+		}
+		if _, ok := tags[key]; ok {
+			return nil, xerrors.Errorf("duplicate key %q", key)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+func validateSessionTag(s string, valid func(r rune) bool) error {
+	switch {
+	case s == "":
+		return xerrors.New("empty")
+	case len(s) > maxSessionTagLength:
+		return xerrors.Errorf("longer than %d bytes", maxSessionTagLength)
+	case strings.IndexFunc(s, func(r rune) bool { return !valid(r) }) >= 0:
+		return xerrors.New("invalid character")
+	}
+	return nil
+}
+
+func isSessionTagKeyRune(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-'
+}
+
+func isSessionTagValueRune(r rune) bool {
+	return isSessionTagKeyRune(r) || r == ':' || r == '/'
+}
@@ -0,0 +1,73 @@
+package agentssh
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseSessionTags(t *testing.T) {
+	t.Parallel()
+
+	long := strings.Repeat("a", maxSessionTagLength)
+	tests := []struct {
+		name    string
+		raw     string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "Empty"},
+		{name: "Single", raw: "ticket=ENG-123", want: map[string]string{"ticket": "ENG-123"}},
+		{
+			name: "Multiple",
+			raw:  "ticket=ENG-123,job=ci:nightly/42,run.id=7_b",
+			want: map[string]string{"ticket": "ENG-123", "job": "ci:nightly/42", "run.id": "7_b"},
+		},
+		{name: "MaxLength", raw: long + "=" + long, want: map[string]string{long: long}},
+		{
+			name: "MaxTags",
+			raw:  "a=1,b=2,c=3,d=4,e=5,f=6,g=7,h=8",
+			want: map[string]string{"a": "1", "b": "2", "c": "3", "d": "4", "e": "5", "f": "6", "g": "7", "h": "8"},
+		},
+		{name: "TooManyTags", raw: "a=1,b=2,c=3,d=4,e=5,f=6,g=7,h=8,i=9", wantErr: true},
+		{name: "KeyTooLong", raw: long + "a=1", wantErr: true},
+		{name: "ValueTooLong", raw: "a=" + long + "a", wantErr: true},
+		{name: "NoValue", raw: "ticket", wantErr: true},
+		{name: "EmptyKey", raw: "=ENG-123", wantErr: true},
+		{name: "EmptyValue", raw: "ticket=", wantErr: true},
+		{name: "TrailingComma", raw: "ticket=ENG-123,", wantErr: true},
+		{name: "Duplicate", raw: "a=1,a=2", wantErr: true},
+		{name: "ValueWithEquals", raw: "a=b=c", wantErr: true},
+		{name: "Space", raw: "ticket=ENG 123", wantErr: true},
+		{name: "KeyWithColon", raw: "a:b=1", wantErr: true},
+		{name: "ControlCharacter", raw: "a=\x1b[31m", wantErr: true},
+		{name: "NonASCII", raw: "a=café", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tags, err := parseSessionTags(tt.raw)
+			if tt.wantErr {
+				require.Error(t, err)
+				require.Nil(t, tags)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, tags)
+		})
+	}
+}
+
+func Test_extractSessionTags(t *testing.T) {
+	t.Parallel()
+
+	raw, env := extractSessionTags([]string{
+		"FOO=bar",
+		SessionTagsEnvironmentVariable + "=a=1",
+		SessionTagsEnvironmentVariable + "=b=2",
+	})
+	// The last instance is used.
+	require.Equal(t, "b=2", raw)
+	require.Equal(t, []string{"FOO=bar"}, env)
+}
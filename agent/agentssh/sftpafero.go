@@ -0,0 +1,387 @@
+package agentssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+// NewAferoSFTPHandler returns a Config.SFTPHandler serving fs instead of the
+// filesystem of the agent. Like DefaultSFTPHandler, relative paths start in
+// the working directory chosen by the server.
+//
+// It behaves like a POSIX filesystem where sshfs relies on it: handles stay
+// bound to the file they opened even if it is renamed or replaced,
+// posix-rename@openssh.com replaces the target, and setting the size of an
+// open handle truncates the open file. The plain SFTP rename refuses to
+// replace the target, as the protocol requires.
+func NewAferoSFTPHandler(fs afero.Fs) func(logger slog.Logger, session ssh.Session) error {
+	return func(logger slog.Logger, session ssh.Session) error {
+		ctx := session.Context()
+
+		var opts []sftp.RequestServerOption
+		if workDir, ok := ctx.Value(sftpWorkingDirectoryKey{}).(string); ok && workDir != "" {
+			opts = append(opts, sftp.WithStartDirectory(workDir))
+		}
+		h := &aferoSFTP{fs: fs}
+		server := sftp.NewRequestServer(session, sftp.Handlers{
+			FileGet:  h,
+			FilePut:  h,
+			FileCmd:  h,
+			FileList: h,
+		}, opts...)
+		defer server.Close()
+
+		err := server.Serve()
+		if err == nil || errors.Is(err, io.EOF) {
+			return nil
+		}
+		logger.Debug(ctx, "afero sftp server closed", slog.Error(err))
+		return err
+	}
+}
+
+// aferoSFTP implements the handlers of sftp.RequestServer on an afero.Fs.
+type aferoSFTP struct {
+	fs afero.Fs
+
+	mu sync.Mutex
+	// open are the files opened for writing, oldest first. The request
+	// server turns SSH_FXP_FSETSTAT into a Setstat of the path the handle
+	// was opened with, which is looked up here to truncate the open file
+	// rather than whatever the path now refers to.
+	open []*aferoSFTPFile
+}
+
+var (
+	_ sftp.FileReader           = (*aferoSFTP)(nil)
+	_ sftp.OpenFileWriter       = (*aferoSFTP)(nil)
+	_ sftp.PosixRenameFileCmder = (*aferoSFTP)(nil)
+	_ sftp.LstatFileLister      = (*aferoSFTP)(nil)
+	_ sftp.ReadlinkFileLister   = (*aferoSFTP)(nil)
+)
+
+// aferoSFTPFile is a file opened for writing.
+type aferoSFTPFile struct {
+	afero.File
+	h *aferoSFTP
+	// opened is the path the file was opened with, and path the current
+	// one, empty once the file was removed or replaced. Both are protected
+	// by the mu of h.
+	opened string
+	path   string
+
+	// mu serializes appends, which write at the end of the file whatever
+	// the offset.
+	mu     sync.Mutex
+	append bool
+}
+
+func (f *aferoSFTPFile) WriteAt(p []byte, off int64) (int, error) {
+	if !f.append {
+		return f.File.WriteAt(p, off)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info, err := f.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, info.Size())
+}
+
+// Close is called by the request server when the handle is closed.
+func (f *aferoSFTPFile) Close() error {
+	f.h.mu.Lock()
+	f.h.open = slices.DeleteFunc(f.h.open, func(other *aferoSFTPFile) bool { return other == f })
+	f.h.mu.Unlock()
+	return f.File.Close()
+}
+
+func (h *aferoSFTP) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.fs.OpenFile(r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (h *aferoSFTP) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.openFile(r)
+}
+
+func (h *aferoSFTP) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return h.openFile(r)
+}
+
+func (h *aferoSFTP) openFile(r *sftp.Request) (*aferoSFTPFile, error) {
+	pflags := r.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	perm := os.FileMode(0o644)
+	if p, ok := openPermissions(r.Attrs); ok {
+		perm = p
+	}
+	// O_APPEND is emulated, as WriteAt fails on files opened with it.
+	file, err := h.fs.OpenFile(r.Filepath, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	f := &aferoSFTPFile{File: file, h: h, opened: r.Filepath, path: r.Filepath, append: pflags.Append}
+	h.mu.Lock()
+	h.open = append(h.open, f)
+	h.mu.Unlock()
+	return f, nil
+}
+
+// openPermissions returns the permissions of the attributes of an
+// SSH_FXP_OPEN, if set. Unlike those of SSH_FXP_SETSTAT, they are passed on
+// unparsed, starting with their flags.
+func openPermissions(attrs []byte) (os.FileMode, bool) {
+	const (
+		attrSize        = 0x1
+		attrUIDGID      = 0x2
+		attrPermissions = 0x4
+	)
+	if len(attrs) < 4 {
+		return 0, false
+	}
+	flags := binary.BigEndian.Uint32(attrs)
+	attrs = attrs[4:]
+	if flags&attrPermissions == 0 {
+		return 0, false
+	}
+	if flags&attrSize != 0 {
+		attrs = attrs[min(8, len(attrs)):]
+	}
+	if flags&attrUIDGID != 0 {
+		attrs = attrs[min(8, len(attrs)):]
+	}
+	if len(attrs) < 4 {
+		return 0, false
+	}
+	return os.FileMode(binary.BigEndian.Uint32(attrs)).Perm(), true
+}
+
+func (h *aferoSFTP) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(r)
+	case "Rename":
+		// SSH_FXP_RENAME fails if the target exists, clients replacing
+		// files use posix-rename@openssh.com.
+		if _, err := h.lstat(r.Target); err == nil {
+			return &os.LinkError{Op: "rename", Old: r.Filepath, New: r.Target, Err: os.ErrExist}
+		}
+		return h.rename(r.Filepath, r.Target)
+	case "Rmdir":
+		info, err := h.lstat(r.Filepath)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return &os.PathError{Op: "rmdir", Path: r.Filepath, Err: xerrors.New("not a directory")}
+		}
+		return h.fs.Remove(r.Filepath)
+	case "Remove":
+		info, err := h.lstat(r.Filepath)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return &os.PathError{Op: "remove", Path: r.Filepath, Err: xerrors.New("is a directory")}
+		}
+		if err := h.fs.Remove(r.Filepath); err != nil {
+			return err
+		}
+		// Handles of the file keep working, but the path no longer
+		// refers to it.
+		h.mu.Lock()
+		for _, f := range h.open {
+			if f.path == r.Filepath {
+				f.path = ""
+			}
+		}
+		h.mu.Unlock()
+		return nil
+	case "Mkdir":
+		return h.fs.Mkdir(r.Filepath, 0o755)
+	case "Symlink":
+		linker, ok := h.fs.(afero.Linker)
+		if !ok {
+			return sftp.ErrSSHFxOpUnsupported
+		}
+		// Filepath is the target of the link, Target is the link.
+		return linker.SymlinkIfPossible(r.Filepath, r.Target)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename renames like rename(2), replacing the target.
+func (h *aferoSFTP) PosixRename(r *sftp.Request) error {
+	return h.rename(r.Filepath, r.Target)
+}
+
+// rename renames the file and updates the path of its open files, and of
+// those in it if it's a directory. Open files of a replaced target no longer
+// have a path.
+func (h *aferoSFTP) rename(oldpath, newpath string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.fs.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	for _, f := range h.open {
+		switch {
+		case f.path == newpath:
+			f.path = ""
+		case f.path == oldpath:
+			f.path = newpath
+		case strings.HasPrefix(f.path, oldpath+"/"):
+			f.path = newpath + strings.TrimPrefix(f.path, oldpath)
+		}
+	}
+	return nil
+}
+
+func (h *aferoSFTP) setstat(r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if flags.Size {
+		if err := h.truncate(r.Filepath, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := h.fs.Chmod(r.Filepath, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := h.fs.Chown(r.Filepath, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := h.fs.Chtimes(r.Filepath, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncate truncates path like ftruncate(2) if it's open for writing, or
+// else if it's the path a renamed or removed open file was opened with,
+// which is how the request server passes SSH_FXP_FSETSTAT. Otherwise the
+// file at path is truncated.
+func (h *aferoSFTP) truncate(path string, size int64) error {
+	h.mu.Lock()
+	var current, moved *aferoSFTPFile
+	for _, f := range h.open {
+		switch {
+		case f.path == path:
+			current = f
+		case f.opened == path:
+			moved = f
+		}
+	}
+	h.mu.Unlock()
+	if current != nil {
+		return current.Truncate(size)
+	}
+	if moved != nil {
+		if _, err := h.lstat(path); errors.Is(err, os.ErrNotExist) {
+			return moved.Truncate(size)
+		}
+	}
+
+	f, err := h.fs.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Truncate(size)
+}
+
+func (h *aferoSFTP) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		dir, err := h.fs.Open(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		defer dir.Close()
+		infos, err := dir.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		return aferoListerAt(infos), nil
+	case "Stat":
+		info, err := h.fs.Stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return aferoListerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *aferoSFTP) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	info, err := h.lstat(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return aferoListerAt{info}, nil
+}
+
+func (h *aferoSFTP) Readlink(path string) (string, error) {
+	reader, ok := h.fs.(afero.LinkReader)
+	if !ok {
+		return "", sftp.ErrSSHFxOpUnsupported
+	}
+	return reader.ReadlinkIfPossible(path)
+}
+
+// lstat doesn't follow symbolic links if fs supports them.
+func (h *aferoSFTP) lstat(path string) (os.FileInfo, error) {
+	if lstater, ok := h.fs.(afero.Lstater); ok {
+		info, _, err := lstater.LstatIfPossible(path)
+		return info, err
+	}
+	return h.fs.Stat(path)
+}
+
+type aferoListerAt []os.FileInfo
+
+func (l aferoListerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
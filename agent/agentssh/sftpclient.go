@@ -0,0 +1,178 @@
+package agentssh
+
+import (
+	"context"
+	"encoding/binary"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+
+	"cdr.dev/slog"
+)
+
+// SFTP packet types of the version negotiation.
+const (
+	sftpPacketInit    = 1
+	sftpPacketVersion = 2
+)
+
+// SFTPClientOverride changes the SFTP server for clients with quirks.
+type SFTPClientOverride struct {
+	// ClientVersion is matched against the SSH client version of the
+	// connection, e.g. "SSH-2.0-WinSCP_release_6.3".
+	ClientVersion *regexp.Regexp
+	// DisabledExtensions are not advertised to matching clients, e.g.
+	// "statvfs@openssh.com".
+	DisabledExtensions []string
+}
+
+// SFTPClientInfo describes the client of an SFTP session.
+type SFTPClientInfo struct {
+	// SSHClientVersion is the SSH client version of the connection.
+	SSHClientVersion string
+	// Version is the SFTP protocol version requested by the client.
+	Version uint32
+	// Extensions are the names of the extensions declared by the client.
+	Extensions []string
+	// DisabledExtensions are the server extensions that weren't advertised
+	// to the client because of Config.SFTPClientOverrides.
+	DisabledExtensions []string
+}
+
+// sftpClientSession records the SFTP client information from the INIT
+// packet and removes disabled extensions from the VERSION response. The
+// rest of the stream is passed through unchanged.
+type sftpClientSession struct {
+	ssh.Session
+	ctx      context.Context
+	logger   slog.Logger
+	disabled []string
+
+	requests sftpPacketScanner
+
+	mu          sync.Mutex
+	info        SFTPClientInfo
+	initDone    bool
+	versionDone bool
+}
+
+func newSFTPClientSession(logger slog.Logger, session ssh.Session, overrides []SFTPClientOverride) *sftpClientSession {
+	clientVersion := session.Context().ClientVersion()
+	var disabled []string
+	for _, o := range overrides {
+		if o.ClientVersion != nil && o.ClientVersion.MatchString(clientVersion) {
+			disabled = append(disabled, o.DisabledExtensions...)
+		}
+	}
+	s := &sftpClientSession{
+		Session:  session,
+		ctx:      session.Context(),
+		logger:   logger,
+		disabled: disabled,
+		info:     SFTPClientInfo{SSHClientVersion: clientVersion},
+	}
+	s.requests.inspect = func(typ byte) bool { return typ == sftpPacketInit }
+	s.requests.handle = s.handleInit
+	return s
+}
+
+// Info returns the client information, complete once the version
+// negotiation is done.
+func (s *sftpClientSession) Info() SFTPClientInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info
+}
+
+func (s *sftpClientSession) Read(p []byte) (int, error) {
+	n, err := s.Session.Read(p)
+	s.mu.Lock()
+	initDone := s.initDone
+	s.mu.Unlock()
+	// INIT is the first packet, nothing else needs to be scanned.
+	if !initDone {
+		s.requests.feed(p[:n])
+	}
+	return n, err
+}
+
+func (s *sftpClientSession) handleInit(_ byte, payload []byte) {
+	d := sftpDecoder{b: payload}
+	version := d.uint32()
+	var extensions []string
+	for !d.err && len(d.b) > 0 {
+		name := d.string()
+		_ = d.string()
+		if !d.err {
+			extensions = append(extensions, name)
+		}
+	}
+
+	s.mu.Lock()
+	s.initDone = true
+	s.info.Version = version
+	s.info.Extensions = extensions
+	info := s.info
+	s.mu.Unlock()
+
+	s.logger.Info(s.ctx, "sftp client connected",
+		slog.F("client_version", info.SSHClientVersion),
+		slog.F("sftp_version", info.Version),
+		slog.F("sftp_extensions", info.Extensions),
+	)
+}
+
+// Write removes the disabled extensions from the VERSION response, which
+// the SFTP server writes with a single Write.
+func (s *sftpClientSession) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	rewrite := !s.versionDone && len(s.disabled) > 0
+	s.versionDone = true
+	s.mu.Unlock()
+	if !rewrite {
+		return s.Session.Write(p)
+	}
+
+	rewritten, removed, ok := withoutSFTPExtensions(p, s.disabled)
+	if !ok {
+		s.logger.Debug(s.ctx, "unexpected first sftp packet, not removing extensions")
+		return s.Session.Write(p)
+	}
+	s.mu.Lock()
+	s.info.DisabledExtensions = removed
+	s.mu.Unlock()
+	if len(removed) > 0 {
+		s.logger.Debug(s.ctx, "disabled sftp extensions for client", slog.F("sftp_extensions", removed))
+	}
+	if _, err := s.Session.Write(rewritten); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// withoutSFTPExtensions returns the VERSION packet p without the disabled
+// extensions, ok is false if p isn't a complete VERSION packet.
+func withoutSFTPExtensions(p []byte, disabled []string) (rewritten []byte, removed []string, ok bool) {
+	if len(p) < 9 || p[4] != sftpPacketVersion || int(binary.BigEndian.Uint32(p))+4 != len(p) {
+		return nil, nil, false
+	}
+	out := append([]byte{}, p[:9]...)
+	d := sftpDecoder{b: p[9:]}
+	for len(d.b) > 0 {
+		start := d.b
+		name := d.string()
+		_ = d.string()
+		if d.err {
+			return nil, nil, false
+		}
+		if slices.Contains(disabled, name) {
+			removed = append(removed, name)
+			continue
+		}
+		out = append(out, start[:len(start)-len(d.b)]...)
+	}
+	binary.BigEndian.PutUint32(out, uint32(len(out)-4)) //nolint:gosec // Smaller than the original packet.
+	return out, removed, true
+}
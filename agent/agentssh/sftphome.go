@@ -0,0 +1,57 @@
+package agentssh
+
+import (
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+)
+
+// sftpWorkingDirectoryKey is the ssh.Context key of the directory SFTP
+// sessions start in, set by the server for DefaultSFTPHandler and
+// NewAferoSFTPHandler.
+type sftpWorkingDirectoryKey struct{}
+
+// Fallbacks of SFTP sessions when the home directory is unusable, the label
+// of the agent_ssh_server_sftp_home_fallbacks_total metric.
+const (
+	sftpFallbackWorkingDirectory  = "working_directory"
+	sftpFallbackFallbackDirectory = "fallback_directory"
+	sftpFallbackRoot              = "root"
+	sftpFallbackRejected          = "rejected"
+)
+
+// sftpWorkingDirectory returns the directory SFTP sessions start in, the
+// home directory of the user if it's usable. Otherwise homeErr says why not
+// and dir is the first usable of wd, the result of Config.WorkingDirectory,
+// and Config.SFTPFallbackDirectory, named by fallback. If neither is usable,
+// dir is empty and sessions start in "/", as pkg/sftp does by default.
+func (s *Server) sftpWorkingDirectory(wd string) (dir, fallback string, homeErr error) {
+	fs := afero.NewOsFs()
+	home, err := resolvedHomeDir(fs)
+	if err == nil {
+		err = usableDir(fs, home)
+		if err == nil {
+			return home, "", nil
+		}
+	}
+	homeErr = err
+
+	if wd != "" && usableDir(fs, wd) == nil {
+		return wd, sftpFallbackWorkingDirectory, homeErr
+	}
+	if fd := s.config.SFTPFallbackDirectory; fd != "" && usableDir(fs, fd) == nil {
+		return fd, sftpFallbackFallbackDirectory, homeErr
+	}
+	return "", sftpFallbackRoot, homeErr
+}
+
+// usableDir returns an error if dir doesn't exist or isn't a directory.
+func usableDir(fs afero.Fs, dir string) error {
+	info, err := fs.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return xerrors.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package agentssh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/v2/pty"
+	"github.com/coder/quartz"
+)
+
+// shellIntegrationMarker is the OSC 633 "prompt start" sequence written by
+// the prompt hook before each prompt. The VS Code terminal understands it,
+// other terminals ignore it.
+const shellIntegrationMarker = "\x1b]633;A\a"
+
+// shellIntegrationBashrc is passed to bash with --rcfile. An interactive
+// shell started with --rcfile isn't a login shell, so it reads the profile
+// files like a login shell would before installing the prompt hook.
+const shellIntegrationBashrc = `# Generated by the Coder agent for shell integration, removed when the session ends.
+if [ -f /etc/profile ]; then . /etc/profile; fi
+if [ -f ~/.bash_profile ]; then . ~/.bash_profile
+elif [ -f ~/.bash_login ]; then . ~/.bash_login
+elif [ -f ~/.profile ]; then . ~/.profile
+fi
+__coder_prompt_ready() {
+	local status=$?
+	printf '\033]633;A\007'
+	return $status
+}
+PROMPT_COMMAND="__coder_prompt_ready${PROMPT_COMMAND:+;$PROMPT_COMMAND}"
+`
+
+// shellIntegrationZshSource is the start of each zsh startup file in the
+// ZDOTDIR shim, sourcing the file of the same name from the user's ZDOTDIR.
+// The user's files may change ZDOTDIR, which is kept for the next file.
+const shellIntegrationZshSource = `# Generated by the Coder agent for shell integration, removed when the session ends.
+__coder_zdotdir=$ZDOTDIR
+ZDOTDIR=${CODER_USER_ZDOTDIR:-$HOME}
+if [[ -f $ZDOTDIR/%[1]s ]]; then source $ZDOTDIR/%[1]s; fi
+CODER_USER_ZDOTDIR=$ZDOTDIR
+ZDOTDIR=$__coder_zdotdir
+`
+
+// shellIntegrationZshrc installs the prompt hook after the user's .zshrc.
+const shellIntegrationZshrc = `__coder_prompt_ready() { printf '\033]633;A\007'; }
+precmd_functions+=(__coder_prompt_ready)
+`
+
+// shellIntegrationZlogin restores ZDOTDIR after .zlogin, the last file read
+// by a login shell.
+const shellIntegrationZlogin = `if [[ $CODER_USER_ZDOTDIR == $HOME ]]; then unset ZDOTDIR; else ZDOTDIR=$CODER_USER_ZDOTDIR; fi
+unset CODER_USER_ZDOTDIR __coder_zdotdir
+`
+
+// shellIntegration injects a prompt hook into a bash or zsh login shell and
+// records when the hook first runs, see Config.ShellIntegration.
+type shellIntegration struct {
+	clock quartz.Clock
+	shell string
+	dir   string
+
+	mu      sync.Mutex
+	start   time.Time
+	readyAt time.Time
+	// tail is the end of the previous output, which may hold the start of
+	// a marker split across writes.
+	tail []byte
+}
+
+// newShellIntegration modifies the login shell cmd to run the prompt hook,
+// writing its startup files to a new directory in baseDir, or the system
+// temporary directory if empty. It returns nil if the shell isn't bash or
+// zsh. The directory is removed by close.
+func newShellIntegration(clock quartz.Clock, baseDir string, cmd *pty.Cmd) (*shellIntegration, error) {
+	shell := strings.TrimPrefix(filepath.Base(unwrapShims(cmd.Path, cmd.Args)), "-")
+	if (shell != "bash" && shell != "zsh") || len(cmd.Args) == 0 || cmd.Args[len(cmd.Args)-1] != "-l" {
+		return nil, nil
+	}
+
+	dir, err := os.MkdirTemp(baseDir, "coder-shell-integration")
+	if err != nil {
+		return nil, xerrors.Errorf("create shell integration dir: %w", err)
+	}
+	files := map[string]string{}
+	switch shell {
+	case "bash":
+		files["bashrc"] = shellIntegrationBashrc
+	case "zsh":
+		for _, name := range []string{".zshenv", ".zprofile", ".zshrc", ".zlogin"} {
+			files[name] = fmt.Sprintf(shellIntegrationZshSource, name)
+		}
+		files[".zshrc"] += shellIntegrationZshrc
+		files[".zlogin"] += shellIntegrationZlogin
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			_ = os.RemoveAll(dir)
+			return nil, xerrors.Errorf("write shell integration file: %w", err)
+		}
+	}
+
+	// The shell's own arguments are last, after those of any shims.
+	switch shell {
+	case "bash":
+		cmd.Args = append(cmd.Args[:len(cmd.Args)-1], "--rcfile", filepath.Join(dir, "bashrc"), "-i")
+	case "zsh":
+		userZDOTDIR, _ := envValue(cmd.Env, "ZDOTDIR")
+		cmd.Env = setEnv(setEnv(cmd.Env, "CODER_USER_ZDOTDIR", userZDOTDIR), "ZDOTDIR", dir)
+	}
+	return &shellIntegration{clock: clock, shell: shell, dir: dir}, nil
+}
+
+// begin marks the time the shell is started.
+func (si *shellIntegration) begin() {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	si.start = si.clock.Now()
+}
+
+// wrap returns a writer detecting the marker in the output written to w,
+// which is passed through unchanged.
+func (si *shellIntegration) wrap(w io.Writer) io.Writer {
+	return &shellIntegrationWriter{si: si, w: w}
+}
+
+// observe records the first marker in the output of the shell.
+func (si *shellIntegration) observe(b []byte) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	if !si.readyAt.IsZero() {
+		return
+	}
+	buf := append(si.tail, b...)
+	if bytes.Contains(buf, []byte(shellIntegrationMarker)) {
+		si.readyAt = si.clock.Now()
+		si.tail = nil
+		return
+	}
+	if keep := len(shellIntegrationMarker) - 1; len(buf) > keep {
+		buf = buf[len(buf)-keep:]
+	}
+	si.tail = bytes.Clone(buf)
+}
+
+// ready returns when the prompt was first ready and how long after starting
+// the shell, or the zero time if it never was.
+func (si *shellIntegration) ready() (time.Time, time.Duration) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	if si.readyAt.IsZero() {
+		return time.Time{}, 0
+	}
+	return si.readyAt, si.readyAt.Sub(si.start)
+}
+
+// close removes the startup files.
+func (si *shellIntegration) close() error {
+	return os.RemoveAll(si.dir)
+}
+
+type shellIntegrationWriter struct {
+	si *shellIntegration
+	w  io.Writer
+}
+
+func (w *shellIntegrationWriter) Write(b []byte) (int, error) {
+	w.si.observe(b)
+	return w.w.Write(b)
+}
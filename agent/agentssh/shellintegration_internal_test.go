@@ -0,0 +1,139 @@
+package agentssh
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/v2/pty"
+	"github.com/coder/coder/v2/testutil"
+	"github.com/coder/quartz"
+)
+
+func Test_newShellIntegration(t *testing.T) {
+	t.Parallel()
+
+	clock := quartz.NewMock(t)
+
+	// Other shells and commands are left alone.
+	for _, args := range [][]string{
+		{"/usr/bin/fish", "-l"},
+		{"/bin/bash", "-c", "echo hi"},
+	} {
+		cmd := pty.Command(args[0], args[1:]...)
+		si, err := newShellIntegration(clock, t.TempDir(), cmd)
+		require.NoError(t, err)
+		require.Nil(t, si)
+		require.Equal(t, args, cmd.Args)
+	}
+
+	cmd := pty.Command("/bin/bash", "-l")
+	si, err := newShellIntegration(clock, t.TempDir(), cmd)
+	require.NoError(t, err)
+	require.NotNil(t, si)
+	require.Equal(t, []string{"/bin/bash", "--rcfile", filepath.Join(si.dir, "bashrc"), "-i"}, cmd.Args)
+	require.FileExists(t, filepath.Join(si.dir, "bashrc"))
+	require.NoError(t, si.close())
+	require.NoDirExists(t, si.dir)
+
+	cmd = pty.Command("/bin/zsh", "-l")
+	cmd.Env = []string{"ZDOTDIR=/home/coder/.config/zsh"}
+	si, err = newShellIntegration(clock, t.TempDir(), cmd)
+	require.NoError(t, err)
+	require.NotNil(t, si)
+	defer si.close()
+	require.Equal(t, []string{"/bin/zsh", "-l"}, cmd.Args)
+	require.Equal(t, []string{
+		"ZDOTDIR=/home/coder/.config/zsh",
+		"CODER_USER_ZDOTDIR=/home/coder/.config/zsh",
+		"ZDOTDIR=" + si.dir,
+	}, cmd.Env)
+	require.FileExists(t, filepath.Join(si.dir, ".zshrc"))
+}
+
+func Test_shellIntegration_observe(t *testing.T) {
+	t.Parallel()
+
+	clock := quartz.NewMock(t)
+	si := &shellIntegration{clock: clock}
+	si.begin()
+	clock.Advance(time.Second)
+
+	var out bytes.Buffer
+	w := si.wrap(&out)
+	_, _ = w.Write([]byte("loading\r\n\x1b]63"))
+	readyAt, _ := si.ready()
+	require.True(t, readyAt.IsZero())
+
+	// The marker is split across writes.
+	_, _ = w.Write([]byte("3;A"))
+	clock.Advance(time.Second)
+	_, _ = w.Write([]byte("\a$ "))
+	readyAt, elapsed := si.ready()
+	require.Equal(t, clock.Now(), readyAt)
+	require.Equal(t, 2*time.Second, elapsed)
+
+	// Only the first prompt is recorded.
+	clock.Advance(time.Second)
+	_, _ = w.Write([]byte(shellIntegrationMarker))
+	readyAt, _ = si.ready()
+	require.Equal(t, clock.Now().Add(-time.Second), readyAt)
+
+	// The output is unchanged.
+	require.Equal(t, "loading\r\n"+shellIntegrationMarker+"$ "+shellIntegrationMarker, out.String())
+}
+
+func Test_shellIntegration_bash(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell integration is not supported on Windows")
+	}
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not installed")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	home := t.TempDir()
+	err = os.WriteFile(filepath.Join(home, ".bash_profile"), []byte(
+		"echo profile-loaded\nPROMPT_COMMAND='echo user-prompt'\n",
+	), 0o600)
+	require.NoError(t, err)
+
+	cmd := pty.CommandContext(ctx, bash, "-l")
+	cmd.Env = []string{"HOME=" + home, "PATH=" + os.Getenv("PATH")}
+	si, err := newShellIntegration(quartz.NewReal(), t.TempDir(), cmd)
+	require.NoError(t, err)
+	require.NotNil(t, si)
+	defer si.close()
+
+	si.begin()
+	ptty, ps, err := pty.Start(cmd)
+	require.NoError(t, err)
+	defer ptty.Close()
+
+	var out bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		_, _ = io.Copy(si.wrap(&out), ptty.OutputReader())
+	}()
+	_, err = ptty.InputWriter().Write([]byte("exit\n"))
+	require.NoError(t, err)
+	require.NoError(t, ps.Wait())
+	_ = testutil.TryReceive(ctx, t, copied)
+
+	readyAt, _ := si.ready()
+	require.False(t, readyAt.IsZero(), "marker not seen in %q", out.String())
+	// The user's profile is still sourced, and their prompt command runs
+	// after the hook.
+	require.Contains(t, out.String(), "profile-loaded")
+	require.Contains(t, out.String(), shellIntegrationMarker+"user-prompt")
+}
@@ -0,0 +1,171 @@
+// Package sshtest provides helpers for connecting to an agentssh.Server in
+// tests, over TCP or in-memory transports.
+package sshtest
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/coder/coder/v2/agent/agentssh"
+)
+
+type options struct {
+	user    string
+	signers []gossh.Signer
+	env     [][2]string
+	pty     *ptyRequest
+}
+
+type ptyRequest struct {
+	term          string
+	width, height int
+}
+
+// Option configures the client or session created by this package.
+type Option func(*options)
+
+// WithUser sets the user name sent during the handshake.
+func WithUser(user string) Option {
+	return func(o *options) {
+		o.user = user
+	}
+}
+
+// WithSigner authenticates the client with the public key of signer, for
+// servers that set agentssh.Config.PublicKeyCallback.
+func WithSigner(signer gossh.Signer) Option {
+	return func(o *options) {
+		o.signers = append(o.signers, signer)
+	}
+}
+
+// WithEnv sets an environment variable on the session.
+func WithEnv(key, value string) Option {
+	return func(o *options) {
+		o.env = append(o.env, [2]string{key, value})
+	}
+}
+
+// WithSessionType identifies the session via the magic session type
+// environment variable.
+func WithSessionType(t agentssh.MagicSessionType) Option {
+	return WithEnv(agentssh.MagicSessionTypeEnvironmentVariable, string(t))
+}
+
+// WithContainer targets a container via the magic container environment
+// variables. An empty user is not sent.
+func WithContainer(container, user string) Option {
+	return func(o *options) {
+		WithEnv(agentssh.ContainerEnvironmentVariable, container)(o)
+		if user != "" {
+			WithEnv(agentssh.ContainerUserEnvironmentVariable, user)(o)
+		}
+	}
+}
+
+// WithPTY requests a PTY for the session.
+func WithPTY(term string, width, height int) Option {
+	return func(o *options) {
+		o.pty = &ptyRequest{term: term, width: width, height: height}
+	}
+}
+
+func applyOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// ClientConfig returns a client config suitable for connecting to an
+// agentssh.Server, which uses no authentication unless WithSigner is given
+// and a deterministic host key.
+func ClientConfig(opts ...Option) *gossh.ClientConfig {
+	o := applyOptions(opts)
+	config := &gossh.ClientConfig{
+		User:            o.user,
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(), //nolint:gosec // This is for tests.
+	}
+	if len(o.signers) > 0 {
+		config.Auth = []gossh.AuthMethod{gossh.PublicKeys(o.signers...)}
+	}
+	return config
+}
+
+// NewClient performs the SSH handshake over conn, which may be a TCP
+// connection or one dialed from an agentssh.InMemoryListener. The client is
+// closed when the test ends.
+func NewClient(t testing.TB, conn net.Conn, opts ...Option) *gossh.Client {
+	t.Helper()
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	sshConn, channels, requests, err := gossh.NewClientConn(conn, "localhost:22", ClientConfig(opts...))
+	require.NoError(t, err)
+	c := gossh.NewClient(sshConn, channels, requests)
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+	return c
+}
+
+// Dial connects to the server listening on the given TCP address.
+func Dial(ctx context.Context, t testing.TB, addr string, opts ...Option) *gossh.Client {
+	t.Helper()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	require.NoError(t, err)
+	return NewClient(t, conn, opts...)
+}
+
+// NewSession opens a session on the client with the environment and PTY
+// requested by opts.
+func NewSession(t testing.TB, c *gossh.Client, opts ...Option) *gossh.Session {
+	t.Helper()
+
+	o := applyOptions(opts)
+	sess, err := c.NewSession()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = sess.Close()
+	})
+	for _, kv := range o.env {
+		err = sess.Setenv(kv[0], kv[1])
+		require.NoError(t, err)
+	}
+	if o.pty != nil {
+		err = sess.RequestPty(o.pty.term, o.pty.height, o.pty.width, nil)
+		require.NoError(t, err)
+	}
+	return sess
+}
+
+// DialSession dials the given TCP address and opens a session. The returned
+// cleanup function closes the session and connection, it is also called when
+// the test ends.
+func DialSession(ctx context.Context, t testing.TB, addr string, opts ...Option) (*gossh.Session, func()) {
+	t.Helper()
+
+	c := Dial(ctx, t, addr, opts...)
+	sess := NewSession(t, c, opts...)
+	return sess, func() {
+		_ = sess.Close()
+		_ = c.Close()
+	}
+}
+
+// DialInMemory connects to the server serving the in-memory listener.
+func DialInMemory(ctx context.Context, t testing.TB, ln *agentssh.InMemoryListener, opts ...Option) *gossh.Client {
+	t.Helper()
+
+	conn, err := ln.Dial(ctx)
+	require.NoError(t, err)
+	return NewClient(t, conn, opts...)
+}
@@ -0,0 +1,26 @@
+package agentssh
+
+import "strings"
+
+// maxSSHUserLength is the length sanitized SSH user names are truncated to.
+const maxSSHUserLength = 64
+
+// sanitizeSSHUser returns the user name the client connected with, safe to
+// log and report. The server doesn't authenticate it, but it often tells
+// which host entry of the SSH config of the client was used. Characters
+// other than those of user names and email addresses are replaced with '?'.
+func sanitizeSSHUser(user string) string {
+	user = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.', r == '-', r == '+', r == '_', r == '@', r == '$':
+			return r
+		}
+		return '?'
+	}, user)
+	if len(user) > maxSSHUserLength {
+		user = user[:maxSSHUserLength]
+	}
+	return user
+}
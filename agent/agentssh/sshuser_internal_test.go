@@ -0,0 +1,35 @@
+package agentssh
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sanitizeSSHUser(t *testing.T) {
+	t.Parallel()
+
+	long := strings.Repeat("a", maxSSHUserLength)
+	tests := []struct {
+		name string
+		user string
+		want string
+	}{
+		{name: "Empty"},
+		{name: "Simple", user: "coder", want: "coder"},
+		{name: "Email", user: "jane.doe+dev@example.com", want: "jane.doe+dev@example.com"},
+		{name: "MachineAccount", user: "HOST-01$", want: "HOST-01$"},
+		{name: "Space", user: "ro ot", want: "ro?ot"},
+		{name: "ControlCharacter", user: "root\x1b[31m\r\n", want: "root?[31m??"},
+		{name: "NonASCII", user: "josé", want: "jos?"},
+		{name: "MaxLength", user: long, want: long},
+		{name: "TooLong", user: long + "b", want: long},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.want, sanitizeSSHUser(tt.user))
+		})
+	}
+}
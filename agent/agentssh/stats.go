@@ -0,0 +1,202 @@
+package agentssh
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/coder/quartz"
+)
+
+// ConnStatsDelta is a change to the connection stats, delivered to
+// subscribers of Server.SubscribeStats.
+type ConnStatsDelta struct {
+	Sessions int64
+	VSCode   int64
+	// JetBrains is the change in JetBrains channels, see
+	// ConnStats.JetBrainsChannels.
+	JetBrains         int64
+	ForwardedChannels int64
+	CLI               int64
+	// Stats are the connection stats after the change.
+	Stats ConnStats
+}
+
+// SubscribeStats returns a channel receiving a delta whenever a session
+// starts or ends, or a forwarded channel is opened or closed. Deltas are
+// delivered in order. The server never blocks on a subscriber, once buffer
+// deltas are pending further deltas are dropped (and counted), so
+// subscribers should resynchronize using the Stats of the next delta.
+//
+// The returned function unsubscribes and closes the channel, the channel is
+// also closed when the server is closed.
+func (s *Server) SubscribeStats(buffer int) (<-chan ConnStatsDelta, func()) {
+	ch := make(chan ConnStatsDelta, max(buffer, 0))
+
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	if s.statsClosed {
+		close(ch)
+		return ch, func() {}
+	}
+	s.statsSubs[ch] = struct{}{}
+
+	return ch, func() {
+		s.statsMu.Lock()
+		defer s.statsMu.Unlock()
+		if _, ok := s.statsSubs[ch]; ok {
+			delete(s.statsSubs, ch)
+			close(ch)
+		}
+	}
+}
+
+// addConnStats applies the delta to the connection stats and notifies
+// subscribers. JetBrains channels are counted by the JetbrainsChannelWatcher,
+// so d.JetBrains is only reported here.
+func (s *Server) addConnStats(d ConnStatsDelta) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	s.connCountSSHSession.Add(d.Sessions)
+	s.connCountVSCode.Add(d.VSCode)
+	s.connCountForwarded.Add(d.ForwardedChannels)
+	s.connCountCLI.Add(d.CLI)
+	d.Stats = s.ConnStats()
+
+	for ch := range s.statsSubs {
+		select {
+		case ch <- d:
+		default:
+			s.metrics.statsDeltasDropped.Add(1)
+		}
+	}
+}
+
+// sessionActivity records the time of the last activity of sessions by
+// session type, in Unix nanoseconds (zero if there was none). Activity is a
+// session starting, input to a PTY session or traffic on a JetBrains
+// channel. Output isn't activity, since e.g. tailing a log produces output
+// forever.
+type sessionActivity struct {
+	ssh       atomic.Int64
+	vscode    atomic.Int64
+	jetbrains atomic.Int64
+}
+
+// forType returns the last activity of the session type, or nil if it
+// isn't tracked.
+func (a *sessionActivity) forType(magicType MagicSessionType) *atomic.Int64 {
+	switch magicType {
+	case MagicSessionTypeSSH:
+		return &a.ssh
+	case MagicSessionTypeVSCode:
+		return &a.vscode
+	case MagicSessionTypeJetBrains:
+		return &a.jetbrains
+	default:
+		return nil
+	}
+}
+
+// touchActivity records activity now in last, if not nil.
+func touchActivity(clock quartz.Clock, last *atomic.Int64) {
+	if last != nil {
+		last.Store(clock.Now().UnixNano())
+	}
+}
+
+func activityTime(last *atomic.Int64) time.Time {
+	nanos := last.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// activityReader records activity for every read returning data.
+type activityReader struct {
+	r     io.Reader
+	clock quartz.Clock
+	last  *atomic.Int64
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		touchActivity(r.clock, r.last)
+	}
+	return n, err
+}
+
+// activityWriter records activity for every write of data.
+type activityWriter struct {
+	w     io.Writer
+	clock quartz.Clock
+	last  *atomic.Int64
+}
+
+func (w activityWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		touchActivity(w.clock, w.last)
+	}
+	return w.w.Write(p)
+}
+
+// closeStatsSubscribers closes the channels of all subscribers.
+func (s *Server) closeStatsSubscribers() {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	s.statsClosed = true
+	for ch := range s.statsSubs {
+		delete(s.statsSubs, ch)
+		close(ch)
+	}
+}
+
+// trackForwardedChannel counts the channel in the connection stats once
+// accepted, until it is closed.
+func (s *Server) trackForwardedChannel(newChan gossh.NewChannel) gossh.NewChannel {
+	var jetbrains int64
+	if _, ok := newChan.(*JetbrainsChannelWatcher); ok {
+		jetbrains = 1
+	}
+	return &statsNewChannel{NewChannel: newChan, s: s, jetbrains: jetbrains}
+}
+
+type statsNewChannel struct {
+	gossh.NewChannel
+	s         *Server
+	jetbrains int64
+}
+
+func (c *statsNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	ch, reqs, err := c.NewChannel.Accept()
+	if err != nil {
+		return ch, reqs, err
+	}
+	c.s.addConnStats(ConnStatsDelta{ForwardedChannels: 1, JetBrains: c.jetbrains})
+	return &statsChannel{
+		Channel: ch,
+		done: func() {
+			c.s.addConnStats(ConnStatsDelta{ForwardedChannels: -1, JetBrains: -c.jetbrains})
+		},
+	}, reqs, nil
+}
+
+// statsChannel is like ChannelOnClose, but calls done after closing the
+// channel so that the stats reported by done include the channel closing.
+type statsChannel struct {
+	gossh.Channel
+	once sync.Once
+	done func()
+}
+
+func (c *statsChannel) Close() error {
+	err := c.Channel.Close()
+	c.once.Do(c.done)
+	return err
+}
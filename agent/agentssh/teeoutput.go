@@ -0,0 +1,174 @@
+package agentssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+// TeeOutputEnvironmentVariable, if set by the client to a path, makes the
+// server also write the output of the session to the file at the path, so
+// that a dropped connection doesn't lose it. Relative paths are relative to
+// the home directory of the user, and the file must be in it or in one of
+// Config.TeeOutputAllowedDirs. If the file can't be opened, the session
+// runs without it after a warning. This is stripped from any commands being
+// executed.
+const TeeOutputEnvironmentVariable = "CODER_SSH_TEE_OUTPUT"
+
+// defaultTeeOutputMaxBytes is the default of Config.TeeOutputMaxBytes.
+const defaultTeeOutputMaxBytes = 64 << 20
+
+// extractTeeOutput returns the path the session requested its output to be
+// teed to, see TeeOutputEnvironmentVariable.
+func extractTeeOutput(env []string) (path string, found bool, _ []string) {
+	env = slices.DeleteFunc(env, func(kv string) bool {
+		v, ok := strings.CutPrefix(kv, TeeOutputEnvironmentVariable+"=")
+		if ok {
+			// Use the last instance, like the magic session type.
+			path, found = v, true
+		}
+		return ok
+	})
+	return path, found, env
+}
+
+// teeOutputPath returns the absolute path of the tee file requested as
+// path, with the symlinks of its directory resolved. The directory must be
+// the home directory of the user or one of Config.TeeOutputAllowedDirs, or
+// inside them.
+func (s *Server) teeOutputPath(path string) (string, error) {
+	if path == "" {
+		return "", xerrors.New("empty path")
+	}
+	home, err := resolvedHomeDir(s.fs)
+	if err != nil {
+		return "", xerrors.Errorf("get home dir: %w", err)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(home, path)
+	}
+	path = filepath.Clean(path)
+	dir := evalSymlinks(s.fs, filepath.Dir(path))
+	path = filepath.Join(dir, filepath.Base(path))
+
+	allowed := false
+	for _, root := range append([]string{home}, s.config.TeeOutputAllowedDirs...) {
+		if pathWithin(dir, evalSymlinks(s.fs, filepath.Clean(root))) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", xerrors.Errorf("%s is not in the home directory or an allowed directory", path)
+	}
+	// The file itself mustn't be a symlink either.
+	if lstater, ok := s.fs.(afero.Lstater); ok {
+		info, _, err := lstater.LstatIfPossible(path)
+		if err == nil && !info.Mode().IsRegular() {
+			return "", xerrors.Errorf("%s is not a regular file", path)
+		}
+	}
+	return path, nil
+}
+
+// pathWithin reports whether path is root or inside it. Both must be clean
+// and absolute.
+func pathWithin(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// openTeeOutput opens the tee file requested as path. On failure, a warning
+// is written to the session and nil is returned, the session runs without
+// it.
+func (s *Server) openTeeOutput(ctx context.Context, logger slog.Logger, stderr io.Writer, path string, inContainer bool) *teeWriter {
+	tee, err := func() (*teeWriter, error) {
+		if inContainer {
+			return nil, xerrors.New("not supported in containers")
+		}
+		resolved, err := s.teeOutputPath(path)
+		if err != nil {
+			return nil, err
+		}
+		f, err := s.fs.OpenFile(resolved, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		return &teeWriter{ctx: ctx, logger: logger.With(slog.F("tee_output", resolved)), f: f, max: s.config.TeeOutputMaxBytes}, nil
+	}()
+	if err != nil {
+		logger.Warn(ctx, "not teeing session output", slog.F("path", path), slog.Error(err))
+		_, _ = fmt.Fprintln(stderr, s.localize(MessageTeeOutputFailed, path, err))
+		return nil
+	}
+	return tee
+}
+
+// teeWriter writes the output of a session to a file, up to max bytes and a
+// truncation notice. It never fails, so that teeing doesn't break the
+// session. Writes of the streams of a session are serialized, each is
+// written whole.
+type teeWriter struct {
+	ctx    context.Context
+	logger slog.Logger
+	max    int64
+
+	mu        sync.Mutex
+	f         io.WriteCloser
+	written   int64
+	truncated bool
+	closed    bool
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || t.truncated {
+		return len(p), nil
+	}
+	b := p
+	if room := t.max - t.written; int64(len(b)) > room {
+		b = b[:room]
+		t.truncated = true
+	}
+	n, err := t.f.Write(b)
+	t.written += int64(n)
+	if err == nil && t.truncated {
+		// #nosec G115 - max is positive.
+		_, err = fmt.Fprintf(t.f, "\n[output truncated after %s]\n", humanize.IBytes(uint64(t.max)))
+	}
+	if err != nil {
+		t.logger.Warn(t.ctx, "failed to tee session output, not teeing the rest", slog.Error(err))
+		_ = t.closeLocked()
+	}
+	return len(p), nil
+}
+
+// Close closes the file, later writes are discarded.
+func (t *teeWriter) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closeLocked()
+}
+
+func (t *teeWriter) closeLocked() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	return t.f.Close()
+}
@@ -0,0 +1,117 @@
+package agentssh
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+
+	"github.com/coder/coder/v2/agent/agentexec"
+	"github.com/coder/coder/v2/testutil"
+)
+
+func Test_teeOutputPath(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := slogtest.Make(t, nil)
+	allowed := evalSymlinks(afero.NewOsFs(), t.TempDir())
+	outside := evalSymlinks(afero.NewOsFs(), t.TempDir())
+	err := os.Mkdir(filepath.Join(allowed, "sub"), 0o700)
+	require.NoError(t, err)
+	err = os.Symlink(outside, filepath.Join(allowed, "escape"))
+	require.NoError(t, err)
+	err = os.Symlink(filepath.Join(outside, "target.log"), filepath.Join(allowed, "link.log"))
+	require.NoError(t, err)
+	home, err := resolvedHomeDir(afero.NewOsFs())
+	require.NoError(t, err)
+	if pathWithin(allowed, home) {
+		t.Skip("the temporary directory is in the home directory")
+	}
+
+	s, err := NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewOsFs(), agentexec.DefaultExecer, &Config{
+		TeeOutputAllowedDirs: []string{allowed},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr string
+	}{
+		{name: "Relative", path: "build.log", want: filepath.Join(home, "build.log")},
+		{name: "Allowed", path: filepath.Join(allowed, "build.log"), want: filepath.Join(allowed, "build.log")},
+		{name: "AllowedSubdir", path: filepath.Join(allowed, "sub", "build.log"), want: filepath.Join(allowed, "sub", "build.log")},
+		{name: "Cleaned", path: allowed + "/sub/../build.log", want: filepath.Join(allowed, "build.log")},
+		{name: "Empty", path: "", wantErr: "empty path"},
+		{name: "Outside", path: filepath.Join(outside, "build.log"), wantErr: "not in the home directory"},
+		{name: "DotDot", path: allowed + "/../build.log", wantErr: "not in the home directory"},
+		{name: "SymlinkedDir", path: filepath.Join(allowed, "escape", "build.log"), wantErr: "not in the home directory"},
+		{name: "SymlinkedFile", path: filepath.Join(allowed, "link.log"), wantErr: "not a regular file"},
+		{name: "Directory", path: filepath.Join(allowed, "sub"), wantErr: "not a regular file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := s.teeOutputPath(tt.path)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func Test_teeWriter(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	var buf bytes.Buffer
+	tee := &teeWriter{ctx: ctx, logger: slogtest.Make(t, nil), max: 10, f: nopCloser{&buf}}
+
+	for _, s := range []string{"hello ", "world", "!"} {
+		n, err := tee.Write([]byte(s))
+		require.NoError(t, err)
+		require.Equal(t, len(s), n)
+	}
+	require.Equal(t, "hello worl\n[output truncated after 10 B]\n", buf.String())
+
+	// Exactly reaching the cap isn't truncation, the next write is.
+	buf.Reset()
+	tee = &teeWriter{ctx: ctx, logger: slogtest.Make(t, nil), max: 5, f: nopCloser{&buf}}
+	_, _ = tee.Write([]byte("hello"))
+	require.Equal(t, "hello", buf.String())
+	_, _ = tee.Write([]byte("!"))
+	require.Equal(t, "hello\n[output truncated after 5 B]\n", buf.String())
+
+	// Writes after close are discarded.
+	buf.Reset()
+	tee = &teeWriter{ctx: ctx, logger: slogtest.Make(t, nil), max: 5, f: nopCloser{&buf}}
+	err := tee.Close()
+	require.NoError(t, err)
+	n, err := tee.Write([]byte("late"))
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+	require.Empty(t, buf.String())
+}
@@ -0,0 +1,127 @@
+package agentssh
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	"go.uber.org/atomic"
+	gossh "golang.org/x/crypto/ssh"
+
+	"cdr.dev/slog"
+)
+
+// DefaultVSCodeServerPorts are the ports of the VS Code servers installed by
+// the code-server (13337) and vscode-web (13338) Coder modules.
+var DefaultVSCodeServerPorts = []uint32{13337, 13338}
+
+// DefaultVSCodeTunnelMatcher reports whether a direct-tcpip channel to the
+// destination is a tunnel to a VS Code server. Only loopback destinations on
+// one of the DefaultVSCodeServerPorts match, so that arbitrary tunnels are
+// not counted as VS Code.
+func DefaultVSCodeTunnelMatcher(host string, port uint32) bool {
+	if !slices.Contains(DefaultVSCodeServerPorts, port) {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+const (
+	tunnelKindVSCode      = "vscode"
+	tunnelKindPortForward = "port_forward"
+)
+
+// trackTunnel counts the bytes and duration of a direct-tcpip channel once
+// accepted. Tunnels to a VS Code server are also reported as VS Code
+// connections, all other tunnels are counted as generic port forwards.
+func (s *Server) trackTunnel(ctx ssh.Context, newChan gossh.NewChannel) gossh.NewChannel {
+	d := localForwardChannelData{}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		// The direct-tcpip handler rejects the channel.
+		return newChan
+	}
+	kind := tunnelKindPortForward
+	if s.config.VSCodeTunnelMatcher(d.DestAddr, d.DestPort) {
+		kind = tunnelKindVSCode
+	}
+	return &tunnelNewChannel{
+		NewChannel: newChan,
+		ctx:        ctx,
+		s:          s,
+		kind:       kind,
+		originAddr: d.OriginAddr,
+		logger: s.logger.With(
+			slog.F("tunnel", kind),
+			slog.F("destination_host", d.DestAddr),
+			slog.F("destination_port", d.DestPort),
+		),
+	}
+}
+
+type tunnelNewChannel struct {
+	gossh.NewChannel
+	ctx        context.Context
+	s          *Server
+	logger     slog.Logger
+	kind       string
+	originAddr string
+}
+
+func (c *tunnelNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	disconnected := func(int, string) {}
+	if c.kind == tunnelKindVSCode {
+		_, disconnected = c.s.reportConnection(ConnectionInfo{ID: uuid.New(), SessionType: MagicSessionTypeVSCode, IP: c.originAddr})
+	}
+
+	ch, reqs, err := c.NewChannel.Accept()
+	if err != nil {
+		disconnected(1, err.Error())
+		return ch, reqs, err
+	}
+	openedAt := c.s.config.Clock.Now()
+	counted := &countingChannel{Channel: ch}
+	return &ChannelOnClose{
+		Channel: counted,
+		done: func() {
+			duration := c.s.config.Clock.Since(openedAt)
+			rx, tx := counted.rx.Load(), counted.tx.Load()
+			c.s.metrics.tunnelBytes.WithLabelValues(c.kind, "rx").Add(float64(rx))
+			c.s.metrics.tunnelBytes.WithLabelValues(c.kind, "tx").Add(float64(tx))
+			c.s.metrics.tunnelSeconds.WithLabelValues(c.kind).Add(duration.Seconds())
+			c.s.metrics.tunnelsTotal.WithLabelValues(c.kind).Add(1)
+			disconnected(0, "")
+			c.logger.Debug(c.ctx, "tunnel closed",
+				slog.F("rx_bytes", rx),
+				slog.F("tx_bytes", tx),
+				slog.F("duration", duration.Round(time.Millisecond)))
+		},
+	}, reqs, nil
+}
+
+// countingChannel counts the bytes read from (rx) and written to (tx) the
+// channel.
+type countingChannel struct {
+	gossh.Channel
+	rx atomic.Int64
+	tx atomic.Int64
+}
+
+func (c *countingChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	c.rx.Add(int64(n))
+	return n, err
+}
+
+func (c *countingChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	c.tx.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,252 @@
+package agentssh
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+
+	"cdr.dev/slog"
+)
+
+// umaskShimScript sets the umask before executing the command passed as
+// arguments, since Go can't set the umask of a child process.
+const umaskShimScript = `umask %04o && exec "$0" "$@"`
+
+// withUmask wraps the command in a shell setting the umask, if set.
+func withUmask(umask *uint32, name string, args []string) (string, []string) {
+	if umask == nil {
+		return name, args
+	}
+	return "/bin/sh", append([]string{"-c", fmt.Sprintf(umaskShimScript, *umask), name}, args...)
+}
+
+// unwrapShims returns the path of the command started by a command line,
+// which may be wrapped by withUmask and sessionCgroup.wrap.
+func unwrapShims(path string, args []string) string {
+	for path == "/bin/sh" && len(args) > 3 && args[1] == "-c" &&
+		(strings.HasPrefix(args[2], "umask ") || strings.HasPrefix(args[2], "{ echo 0 > ")) {
+		path, args = args[3], args[3:]
+	}
+	return path
+}
+
+// SFTP packet types and flags, see
+// https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02.
+const (
+	sftpPacketOpen   = 3
+	sftpPacketMkdir  = 14
+	sftpPacketStatus = 101
+	sftpPacketHandle = 102
+
+	sftpOpenCreate = 0x08
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+
+	// sftpMaxInspectedPacket is the largest packet the scanner buffers,
+	// larger packets can't be requests or responses we are interested in.
+	sftpMaxInspectedPacket = 64 << 10
+)
+
+// sftpUmaskSession applies a umask to files and directories created by an
+// in-process SFTP server. The umask of the agent process can't be changed
+// per session, so the modes of created files are fixed with chmod before
+// the response reaches the client.
+type sftpUmaskSession struct {
+	ssh.Session
+	ctx     context.Context
+	logger  slog.Logger
+	workDir string
+	umask   os.FileMode
+
+	requests  sftpPacketScanner
+	responses sftpPacketScanner
+
+	mu      sync.Mutex
+	pending map[uint32]sftpCreate
+}
+
+// sftpCreate is a file or directory being created by a request.
+type sftpCreate struct {
+	path string
+	mode os.FileMode
+}
+
+// newSFTPUmaskSession returns a session applying umask to files created by
+// the SFTP server reading from it. Relative paths are resolved against
+// workDir, like the SFTP server does.
+func newSFTPUmaskSession(logger slog.Logger, session ssh.Session, workDir string, umask uint32) *sftpUmaskSession {
+	s := &sftpUmaskSession{
+		Session: session,
+		ctx:     session.Context(),
+		logger:  logger,
+		workDir: workDir,
+		umask:   os.FileMode(umask),
+		pending: make(map[uint32]sftpCreate),
+	}
+	s.requests.handle = s.handleRequest
+	s.requests.inspect = func(typ byte) bool { return typ == sftpPacketOpen || typ == sftpPacketMkdir }
+	s.responses.handle = s.handleResponse
+	s.responses.inspect = func(typ byte) bool { return typ == sftpPacketStatus || typ == sftpPacketHandle }
+	return s
+}
+
+func (s *sftpUmaskSession) Read(p []byte) (int, error) {
+	n, err := s.Session.Read(p)
+	s.requests.feed(p[:n])
+	return n, err
+}
+
+// Write fixes the modes of created files before the response completing
+// the request is sent.
+func (s *sftpUmaskSession) Write(p []byte) (int, error) {
+	s.responses.feed(p)
+	return s.Session.Write(p)
+}
+
+func (s *sftpUmaskSession) handleRequest(typ byte, payload []byte) {
+	d := sftpDecoder{b: payload}
+	id := d.uint32()
+	name := d.string()
+	mode := os.FileMode(0o755) // The SFTP server ignores the mode of mkdir.
+	if typ == sftpPacketOpen {
+		if d.uint32()&sftpOpenCreate == 0 {
+			return
+		}
+		// The SFTP server creates files with 0644, unless the client
+		// requested permissions.
+		mode = 0o644
+		flags := d.uint32()
+		if flags&sftpAttrSize != 0 {
+			d.skip(8)
+		}
+		if flags&sftpAttrUIDGID != 0 {
+			d.skip(8)
+		}
+		if flags&sftpAttrPermissions != 0 {
+			mode = os.FileMode(d.uint32()) & os.ModePerm
+		}
+	}
+	if d.err {
+		return
+	}
+	if s.workDir != "" && !path.IsAbs(name) {
+		name = path.Join(s.workDir, name)
+	}
+	// Only the modes of new files are changed.
+	if _, err := os.Lstat(name); err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.pending[id] = sftpCreate{path: name, mode: mode &^ s.umask}
+	s.mu.Unlock()
+}
+
+func (s *sftpUmaskSession) handleResponse(typ byte, payload []byte) {
+	d := sftpDecoder{b: payload}
+	id := d.uint32()
+	if d.err {
+		return
+	}
+	s.mu.Lock()
+	created, ok := s.pending[id]
+	delete(s.pending, id)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	// A status response to an open request is an error, to a mkdir
+	// request it is an error unless the code is 0 (SSH_FX_OK).
+	if typ == sftpPacketStatus && d.uint32() != 0 {
+		return
+	}
+	if err := os.Chmod(created.path, created.mode); err != nil {
+		s.logger.Warn(s.ctx, "failed to apply umask to file created over sftp", slog.F("path", created.path), slog.Error(err))
+	}
+}
+
+// sftpPacketScanner splits a stream of SFTP packets and passes the packets
+// whose type is selected by inspect to handle, without the length and type.
+type sftpPacketScanner struct {
+	inspect func(typ byte) bool
+	handle  func(typ byte, payload []byte)
+
+	buf  []byte
+	skip int
+}
+
+func (sc *sftpPacketScanner) feed(p []byte) {
+	for len(p) > 0 {
+		if sc.skip > 0 {
+			n := min(sc.skip, len(p))
+			sc.skip -= n
+			p = p[n:]
+			continue
+		}
+		// The header is the packet length and type.
+		if len(sc.buf) < 5 {
+			n := min(5-len(sc.buf), len(p))
+			sc.buf = append(sc.buf, p[:n]...)
+			p = p[n:]
+			continue
+		}
+		length := int(binary.BigEndian.Uint32(sc.buf))
+		typ := sc.buf[4]
+		if length < 1 || length > sftpMaxInspectedPacket || !sc.inspect(typ) {
+			sc.skip = max(length-1, 0)
+			sc.buf = sc.buf[:0]
+			continue
+		}
+		n := min(4+length-len(sc.buf), len(p))
+		sc.buf = append(sc.buf, p[:n]...)
+		p = p[n:]
+		if len(sc.buf) == 4+length {
+			sc.handle(typ, sc.buf[5:])
+			sc.buf = sc.buf[:0]
+		}
+	}
+}
+
+// sftpDecoder decodes fields of an SFTP packet, err is set if the packet
+// is too short.
+type sftpDecoder struct {
+	b   []byte
+	err bool
+}
+
+func (d *sftpDecoder) skip(n int) {
+	if len(d.b) < n {
+		d.err = true
+		d.b = nil
+		return
+	}
+	d.b = d.b[n:]
+}
+
+func (d *sftpDecoder) uint32() uint32 {
+	if len(d.b) < 4 {
+		d.err = true
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *sftpDecoder) string() string {
+	n := int(d.uint32())
+	if len(d.b) < n {
+		d.err = true
+		return ""
+	}
+	v := string(d.b[:n])
+	d.b = d.b[n:]
+	return v
+}
@@ -10,8 +10,11 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gliderlabs/ssh"
@@ -35,8 +38,87 @@ const (
 	// we will create. It seems more useful to have a maximum port number than a direct limit on sockets with no max
 	// port because we'd like to be able to tell users the exact range of ports the Agent might use.
 	X11MaxPort = X11StartPort + X11MaxDisplays
+	// X11DefaultMaxConnectionsPerDisplay is the default of
+	// Config.X11MaxConnectionsPerDisplay.
+	X11DefaultMaxConnectionsPerDisplay = 1024
+	// X11DisplayOffsetEnvironmentVariable overrides Config.X11DisplayOffset
+	// for the session, e.g. so that forwarded displays don't collide with
+	// those of a nested agent or an Xpra server. The value must be between
+	// 0 and X11MaxDisplays, otherwise the session is told and the offset of
+	// the server is used. This is stripped from any commands being
+	// executed.
+	X11DisplayOffsetEnvironmentVariable = "CODER_SSH_X11_OFFSET"
 )
 
+const (
+	// x11ChannelOpenAttempts is the number of times opening an x11 channel
+	// is attempted when the client reports a transient failure.
+	x11ChannelOpenAttempts = 3
+	// x11ChannelOpenRetryDelay is the delay before the first retry, it is
+	// doubled for each following retry.
+	x11ChannelOpenRetryDelay = 100 * time.Millisecond
+	// x11ChannelOpenTimeout is how long we wait for the client to confirm
+	// an x11 channel before closing the X11 connection.
+	x11ChannelOpenTimeout = 10 * time.Second
+)
+
+var errX11ChannelOpenTimeout = xerrors.New("timed out waiting for the client to open the x11 channel")
+
+// X11FailureMode is what happens to a session when X11 forwarding can't be
+// set up for it, see Config.X11FailureMode.
+type X11FailureMode string
+
+const (
+	// X11FailureModeFailSession ends the session with exit status 1.
+	X11FailureModeFailSession X11FailureMode = "fail-session"
+	// X11FailureModeContinue runs the session without X11 forwarding.
+	X11FailureModeContinue X11FailureMode = "continue-without-x11"
+)
+
+// Phases of the X11 forwarding setup that can fail, used as the error_type
+// label of x11HandlerErrors.
+const (
+	x11PhaseConnection = "connection"
+	x11PhaseHostname   = "hostname"
+	x11PhaseNoDisplays = "no_displays"
+	x11PhaseListen     = "listen"
+	x11PhaseClosing    = "closing"
+	x11PhaseXauthority = "xauthority"
+)
+
+// x11SetupError is a failure to set up X11 forwarding for a session.
+type x11SetupError struct {
+	phase string
+	// key and args are the message shown to the user, see
+	// Config.Localizer.
+	key  string
+	args []any
+	err  error
+}
+
+func (e *x11SetupError) Error() string {
+	return fmt.Sprintf("x11 setup failed (%s): %s", e.phase, e.err)
+}
+
+func (e *x11SetupError) Unwrap() error {
+	return e.err
+}
+
+var (
+	// errX11NoDisplays is returned by createX11Listener when the port of
+	// every display is in use.
+	errX11NoDisplays = xerrors.New("no free displays")
+	errX11Closing    = xerrors.New("server is closing")
+)
+
+// x11AuthProtocolMITMagicCookie is the only X11 auth protocol we write to
+// the Xauthority file, an empty protocol means no authentication.
+const x11AuthProtocolMITMagicCookie = "MIT-MAGIC-COOKIE-1"
+
+func x11AuthProtocolSupported(protocol string) bool {
+	return protocol == "" || protocol == x11AuthProtocolMITMagicCookie
+}
+
 // X11Network abstracts the creation of network listeners for X11 forwarding.
 // It is intended mainly for testing; production code uses the default
 // implementation backed by the operating system networking stack.
@@ -56,10 +138,18 @@ type x11Forwarder struct {
 	logger           slog.Logger
 	x11HandlerErrors *prometheus.CounterVec
 	fs               afero.Fs
-	displayOffset    int
+	// displayOffset is the offset of sessions that don't override it.
+	displayOffset int
+	// maxConnsPerDisplay is the most X11 connections forwarded at once for
+	// each display.
+	maxConnsPerDisplay int
+	openConns          prometheus.Gauge
+	refusedConns       prometheus.Counter
 
 	// network creates X11 listener sockets. Defaults to osNet{}.
 	network X11Network
+	// channelOpenTimeout overrides x11ChannelOpenTimeout in tests.
+	channelOpenTimeout time.Duration
 
 	mu          sync.Mutex
 	sessions    map[*x11Session]struct{}
@@ -73,52 +163,142 @@ type x11Session struct {
 	display  int
 	listener net.Listener
 	usedAt   time.Time
+	// openFailed is set once opening an x11 channel failed, to only log
+	// the first failure per display at warn level.
+	openFailed bool
+	// conns is the number of open connections to the display.
+	conns int
+	// refused is set once a connection was refused because of
+	// maxConnsPerDisplay, to only log the first at warn level.
+	refused bool
 }
 
-// x11Callback is called when the client requests X11 forwarding.
-func (*Server) x11Callback(_ ssh.Context, _ ssh.X11) bool {
-	// Always allow.
+// x11Callback is called when the client requests X11 forwarding. Note that
+// the session still reports the request from X11() if it is rejected, so
+// the session handler must check the auth protocol again.
+func (s *Server) x11Callback(ctx ssh.Context, x11 ssh.X11) bool {
+	if s.config.DisableX11 {
+		// Requests are rejected by filterX11Requests already.
+		return false
+	}
+	if !x11AuthProtocolSupported(x11.AuthProtocol) {
+		s.logger.Warn(ctx, "rejected x11 forwarding request with unsupported auth protocol",
+			slog.F("auth_protocol", x11.AuthProtocol))
+		s.metrics.x11RequestsRejected.WithLabelValues("unsupported_protocol").Add(1)
+		return false
+	}
 	return true
 }
 
+// filterX11Requests rejects all but the first x11-req of a session channel.
+// The SSH server also ignores duplicate requests, but without logging them.
+func (s *Server) filterX11Requests(ctx ssh.Context, newChan gossh.NewChannel) gossh.NewChannel {
+	return &x11FilterNewChannel{NewChannel: newChan, ctx: ctx, s: s}
+}
+
+type x11FilterNewChannel struct {
+	gossh.NewChannel
+	ctx ssh.Context
+	s   *Server
+}
+
+func (c *x11FilterNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	ch, reqs, err := c.NewChannel.Accept()
+	if err != nil {
+		return ch, reqs, err
+	}
+	filtered := make(chan *gossh.Request)
+	go func() {
+		defer close(filtered)
+		requested := false
+		for req := range reqs {
+			if req.Type == "x11-req" {
+				if c.s.config.DisableX11 {
+					c.s.logger.Debug(c.ctx, "rejected x11 forwarding request, disabled by config")
+					c.s.metrics.x11RequestsRejected.WithLabelValues("disabled").Add(1)
+					_ = req.Reply(false, nil)
+					_, _ = fmt.Fprintln(ch.Stderr(), c.s.localize(MessageX11Disabled))
+					continue
+				}
+				if requested {
+					c.s.logger.Warn(c.ctx, "rejected x11 forwarding request, the session already requested x11 forwarding")
+					c.s.metrics.x11RequestsRejected.WithLabelValues("duplicate").Add(1)
+					_ = req.Reply(false, nil)
+					continue
+				}
+				requested = true
+			}
+			filtered <- req
+		}
+	}()
+	return ch, filtered, nil
+}
+
+// extractX11DisplayOffset returns the raw display offset requested by the
+// session, see X11DisplayOffsetEnvironmentVariable.
+func extractX11DisplayOffset(env []string) (raw string, found bool, _ []string) {
+	env = slices.DeleteFunc(env, func(kv string) bool {
+		v, ok := strings.CutPrefix(kv, X11DisplayOffsetEnvironmentVariable+"=")
+		if ok {
+			// Use the last instance, like the magic session type.
+			raw, found = v, true
+		}
+		return ok
+	})
+	return raw, found, env
+}
+
+// parseX11DisplayOffset parses a display offset requested by a session.
+func parseX11DisplayOffset(raw string) (int, error) {
+	offset, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, xerrors.Errorf("not a number: %q", raw)
+	}
+	if offset < 0 || offset > X11MaxDisplays {
+		return 0, xerrors.Errorf("%d is not between 0 and %d", offset, X11MaxDisplays)
+	}
+	return offset, nil
+}
+
 // x11Handler is called when a session has requested X11 forwarding.
-// It listens for X11 connections and forwards them to the client.
-func (x *x11Forwarder) x11Handler(sshCtx ssh.Context, sshSession ssh.Session) (displayNumber int, handled bool) {
+// It listens for X11 connections and forwards them to the client, on the
+// first free display from displayOffset. The display is released when the
+// connection closes or release is called. Errors are of type
+// *x11SetupError.
+func (x *x11Forwarder) x11Handler(sshCtx ssh.Context, sshSession ssh.Session, displayOffset int) (displayNumber int, release func(), err error) {
 	x11, hasX11 := sshSession.X11()
 	if !hasX11 {
-		return -1, false
+		return -1, nil, x.setupFailed(sshCtx, x11PhaseConnection, xerrors.New("x11 forwarding was not requested"), MessageX11Internal)
 	}
 	serverConn, valid := sshCtx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
 	if !valid {
-		x.logger.Warn(sshCtx, "failed to get server connection")
-		return -1, false
+		return -1, nil, x.setupFailed(sshCtx, x11PhaseConnection, xerrors.New("failed to get server connection"), MessageX11Internal)
 	}
 	ctx := slog.With(sshCtx, slog.F("session_id", fmt.Sprintf("%x", serverConn.SessionID())))
 
 	hostname, err := os.Hostname()
 	if err != nil {
-		x.logger.Warn(ctx, "failed to get hostname", slog.Error(err))
-		x.x11HandlerErrors.WithLabelValues("hostname").Add(1)
-		return -1, false
+		return -1, nil, x.setupFailed(ctx, x11PhaseHostname, xerrors.Errorf("get hostname: %w", err), MessageX11Hostname, err)
 	}
 
-	x11session, err := x.createX11Session(ctx, sshSession)
-	if err != nil {
-		x.logger.Warn(ctx, "failed to create X11 listener", slog.Error(err))
-		x.x11HandlerErrors.WithLabelValues("listen").Add(1)
-		return -1, false
+	x11session, err := x.createX11Session(ctx, sshSession, displayOffset)
+	switch {
+	case errors.Is(err, errX11NoDisplays):
+		return -1, nil, x.setupFailed(ctx, x11PhaseNoDisplays, err, MessageX11NoDisplays, displayOffset, X11MaxDisplays)
+	case errors.Is(err, errX11Closing):
+		return -1, nil, x.setupFailed(ctx, x11PhaseClosing, err, MessageX11Closing)
+	case err != nil:
+		return -1, nil, x.setupFailed(ctx, x11PhaseListen, err, MessageX11Listen, err)
 	}
 	defer func() {
-		if !handled {
+		if err != nil {
 			x.closeAndRemoveSession(x11session)
 		}
 	}()
 
 	err = addXauthEntry(ctx, x.fs, hostname, strconv.Itoa(x11session.display), x11.AuthProtocol, x11.AuthCookie)
 	if err != nil {
-		x.logger.Warn(ctx, "failed to add Xauthority entry", slog.Error(err))
-		x.x11HandlerErrors.WithLabelValues("xauthority").Add(1)
-		return -1, false
+		return -1, nil, x.setupFailed(ctx, x11PhaseXauthority, err, MessageX11Xauthority, err)
 	}
 
 	// clean up the X11 session if the SSH session completes.
@@ -130,7 +310,15 @@ func (x *x11Forwarder) x11Handler(sshCtx ssh.Context, sshSession ssh.Session) (d
 	go x.listenForConnections(ctx, x11session, serverConn, x11)
 	x.logger.Debug(ctx, "X11 forwarding started", slog.F("display", x11session.display))
 
-	return x11session.display, true
+	return x11session.display, func() { x.closeAndRemoveSession(x11session) }, nil
+}
+
+// setupFailed logs and counts the failure of a phase of x11Handler, and
+// returns it with the message of key for the user.
+func (x *x11Forwarder) setupFailed(ctx context.Context, phase string, err error, key string, args ...any) *x11SetupError {
+	x.logger.Warn(ctx, "failed to set up X11 forwarding", slog.F("phase", phase), slog.Error(err))
+	x.x11HandlerErrors.WithLabelValues(phase).Add(1)
+	return &x11SetupError{phase: phase, key: key, args: args, err: err}
 }
 
 func (x *x11Forwarder) trackGoroutine() (closing bool, done func()) {
@@ -163,6 +351,11 @@ func (x *x11Forwarder) listenForConnections(
 			return
 		}
 
+		if !x.acquireConn(ctx, session) {
+			_ = conn.Close()
+			continue
+		}
+
 		// Update session usage time since a new X11 connection was forwarded.
 		x.mu.Lock()
 		session.usedAt = time.Now()
@@ -187,7 +380,7 @@ func (x *x11Forwarder) listenForConnections(
 			originAddr = "127.0.0.1"
 		}
 
-		channel, reqs, err := serverConn.OpenChannel("x11", gossh.Marshal(struct {
+		channel, reqs, err := x.openChannel(ctx, serverConn, gossh.Marshal(struct {
 			OriginatorAddress string
 			OriginatorPort    uint32
 		}{
@@ -195,8 +388,22 @@ func (x *x11Forwarder) listenForConnections(
 			OriginatorPort:    originPort,
 		}))
 		if err != nil {
-			x.logger.Warn(ctx, "failed to open X11 channel", slog.Error(err))
+			errorType, _ := x11ChannelOpenErrorType(err)
+			x.x11HandlerErrors.WithLabelValues(errorType).Add(1)
+			// Close the connection right away so that the X11 client
+			// fails fast instead of waiting for its own timeout.
 			_ = conn.Close()
+			x.releaseConn(session)
+			x.mu.Lock()
+			first := !session.openFailed
+			session.openFailed = true
+			x.mu.Unlock()
+			fields := []any{slog.F("display", session.display), slog.F("error_type", errorType), slog.Error(err)}
+			if first {
+				x.logger.Warn(ctx, "failed to open X11 channel", fields...)
+			} else {
+				x.logger.Debug(ctx, "failed to open X11 channel", fields...)
+			}
 			continue
 		}
 		go gossh.DiscardRequests(reqs)
@@ -204,15 +411,132 @@ func (x *x11Forwarder) listenForConnections(
 		if !x.trackConn(conn, true) {
 			x.logger.Warn(ctx, "failed to track X11 connection")
 			_ = conn.Close()
+			_ = channel.Close()
+			x.releaseConn(session)
 			continue
 		}
 		go func() {
 			defer x.trackConn(conn, false)
+			defer x.releaseConn(session)
 			Bicopy(ctx, conn, channel)
 		}()
 	}
 }
 
+// openChannel opens an x11 channel to the client, retrying transient
+// failures.
+func (x *x11Forwarder) openChannel(ctx context.Context, serverConn *gossh.ServerConn, payload []byte) (gossh.Channel, <-chan *gossh.Request, error) {
+	delay := x11ChannelOpenRetryDelay
+	for attempt := 1; ; attempt++ {
+		channel, reqs, err := x.openChannelOnce(ctx, serverConn, payload)
+		if err == nil {
+			return channel, reqs, nil
+		}
+		if _, transient := x11ChannelOpenErrorType(err); !transient || attempt >= x11ChannelOpenAttempts {
+			return nil, nil, err
+		}
+		x.logger.Debug(ctx, "retrying X11 channel open", slog.F("attempt", attempt), slog.Error(err))
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, nil, ctx.Err()
+		case <-t.C:
+		}
+		delay *= 2
+	}
+}
+
+// openChannelOnce opens an x11 channel, giving up after
+// x11ChannelOpenTimeout. A channel opened after giving up is closed.
+func (x *x11Forwarder) openChannelOnce(ctx context.Context, serverConn *gossh.ServerConn, payload []byte) (gossh.Channel, <-chan *gossh.Request, error) {
+	type result struct {
+		channel gossh.Channel
+		reqs    <-chan *gossh.Request
+		err     error
+	}
+	res := make(chan result, 1)
+	go func() {
+		channel, reqs, err := serverConn.OpenChannel("x11", payload)
+		res <- result{channel, reqs, err}
+	}()
+
+	timeout := x.channelOpenTimeout
+	if timeout <= 0 {
+		timeout = x11ChannelOpenTimeout
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	var err error
+	select {
+	case r := <-res:
+		return r.channel, r.reqs, r.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-t.C:
+		err = errX11ChannelOpenTimeout
+	}
+	go func() {
+		// OpenChannel returns once the client replies or the connection
+		// is closed.
+		if r := <-res; r.err == nil {
+			go gossh.DiscardRequests(r.reqs)
+			_ = r.channel.Close()
+		}
+	}()
+	return nil, nil, err
+}
+
+// x11ChannelOpenErrorType returns the error type label of a failure to open
+// an x11 channel, and whether the failure is transient.
+func x11ChannelOpenErrorType(err error) (errorType string, transient bool) {
+	var openErr *gossh.OpenChannelError
+	switch {
+	case errors.Is(err, errX11ChannelOpenTimeout):
+		return "timeout", false
+	case errors.As(err, &openErr):
+		// The client is out of resources, anything else means it won't
+		// open the channel, e.g. because it can't connect to the X
+		// server.
+		return "refused", openErr.Reason == gossh.ResourceShortage
+	default:
+		return "other", false
+	}
+}
+
+// acquireConn counts a new connection to the display of the session, unless
+// the display already has maxConnsPerDisplay connections, in which case the
+// connection must be refused. Counted connections must be released with
+// releaseConn once closed.
+func (x *x11Forwarder) acquireConn(ctx context.Context, session *x11Session) bool {
+	x.mu.Lock()
+	if x.maxConnsPerDisplay > 0 && session.conns >= x.maxConnsPerDisplay {
+		first := !session.refused
+		session.refused = true
+		x.mu.Unlock()
+		x.refusedConns.Add(1)
+		fields := []any{slog.F("display", session.display), slog.F("max_connections", x.maxConnsPerDisplay)}
+		if first {
+			x.logger.Warn(ctx, "refused X11 connection, too many connections to the display", fields...)
+		} else {
+			x.logger.Debug(ctx, "refused X11 connection, too many connections to the display", fields...)
+		}
+		return false
+	}
+	session.conns++
+	x.mu.Unlock()
+	x.openConns.Inc()
+	return true
+}
+
+func (x *x11Forwarder) releaseConn(session *x11Session) {
+	x.mu.Lock()
+	session.conns--
+	x.mu.Unlock()
+	x.openConns.Dec()
+}
+
 // closeAndRemoveSession closes and removes the session.
 func (x *x11Forwarder) closeAndRemoveSession(x11session *x11Session) {
 	_ = x11session.listener.Close()
@@ -221,8 +545,10 @@ func (x *x11Forwarder) closeAndRemoveSession(x11session *x11Session) {
 	x.mu.Unlock()
 }
 
-// createX11Session creates an X11 forwarding session.
-func (x *x11Forwarder) createX11Session(ctx context.Context, sshSession ssh.Session) (*x11Session, error) {
+// createX11Session creates an X11 forwarding session on the first free
+// display from displayOffset. If there is none, the least recently used
+// session that frees one is evicted, whatever offset it was created with.
+func (x *x11Forwarder) createX11Session(ctx context.Context, sshSession ssh.Session, displayOffset int) (*x11Session, error) {
 	var (
 		ln      net.Listener
 		display int
@@ -231,17 +557,25 @@ func (x *x11Forwarder) createX11Session(ctx context.Context, sshSession ssh.Sess
 	// retry listener creation after evictions. Limit to 10 retries to prevent pathological cases looping forever.
 	const maxRetries = 10
 	for try := range maxRetries {
-		ln, display, err = x.createX11Listener(ctx)
+		ln, display, err = x.createX11Listener(ctx, displayOffset)
 		if err == nil {
 			break
 		}
+		if !errors.Is(err, errX11NoDisplays) {
+			// Evicting sessions doesn't help if we can't listen at all.
+			return nil, err
+		}
 		if try == maxRetries-1 {
-			return nil, xerrors.New("max retries exceeded while creating X11 session")
+			return nil, xerrors.Errorf("max retries exceeded while creating X11 session: %w", err)
 		}
 		x.logger.Warn(ctx, "failed to create X11 listener; will evict an X11 forwarding session",
 			slog.F("num_current_sessions", x.numSessions()),
+			slog.F("display_offset", displayOffset),
 			slog.Error(err))
-		x.evictLeastRecentlyUsedSession()
+		if !x.evictLeastRecentlyUsedSession(displayOffset) {
+			// The displays from the offset are used by something else.
+			return nil, err
+		}
 	}
 	x.mu.Lock()
 	defer x.mu.Unlock()
@@ -250,7 +584,7 @@ func (x *x11Forwarder) createX11Session(ctx context.Context, sshSession ssh.Sess
 		if closeErr != nil {
 			x.logger.Error(ctx, "error closing X11 listener", slog.Error(closeErr))
 		}
-		return nil, xerrors.New("server is closing")
+		return nil, errX11Closing
 	}
 	x11Sess := &x11Session{
 		session:  sshSession,
@@ -268,11 +602,17 @@ func (x *x11Forwarder) numSessions() int {
 	return len(x.sessions)
 }
 
-func (x *x11Forwarder) popLeastRecentlyUsedSession() *x11Session {
+// popLeastRecentlyUsedSession removes the least recently used session with
+// a display of at least minDisplay. Sessions may use different offsets, so
+// evicting one with a lower display wouldn't free a usable one.
+func (x *x11Forwarder) popLeastRecentlyUsedSession(minDisplay int) *x11Session {
 	x.mu.Lock()
 	defer x.mu.Unlock()
 	var lru *x11Session
 	for s := range x.sessions {
+		if s.display < minDisplay {
+			continue
+		}
 		if lru == nil {
 			lru = s
 			continue
@@ -290,10 +630,12 @@ func (x *x11Forwarder) popLeastRecentlyUsedSession() *x11Session {
 	return lru
 }
 
-func (x *x11Forwarder) evictLeastRecentlyUsedSession() {
-	lru := x.popLeastRecentlyUsedSession()
+// evictLeastRecentlyUsedSession closes the least recently used session with
+// a display of at least minDisplay, it returns false if there is none.
+func (x *x11Forwarder) evictLeastRecentlyUsedSession(minDisplay int) bool {
+	lru := x.popLeastRecentlyUsedSession(minDisplay)
 	if lru == nil {
-		return
+		return false
 	}
 	err := lru.listener.Close()
 	if err != nil {
@@ -308,13 +650,15 @@ func (x *x11Forwarder) evictLeastRecentlyUsedSession() {
 	if err != nil {
 		x.logger.Error(context.Background(), "failed to close evicted X11 SSH session", slog.Error(err))
 	}
+	return true
 }
 
 // createX11Listener creates a listener for X11 forwarding, it will use
 // the next available port starting from X11StartPort and displayOffset.
-func (x *x11Forwarder) createX11Listener(ctx context.Context) (ln net.Listener, display int, err error) {
+// If every port is in use, the error wraps errX11NoDisplays.
+func (x *x11Forwarder) createX11Listener(ctx context.Context, displayOffset int) (ln net.Listener, display int, err error) {
 	// Look for an open port to listen on.
-	for port := X11StartPort + x.displayOffset; port <= X11MaxPort; port++ {
+	for port := X11StartPort + displayOffset; port <= X11MaxPort; port++ {
 		if ctx.Err() != nil {
 			return nil, -1, ctx.Err()
 		}
@@ -324,8 +668,23 @@ func (x *x11Forwarder) createX11Listener(ctx context.Context) (ln net.Listener,
 			display = port - X11StartPort
 			return ln, display, nil
 		}
+		if x11ListenFatal(err) {
+			return nil, -1, xerrors.Errorf("listen on port %d: %w", port, err)
+		}
+	}
+	return nil, -1, xerrors.Errorf("failed to find open port for X11 listener, last error %q: %w", err, errX11NoDisplays)
+}
+
+// x11ListenFatal reports whether err means that no X11 listener can be
+// created on any port, e.g. because localhost isn't available. Other errors
+// are assumed to mean that the port is in use.
+func x11ListenFatal(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EACCES, syscall.EPERM, syscall.EADDRNOTAVAIL, syscall.EAFNOSUPPORT} {
+		if errors.Is(err, errno) {
+			return true
+		}
 	}
-	return nil, -1, xerrors.Errorf("failed to find open port for X11 listener: %w", err)
+	return false
 }
 
 // trackConn registers the connection with the x11Forwarder. If the server is
@@ -3,6 +3,7 @@ package agentssh_test
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -12,6 +13,8 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 
 	"github.com/gliderlabs/ssh"
@@ -20,9 +23,13 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/sloggers/slogtest"
 
 	"github.com/coder/coder/v2/agent/agentexec"
 	"github.com/coder/coder/v2/agent/agentssh"
+	"github.com/coder/coder/v2/agent/agentssh/sshtest"
 	"github.com/coder/coder/v2/testutil"
 )
 
@@ -60,7 +67,7 @@ func TestServer_X11(t *testing.T) {
 		assert.Error(t, err) // Server is closed.
 	}()
 
-	c := sshClient(t, ln.Addr().String())
+	c := sshtest.Dial(ctx, t, ln.Addr().String())
 
 	sess, err := c.NewSession()
 	require.NoError(t, err)
@@ -129,6 +136,137 @@ func TestServer_X11(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestServer_X11_RejectedRequests(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("X11 forwarding is only supported on Linux")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := testutil.Logger(t)
+	reg := prometheus.NewRegistry()
+	s, err := agentssh.NewServer(ctx, logger, reg, afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		X11Net: testutil.NewInProcNet(),
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	assert.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := s.Serve(ln)
+		assert.Error(t, err) // Server is closed.
+	}()
+
+	c := sshtest.Dial(ctx, t, ln.Addr().String())
+	display := func(sess *gossh.Session) string {
+		out, err := sess.Output("echo DISPLAY=$DISPLAY")
+		require.NoError(t, err)
+		return strings.TrimSpace(string(out))
+	}
+
+	// Only the first request of a session is accepted.
+	sess, err := c.NewSession()
+	require.NoError(t, err)
+	for i, want := range []bool{true, false} {
+		reply, err := sess.SendRequest("x11-req", true, gossh.Marshal(ssh.X11{
+			AuthProtocol: "MIT-MAGIC-COOKIE-1",
+			AuthCookie:   hex.EncodeToString([]byte("cookie")),
+			ScreenNumber: uint32(i),
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, want, reply)
+	}
+	assert.Regexp(t, `^DISPLAY=localhost:\d+\.0$`, display(sess))
+
+	// Unsupported auth protocols are rejected and don't set a display.
+	sess, err = c.NewSession()
+	require.NoError(t, err)
+	reply, err := sess.SendRequest("x11-req", true, gossh.Marshal(ssh.X11{
+		AuthProtocol: "XDM-AUTHORIZATION-1",
+		AuthCookie:   hex.EncodeToString([]byte("cookie")),
+	}))
+	require.NoError(t, err)
+	assert.False(t, reply)
+	assert.NotRegexp(t, `^DISPLAY=localhost:\d+`, display(sess))
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	rejected := map[string]float64{}
+	for _, m := range metrics {
+		if m.GetName() != "agent_x11_handler_requests_rejected_total" {
+			continue
+		}
+		for _, metric := range m.GetMetric() {
+			rejected[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, map[string]float64{"duplicate": 1, "unsupported_protocol": 1}, rejected)
+
+	_ = s.Close()
+	<-done
+}
+
+func TestServer_X11_Disabled(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The command used here is not available on Windows")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitShort)
+	logger := testutil.Logger(t)
+	reg := prometheus.NewRegistry()
+	s, err := agentssh.NewServer(ctx, logger, reg, afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		DisableX11: true,
+		// Like a display in the environment of the agent.
+		UpdateEnv: func(current []string) ([]string, error) {
+			return append(current, "DISPLAY=:99"), nil
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	assert.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := s.Serve(ln)
+		assert.Error(t, err) // Server is closed.
+	}()
+
+	c := sshtest.Dial(ctx, t, ln.Addr().String())
+	sess, err := c.NewSession()
+	require.NoError(t, err)
+	reply, err := sess.SendRequest("x11-req", true, gossh.Marshal(ssh.X11{
+		AuthProtocol: "MIT-MAGIC-COOKIE-1",
+		AuthCookie:   hex.EncodeToString([]byte("cookie")),
+	}))
+	require.NoError(t, err)
+	assert.False(t, reply)
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	out, err := sess.Output("echo DISPLAY=$DISPLAY")
+	require.NoError(t, err)
+	assert.Equal(t, "DISPLAY=", strings.TrimSpace(string(out)))
+	assert.Equal(t, "X11 forwarding disabled by administrator\n", stderr.String())
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	require.True(t, testutil.PromCounterHasValue(t, metrics, 1, "agent_x11_handler_requests_rejected_total", "disabled"))
+
+	_ = s.Close()
+	<-done
+}
+
 func TestServer_X11_EvictionLRU(t *testing.T) {
 	t.Parallel()
 	if runtime.GOOS != "linux" {
@@ -160,7 +298,7 @@ func TestServer_X11_EvictionLRU(t *testing.T) {
 		assert.Error(t, err)
 	})
 
-	c := sshClient(t, ln.Addr().String())
+	c := sshtest.Dial(ctx, t, ln.Addr().String())
 
 	// block off one port to test x11Forwarder evicts at highest port, not number of listeners.
 	externalListener, err := inproc.Listen("tcp",
@@ -334,3 +472,467 @@ func TestServer_X11_EvictionLRU(t *testing.T) {
 	require.NoError(t, err)
 	_ = testutil.TryReceive(ctx, t, done)
 }
+
+func TestServer_X11_DisplayOffsetOverride(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("X11 forwarding is only supported on Linux")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitLong)
+	logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+	inproc := testutil.NewInProcNet()
+	s, err := agentssh.NewServer(ctx, logger, prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		X11Net: inproc,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := testutil.Go(t, func() {
+		err := s.Serve(ln)
+		assert.Error(t, err)
+	})
+
+	c := sshtest.Dial(ctx, t, ln.Addr().String())
+
+	// start starts a session forwarding X11 with the display offset, if
+	// set, and returns its display. It may be called concurrently.
+	start := func(offset string) (sess *gossh.Session, display int, stderr io.Reader) {
+		sess, err := c.NewSession()
+		if !assert.NoError(t, err) {
+			return nil, -1, nil
+		}
+		if offset != "" {
+			assert.NoError(t, sess.Setenv(agentssh.X11DisplayOffsetEnvironmentVariable, offset))
+		}
+		_, err = sess.SendRequest("x11-req", true, gossh.Marshal(ssh.X11{
+			AuthProtocol: "MIT-MAGIC-COOKIE-1",
+			AuthCookie:   hex.EncodeToString([]byte("cookie")),
+		}))
+		assert.NoError(t, err)
+		stdout, err := sess.StdoutPipe()
+		assert.NoError(t, err)
+		stderr, err = sess.StderrPipe()
+		assert.NoError(t, err)
+		if !assert.NoError(t, sess.Start(`echo "$DISPLAY"; exec sleep 600`)) {
+			return nil, -1, nil
+		}
+		sc := bufio.NewScanner(stdout)
+		if !assert.True(t, sc.Scan()) {
+			return nil, -1, nil
+		}
+		// e.g. "localhost:190.0"
+		display, err = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(sc.Text(), "localhost:"), ".0"))
+		assert.NoError(t, err, sc.Text())
+		return sess, display, stderr
+	}
+
+	// Sessions with and without an override allocate their displays at
+	// the same time, each from its own offset.
+	const overrideOffset = 190
+	type started struct {
+		offset  string
+		sess    *gossh.Session
+		display int
+	}
+	results := make(chan started, 6)
+	var wg sync.WaitGroup
+	for _, offset := range []string{"", strconv.Itoa(overrideOffset)} {
+		for range 3 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sess, display, _ := start(offset)
+				results <- started{offset: offset, sess: sess, display: display}
+			}()
+		}
+	}
+	wg.Wait()
+	close(results)
+	displays := make(map[int]bool)
+	var sessions []*gossh.Session
+	for r := range results {
+		require.NotNil(t, r.sess)
+		sessions = append(sessions, r.sess)
+		require.False(t, displays[r.display], "display %d allocated twice", r.display)
+		displays[r.display] = true
+		if r.offset == "" {
+			require.GreaterOrEqual(t, r.display, agentssh.X11DefaultDisplayOffset)
+			require.Less(t, r.display, overrideOffset)
+		} else {
+			require.GreaterOrEqual(t, r.display, overrideOffset)
+		}
+	}
+	exited := make(chan *gossh.Session, len(sessions))
+	for _, sess := range sessions {
+		go func() {
+			_ = sess.Wait()
+			exited <- sess
+		}()
+	}
+
+	// Evictions only consider displays from the offset of the new
+	// session, the older sessions on lower displays are kept.
+	first, display, _ := start(strconv.Itoa(agentssh.X11MaxDisplays))
+	require.NotNil(t, first)
+	require.Equal(t, agentssh.X11MaxDisplays, display)
+	second, display, _ := start(strconv.Itoa(agentssh.X11MaxDisplays))
+	require.NotNil(t, second)
+	require.Equal(t, agentssh.X11MaxDisplays, display)
+	require.Error(t, first.Wait(), "evicted session")
+	require.Empty(t, exited)
+
+	// Invalid offsets fall back to the offset of the server.
+	invalid, display, stderr := start(strconv.Itoa(agentssh.X11MaxDisplays + 1))
+	require.NotNil(t, invalid)
+	require.GreaterOrEqual(t, display, agentssh.X11DefaultDisplayOffset)
+	require.Less(t, display, overrideOffset)
+	sc := bufio.NewScanner(stderr)
+	require.True(t, sc.Scan())
+	require.Contains(t, sc.Text(), "Ignoring invalid "+agentssh.X11DisplayOffsetEnvironmentVariable)
+
+	for _, sess := range append(sessions, second, invalid) {
+		_ = sess.Close()
+	}
+	err = s.Close()
+	require.NoError(t, err)
+	_ = testutil.TryReceive(ctx, t, done)
+}
+
+func TestServer_X11_ChannelOpenFailure(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("X11 forwarding is only supported on Linux")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := testutil.Logger(t)
+	reg := prometheus.NewRegistry()
+	inproc := testutil.NewInProcNet()
+
+	s, err := agentssh.NewServer(ctx, logger, reg, afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		X11Net: inproc,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := testutil.Go(t, func() {
+		err := s.Serve(ln)
+		assert.Error(t, err)
+	})
+
+	c := sshtest.Dial(ctx, t, ln.Addr().String())
+	sess, err := c.NewSession()
+	require.NoError(t, err)
+	reply, err := sess.SendRequest("x11-req", true, gossh.Marshal(ssh.X11{
+		AuthProtocol: "MIT-MAGIC-COOKIE-1",
+		AuthCookie:   hex.EncodeToString([]byte("cookie")),
+	}))
+	require.NoError(t, err)
+	require.True(t, reply)
+	out, err := sess.Output("echo $DISPLAY")
+	require.NoError(t, err)
+	display, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(string(out)), "localhost:"), ".")
+	displayNumber, err := strconv.Atoi(display)
+	require.NoError(t, err)
+
+	x11Chans := c.HandleChannelOpen("x11")
+	dial := func() net.Conn {
+		conn, err := inproc.Dial(ctx, testutil.NewAddr("tcp", fmt.Sprintf("localhost:%d", agentssh.X11StartPort+displayNumber)))
+		require.NoError(t, err)
+		return conn
+	}
+
+	// Transient failures are retried.
+	conn := dial()
+	testutil.RequireReceive(ctx, t, x11Chans).Reject(gossh.ResourceShortage, "busy")
+	ch, reqs, err := testutil.RequireReceive(ctx, t, x11Chans).Accept()
+	require.NoError(t, err)
+	go gossh.DiscardRequests(reqs)
+	go func() {
+		_, _ = conn.Write([]byte("hello"))
+	}()
+	got := make([]byte, len("hello"))
+	_, err = io.ReadFull(ch, got)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(got))
+	_ = ch.Close()
+	_ = conn.Close()
+
+	// Refusals close the X11 connection right away so that the X11 client
+	// doesn't hang.
+	for range 2 {
+		conn := dial()
+		testutil.RequireReceive(ctx, t, x11Chans).Reject(gossh.ConnectionFailed, "no X server")
+		readErr := make(chan error, 1)
+		go func() {
+			_, err := conn.Read(make([]byte, 1))
+			readErr <- err
+		}()
+		require.ErrorIs(t, testutil.RequireReceive(ctx, t, readErr), io.EOF)
+	}
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	errorsByType := map[string]float64{}
+	for _, m := range metrics {
+		if m.GetName() != "agent_x11_handler_errors_total" {
+			continue
+		}
+		for _, metric := range m.GetMetric() {
+			errorsByType[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+		}
+	}
+	require.Equal(t, map[string]float64{"refused": 2}, errorsByType)
+
+	err = s.Close()
+	require.NoError(t, err)
+	_ = testutil.TryReceive(ctx, t, done)
+}
+
+func TestServer_X11_MaxConnectionsPerDisplay(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("X11 forwarding is only supported on Linux")
+	}
+
+	ctx := testutil.Context(t, testutil.WaitMedium)
+	logger := testutil.Logger(t)
+	reg := prometheus.NewRegistry()
+	inproc := testutil.NewInProcNet()
+
+	const maxConns = 3
+	s, err := agentssh.NewServer(ctx, logger, reg, afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		X11Net:                      inproc,
+		X11MaxConnectionsPerDisplay: maxConns,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.UpdateHostSigner(42)
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := testutil.Go(t, func() {
+		err := s.Serve(ln)
+		assert.Error(t, err)
+	})
+
+	c := sshtest.Dial(ctx, t, ln.Addr().String())
+	sess, err := c.NewSession()
+	require.NoError(t, err)
+	reply, err := sess.SendRequest("x11-req", true, gossh.Marshal(ssh.X11{
+		AuthProtocol: "MIT-MAGIC-COOKIE-1",
+		AuthCookie:   hex.EncodeToString([]byte("cookie")),
+	}))
+	require.NoError(t, err)
+	require.True(t, reply)
+	out, err := sess.Output("echo $DISPLAY")
+	require.NoError(t, err)
+	display, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(string(out)), "localhost:"), ".")
+	displayNumber, err := strconv.Atoi(display)
+	require.NoError(t, err)
+
+	x11Chans := c.HandleChannelOpen("x11")
+	dial := func() net.Conn {
+		conn, err := inproc.Dial(ctx, testutil.NewAddr("tcp", fmt.Sprintf("localhost:%d", agentssh.X11StartPort+displayNumber)))
+		require.NoError(t, err)
+		return conn
+	}
+	metric := func(name string) float64 {
+		metrics, err := reg.Gather()
+		require.NoError(t, err)
+		for _, m := range metrics {
+			if m.GetName() != name {
+				continue
+			}
+			if g := m.GetMetric()[0].GetGauge(); g != nil {
+				return g.GetValue()
+			}
+			return m.GetMetric()[0].GetCounter().GetValue()
+		}
+		return 0
+	}
+
+	// Connections are torn down by either side in each round, the count
+	// must return to zero so that the display accepts connections again.
+	for round := range 4 {
+		conns := make([]net.Conn, maxConns)
+		chans := make([]gossh.Channel, maxConns)
+		for i := range conns {
+			conns[i] = dial()
+			ch, reqs, err := testutil.RequireReceive(ctx, t, x11Chans).Accept()
+			require.NoError(t, err)
+			go gossh.DiscardRequests(reqs)
+			chans[i] = ch
+		}
+		require.Equal(t, float64(maxConns), metric("agent_x11_handler_connections"))
+
+		// Further connections are closed without opening a channel.
+		conn := dial()
+		readErr := make(chan error, 1)
+		go func() {
+			_, err := conn.Read(make([]byte, 1))
+			readErr <- err
+		}()
+		require.ErrorIs(t, testutil.RequireReceive(ctx, t, readErr), io.EOF)
+		require.Equal(t, float64(round+1), metric("agent_x11_handler_connections_refused_total"))
+
+		for i := range conns {
+			if i%2 == 0 {
+				_ = chans[i].Close()
+			} else {
+				_ = conns[i].Close()
+			}
+		}
+		require.Eventually(t, func() bool {
+			return metric("agent_x11_handler_connections") == 0
+		}, testutil.WaitShort, testutil.IntervalFast)
+	}
+	select {
+	case newChan := <-x11Chans:
+		t.Fatalf("unexpected x11 channel for a refused connection: %v", newChan.ChannelType())
+	default:
+	}
+
+	err = s.Close()
+	require.NoError(t, err)
+	_ = testutil.TryReceive(ctx, t, done)
+}
+
+// x11ListenFunc is an agentssh.X11Network that listens with a function.
+type x11ListenFunc func(network, address string) (net.Listener, error)
+
+func (f x11ListenFunc) Listen(network, address string) (net.Listener, error) {
+	return f(network, address)
+}
+
+func TestServer_X11_SetupFailure(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("X11 forwarding is only supported on Linux")
+	}
+
+	busy := x11ListenFunc(func(string, string) (net.Listener, error) {
+		return nil, xerrors.New("address in use")
+	})
+	denied := x11ListenFunc(func(network, address string) (net.Listener, error) {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: os.NewSyscallError("bind", syscall.EACCES)}
+	})
+	tests := []struct {
+		name      string
+		network   agentssh.X11Network
+		fs        afero.Fs
+		mode      agentssh.X11FailureMode
+		errorType string
+		message   string
+	}{
+		{
+			name:      "NoDisplays",
+			network:   busy,
+			errorType: "no_displays",
+			message:   "X11 forwarding failed: no free displays (offset 10, max 200)\n",
+		},
+		{
+			name:      "Listen",
+			network:   denied,
+			errorType: "listen",
+			message:   "X11 forwarding failed: unable to listen for X11 connections: ",
+		},
+		{
+			name:      "Xauthority",
+			network:   testutil.NewInProcNet(),
+			fs:        afero.NewReadOnlyFs(afero.NewMemMapFs()),
+			errorType: "xauthority",
+			message:   "X11 forwarding failed: unable to add the auth cookie to ~/.Xauthority: ",
+		},
+		{
+			name:      "ContinueWithoutX11",
+			network:   busy,
+			mode:      agentssh.X11FailureModeContinue,
+			errorType: "no_displays",
+			message:   "X11 forwarding failed: no free displays (offset 10, max 200)\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.Context(t, testutil.WaitMedium)
+			logger := slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			reg := prometheus.NewRegistry()
+			fs := tt.fs
+			if fs == nil {
+				fs = afero.NewMemMapFs()
+			}
+			s, err := agentssh.NewServer(ctx, logger, reg, fs, agentexec.DefaultExecer, &agentssh.Config{
+				X11Net:         tt.network,
+				X11FailureMode: tt.mode,
+			})
+			require.NoError(t, err)
+			defer s.Close()
+			err = s.UpdateHostSigner(42)
+			require.NoError(t, err)
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			done := testutil.Go(t, func() {
+				err := s.Serve(ln)
+				assert.Error(t, err)
+			})
+
+			c := sshtest.Dial(ctx, t, ln.Addr().String())
+			sess, err := c.NewSession()
+			require.NoError(t, err)
+			reply, err := sess.SendRequest("x11-req", true, gossh.Marshal(ssh.X11{
+				AuthProtocol: "MIT-MAGIC-COOKIE-1",
+				AuthCookie:   hex.EncodeToString([]byte("cookie")),
+			}))
+			require.NoError(t, err)
+			require.True(t, reply)
+			var stderr bytes.Buffer
+			sess.Stderr = &stderr
+			out, err := sess.Output("echo DISPLAY=$DISPLAY")
+			require.True(t, strings.HasPrefix(stderr.String(), tt.message), "stderr: %q", stderr.String())
+			if tt.mode == agentssh.X11FailureModeContinue {
+				require.NoError(t, err)
+				require.NotContains(t, string(out), "DISPLAY=localhost:")
+			} else {
+				exitErr := &gossh.ExitError{}
+				require.ErrorAs(t, err, &exitErr)
+				require.Equal(t, 1, exitErr.ExitStatus())
+				require.Empty(t, out)
+			}
+
+			metrics, err := reg.Gather()
+			require.NoError(t, err)
+			errorTypes := map[string]float64{}
+			for _, m := range metrics {
+				if m.GetName() != "agent_x11_handler_errors_total" {
+					continue
+				}
+				for _, metric := range m.GetMetric() {
+					errorTypes[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+				}
+			}
+			require.Equal(t, map[string]float64{tt.errorType: 1}, errorTypes)
+
+			err = s.Close()
+			require.NoError(t, err)
+			_ = testutil.TryReceive(ctx, t, done)
+		})
+	}
+
+	_, err := agentssh.NewServer(context.Background(), slogtest.Make(t, nil), prometheus.NewRegistry(), afero.NewMemMapFs(), agentexec.DefaultExecer, &agentssh.Config{
+		X11FailureMode: "ignore",
+	})
+	require.Error(t, err)
+}
@@ -56,6 +56,7 @@ func (a *agent) apiHandler() http.Handler {
 	r.Get("/debug/magicsock", a.HandleHTTPDebugMagicsock)
 	r.Get("/debug/magicsock/debug-logging/{state}", a.HandleHTTPMagicsockDebugLoggingState)
 	r.Get("/debug/manifest", a.HandleHTTPDebugManifest)
+	r.Get("/debug/ssh/processes", a.HandleHTTPDebugSSHProcesses)
 	r.Get("/debug/prometheus", promHandler.ServeHTTP)
 
 	return r
@@ -1,6 +1,7 @@
 package usershell
 
 import (
+	"context"
 	"os"
 	"os/user"
 
@@ -26,27 +27,94 @@ func HomeDir() (string, error) {
 }
 
 // EnvInfoer encapsulates external information about the environment.
+// Lookups that may block, e.g. on an NSS module or a container runtime, take
+// a context and return its error once it is done.
 type EnvInfoer interface {
 	// User returns the current user.
-	User() (*user.User, error)
+	User(ctx context.Context) (*user.User, error)
 	// Environ returns the environment variables of the current process.
 	Environ() []string
 	// HomeDir returns the home directory of the current user.
-	HomeDir() (string, error)
+	HomeDir(ctx context.Context) (string, error)
 	// Shell returns the shell of the given user.
-	Shell(username string) (string, error)
+	Shell(ctx context.Context, username string) (string, error)
 	// ModifyCommand modifies the command and arguments before execution based on
 	// the environment. This is useful for executing a command inside a container.
 	// In the default case, the command and arguments are returned unchanged.
 	ModifyCommand(name string, args ...string) (string, []string)
 }
 
+// LegacyEnvInfoer is EnvInfoer before lookups took a context, see
+// FromLegacy.
+type LegacyEnvInfoer interface {
+	User() (*user.User, error)
+	Environ() []string
+	HomeDir() (string, error)
+	Shell(username string) (string, error)
+	ModifyCommand(name string, args ...string) (string, []string)
+}
+
+// FromLegacy adapts a LegacyEnvInfoer to EnvInfoer. Lookups return once
+// their context is done, but the legacy lookup keeps running in the
+// background until it returns.
+func FromLegacy(ei LegacyEnvInfoer) EnvInfoer {
+	return legacyEnvInfo{ei: ei}
+}
+
+type legacyEnvInfo struct {
+	ei LegacyEnvInfoer
+}
+
+func (l legacyEnvInfo) User(ctx context.Context) (*user.User, error) {
+	return withContext(ctx, l.ei.User)
+}
+
+func (l legacyEnvInfo) Environ() []string {
+	return l.ei.Environ()
+}
+
+func (l legacyEnvInfo) HomeDir(ctx context.Context) (string, error) {
+	return withContext(ctx, l.ei.HomeDir)
+}
+
+func (l legacyEnvInfo) Shell(ctx context.Context, username string) (string, error) {
+	return withContext(ctx, func() (string, error) { return l.ei.Shell(username) })
+}
+
+func (l legacyEnvInfo) ModifyCommand(name string, args ...string) (string, []string) {
+	return l.ei.ModifyCommand(name, args...)
+}
+
+// withContext runs lookup, which can't be canceled, and returns early with
+// the error of ctx if it is done first.
+func withContext[T any](ctx context.Context, lookup func() (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := lookup()
+		done <- result{v: v, err: err}
+	}()
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
 // SystemEnvInfo encapsulates the information about the environment
 // just using the default Go implementations.
 type SystemEnvInfo struct{}
 
-func (SystemEnvInfo) User() (*user.User, error) {
-	return user.Current()
+func (SystemEnvInfo) User(ctx context.Context) (*user.User, error) {
+	return withContext(ctx, user.Current)
 }
 
 func (SystemEnvInfo) Environ() []string {
@@ -63,12 +131,12 @@ func (SystemEnvInfo) Environ() []string {
 	return env
 }
 
-func (SystemEnvInfo) HomeDir() (string, error) {
-	return HomeDir()
+func (SystemEnvInfo) HomeDir(ctx context.Context) (string, error) {
+	return withContext(ctx, HomeDir)
 }
 
-func (SystemEnvInfo) Shell(username string) (string, error) {
-	return Get(username)
+func (SystemEnvInfo) Shell(ctx context.Context, username string) (string, error) {
+	return withContext(ctx, func() (string, error) { return Get(username) })
 }
 
 func (SystemEnvInfo) ModifyCommand(name string, args ...string) (string, []string) {
@@ -1,6 +1,7 @@
 package usershell_test
 
 import (
+	"context"
 	"os/user"
 	"runtime"
 	"testing"
@@ -8,6 +9,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/coder/coder/v2/agent/usershell"
+	"github.com/coder/coder/v2/testutil"
 )
 
 //nolint:paralleltest,tparallel // This test sets an environment variable.
@@ -53,3 +55,48 @@ func TestGet(t *testing.T) {
 		}
 	})
 }
+
+func TestFromLegacy(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	defer close(release)
+	ei := usershell.FromLegacy(&legacyEnvInfoer{release: release})
+
+	// Lookups that return are passed through.
+	shell, err := ei.Shell(context.Background(), "coder")
+	require.NoError(t, err)
+	require.Equal(t, "/bin/coder-shell", shell)
+	name, args := ei.ModifyCommand("echo", "hi")
+	require.Equal(t, "echo", name)
+	require.Equal(t, []string{"hi"}, args)
+
+	// Blocked lookups return once the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := ei.User(ctx)
+		errs <- err
+	}()
+	cancel()
+	require.ErrorIs(t, testutil.RequireReceive(testutil.Context(t, testutil.WaitShort), t, errs), context.Canceled)
+}
+
+type legacyEnvInfoer struct {
+	release chan struct{}
+}
+
+func (l *legacyEnvInfoer) User() (*user.User, error) {
+	<-l.release
+	return &user.User{Username: "coder"}, nil
+}
+
+func (*legacyEnvInfoer) Environ() []string { return nil }
+
+func (*legacyEnvInfoer) HomeDir() (string, error) { return "/home/coder", nil }
+
+func (*legacyEnvInfoer) Shell(string) (string, error) { return "/bin/coder-shell", nil }
+
+func (*legacyEnvInfoer) ModifyCommand(name string, args ...string) (string, []string) {
+	return name, args
+}
@@ -41,6 +41,7 @@ import (
 	"github.com/coder/coder/v2/agent/agentssh"
 	"github.com/coder/coder/v2/agent/agenttest"
 	agentproto "github.com/coder/coder/v2/agent/proto"
+	"github.com/coder/coder/v2/buildinfo"
 	"github.com/coder/coder/v2/cli"
 	"github.com/coder/coder/v2/cli/clitest"
 	"github.com/coder/coder/v2/cli/cliui"
@@ -720,7 +721,7 @@ func TestSSH(t *testing.T) {
 					// being sent to the SSH client before trying to connect.
 					if !gotHeader {
 						gotHeader = true
-						assert.Equal(t, "SSH-2.0-Go", string(out), "invalid header")
+						assert.Equal(t, agentssh.AgentServerVersion(buildinfo.Version()), string(out), "invalid header")
 					}
 				} else {
 					_ = buf.WriteByte(b)
@@ -3240,6 +3240,53 @@ type BannerConfig struct {
 	BackgroundColor string `json:"background_color,omitempty"`
 }
 
+// BannerTarget restricts which SSH sessions an announcement banner is shown
+// in. The zero value matches every session.
+type BannerTarget struct {
+	// SessionTypes limits the banner to the given SSH session types (e.g.
+	// "ssh", "vscode", "jetbrains"). Matching is case-insensitive. If empty,
+	// every session type matches.
+	SessionTypes []string `json:"session_types,omitempty"`
+	// PTYOnly limits the banner to sessions that requested a PTY.
+	PTYOnly bool `json:"pty_only,omitempty"`
+}
+
+// Matches returns true if a session of the given type and PTY state should
+// be shown a banner with this target.
+func (t BannerTarget) Matches(sessionType string, pty bool) bool {
+	if t.PTYOnly && !pty {
+		return false
+	}
+	if len(t.SessionTypes) == 0 {
+		return true
+	}
+	for _, st := range t.SessionTypes {
+		if strings.EqualFold(st, sessionType) {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetedBanner is an announcement banner that is only shown to the SSH
+// sessions matched by Target.
+type TargetedBanner struct {
+	BannerConfig
+	Target BannerTarget `json:"target"`
+}
+
+// FilterBanners returns the banners whose target matches the given session
+// type and PTY state, preserving order.
+func FilterBanners(banners []TargetedBanner, sessionType string, pty bool) []BannerConfig {
+	filtered := make([]BannerConfig, 0, len(banners))
+	for _, banner := range banners {
+		if banner.Target.Matches(sessionType, pty) {
+			filtered = append(filtered, banner.BannerConfig)
+		}
+	}
+	return filtered
+}
+
 // Appearance returns the configuration that modifies the visual
 // display of the dashboard.
 func (c *Client) Appearance(ctx context.Context) (AppearanceConfig, error) {
@@ -628,3 +628,51 @@ func TestNotificationsCanBeDisabled(t *testing.T) {
 		})
 	}
 }
+
+func TestFilterBanners(t *testing.T) {
+	t.Parallel()
+
+	all := codersdk.TargetedBanner{
+		BannerConfig: codersdk.BannerConfig{Enabled: true, Message: "all"},
+	}
+	jetbrains := codersdk.TargetedBanner{
+		BannerConfig: codersdk.BannerConfig{Enabled: true, Message: "jetbrains"},
+		Target:       codersdk.BannerTarget{SessionTypes: []string{"JetBrains"}},
+	}
+	ptyOnly := codersdk.TargetedBanner{
+		BannerConfig: codersdk.BannerConfig{Enabled: true, Message: "pty"},
+		Target:       codersdk.BannerTarget{PTYOnly: true},
+	}
+	sshPTY := codersdk.TargetedBanner{
+		BannerConfig: codersdk.BannerConfig{Enabled: true, Message: "ssh-pty"},
+		Target:       codersdk.BannerTarget{SessionTypes: []string{"ssh", "vscode"}, PTYOnly: true},
+	}
+	banners := []codersdk.TargetedBanner{all, jetbrains, ptyOnly, sshPTY}
+
+	tests := []struct {
+		sessionType string
+		pty         bool
+		want        []string
+	}{
+		{sessionType: "ssh", pty: true, want: []string{"all", "pty", "ssh-pty"}},
+		{sessionType: "ssh", pty: false, want: []string{"all"}},
+		{sessionType: "vscode", pty: true, want: []string{"all", "pty", "ssh-pty"}},
+		{sessionType: "vscode", pty: false, want: []string{"all"}},
+		{sessionType: "jetbrains", pty: true, want: []string{"all", "jetbrains", "pty"}},
+		{sessionType: "jetbrains", pty: false, want: []string{"all", "jetbrains"}},
+		{sessionType: "unknown", pty: true, want: []string{"all", "pty"}},
+		{sessionType: "unknown", pty: false, want: []string{"all"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/pty=%t", tt.sessionType, tt.pty), func(t *testing.T) {
+			t.Parallel()
+
+			got := codersdk.FilterBanners(banners, tt.sessionType, tt.pty)
+			messages := make([]string, 0, len(got))
+			for _, b := range got {
+				messages = append(messages, b.Message)
+			}
+			require.Equal(t, tt.want, messages)
+		})
+	}
+}
@@ -77,6 +77,14 @@ type Process interface {
 	Signal(sig os.Signal) error
 }
 
+// WithPID represents a process whose ID is known, e.g. to inspect it.
+type WithPID interface {
+	Process
+
+	// PID returns the ID of the command process.
+	PID() int
+}
+
 // WithFlags represents a PTY whose flags can be inspected, in particular
 // to determine whether local echo is enabled.
 type WithFlags interface {
@@ -174,6 +174,11 @@ func (p *otherProcess) Signal(sig os.Signal) error {
 	return p.cmd.Process.Signal(sig)
 }
 
+// PID returns the ID of the command process.
+func (p *otherProcess) PID() int {
+	return p.cmd.Process.Pid
+}
+
 func (p *otherProcess) waitInternal() {
 	// The GC can garbage collect the TTY FD before the command
 	// has finished running. See:
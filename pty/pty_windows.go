@@ -248,6 +248,11 @@ func (p *windowsProcess) Signal(sig os.Signal) error {
 	return p.Kill()
 }
 
+// PID returns the ID of the command process.
+func (p *windowsProcess) PID() int {
+	return p.proc.Pid
+}
+
 // killOnContext waits for the context to be done and kills the process, unless it exits on its own first.
 func (p *windowsProcess) killOnContext(ctx context.Context) {
 	select {
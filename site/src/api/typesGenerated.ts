@@ -252,6 +252,12 @@ export interface BannerConfig {
 	readonly background_color?: string;
 }
 
+// From codersdk/deployment.go
+export interface BannerTarget {
+	readonly session_types?: readonly string[];
+	readonly pty_only?: boolean;
+}
+
 // From healthsdk/healthsdk.go
 export interface BaseReport {
 	readonly error?: string;
@@ -2552,6 +2558,11 @@ export interface TailDERPRegion {
 	readonly Nodes: readonly TailDERPNode[];
 }
 
+// From codersdk/deployment.go
+export interface TargetedBanner extends BannerConfig {
+	readonly target: BannerTarget;
+}
+
 // From codersdk/deployment.go
 export interface TelemetryConfig {
 	readonly enable: boolean;